@@ -44,6 +44,10 @@ type IndexExpression struct {
 
 	// Index is the value we're indexing
 	Index Expression
+
+	// Optional is true for safe-navigation, such as `a?.b`, which
+	// returns null without evaluating the index if Left is null.
+	Optional bool
 }
 
 func (ie *IndexExpression) expressionNode() {}
@@ -56,8 +60,48 @@ func (ie *IndexExpression) String() string {
 	var out bytes.Buffer
 	out.WriteString("(")
 	out.WriteString(ie.Left.String())
+	if ie.Optional {
+		out.WriteString("?.")
+	}
 	out.WriteString("[")
 	out.WriteString(ie.Index.String())
 	out.WriteString("])")
 	return out.String()
 }
+
+// SliceExpression holds a slice-expression, such as `a[1:3]`.
+type SliceExpression struct {
+	// Token is the actual token
+	Token token.Token
+
+	// Left is the thing being sliced.
+	Left Expression
+
+	// Start is the index of the first element, which may be nil.
+	Start Expression
+
+	// End is the index after the last element, which may be nil.
+	End Expression
+}
+
+func (se *SliceExpression) expressionNode() {}
+
+// TokenLiteral returns the literal token.
+func (se *SliceExpression) TokenLiteral() string { return se.Token.Literal }
+
+// String returns this object as a string.
+func (se *SliceExpression) String() string {
+	var out bytes.Buffer
+	out.WriteString("(")
+	out.WriteString(se.Left.String())
+	out.WriteString("[")
+	if se.Start != nil {
+		out.WriteString(se.Start.String())
+	}
+	out.WriteString(":")
+	if se.End != nil {
+		out.WriteString(se.End.String())
+	}
+	out.WriteString("])")
+	return out.String()
+}
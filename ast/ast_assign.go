@@ -2,14 +2,19 @@ package ast
 
 import (
 	"bytes"
+	"strings"
 
 	"github.com/skx/evalfilter/v2/token"
 )
 
 // AssignStatement is used for a assignment statement.
+//
+// A multiple assignment, such as `a, b = [1, 2]`, stores each of
+// its targets in Names, and leaves Name nil.
 type AssignStatement struct {
 	Token token.Token
 	Name  *Identifier
+	Names []*Identifier
 	Value Expression
 }
 
@@ -21,7 +26,15 @@ func (as *AssignStatement) TokenLiteral() string { return as.Token.Literal }
 // String returns this object as a string.
 func (as *AssignStatement) String() string {
 	var out bytes.Buffer
-	out.WriteString(as.Name.String())
+	if as.Name != nil {
+		out.WriteString(as.Name.String())
+	} else {
+		names := make([]string, 0, len(as.Names))
+		for _, n := range as.Names {
+			names = append(names, n.String())
+		}
+		out.WriteString(strings.Join(names, ", "))
+	}
 	out.WriteString("=")
 	out.WriteString(as.Value.String())
 	return out.String()
@@ -0,0 +1,31 @@
+package ast
+
+import "github.com/skx/evalfilter/v2/token"
+
+// BreakStatement terminates the enclosing loop.
+type BreakStatement struct {
+	// Token contains the literal token.
+	Token token.Token
+}
+
+func (bs *BreakStatement) statementNode() {}
+
+// TokenLiteral returns the literal token.
+func (bs *BreakStatement) TokenLiteral() string { return bs.Token.Literal }
+
+// String returns this object as a string.
+func (bs *BreakStatement) String() string { return "break;" }
+
+// ContinueStatement skips to the next iteration of the enclosing loop.
+type ContinueStatement struct {
+	// Token contains the literal token.
+	Token token.Token
+}
+
+func (cs *ContinueStatement) statementNode() {}
+
+// TokenLiteral returns the literal token.
+func (cs *ContinueStatement) TokenLiteral() string { return cs.Token.Literal }
+
+// String returns this object as a string.
+func (cs *ContinueStatement) String() string { return "continue;" }
@@ -0,0 +1,43 @@
+package ast
+
+import (
+	"bytes"
+
+	"github.com/skx/evalfilter/v2/token"
+)
+
+// ComparisonExpression holds a chain of comparisons, such as `1 < x < 10`,
+// which is true if each of the comparisons is true.
+//
+// Each operand is evaluated at most once, from left to right, and the
+// comparisons stop as soon as one of them is false.
+type ComparisonExpression struct {
+	// Token is the token of the first comparison.
+	Token token.Token
+
+	// Operands holds the values which are compared.
+	Operands []Expression
+
+	// Operators holds the comparisons to make between each operand
+	// and the next, e.g. "<".
+	Operators []string
+}
+
+func (ce *ComparisonExpression) expressionNode() {}
+
+// TokenLiteral returns the literal token.
+func (ce *ComparisonExpression) TokenLiteral() string { return ce.Token.Literal }
+
+// String returns this object as a string.
+func (ce *ComparisonExpression) String() string {
+	var out bytes.Buffer
+	out.WriteString("(")
+	for i, operand := range ce.Operands {
+		if i > 0 {
+			out.WriteString(" " + ce.Operators[i-1] + " ")
+		}
+		out.WriteString(operand.String())
+	}
+	out.WriteString(")")
+	return out.String()
+}
@@ -0,0 +1,45 @@
+package ast
+
+import (
+	"bytes"
+	"strings"
+
+	"github.com/skx/evalfilter/v2/token"
+)
+
+// FunctionStatement holds the definition of a user-defined function.
+type FunctionStatement struct {
+	// Token is the actual token
+	Token token.Token
+
+	// Name is the name of the function.
+	Name *Identifier
+
+	// Parameters holds the names of the function-parameters.
+	Parameters []*Identifier
+
+	// Body holds the statements of the function.
+	Body *BlockStatement
+}
+
+func (fs *FunctionStatement) statementNode() {}
+
+// TokenLiteral returns the literal token.
+func (fs *FunctionStatement) TokenLiteral() string { return fs.Token.Literal }
+
+// String returns this object as a string.
+func (fs *FunctionStatement) String() string {
+	var out bytes.Buffer
+	params := make([]string, 0)
+	for _, p := range fs.Parameters {
+		params = append(params, p.String())
+	}
+	out.WriteString("function ")
+	out.WriteString(fs.Name.String())
+	out.WriteString("(")
+	out.WriteString(strings.Join(params, ", "))
+	out.WriteString(") {")
+	out.WriteString(fs.Body.String())
+	out.WriteString("}")
+	return out.String()
+}
@@ -27,3 +27,27 @@ func (sl *StringLiteral) String() string {
 	str = strings.ReplaceAll(str, "\n", "\\n")
 	return str
 }
+
+// InterpolatedString holds a string containing embedded expressions,
+// such as "Hello ${name}".
+type InterpolatedString struct {
+	// Token is the token
+	Token token.Token
+
+	// Parts holds the literal text and the embedded expressions,
+	// in order.  The first part is always a string-literal.
+	Parts []Expression
+}
+
+func (is *InterpolatedString) expressionNode() {}
+
+// TokenLiteral returns the literal token.
+func (is *InterpolatedString) TokenLiteral() string { return is.Token.Literal }
+
+// String returns this object as a string.
+func (is *InterpolatedString) String() string {
+	str := "\"" + is.Token.Literal + "\""
+
+	str = strings.ReplaceAll(str, "\n", "\\n")
+	return str
+}
@@ -0,0 +1,60 @@
+package ast
+
+import (
+	"bytes"
+
+	"github.com/skx/evalfilter/v2/token"
+)
+
+// CaseClause holds a single case within a switch-statement.
+type CaseClause struct {
+	// Value is the expression which is compared against the
+	// subject of the switch-statement.
+	Value Expression
+
+	// Body is the block executed if the value matches.
+	Body *BlockStatement
+}
+
+// SwitchStatement holds a switch-statement.
+type SwitchStatement struct {
+	// Token is the actual token
+	Token token.Token
+
+	// Subject is the expression which is compared against each case.
+	Subject Expression
+
+	// Cases holds the case-clauses, in the order they were declared.
+	Cases []CaseClause
+
+	// Default is the block executed if no case matches, and
+	// may be nil.
+	Default *BlockStatement
+}
+
+func (ss *SwitchStatement) statementNode() {}
+
+// TokenLiteral returns the literal token.
+func (ss *SwitchStatement) TokenLiteral() string { return ss.Token.Literal }
+
+// String returns this object as a string.
+func (ss *SwitchStatement) String() string {
+	var out bytes.Buffer
+	out.WriteString("switch (")
+	out.WriteString(ss.Subject.String())
+	out.WriteString(") {")
+	for _, c := range ss.Cases {
+		out.WriteString(" case ")
+		out.WriteString(c.Value.String())
+		out.WriteString(" {")
+		out.WriteString(c.Body.String())
+		out.WriteString("}")
+	}
+	if ss.Default != nil {
+		out.WriteString(" default {")
+		out.WriteString(ss.Default.String())
+		out.WriteString("}")
+	}
+	out.WriteString(" }")
+	return out.String()
+}
@@ -0,0 +1,41 @@
+package ast
+
+import (
+	"bytes"
+
+	"github.com/skx/evalfilter/v2/token"
+)
+
+// TernaryExpression holds a ternary-expression, `cond ? a : b`.
+type TernaryExpression struct {
+	// Token is the actual token
+	Token token.Token
+
+	// Condition is the thing that is evaluated to determine
+	// which value is returned.
+	Condition Expression
+
+	// Then is the expression evaluated if the condition is true.
+	Then Expression
+
+	// Else is the expression evaluated if the condition is false.
+	Else Expression
+}
+
+func (te *TernaryExpression) expressionNode() {}
+
+// TokenLiteral returns the literal token.
+func (te *TernaryExpression) TokenLiteral() string { return te.Token.Literal }
+
+// String returns this object as a string.
+func (te *TernaryExpression) String() string {
+	var out bytes.Buffer
+	out.WriteString("(")
+	out.WriteString(te.Condition.String())
+	out.WriteString(" ? ")
+	out.WriteString(te.Then.String())
+	out.WriteString(" : ")
+	out.WriteString(te.Else.String())
+	out.WriteString(")")
+	return out.String()
+}
@@ -0,0 +1,66 @@
+package ast
+
+import (
+	"bytes"
+
+	"github.com/skx/evalfilter/v2/token"
+)
+
+// TryStatement holds a try-statement, which runs the catch-block if the
+// body throws a value, or fails at run-time.
+type TryStatement struct {
+	// Token is the actual token
+	Token token.Token
+
+	// Body is the block which is attempted.
+	Body *BlockStatement
+
+	// Name is the variable which holds the error within the
+	// catch-block, and may be nil.
+	Name *Identifier
+
+	// Catch is the block executed if the body fails.
+	Catch *BlockStatement
+}
+
+func (ts *TryStatement) statementNode() {}
+
+// TokenLiteral returns the literal token.
+func (ts *TryStatement) TokenLiteral() string { return ts.Token.Literal }
+
+// String returns this object as a string.
+func (ts *TryStatement) String() string {
+	var out bytes.Buffer
+	out.WriteString("try {")
+	out.WriteString(ts.Body.String())
+	out.WriteString("} catch ")
+	if ts.Name != nil {
+		out.WriteString("(")
+		out.WriteString(ts.Name.String())
+		out.WriteString(") ")
+	}
+	out.WriteString("{")
+	out.WriteString(ts.Catch.String())
+	out.WriteString("}")
+	return out.String()
+}
+
+// ThrowStatement holds a throw-statement, which aborts execution with
+// the given value unless it is caught.
+type ThrowStatement struct {
+	// Token contains the literal token.
+	Token token.Token
+
+	// Value is the value which is thrown.
+	Value Expression
+}
+
+func (ts *ThrowStatement) statementNode() {}
+
+// TokenLiteral returns the literal token.
+func (ts *ThrowStatement) TokenLiteral() string { return ts.Token.Literal }
+
+// String returns this object as a string.
+func (ts *ThrowStatement) String() string {
+	return "throw " + ts.Value.String() + ";"
+}
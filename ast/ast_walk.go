@@ -0,0 +1,109 @@
+package ast
+
+// Walk traverses the AST rooted at the given node, depth-first, calling
+// the function for each node it finds - including the given node.
+//
+// Children are visited in the order they appear within the source.  If
+// the function returns false then the children of that node are not
+// visited.
+func Walk(node Node, fn func(Node) bool) {
+
+	if node == nil || !fn(node) {
+		return
+	}
+
+	switch n := node.(type) {
+	case *Program:
+		for _, s := range n.Statements {
+			Walk(s, fn)
+		}
+	case *BlockStatement:
+		for _, s := range n.Statements {
+			Walk(s, fn)
+		}
+	case *ExpressionStatement:
+		Walk(n.Expression, fn)
+	case *ReturnStatement:
+		Walk(n.ReturnValue, fn)
+	case *AssignStatement:
+		if n.Name != nil {
+			Walk(n.Name, fn)
+		}
+		for _, name := range n.Names {
+			Walk(name, fn)
+		}
+		Walk(n.Value, fn)
+	case *FunctionStatement:
+		Walk(n.Name, fn)
+		for _, param := range n.Parameters {
+			Walk(param, fn)
+		}
+		Walk(n.Body, fn)
+	case *IfExpression:
+		Walk(n.Condition, fn)
+		Walk(n.Consequence, fn)
+		if n.Alternative != nil {
+			Walk(n.Alternative, fn)
+		}
+	case *WhileStatement:
+		Walk(n.Condition, fn)
+		Walk(n.Body, fn)
+	case *SwitchStatement:
+		Walk(n.Subject, fn)
+		for _, c := range n.Cases {
+			Walk(c.Value, fn)
+			Walk(c.Body, fn)
+		}
+		if n.Default != nil {
+			Walk(n.Default, fn)
+		}
+	case *TryStatement:
+		Walk(n.Body, fn)
+		if n.Name != nil {
+			Walk(n.Name, fn)
+		}
+		Walk(n.Catch, fn)
+	case *ThrowStatement:
+		Walk(n.Value, fn)
+	case *YieldStatement:
+		Walk(n.Value, fn)
+	case *TernaryExpression:
+		Walk(n.Condition, fn)
+		Walk(n.Then, fn)
+		Walk(n.Else, fn)
+	case *PrefixExpression:
+		Walk(n.Right, fn)
+	case *InfixExpression:
+		Walk(n.Left, fn)
+		Walk(n.Right, fn)
+	case *ComparisonExpression:
+		for _, operand := range n.Operands {
+			Walk(operand, fn)
+		}
+	case *CallExpression:
+		Walk(n.Function, fn)
+		for _, arg := range n.Arguments {
+			Walk(arg, fn)
+		}
+	case *IndexExpression:
+		Walk(n.Left, fn)
+		Walk(n.Index, fn)
+	case *SliceExpression:
+		Walk(n.Left, fn)
+		Walk(n.Start, fn)
+		Walk(n.End, fn)
+	case *ArrayLiteral:
+		for _, e := range n.Elements {
+			Walk(e, fn)
+		}
+	case *HashLiteral:
+		for _, pair := range n.Pairs {
+			Walk(pair.Key, fn)
+			Walk(pair.Value, fn)
+		}
+	case *InterpolatedString:
+		for _, part := range n.Parts {
+			Walk(part, fn)
+		}
+	}
+}
@@ -0,0 +1,23 @@
+package ast
+
+import "github.com/skx/evalfilter/v2/token"
+
+// YieldStatement holds a yield-statement, which adds a value to those
+// the script has produced, without ending the script.
+type YieldStatement struct {
+	// Token contains the literal token.
+	Token token.Token
+
+	// Value is the value which is yielded.
+	Value Expression
+}
+
+func (ys *YieldStatement) statementNode() {}
+
+// TokenLiteral returns the literal token.
+func (ys *YieldStatement) TokenLiteral() string { return ys.Token.Literal }
+
+// String returns this object as a string.
+func (ys *YieldStatement) String() string {
+	return "yield " + ys.Value.String() + ";"
+}
@@ -2,7 +2,10 @@ package evalfilter
 
 import (
 	"fmt"
+	"strings"
 	"testing"
+
+	"github.com/skx/evalfilter/v2/object"
 )
 
 // Benchmark_evalfilter_complex_map - This is a complex test against a map.
@@ -173,3 +176,190 @@ func Benchmark_evalfilter_trivial(b *testing.B) {
 		b.Fail()
 	}
 }
+
+// Benchmark_evalfilter_constants - This tests compiling a script which
+// contains thousands of distinct constants.
+func Benchmark_evalfilter_constants(b *testing.B) {
+
+	//
+	// Generate the script.
+	//
+	var script strings.Builder
+	script.WriteString("a = [")
+	for i := 0; i < 5000; i++ {
+		fmt.Fprintf(&script, "\"s%d\", %d.5, ", i, i)
+	}
+	script.WriteString("1 ];\nreturn true;")
+
+	for n := 0; n < b.N; n++ {
+		eval := New(script.String())
+
+		err := eval.Prepare()
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// Benchmark_evalfilter_reuse - This tests running a prepared script many
+// times, via both Execute and ExecuteInto, reporting the allocations made
+// by each run so that the two may be compared.
+func Benchmark_evalfilter_reuse(b *testing.B) {
+
+	//
+	// Prepare the script
+	//
+	eval := New(`if ( Count > 3 && Name == "Steve" ) { return Count * 2; } return 0;`)
+
+	//
+	// Ensure this compiled properly.
+	//
+	err := eval.Prepare()
+	if err != nil {
+		fmt.Printf("Failed to compile: %s\n", err.Error())
+		return
+	}
+
+	//
+	// Create the object we'll test against.
+	//
+	type Input struct {
+		Count int
+		Name  string
+	}
+	obj := &Input{Count: 4, Name: "Steve"}
+
+	var execute, into object.Object
+
+	b.Run("Execute", func(b *testing.B) {
+		b.ReportAllocs()
+		for n := 0; n < b.N; n++ {
+			execute, err = eval.Execute(obj)
+		}
+		if err != nil {
+			b.Fatal(err)
+		}
+	})
+
+	b.Run("ExecuteInto", func(b *testing.B) {
+		b.ReportAllocs()
+		for n := 0; n < b.N; n++ {
+			err = eval.ExecuteInto(obj, &into)
+		}
+		if err != nil {
+			b.Fatal(err)
+		}
+	})
+
+	//
+	// Both must have given the same result.
+	//
+	if execute == nil || into == nil || !object.Equals(execute, into) || execute.Inspect() != "8" {
+		b.Fatalf("Unexpected results: %v, %v", execute, into)
+	}
+}
+
+// Benchmark_evalfilter_calls - This tests a script which calls functions,
+// both built-in and those of the host application, many times.
+func Benchmark_evalfilter_calls(b *testing.B) {
+
+	//
+	// Prepare the script
+	//
+	eval := New(`
+i = 0;
+n = 0;
+while ( i < 100 ) {
+   if ( exists("Name") ) {
+      n = n + len(Name) + double(i);
+   }
+   i = i + 1;
+}
+return n;
+`)
+	eval.AddFunction("double", func(args []object.Object) object.Object {
+		return &object.Integer{Value: args[0].(*object.Integer).Value * 2}
+	})
+
+	//
+	// Ensure this compiled properly.
+	//
+	err := eval.Prepare()
+	if err != nil {
+		fmt.Printf("Failed to compile: %s\n", err.Error())
+		return
+	}
+
+	//
+	// Create the object we'll test against.
+	//
+	type Input struct {
+		Name string
+	}
+	obj := &Input{Name: "Steve"}
+
+	var ret object.Object
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		ret, err = eval.Execute(obj)
+	}
+	b.StopTimer()
+
+	if err != nil {
+		b.Fatal(err)
+	}
+	if ret.Inspect() != "10400" {
+		b.Fatalf("unexpected result %s", ret.Inspect())
+	}
+}
+
+// Benchmark_evalfilter_regexp - This tests filtering many records with a
+// regular expression, which should be compiled only once.
+func Benchmark_evalfilter_regexp(b *testing.B) {
+
+	//
+	// Prepare the script
+	//
+	eval := New(`return ( Name ~= /^ste(ve|ven)$/i && Email !~ /@example\.(com|org)$/ );`)
+
+	//
+	// Ensure this compiled properly.
+	//
+	err := eval.Prepare()
+	if err != nil {
+		fmt.Printf("Failed to compile: %s\n", err.Error())
+		return
+	}
+
+	//
+	// Create the records we'll filter.
+	//
+	type Input struct {
+		Name  string
+		Email string
+	}
+	var records []*Input
+	for i := 0; i < 100; i++ {
+		records = append(records, &Input{Name: "Steve", Email: fmt.Sprintf("user%d@example.net", i)})
+	}
+
+	var ret bool
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		for _, obj := range records {
+			ret, err = eval.Run(obj)
+		}
+	}
+	b.StopTimer()
+
+	if err != nil {
+		b.Fatal(err)
+	}
+	if !ret {
+		b.Fail()
+	}
+}
@@ -23,6 +23,9 @@ type runCmd struct {
 	// Disable the bytecode optimizer
 	raw bool
 
+	// Show variables which are read before they're assigned
+	warn bool
+
 	// The user may specify a JSON file.
 	jsonFile string
 }
@@ -45,6 +48,7 @@ func (p *runCmd) SetFlags(f *flag.FlagSet) {
 	f.StringVar(&p.jsonFile, "json", "", "The JSON file, containing the object to test the script with.")
 	f.BoolVar(&p.raw, "no-optimizer", false, "Disable the bytecode optimizer")
 	f.BoolVar(&p.debug, "debug", false, "Show instructions and the stack at ever step")
+	f.BoolVar(&p.warn, "warn", false, "Warn about variables which are read before they're assigned")
 }
 
 //
@@ -98,6 +102,9 @@ func (p *runCmd) Run(file string) {
 	if p.raw {
 		flags = append(flags, evalfilter.NoOptimize)
 	}
+	if p.warn {
+		flags = append(flags, evalfilter.WarnUnassigned)
+	}
 
 	//
 	// If we're to debug then set the appropriate variable
@@ -116,6 +123,9 @@ func (p *runCmd) Run(file string) {
 		fmt.Printf("Error compiling:%s\n", err.Error())
 		return
 	}
+	for _, warning := range eval.Warnings() {
+		fmt.Printf("Warning: %s\n", warning)
+	}
 
 	//
 	// Run the script.
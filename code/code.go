@@ -2,6 +2,8 @@
 // our compiler emits, and our virtual machine executes.
 package code
 
+import "encoding/binary"
+
 // Opcode is a type-alias.
 type Opcode byte
 
@@ -49,6 +51,34 @@ const (
 	// Store a literal array
 	OpArray
 
+	// Store a literal hash.
+	//
+	// The 16-bit argument is the number of key/value pairs, so
+	// twice that many items are popped from the stack.
+	OpHash
+
+	// If the value at the top of the stack is not null then
+	// jump to the specified offset, leaving it in place.
+	// Otherwise pop the null value and continue.
+	//
+	// 16-bit argument is the offset to jump to.
+	OpCoalesce
+
+	// Pop an array from the stack, and push its first N elements
+	// in reverse order, so that the first element is at the top.
+	//
+	// Missing elements are pushed as null values.
+	//
+	// 16-bit argument is the number of elements to push.
+	OpUnpack
+
+	// Begin a try-block, recording the handler which is run if a
+	// value is thrown, or a run-time error occurs, before the
+	// matching OpEndTry.
+	//
+	// 16-bit argument is the offset of the handler.
+	OpTry
+
 	//
 	// NOTE:  This is a fake opcode.
 	//
@@ -137,22 +167,96 @@ const (
 	// otherwise push FALSE.
 	OpOr
 
-	// Array index operaton
+	// Array index operaton.
+	//
+	// This is also used to lookup the value of a hash-key.
 	OpArrayIndex
 
 	// Pop two values from the the stack, if the first value is
 	// contained in the second-argument (which must be an array),
-	// push TRUE, else push FALSE
+	// push TRUE, else push FALSE.
+	//
+	// If both values are strings then test whether the first is a
+	// substring of the second instead.
 	OpArrayIn
 
+	// Push a copy of the value at the top of the stack.
+	OpDup
+
+	// Pop a value from the stack, and discard it.
+	OpPop
+
+	// Push a copy of the value at the top of the stack beneath the
+	// value which is below it, so `a b` becomes `b a b`.
+	OpTuck
+
+	// Pop the end-index, start-index, and the array or string, from
+	// the stack, and push the slice they describe.
+	//
+	// Either index may be null, meaning the start, or end, respectively.
+	OpSlice
+
+	// Begin a new block-scope, which is where variables which are
+	// first assigned within the block are stored.
+	OpPushScope
+
+	// End the current block-scope, discarding its variables.
+	OpPopScope
+
+	// End the current try-block, discarding its handler.
+	OpEndTry
+
+	// Pop a value from the stack, and throw it to the handler of
+	// the innermost try-block.
+	OpThrow
+
+	// Pop a name and a value from the stack, and store the variable
+	// in the current block-scope - even if a variable with the same
+	// name exists outside it.
+	OpSetLocal
+
+	// Pop a value from the stack, and add it to the values which the
+	// script has yielded.
+	OpYield
+
 	//
 	// NOTE:  This is a fake opcode.
 	//
 	// This is our final opcode.
 	//
+	// It must remain below Wide, which is used as a flag.
+	//
 	OpFinal
 )
 
+// Wide may be combined with any opcode which takes an argument, giving
+// its wide variant.  The argument of a wide opcode is a 32-bit integer,
+// rather than a 16-bit one.
+//
+// Wide opcodes are only used when an argument is too large to fit in
+// 16-bits, for example a jump within a very large program.
+const Wide Opcode = 0x80
+
+// MaxOperand is the largest argument which an opcode, which is not wide,
+// may have.
+const MaxOperand = 0xFFFF
+
+// Position holds the location, within the source, of the code which
+// generated an instruction.
+type Position struct {
+	// Line is the line-number, counting from one.
+	Line int
+
+	// Column is the column within the line, counting from one.
+	Column int
+}
+
+// Positions maps the offsets of instructions to their positions in
+// the source.
+//
+// It is used to report the location of run-time errors.
+type Positions map[int]Position
+
 // Length returns the length of the given opcode.
 //
 // All opcodes are a single byte, but some require a mandatory argument.
@@ -160,18 +264,53 @@ const (
 // This function returns the total expected length of the opcode and
 // any required argument.  Note that at the moment all opcodes require
 // either zero or one arguments (where the argument is a two-byte
-// 16-bit integer).  This might change in the future.
+// 16-bit integer, or a four-byte 32-bit integer for wide opcodes).
 func Length(op Opcode) int {
+	if op&Wide != 0 {
+		return 5
+	}
 	if op < OpCodeSingleArg {
 		return 3
 	}
 	return 1
 }
 
+// IsJump returns true if the given opcode is a jump, which means
+// that its argument is an offset within the bytecode.
+//
+// These arguments must be updated if the bytecode is rewritten.
+func IsJump(op Opcode) bool {
+	op &^= Wide
+	return op == OpJump || op == OpJumpIfFalse || op == OpCoalesce || op == OpTry
+}
+
+// Operand returns the argument of the instruction at the given offset,
+// which must be an opcode that takes one.
+func Operand(ins Instructions, ip int) int {
+	if Opcode(ins[ip])&Wide != 0 {
+		return int(binary.BigEndian.Uint32(ins[ip+1 : ip+5]))
+	}
+	return int(binary.BigEndian.Uint16(ins[ip+1 : ip+3]))
+}
+
+// SetOperand changes the argument of the instruction at the given offset,
+// which must be large enough to hold it.
+func SetOperand(ins Instructions, ip int, operand int) {
+	if Opcode(ins[ip])&Wide != 0 {
+		binary.BigEndian.PutUint32(ins[ip+1:ip+5], uint32(operand))
+		return
+	}
+	binary.BigEndian.PutUint16(ins[ip+1:ip+3], uint16(operand))
+}
+
 // String converts the given opcode to a string, this is used by our
 // bytecode disassembler/dumper.
 func String(op Opcode) string {
 
+	if op&Wide != 0 && op&^Wide < OpCodeSingleArg {
+		return String(op&^Wide) + "Wide"
+	}
+
 	switch op {
 	case OpConstant:
 		return "OpConstant"
@@ -237,10 +376,38 @@ func String(op Opcode) string {
 		return "OpOr"
 	case OpArray:
 		return "OpArray"
+	case OpHash:
+		return "OpHash"
+	case OpCoalesce:
+		return "OpCoalesce"
+	case OpUnpack:
+		return "OpUnpack"
+	case OpTry:
+		return "OpTry"
 	case OpArrayIndex:
 		return "OpArrayIndex"
 	case OpArrayIn:
 		return "OpArrayIn"
+	case OpDup:
+		return "OpDup"
+	case OpPop:
+		return "OpPop"
+	case OpTuck:
+		return "OpTuck"
+	case OpSlice:
+		return "OpSlice"
+	case OpPushScope:
+		return "OpPushScope"
+	case OpPopScope:
+		return "OpPopScope"
+	case OpEndTry:
+		return "OpEndTry"
+	case OpThrow:
+		return "OpThrow"
+	case OpSetLocal:
+		return "OpSetLocal"
+	case OpYield:
+		return "OpYield"
 	default:
 		return "OpUnknown"
 	}
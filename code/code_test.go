@@ -32,3 +32,25 @@ func TestOpcodes(t *testing.T) {
 		i++
 	}
 }
+
+// TestWide tests the wide variants of our opcodes.
+func TestWide(t *testing.T) {
+
+	ins := Instructions{byte(OpJump | Wide), 0, 0, 0, 0, byte(OpConstant), 0, 0}
+
+	if Length(OpJump|Wide) != 5 {
+		t.Fatalf("Invalid length of wide opcode")
+	}
+	if !IsJump(OpJump | Wide) {
+		t.Fatalf("Wide jump isn't a jump")
+	}
+	if String(OpJump|Wide) != "OpJumpWide" {
+		t.Fatalf("Wide opcode has the wrong name: %s", String(OpJump|Wide))
+	}
+
+	SetOperand(ins, 0, 70000)
+	SetOperand(ins, 5, 1234)
+	if Operand(ins, 0) != 70000 || Operand(ins, 5) != 1234 {
+		t.Fatalf("Operands weren't stored correctly: %v", ins)
+	}
+}
@@ -5,35 +5,258 @@
 package evalfilter
 
 import (
-	"encoding/binary"
+	"errors"
 	"fmt"
+	"math"
 
 	"github.com/skx/evalfilter/v2/ast"
 	"github.com/skx/evalfilter/v2/code"
 	"github.com/skx/evalfilter/v2/object"
+	"github.com/skx/evalfilter/v2/token"
 )
 
+// loop holds the state of a loop which is being compiled.
+//
+// We need to know the loop-start, to handle `continue`, and we need to
+// record the location of every `break` so that the jump can be updated
+// once we know where the loop ends.
+type loop struct {
+	// start is the offset of the loop-condition.
+	start int
+
+	// breaks holds the offsets of the jumps generated for `break`.
+	breaks []int
+
+	// scopes is the number of block-scopes which were open when the
+	// loop began, so that `break` and `continue` can end those which
+	// were begun within it.
+	scopes int
+
+	// tries is the number of try-blocks which were open when the
+	// loop began, for the same reason.
+	tries int
+}
+
+// call records a call to a function, so that the number of arguments can
+// be checked once the whole script has been compiled - and all the
+// functions it defines are known.
+type call struct {
+	// name is the name of the function.
+	name string
+
+	// args is the number of arguments it is called with.
+	args int
+
+	// tok is the token of the call, used to report errors.
+	tok token.Token
+}
+
+// compileStatements compiles the statements of a program, or a block.
+//
+// Statements which follow a `return` in the same block can never be
+// reached, so they are not compiled.  Function definitions are the
+// exception, since they may be called from before their definition.
+//
+// A statement which fails to compile doesn't stop those which follow it
+// from being compiled, so that all the errors in a script may be found.
+// The errors are recorded, and errReported returned in their place.
+func (e *Eval) compileStatements(statements []ast.Statement) error {
+
+	returned := false
+	failed := false
+
+	for _, s := range statements {
+
+		if returned {
+			if _, ok := s.(*ast.FunctionStatement); !ok {
+				continue
+			}
+		}
+
+		err := e.compile(s)
+		if err != nil {
+			if err != errReported {
+				e.errors = append(e.errors, err)
+			}
+			failed = true
+			continue
+		}
+
+		switch s.(type) {
+		case *ast.ReturnStatement, *ast.ThrowStatement:
+			returned = true
+		}
+	}
+
+	if failed {
+		return errReported
+	}
+	return nil
+}
+
+// errReported is returned by compileStatements when the errors it found
+// have been recorded.
+var errReported = errors.New("errors have been reported")
+
+// errorf returns an error, at the position of the node being compiled.
+func (e *Eval) errorf(format string, args ...interface{}) error {
+	return &CompileError{Position: e.position, Message: fmt.Sprintf(format, args...)}
+}
+
+// compileProgram compiles the given program, and checks the calls it
+// makes, returning all the errors which were found.
+//
+// If a jump is too far for its argument then we start again, with every
+// jump using the wide variant.
+func (e *Eval) compileProgram(program *ast.Program) []error {
+
+	e.wideJumps = false
+	for {
+		e.instructions = nil
+		e.positions = make(code.Positions)
+		e.functions = nil
+		e.calls = nil
+		e.errors = nil
+		e.scopes = 0
+		e.tries = 0
+		e.tooLarge = false
+
+		err := e.compile(program)
+		if err != nil && err != errReported {
+			e.errors = append(e.errors, err)
+		}
+		if len(e.errors) > 0 || !e.tooLarge || e.wideJumps {
+			break
+		}
+		e.wideJumps = true
+	}
+
+	//
+	// Ensure functions are called with the number of arguments
+	// they expect, now that we know about all of them.
+	//
+	e.checkCalls()
+
+	return e.errors
+}
+
+// assigns returns true if the given block assigns to a variable, and so
+// needs a scope of its own.
+//
+// Assignments within nested blocks, and functions, don't count because
+// they have their own scopes.
+func assigns(block *ast.BlockStatement) bool {
+	found := false
+	for _, s := range block.Statements {
+		ast.Walk(s, func(node ast.Node) bool {
+			switch node.(type) {
+			case *ast.AssignStatement:
+				found = true
+			case *ast.BlockStatement, *ast.FunctionStatement:
+				return false
+			}
+			return !found
+		})
+	}
+	return found
+}
+
+// endScopes ends the block-scopes, and try-blocks, which have been begun
+// since the given loop began, before jumping out of them.
+func (e *Eval) endScopes(l *loop) {
+	for i := l.scopes; i < e.scopes; i++ {
+		e.emit(code.OpPopScope)
+	}
+	for i := l.tries; i < e.tries; i++ {
+		e.emit(code.OpEndTry)
+	}
+}
+
+// leavesValue returns true if the code generated for the given expression
+// leaves a value upon the stack.
+//
+// Assignments, and control-flow such as `if`, do not.
+func leavesValue(node ast.Expression) bool {
+	switch node := node.(type) {
+	case *ast.AssignStatement, *ast.IfExpression, *ast.WhileStatement:
+		return false
+	case *ast.TernaryExpression:
+		return leavesValue(node.Then) && leavesValue(node.Else)
+	}
+	return true
+}
+
+// implicitReturn returns the statements of a program, with the final
+// statement changed into a return-statement if it is an expression
+// which leaves a value, so that a script such as `1 + 2;` returns `3`.
+//
+// Functions may be defined after the final statement, so they are
+// skipped.  The program itself is left unchanged.
+func implicitReturn(statements []ast.Statement) []ast.Statement {
+	for i := len(statements) - 1; i >= 0; i-- {
+		if _, ok := statements[i].(*ast.FunctionStatement); ok {
+			continue
+		}
+
+		es, ok := statements[i].(*ast.ExpressionStatement)
+		if !ok || !leavesValue(es.Expression) {
+			return statements
+		}
+
+		out := make([]ast.Statement, len(statements))
+		copy(out, statements)
+		out[i] = &ast.ReturnStatement{Token: es.Token, ReturnValue: es.Expression}
+		return out
+	}
+	return statements
+}
+
 // compile is core-code for converting the AST into a series of bytecodes.
 func (e *Eval) compile(node ast.Node) error {
 
+	//
+	// Record the position of the node, so that errors with the
+	// instructions we generate for it can be reported helpfully.
+	//
+	if tok, ok := nodeToken(node); ok {
+		prev := e.position
+		e.position = code.Position{Line: tok.Line, Column: tok.Column}
+		defer func() { e.position = prev }()
+	}
+
 	switch node := node.(type) {
 
 	case *ast.Program:
-		for _, s := range node.Statements {
-			err := e.compile(s)
-			if err != nil {
-				return err
-			}
+		err := e.compileStatements(implicitReturn(node.Statements))
+		if err != nil {
+			return err
 		}
 
 	case *ast.BlockStatement:
-		for _, s := range node.Statements {
-			err := e.compile(s)
-			if err != nil {
-				return err
-			}
+
+		//
+		// Variables first assigned within a block are only
+		// visible within it, so the block needs its own scope.
+		//
+		// Blocks which assign nothing don't need one, and
+		// neither do any blocks unless block-scoping has been
+		// requested.
+		//
+		if !e.blockScope || !assigns(node) {
+			return e.compileStatements(node.Statements)
 		}
 
+		e.emit(code.OpPushScope)
+		e.scopes++
+
+		err := e.compileStatements(node.Statements)
+		e.scopes--
+		if err != nil {
+			return err
+		}
+
+		e.emit(code.OpPopScope)
+
 	case *ast.BooleanLiteral:
 		if node.Value {
 			e.emit(code.OpTrue)
@@ -68,6 +291,22 @@ func (e *Eval) compile(node ast.Node) error {
 		str := &object.String{Value: node.Value}
 		e.emit(code.OpConstant, e.addConstant(str))
 
+	case *ast.InterpolatedString:
+
+		//
+		// The parts are concatenated, and since the first is
+		// always a string the others are converted as we go.
+		//
+		for i, part := range node.Parts {
+			err := e.compile(part)
+			if err != nil {
+				return err
+			}
+			if i > 0 {
+				e.emit(code.OpAdd)
+			}
+		}
+
 	case *ast.RegexpLiteral:
 
 		// The regexp body
@@ -94,6 +333,19 @@ func (e *Eval) compile(node ast.Node) error {
 		}
 		e.emit(code.OpArray, len(node.Elements))
 
+	case *ast.HashLiteral:
+		for _, pair := range node.Pairs {
+			err := e.compile(pair.Key)
+			if err != nil {
+				return err
+			}
+			err = e.compile(pair.Value)
+			if err != nil {
+				return err
+			}
+		}
+		e.emit(code.OpHash, len(node.Pairs))
+
 	case *ast.ReturnStatement:
 		err := e.compile(node.ReturnValue)
 		if err != nil {
@@ -107,7 +359,44 @@ func (e *Eval) compile(node ast.Node) error {
 			return err
 		}
 
+		//
+		// Discard the value of the expression, if it has one,
+		// otherwise a statement such as `print(x);` within a
+		// loop would grow the stack each time it was executed.
+		//
+		if leavesValue(node.Expression) {
+			e.emit(code.OpPop)
+		}
+
 	case *ast.InfixExpression:
+
+		//
+		// The null-coalescing operator is special, because
+		// the right-hand side is only evaluated if the left
+		// is null:
+		//
+		//     left
+		//     COALESCE END:
+		//     right
+		//  END:
+		//
+		if node.Operator == "??" {
+			err := e.compile(node.Left)
+			if err != nil {
+				return err
+			}
+
+			jumpPos := e.emit(code.OpCoalesce, 9999)
+
+			err = e.compile(node.Right)
+			if err != nil {
+				return err
+			}
+
+			e.changeOperand(jumpPos, len(e.instructions))
+			return nil
+		}
+
 		err := e.compile(node.Left)
 		if err != nil {
 			return err
@@ -162,7 +451,7 @@ func (e *Eval) compile(node ast.Node) error {
 		case "||":
 			e.emit(code.OpOr)
 		default:
-			return fmt.Errorf("unknown operator %s", node.Operator)
+			return e.errorf("unknown operator %s", node.Operator)
 		}
 
 	case *ast.PrefixExpression:
@@ -179,7 +468,7 @@ func (e *Eval) compile(node ast.Node) error {
 		case "√":
 			e.emit(code.OpRoot)
 		default:
-			return fmt.Errorf("unknown operator %s", node.Operator)
+			return e.errorf("unknown operator %s", node.Operator)
 		}
 
 	case *ast.IfExpression:
@@ -301,6 +590,107 @@ func (e *Eval) compile(node ast.Node) error {
 		//  C:
 		//
 
+	case *ast.ComparisonExpression:
+
+		//
+		// Each operand which is compared twice is kept upon the
+		// stack for the next comparison, and the chain stops as
+		// soon as a comparison is false:
+		//
+		//     a
+		//     b
+		//     TUCK
+		//     LESS
+		//     JUMP IF NOT FALSE:
+		//     c
+		//     LESS
+		//     JUMP END:
+		//  FALSE:
+		//     POP
+		//     FALSE
+		//  END:
+		//
+		err := e.compile(node.Operands[0])
+		if err != nil {
+			return err
+		}
+
+		var fails []int
+		for i, op := range node.Operators {
+
+			err = e.compile(node.Operands[i+1])
+			if err != nil {
+				return err
+			}
+
+			last := i == len(node.Operators)-1
+			if !last {
+				e.emit(code.OpTuck)
+			}
+
+			switch op {
+			case "<":
+				e.emit(code.OpLess)
+			case "<=":
+				e.emit(code.OpLessEqual)
+			case ">":
+				e.emit(code.OpGreater)
+			case ">=":
+				e.emit(code.OpGreaterEqual)
+			default:
+				return e.errorf("unknown operator %s", op)
+			}
+
+			if !last {
+				fails = append(fails, e.emit(code.OpJumpIfFalse, 9999))
+			}
+		}
+
+		end := e.emit(code.OpJump, 9999)
+		for _, pos := range fails {
+			e.changeOperand(pos, len(e.instructions))
+		}
+		e.emit(code.OpPop)
+		e.emit(code.OpFalse)
+		e.changeOperand(end, len(e.instructions))
+
+	case *ast.TernaryExpression:
+
+		//
+		// This is handled like an if-expression with an
+		// else-clause, except each branch is an expression
+		// which leaves a single value upon the stack:
+		//
+		//     cond
+		//     JUMP IF NOT B:
+		//     A
+		//     JUMP C:
+		//  B:
+		//     B
+		//  C:
+		//
+		err := e.compile(node.Condition)
+		if err != nil {
+			return err
+		}
+
+		jumpNotTruthyPos := e.emit(code.OpJumpIfFalse, 9999)
+
+		err = e.compile(node.Then)
+		if err != nil {
+			return err
+		}
+
+		jumpPos := e.emit(code.OpJump, 9999)
+		e.changeOperand(jumpNotTruthyPos, len(e.instructions))
+
+		err = e.compile(node.Else)
+		if err != nil {
+			return err
+		}
+
+		e.changeOperand(jumpPos, len(e.instructions))
+
 	case *ast.WhileStatement:
 
 		//
@@ -345,10 +735,20 @@ func (e *Eval) compile(node ast.Node) error {
 		//
 		jumpNotTruthyPos := e.emit(code.OpJumpIfFalse, 9999)
 
+		//
+		// Record the loop, so that `break` and `continue`
+		// know where to jump to.
+		//
+		l := &loop{start: cur, scopes: e.scopes, tries: e.tries}
+		e.loops = append(e.loops, l)
+
 		//
 		// Compile the code in the body
 		//
 		err = e.compile(node.Body)
+
+		e.loops = e.loops[:len(e.loops)-1]
+
 		if err != nil {
 			return err
 		}
@@ -364,6 +764,194 @@ func (e *Eval) compile(node ast.Node) error {
 		//
 		e.changeOperand(jumpNotTruthyPos, len(e.instructions))
 
+		//
+		// Any `break` statements also jump to C.
+		//
+		for _, pos := range l.breaks {
+			e.changeOperand(pos, len(e.instructions))
+		}
+
+	case *ast.SwitchStatement:
+
+		//
+		// The subject is evaluated once, and then a copy of
+		// it is compared against each case in turn:
+		//
+		//     subject
+		//     DUP
+		//     case-value
+		//     EQUAL
+		//     JUMP IF NOT NEXT:
+		//     POP
+		//     body
+		//     JUMP END:
+		//  NEXT:
+		//     .. more cases ..
+		//     POP
+		//     default-body
+		//  END:
+		//
+		// The copy of the subject is removed before a body
+		// is executed, so the stack is balanced regardless of
+		// how the body exits.
+		//
+		err := e.compile(node.Subject)
+		if err != nil {
+			return err
+		}
+
+		var ends []int
+		for _, c := range node.Cases {
+
+			e.emit(code.OpDup)
+
+			err = e.compile(c.Value)
+			if err != nil {
+				return err
+			}
+
+			e.emit(code.OpEqual)
+			next := e.emit(code.OpJumpIfFalse, 9999)
+
+			e.emit(code.OpPop)
+			err = e.compile(c.Body)
+			if err != nil {
+				return err
+			}
+			ends = append(ends, e.emit(code.OpJump, 9999))
+
+			e.changeOperand(next, len(e.instructions))
+		}
+
+		e.emit(code.OpPop)
+		if node.Default != nil {
+			err = e.compile(node.Default)
+			if err != nil {
+				return err
+			}
+		}
+
+		for _, pos := range ends {
+			e.changeOperand(pos, len(e.instructions))
+		}
+
+	case *ast.TryStatement:
+
+		//
+		// The handler of the try-block is recorded while its
+		// body is executed, and the catch-block receives the
+		// error in a scope of its own:
+		//
+		//     TRY CATCH:
+		//     body
+		//     ENDTRY
+		//     JUMP END:
+		//  CATCH:
+		//     PUSHSCOPE
+		//     CONSTANT name
+		//     SETLOCAL
+		//     catch-body
+		//     POPSCOPE
+		//  END:
+		//
+		// If the error isn't given a name it is discarded, and
+		// the catch-block is compiled like any other.
+		//
+		handler := e.emit(code.OpTry, 9999)
+
+		e.tries++
+		err := e.compile(node.Body)
+		e.tries--
+		if err != nil {
+			return err
+		}
+
+		e.emit(code.OpEndTry)
+		end := e.emit(code.OpJump, 9999)
+		e.changeOperand(handler, len(e.instructions))
+
+		if node.Name == nil {
+			e.emit(code.OpPop)
+			err = e.compile(node.Catch)
+		} else if !e.blockScope {
+			// The error is stored in an ordinary variable.
+			str := &object.String{Value: node.Name.Value}
+			e.emit(code.OpConstant, e.addConstant(str))
+			e.emit(code.OpSet)
+			err = e.compile(node.Catch)
+		} else {
+			e.emit(code.OpPushScope)
+			str := &object.String{Value: node.Name.Value}
+			e.emit(code.OpConstant, e.addConstant(str))
+			e.emit(code.OpSetLocal)
+
+			e.scopes++
+			err = e.compileStatements(node.Catch.Statements)
+			e.scopes--
+
+			e.emit(code.OpPopScope)
+		}
+		if err != nil {
+			return err
+		}
+
+		e.changeOperand(end, len(e.instructions))
+
+	case *ast.ThrowStatement:
+		err := e.compile(node.Value)
+		if err != nil {
+			return err
+		}
+		e.emit(code.OpThrow)
+
+	case *ast.YieldStatement:
+		err := e.compile(node.Value)
+		if err != nil {
+			return err
+		}
+		e.emit(code.OpYield)
+
+	case *ast.BreakStatement:
+		if len(e.loops) == 0 {
+			return e.errorf("break statement outside of a loop")
+		}
+
+		// Jump to the end of the loop, which we don't yet know.
+		l := e.loops[len(e.loops)-1]
+		e.endScopes(l)
+		l.breaks = append(l.breaks, e.emit(code.OpJump, 9999))
+
+	case *ast.ContinueStatement:
+		if len(e.loops) == 0 {
+			return e.errorf("continue statement outside of a loop")
+		}
+
+		// Jump back to retest the loop-condition.
+		l := e.loops[len(e.loops)-1]
+		e.endScopes(l)
+		e.emit(code.OpJump, l.start)
+
+	case *ast.FunctionStatement:
+
+		//
+		// Compile the body of the function
+		//
+		fn, err := e.compileFunction(node)
+		if err != nil {
+			return err
+		}
+
+		//
+		// Record the function, and make it available to the
+		// script.
+		//
+		// Because this happens at compile-time it is possible
+		// to call functions before they are defined, and for
+		// them to call themselves recursively.
+		//
+		e.functions = append(e.functions, fn)
+		e.environment.SetFunction(fn.Name, fn)
+
 	case *ast.AssignStatement:
 
 		// Get the value
@@ -372,6 +960,21 @@ func (e *Eval) compile(node ast.Node) error {
 			return err
 		}
 
+		//
+		// A multiple assignment unpacks the array, leaving
+		// the first element at the top of the stack, and
+		// then stores each element in turn.
+		//
+		if node.Name == nil {
+			e.emit(code.OpUnpack, len(node.Names))
+			for _, name := range node.Names {
+				str := &object.String{Value: name.String()}
+				e.emit(code.OpConstant, e.addConstant(str))
+				e.emit(code.OpSet)
+			}
+			return nil
+		}
+
 		// Store the name
 		str := &object.String{Value: node.Name.String()}
 		e.emit(code.OpConstant, e.addConstant(str))
@@ -416,6 +1019,13 @@ func (e *Eval) compile(node ast.Node) error {
 		str := &object.String{Value: node.Function.String()}
 		e.emit(code.OpConstant, e.addConstant(str))
 
+		// Record the call, so the arguments can be checked.
+		tok := node.Token
+		if id, ok := node.Function.(*ast.Identifier); ok {
+			tok = id.Token
+		}
+		e.calls = append(e.calls, call{name: str.Value, args: args, tok: tok})
+
 		// then a call instruction with the number of args.
 		e.emit(code.OpCall, args)
 
@@ -425,6 +1035,29 @@ func (e *Eval) compile(node ast.Node) error {
 			return err
 		}
 
+		//
+		// Safe-navigation, `a?.b`, skips the index if the left
+		// side is null, leaving that as the result:
+		//
+		//     left
+		//     DUP
+		//     COALESCE INDEX:
+		//     JUMP END:
+		//  INDEX:
+		//     POP
+		//     index
+		//     ARRAYINDEX
+		//  END:
+		//
+		end := -1
+		if node.Optional {
+			e.emit(code.OpDup)
+			index := e.emit(code.OpCoalesce, 9999)
+			end = e.emit(code.OpJump, 9999)
+			e.changeOperand(index, len(e.instructions))
+			e.emit(code.OpPop)
+		}
+
 		err = e.compile(node.Index)
 		if err != nil {
 			return err
@@ -432,28 +1065,208 @@ func (e *Eval) compile(node ast.Node) error {
 
 		e.emit(code.OpArrayIndex)
 
+		if end >= 0 {
+			e.changeOperand(end, len(e.instructions))
+		}
+
+	case *ast.SliceExpression:
+		err := e.compile(node.Left)
+		if err != nil {
+			return err
+		}
+
+		//
+		// Missing bounds are represented by null.
+		//
+		for _, bound := range []ast.Expression{node.Start, node.End} {
+			if bound == nil {
+				e.emit(code.OpConstant, e.addConstant(&object.Null{}))
+				continue
+			}
+			err = e.compile(bound)
+			if err != nil {
+				return err
+			}
+		}
+
+		e.emit(code.OpSlice)
+
 	default:
-		return fmt.Errorf("unknown node type %T %v", node, node)
+		return e.errorf("unknown node type %T %v", node, node)
 	}
 	return nil
 }
 
-// addConstant adds a constant to the pool
-func (e *Eval) addConstant(obj object.Object) int {
+// compileFunction compiles the body of a user-defined function.
+//
+// Each function has its own bytecode, which is separate from that of the
+// main program, but they share the pool of constants.
+func (e *Eval) compileFunction(node *ast.FunctionStatement) (*object.Function, error) {
+
+	fn := &object.Function{Name: node.Name.Value}
+	for _, p := range node.Parameters {
+		fn.Parameters = append(fn.Parameters, p.Value)
+	}
 
 	//
-	// Look to see if the constant is present already
+	// Save the state of the program we're compiling, and
+	// restore it when we're done.
 	//
-	for i, c := range e.constants {
+	// Loops are saved because `break` and `continue` must not
+	// jump out of the function.
+	//
+	instructions := e.instructions
+	positions := e.positions
+	loops := e.loops
+	scopes := e.scopes
+	tries := e.tries
+
+	e.instructions = code.Instructions{}
+	e.positions = make(code.Positions)
+	e.loops = nil
+	e.scopes = 0
+	e.tries = 0
+
+	defer func() {
+		e.instructions = instructions
+		e.positions = positions
+		e.loops = loops
+		e.scopes = scopes
+		e.tries = tries
+	}()
 
-		//
-		// If the existing constant has the same
-		// type and value - then return the offset.
-		//
-		if c.Type() == obj.Type() &&
-			c.Inspect() == obj.Inspect() {
-			return i
+	//
+	// The body doesn't need a block-scope, because variables
+	// first assigned within a function are local to it anyway.
+	//
+	err := e.compileStatements(node.Body.Statements)
+	if err != nil {
+		return nil, err
+	}
+
+	//
+	// If the function doesn't explicitly return then it
+	// returns null.
+	//
+	e.emit(code.OpConstant, e.addConstant(&object.Null{}))
+	e.emit(code.OpReturn)
+
+	fn.Instructions = e.instructions
+	fn.Positions = e.positions
+	return fn, nil
+}
+
+// nodeToken returns the token of the given node, for those nodes which
+// generate instructions that might fail at run-time.
+func nodeToken(node ast.Node) (token.Token, bool) {
+	switch node := node.(type) {
+	case *ast.AssignStatement:
+		return node.Token, true
+	case *ast.BreakStatement:
+		return node.Token, true
+	case *ast.CallExpression:
+		return node.Token, true
+	case *ast.ComparisonExpression:
+		return node.Token, true
+	case *ast.ContinueStatement:
+		return node.Token, true
+	case *ast.ExpressionStatement:
+		return node.Token, true
+	case *ast.Identifier:
+		return node.Token, true
+	case *ast.IfExpression:
+		return node.Token, true
+	case *ast.IndexExpression:
+		return node.Token, true
+	case *ast.InfixExpression:
+		return node.Token, true
+	case *ast.PrefixExpression:
+		return node.Token, true
+	case *ast.ReturnStatement:
+		return node.Token, true
+	case *ast.SliceExpression:
+		return node.Token, true
+	case *ast.SwitchStatement:
+		return node.Token, true
+	case *ast.TernaryExpression:
+		return node.Token, true
+	case *ast.ThrowStatement:
+		return node.Token, true
+	case *ast.WhileStatement:
+		return node.Token, true
+	case *ast.YieldStatement:
+		return node.Token, true
+	}
+	return token.Token{}, false
+}
+
+// checkCalls records an error for each call to a function which has the
+// wrong number of arguments.
+//
+// Functions defined by the script expect exactly as many arguments as
+// they have parameters, while other functions are checked only if the
+// number of arguments they expect is known.  Calls to functions which
+// are unknown are left to fail at run-time, since they may be added
+// after the script has been compiled.
+func (e *Eval) checkCalls() {
+
+	for _, c := range e.calls {
+
+		fn, ok := e.environment.GetFunction(c.name)
+		if !ok {
+			continue
 		}
+
+		var min, max int
+		if f, ok := fn.(*object.Function); ok {
+			min, max = len(f.Parameters), len(f.Parameters)
+		} else if min, max, ok = e.environment.Arity(c.name); !ok {
+			continue
+		}
+
+		if c.args >= min && (max < 0 || c.args <= max) {
+			continue
+		}
+
+		expected := fmt.Sprintf("%d argument(s)", min)
+		if max < 0 {
+			expected = fmt.Sprintf("at least %d argument(s)", min)
+		} else if max != min {
+			expected = fmt.Sprintf("%d to %d arguments", min, max)
+		}
+		e.errors = append(e.errors, &CompileError{
+			Position: code.Position{Line: c.tok.Line, Column: c.tok.Column},
+			Message:  fmt.Sprintf("the function %s expects %s, got %d", c.name, expected, c.args),
+		})
+	}
+}
+
+// constantKey returns the key used to find duplicate constants.
+//
+// Floats are keyed by their bits, rather than their string-form, so that
+// distinct values which print identically, such as different NaNs,
+// are never merged.
+func constantKey(obj object.Object) string {
+	if f, ok := obj.(*object.Float); ok {
+		return fmt.Sprintf("%s:%x", obj.Type(), math.Float64bits(f.Value))
+	}
+	return string(obj.Type()) + ":" + obj.Inspect()
+}
+
+// addConstant adds a constant to the pool
+func (e *Eval) addConstant(obj object.Object) int {
+
+	if e.constantIndex == nil {
+		e.constantIndex = make(map[string]int)
+	}
+
+	//
+	// If a constant with the same type and value is present
+	// already then return its offset.
+	//
+	key := constantKey(obj)
+	if i, ok := e.constantIndex[key]; ok {
+		return i
 	}
 
 	//
@@ -461,60 +1274,53 @@ func (e *Eval) addConstant(obj object.Object) int {
 	// be added.
 	//
 	e.constants = append(e.constants, obj)
+	e.constantIndex[key] = len(e.constants) - 1
 	return len(e.constants) - 1
 }
 
 // emit generates a bytecode operation, and adds it to our program-array.
+//
+// If the argument is too large for the opcode the wide variant is used
+// instead.  Jumps are always wide if wideJumps is set, because their
+// arguments are only known once they've been emitted.
 func (e *Eval) emit(op code.Opcode, operands ...int) int {
 
-	ins := make([]byte, 1)
+	if len(operands) == 1 && (operands[0] > code.MaxOperand || (e.wideJumps && code.IsJump(op))) {
+		op |= code.Wide
+	}
+
+	ins := make([]byte, code.Length(op))
 	ins[0] = byte(op)
 
 	if len(operands) == 1 {
-
-		// Make a buffer for the arg
-		b := make([]byte, 2)
-		binary.BigEndian.PutUint16(b, uint16(operands[0]))
-
-		// append
-		ins = append(ins, b...)
+		code.SetOperand(ins, 0, operands[0])
 	}
 
 	posNewInstruction := len(e.instructions)
 	e.instructions = append(e.instructions, ins...)
 
+	if e.position.Line > 0 {
+		e.positions[posNewInstruction] = e.position
+	}
+
 	return posNewInstruction
 }
 
 // changeOperand is designed to patch the operand of
 // and instruction.  It is basically used to rewrite the target
 // of our jump instructions in the handling of `if`.
+//
+// If the operand is too large for the instruction then tooLarge is
+// set, and the program must be compiled again using wide jumps.
 func (e *Eval) changeOperand(opPos int, operand int) {
 
 	// get the opcode
 	op := code.Opcode(e.instructions[opPos])
 
-	// make a new buffer for the opcode
-	ins := make([]byte, 1)
-	ins[0] = byte(op)
-
-	// Make a buffer for the arg
-	b := make([]byte, 2)
-	binary.BigEndian.PutUint16(b, uint16(operand))
-
-	// append argument
-	ins = append(ins, b...)
-
-	// replace
-	e.replaceInstruction(opPos, ins)
-}
-
-// replaceInstruction rewrites the instruction at the given
-// bytecode position.
-func (e *Eval) replaceInstruction(pos int, newInstruction []byte) {
-	ins := e.instructions
-
-	for i := 0; i < len(newInstruction); i++ {
-		ins[pos+i] = newInstruction[i]
+	if op&code.Wide == 0 && operand > code.MaxOperand {
+		e.tooLarge = true
+		return
 	}
+
+	code.SetOperand(e.instructions, opPos, operand)
 }
@@ -4,10 +4,12 @@ package environment
 
 import (
 	"fmt"
+	"math"
 	"os"
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 	"unicode/utf8"
 
@@ -19,69 +21,234 @@ import (
 // is essentially constant.
 var regCache map[string]*regexp.Regexp
 
+// regCacheLock protects regCache, because our functions may be called
+// from multiple goroutines at the same time.
+var regCacheLock sync.Mutex
+
 // init ensures that our regexp cache is populated
 func init() {
 	regCache = make(map[string]*regexp.Regexp)
 }
 
+// fnAssert is the implementation of our `assert` function.
+//
+// If the first argument is false it aborts the script, with an error
+// containing the optional message.  Otherwise it returns true.
+func fnAssert(args []object.Object) (object.Object, error) {
+
+	// We expect one or two arguments
+	if len(args) < 1 || len(args) > 2 {
+		return &object.Error{Message: fmt.Sprintf("assert expects 1 or 2 arguments, got %d", len(args))}, nil
+	}
+
+	if args[0].True() {
+		return &object.Boolean{Value: true}, nil
+	}
+
+	if len(args) == 2 {
+		return nil, fmt.Errorf("assertion failed: %s", args[1].Inspect())
+	}
+	return nil, fmt.Errorf("assertion failed")
+}
+
+// fnBool is the implementation of our `bool` function.
+//
+// It returns the truthiness of its argument, which is the same rule
+// used by `if`, `while`, and `!`.
+func fnBool(args []object.Object) object.Object {
+
+	// We expect one argument
+	if len(args) != 1 {
+		return &object.Error{Message: fmt.Sprintf("bool expects 1 argument, got %d", len(args))}
+	}
+
+	return &object.Boolean{Value: args[0].True()}
+}
+
+// fnCoalesce is the implementation of our `coalesce` function.
+//
+// It returns the first argument which isn't null, or null if they all
+// are.  Unlike the `??` operator every argument is evaluated before the
+// function is called.
+func fnCoalesce(args []object.Object) object.Object {
+
+	// We expect at least one argument
+	if len(args) < 1 {
+		return &object.Error{Message: fmt.Sprintf("coalesce expects at least 1 argument, got %d", len(args))}
+	}
+
+	for _, arg := range args {
+		if arg.Type() != object.NULL {
+			return arg
+		}
+	}
+	return &object.Null{}
+}
+
+// fnDefault is the implementation of our `default` function.
+//
+// It returns the first argument, unless that is null in which case the
+// second argument is returned instead.
+func fnDefault(args []object.Object) object.Object {
+
+	// We expect two arguments
+	if len(args) != 2 {
+		return &object.Error{Message: fmt.Sprintf("default expects 2 arguments, got %d", len(args))}
+	}
+
+	if args[0].Type() == object.NULL {
+		return args[1]
+	}
+	return args[0]
+}
+
+// fnEndsWith is the implementation of our `endswith` function.
+//
+// It returns true if the first string ends with the second, so every
+// string ends with the empty string.  The arguments are converted to
+// strings first.
+func fnEndsWith(args []object.Object) object.Object {
+
+	// We expect two arguments
+	if len(args) != 2 {
+		return &object.Error{Message: fmt.Sprintf("endswith expects 2 arguments, got %d", len(args))}
+	}
+
+	return &object.Boolean{Value: strings.HasSuffix(args[0].Inspect(), args[1].Inspect())}
+}
+
+// fnEqFold is the implementation of our `eq_fold` function.
+//
+// It returns true if the two strings are equal, ignoring case.  Unicode
+// case-folding is used, so `eq_fold("Σ", "ς")` is true.
+//
+// Like our other string functions the arguments are converted to
+// strings first.
+func fnEqFold(args []object.Object) object.Object {
+
+	// We expect two arguments
+	if len(args) != 2 {
+		return &object.Error{Message: fmt.Sprintf("eq_fold expects 2 arguments, got %d", len(args))}
+	}
+
+	return &object.Boolean{Value: strings.EqualFold(args[0].Inspect(), args[1].Inspect())}
+}
+
+// fnExists is the implementation of our `exists` function.
+//
+// It returns true if the object the script is running against has the
+// named field, even if the value of that field is null.
+func fnExists(env *Environment, args []object.Object) object.Object {
+
+	// We expect one argument
+	if len(args) != 1 {
+		return &object.Error{Message: fmt.Sprintf("exists expects 1 argument, got %d", len(args))}
+	}
+
+	// Without a running script there is no object.
+	if env.fieldLookup == nil {
+		return &object.Boolean{Value: false}
+	}
+
+	_, ok := env.fieldLookup(args[0].Inspect())
+	return &object.Boolean{Value: ok}
+}
+
 // fnFloat is the implementation of the `float` function.
 //
-// It converts an object to a float, if it can.
+// It converts an object to a float, if it can.  Integers, and strings
+// which contain numbers, are converted, and booleans become 1 or 0.
+// Times are converted to seconds since the Unix Epoch.
 //
-// On failure it returns Null
+// Anything else, including null and strings which aren't numbers, results
+// in an error - so that a failed conversion can't be mistaken for zero.
+// Strings such as "NaN" and "Inf" aren't numbers either.
 func fnFloat(args []object.Object) object.Object {
 
 	// We expect one argument
 	if len(args) != 1 {
-		return &object.Null{}
+		return &object.Error{Message: fmt.Sprintf("float expects 1 argument, got %d", len(args))}
 	}
 
-	// Stringify
-	str := args[0].Inspect()
-
-	i, err := strconv.ParseFloat(str, 64)
-	if err != nil {
-		return &object.Null{}
+	switch arg := args[0].(type) {
+	case *object.Float:
+		return arg
+	case *object.Integer:
+		return &object.Float{Value: float64(arg.Value)}
+	case *object.Boolean:
+		if arg.Value {
+			return &object.Float{Value: 1}
+		}
+		return &object.Float{Value: 0}
+	case *object.Time:
+		return &object.Float{Value: float64(arg.Value.Unix())}
+	case *object.String:
+		// ParseFloat accepts "NaN", and "Inf", which aren't
+		// numbers - so those are rejected too.
+		f, err := strconv.ParseFloat(strings.TrimSpace(arg.Value), 64)
+		if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+			return &object.Error{Message: fmt.Sprintf("float: cannot convert %q to a float", arg.Value)}
+		}
+		return &object.Float{Value: f}
 	}
 
-	return &object.Float{Value: i}
+	return &object.Error{Message: fmt.Sprintf("float: cannot convert %s to a float", strings.ToLower(string(args[0].Type())))}
 }
 
 // fnInt is the implementation of the `int` function.
 //
-// It converts an object to an integer, if it can.
+// It converts an object to an integer, if it can.  Strings which contain
+// integers are converted, floats are truncated towards zero, and booleans
+// become 1 or 0.  Times are converted to seconds since the Unix Epoch.
 //
-// On failure it returns Null
+// Anything else, including null, strings which aren't integers, and floats
+// which are too large, results in an error - so that a failed conversion
+// can't be mistaken for zero.
 func fnInt(args []object.Object) object.Object {
 
 	// We expect one argument
 	if len(args) != 1 {
-		return &object.Null{}
+		return &object.Error{Message: fmt.Sprintf("int expects 1 argument, got %d", len(args))}
 	}
 
-	// Stringify
-	str := args[0].Inspect()
-
-	i, err := strconv.ParseInt(str, 10, 64)
-	if err != nil {
-		return &object.Null{}
+	switch arg := args[0].(type) {
+	case *object.Integer:
+		return arg
+	case *object.Float:
+		if math.IsNaN(arg.Value) || arg.Value >= math.MaxInt64 || arg.Value < math.MinInt64 {
+			return &object.Error{Message: fmt.Sprintf("int: cannot convert %s to an integer", arg.Inspect())}
+		}
+		return &object.Integer{Value: int64(arg.Value)}
+	case *object.Boolean:
+		if arg.Value {
+			return &object.Integer{Value: 1}
+		}
+		return &object.Integer{Value: 0}
+	case *object.Time:
+		return &object.Integer{Value: arg.Value.Unix()}
+	case *object.String:
+		i, err := strconv.ParseInt(strings.TrimSpace(arg.Value), 10, 64)
+		if err != nil {
+			return &object.Error{Message: fmt.Sprintf("int: cannot convert %q to an integer", arg.Value)}
+		}
+		return &object.Integer{Value: i}
 	}
 
-	return &object.Integer{Value: i}
+	return &object.Error{Message: fmt.Sprintf("int: cannot convert %s to an integer", strings.ToLower(string(args[0].Type())))}
 }
 
 // fnLen is the implementation of our `len` function.
 //
-// Interestingly this function doesn't just count the length of string
-// objects, instead we cast all objects to strings and allow their lengths
-// to be calculated.
-//
-// The obvious exception is the handling of arrays.  The length of
-// an array is the number of elements which it contains.
+// The length of a string is the number of characters (runes) it contains,
+// rather than the number of bytes.  The length of an array is the number
+// of elements it contains, and the length of a hash is the number of
+// keys it contains.  The length of null is zero.
 //
-// So `len(false)` is 5, len(3) is 1, and `len(0.123)` is 5, and arrays
-// work as expectd: len([]) is zero, and len(["steve", "kemp"]) is two.
+// Other objects are cast to strings and the length of that string is
+// returned, so `len(false)` is 5, len(3) is 1, and `len(0.123)` is 5.
 //
+// The function must be called with exactly one argument, otherwise
+// null is returned.
 func fnLen(args []object.Object) object.Object {
 
 	// We expect one argument
@@ -89,10 +256,14 @@ func fnLen(args []object.Object) object.Object {
 		return &object.Null{}
 	}
 
-	// array is handled differently
+	// Some types are handled differently
 	switch arg := args[0].(type) {
 	case *object.Array:
 		return &object.Integer{Value: int64(len(arg.Elements))}
+	case *object.Hash:
+		return &object.Integer{Value: int64(len(arg.Pairs))}
+	case *object.Null:
+		return &object.Integer{Value: 0}
 	}
 
 	// Stringify
@@ -134,7 +305,9 @@ func fnMatch(args []object.Object) object.Object {
 	reg := args[1].Inspect()
 
 	// Look for the compiled regular-expression object in our cache.
+	regCacheLock.Lock()
 	r, ok := regCache[reg]
+	regCacheLock.Unlock()
 	if !ok {
 
 		// OK it wasn't found, so compile it.
@@ -148,9 +321,20 @@ func fnMatch(args []object.Object) object.Object {
 		}
 
 		// store in the cache for next time
+		regCacheLock.Lock()
 		regCache[reg] = r
+		regCacheLock.Unlock()
 	}
 
+	return &object.Boolean{Value: Match(r, str)}
+}
+
+// Match returns true if the regular expression matches any line of the
+// given string, once leading and trailing whitespace has been removed.
+//
+// This is the matching used by both `match` and the `~=` operator.
+func Match(r *regexp.Regexp, str string) bool {
+
 	// Split the input by newline.
 	for _, s := range strings.Split(str, "\n") {
 
@@ -159,22 +343,83 @@ func fnMatch(args []object.Object) object.Object {
 
 		// Test if it matched
 		if r.MatchString(s) {
-			return &object.Boolean{Value: true}
+			return true
 		}
 	}
-	return &object.Boolean{Value: false}
+	return false
+}
+
+// fnReplace is the implementation of our `replace` function.
+//
+// All occurrences of the second argument within the first are replaced
+// by the third.  All arguments are cast to strings.
+func fnReplace(args []object.Object) object.Object {
+
+	// We expect three arguments
+	if len(args) != 3 {
+		return &object.Error{Message: fmt.Sprintf("replace expects 3 arguments, got %d", len(args))}
+	}
+
+	str := args[0].Inspect()
+	old := args[1].Inspect()
+	rep := args[2].Inspect()
+
+	return &object.String{Value: strings.ReplaceAll(str, old, rep)}
+}
+
+// fnSplit is the implementation of our `split` function.
+//
+// The first argument is split by the second, and an array of strings
+// is returned.  If the separator is empty the string is split into
+// individual characters.  All arguments are cast to strings.
+func fnSplit(args []object.Object) object.Object {
+
+	// We expect two arguments
+	if len(args) != 2 {
+		return &object.Error{Message: fmt.Sprintf("split expects 2 arguments, got %d", len(args))}
+	}
+
+	str := args[0].Inspect()
+	sep := args[1].Inspect()
+
+	var elements []object.Object
+	for _, s := range strings.Split(str, sep) {
+		elements = append(elements, &object.String{Value: s})
+	}
+
+	return &object.Array{Elements: elements}
+}
+
+// fnStartsWith is the implementation of our `startswith` function.
+//
+// It returns true if the first string begins with the second, so every
+// string begins with the empty string.  The arguments are converted to
+// strings first.
+func fnStartsWith(args []object.Object) object.Object {
+
+	// We expect two arguments
+	if len(args) != 2 {
+		return &object.Error{Message: fmt.Sprintf("startswith expects 2 arguments, got %d", len(args))}
+	}
+
+	return &object.Boolean{Value: strings.HasPrefix(args[0].Inspect(), args[1].Inspect())}
 }
 
 // fnString is the implementation of our `string` function.
+//
+// Every object may be converted to a string, which is the same as the
+// form used by `print`, so null becomes "null".
 func fnString(args []object.Object) object.Object {
 
 	// We expect one argument
 	if len(args) != 1 {
-		return &object.Null{}
+		return &object.Error{Message: fmt.Sprintf("string expects 1 argument, got %d", len(args))}
 	}
 
-	str := args[0].Inspect()
-	return &object.String{Value: str}
+	if str, ok := args[0].(*object.String); ok {
+		return str
+	}
+	return &object.String{Value: args[0].Inspect()}
 }
 
 // fnTrim is the implementation of our `trim` function.
@@ -211,13 +456,26 @@ func fnType(args []object.Object) object.Object {
 }
 
 // fnPrint is the implementation of our `print` function.
-func fnPrint(args []object.Object) object.Object {
+//
+// Output is written to the environment's output, which defaults to
+// STDOUT.
+func fnPrint(env *Environment, args []object.Object) object.Object {
 	for _, e := range args {
-		fmt.Printf("%s", e.Inspect())
+		fmt.Fprintf(env.output, "%s", e.Inspect())
 	}
 	return &object.Integer{Value: 0}
 }
 
+// fnPrintln is the implementation of our `println` function.
+//
+// This is the same as `print`, except a newline is written after
+// the arguments.
+func fnPrintln(env *Environment, args []object.Object) object.Object {
+	fnPrint(env, args)
+	fmt.Fprintf(env.output, "\n")
+	return &object.Integer{Value: 0}
+}
+
 // fnUpper is the implementation of our `upper` function.
 //
 // Again we stringify our arguments here so `upper(true)` is
@@ -237,7 +495,8 @@ func fnUpper(args []object.Object) object.Object {
 }
 
 // getTimeField handles returning a time-related field from an object
-// which is assumed to contain a time in the Unix Epoch format.
+// which is either a time, or an integer assumed to contain a time in
+// the Unix Epoch format.
 func getTimeField(args []object.Object, val string) object.Object {
 
 	// We expect one argument
@@ -245,25 +504,32 @@ func getTimeField(args []object.Object, val string) object.Object {
 		return &object.Null{}
 	}
 
-	// It must be an integer
-	if args[0].Type() != object.INTEGER {
-		return &object.Null{}
-	}
+	var ts time.Time
 
-	// Convert that to a time
-	ts := time.Unix(args[0].(*object.Integer).Value, 0)
+	switch arg := args[0].(type) {
+	case *object.Time:
+		// Times keep their own timezone.
+		ts = arg.Value
+
+	case *object.Integer:
+		// Convert that to a time
+		ts = time.Unix(arg.Value, 0)
+
+		// Handle timezones, by reading $TZ, and if not set
+		// defaulting to UTC.
+		env := os.Getenv("TZ")
+		if env == "" {
+			env = "UTC"
+		}
 
-	// Handle timezones, by reading $TZ, and if not set
-	// defaulting to UTC.
-	env := os.Getenv("TZ")
-	if env == "" {
-		env = "UTC"
-	}
+		// Ensure we set that timezone.
+		loc, err := time.LoadLocation(env)
+		if err == nil {
+			ts = ts.In(loc)
+		}
 
-	// Ensure we set that timezone.
-	loc, err := time.LoadLocation(env)
-	if err == nil {
-		ts = ts.In(loc)
+	default:
+		return &object.Null{}
 	}
 
 	// Now get the fields
@@ -326,3 +592,46 @@ func fnYear(args []object.Object) object.Object {
 func fnWeekday(args []object.Object) object.Object {
 	return getTimeField(args, "weekday")
 }
+
+// fnNow returns the current time.
+func fnNow(args []object.Object) object.Object {
+
+	if len(args) != 0 {
+		return &object.Error{Message: fmt.Sprintf("now expects no arguments, got %d", len(args))}
+	}
+
+	return &object.Time{Value: time.Now()}
+}
+
+// fnParseTime parses the given string as a time.
+//
+// The optional second argument is the layout to use, in the format
+// used by golang's time-package, if it is not supplied then the
+// string is expected to be in RFC3339 format.
+func fnParseTime(args []object.Object) object.Object {
+
+	if len(args) != 1 && len(args) != 2 {
+		return &object.Error{Message: fmt.Sprintf("parse_time expects 1 or 2 arguments, got %d", len(args))}
+	}
+
+	str, ok := args[0].(*object.String)
+	if !ok {
+		return &object.Error{Message: fmt.Sprintf("parse_time expects a string, got %s", args[0].Type())}
+	}
+
+	layout := time.RFC3339
+	if len(args) == 2 {
+		l, ok := args[1].(*object.String)
+		if !ok {
+			return &object.Error{Message: fmt.Sprintf("parse_time expects a string layout, got %s", args[1].Type())}
+		}
+		layout = l.Value
+	}
+
+	ts, err := time.Parse(layout, str.Value)
+	if err != nil {
+		return &object.Error{Message: fmt.Sprintf("parse_time failed: %s", err)}
+	}
+
+	return &object.Time{Value: ts}
+}
@@ -0,0 +1,323 @@
+// builtins_array.go contains our in-built functions for working with arrays.
+
+package environment
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/skx/evalfilter/v2/object"
+)
+
+// arrayArgument returns the first argument of an array-function, which
+// must be an array, or an error-object if it isn't.
+func arrayArgument(name string, args []object.Object, count int) (*object.Array, object.Object) {
+
+	if len(args) != count {
+		return nil, &object.Error{Message: fmt.Sprintf("%s expects %d argument(s), got %d", name, count, len(args))}
+	}
+
+	arr, ok := args[0].(*object.Array)
+	if !ok {
+		return nil, &object.Error{Message: fmt.Sprintf("%s expects an array, got %s", name, args[0].Type())}
+	}
+
+	return arr, nil
+}
+
+// sequenceArgument returns the first argument of a function which iterates
+// over its elements, which must be an array, or a string.
+//
+// Strings are converted to an array holding each of their characters, as
+// strings, so that multi-byte characters are never split.
+func sequenceArgument(name string, args []object.Object, count int) (*object.Array, object.Object) {
+
+	if len(args) != count {
+		return nil, &object.Error{Message: fmt.Sprintf("%s expects %d argument(s), got %d", name, count, len(args))}
+	}
+
+	switch arg := args[0].(type) {
+	case *object.Array:
+		return arg, nil
+	case *object.String:
+		return characters(arg.Value), nil
+	}
+
+	return nil, &object.Error{Message: fmt.Sprintf("%s expects an array or a string, got %s", name, args[0].Type())}
+}
+
+// characters returns an array of the characters in the given string.
+func characters(str string) *object.Array {
+	elements := make([]object.Object, 0, len(str))
+	for _, r := range str {
+		elements = append(elements, &object.String{Value: string(r)})
+	}
+	return &object.Array{Elements: elements}
+}
+
+// fnContains is the implementation of our `contains` function.
+//
+// It returns true if the array contains an element which is equal to the
+// second argument, as it would be with `==`.
+//
+// If the first argument isn't an array then the arguments are converted
+// to strings, and it returns true if the first contains the second.
+func fnContains(args []object.Object) object.Object {
+
+	if len(args) == 2 {
+		if _, ok := args[0].(*object.Array); !ok {
+			return &object.Boolean{Value: strings.Contains(args[0].Inspect(), args[1].Inspect())}
+		}
+	}
+
+	arr, err := arrayArgument("contains", args, 2)
+	if err != nil {
+		return err
+	}
+
+	for _, el := range arr.Elements {
+		if object.Equals(el, args[1]) {
+			return &object.Boolean{Value: true}
+		}
+	}
+	return &object.Boolean{Value: false}
+}
+
+// fnPop is the implementation of our `pop` function.
+//
+// It returns the last element of the array, or null if the array is
+// empty.  The array itself is not modified.
+func fnPop(args []object.Object) object.Object {
+
+	arr, err := arrayArgument("pop", args, 1)
+	if err != nil {
+		return err
+	}
+
+	if len(arr.Elements) == 0 {
+		return &object.Null{}
+	}
+	return arr.Elements[len(arr.Elements)-1]
+}
+
+// fnPush is the implementation of our `push` function.
+//
+// It returns a new array, with the value appended.  The original array
+// is not modified.
+func fnPush(args []object.Object) object.Object {
+
+	arr, err := arrayArgument("push", args, 2)
+	if err != nil {
+		return err
+	}
+
+	elements := make([]object.Object, len(arr.Elements), len(arr.Elements)+1)
+	copy(elements, arr.Elements)
+	elements = append(elements, args[1])
+
+	return &object.Array{Elements: elements}
+}
+
+// fnReverse is the implementation of our `reverse` function.
+//
+// It returns a new array, with the elements in reverse order.  If it
+// is given a string it returns a string, with the characters reversed.
+func fnReverse(args []object.Object) object.Object {
+
+	if len(args) == 1 {
+		if str, ok := args[0].(*object.String); ok {
+			runes := []rune(str.Value)
+			for i, j := 0, len(runes)-1; i < j; i, j = i+1, j-1 {
+				runes[i], runes[j] = runes[j], runes[i]
+			}
+			return &object.String{Value: string(runes)}
+		}
+	}
+
+	arr, err := arrayArgument("reverse", args, 1)
+	if err != nil {
+		return err
+	}
+
+	elements := make([]object.Object, len(arr.Elements))
+	for i, el := range arr.Elements {
+		elements[len(arr.Elements)-1-i] = el
+	}
+
+	return &object.Array{Elements: elements}
+}
+
+// sortRank returns the position of the given object's type in our
+// sort-order.
+//
+// Numbers are ranked together, so that integers and floats are
+// compared by value.
+func sortRank(obj object.Object) int {
+	switch obj.Type() {
+	case object.NULL:
+		return 0
+	case object.BOOLEAN:
+		return 1
+	case object.INTEGER, object.FLOAT:
+		return 2
+	case object.STRING:
+		return 3
+	}
+	return 4
+}
+
+// sortLess returns true if the first object sorts before the second.
+func sortLess(a, b object.Object) bool {
+
+	ra := sortRank(a)
+	rb := sortRank(b)
+	if ra != rb {
+		return ra < rb
+	}
+
+	switch ra {
+	case 1:
+		return !a.True() && b.True()
+	case 2:
+		na, _ := numericValue(a)
+		nb, _ := numericValue(b)
+		return na < nb
+	}
+
+	return a.Inspect() < b.Inspect()
+}
+
+// fnSort is the implementation of our `sort` function.
+//
+// It returns a new array with the elements sorted.  Arrays may contain
+// values of different types, in which case they're sorted by type and
+// then by value, with null first followed by booleans, numbers, strings,
+// and finally all other values.
+func fnSort(args []object.Object) object.Object {
+
+	arr, err := arrayArgument("sort", args, 1)
+	if err != nil {
+		return err
+	}
+
+	elements := make([]object.Object, len(arr.Elements))
+	copy(elements, arr.Elements)
+
+	sort.SliceStable(elements, func(i, j int) bool {
+		return sortLess(elements[i], elements[j])
+	})
+
+	return &object.Array{Elements: elements}
+}
+
+// functionArgument returns an error-object if the given argument to an
+// array-function cannot be called as a function.
+//
+// Functions defined within the script may be passed by name, as may
+// any function if its name is given as a string.
+func functionArgument(env *Environment, name string, fn object.Object) object.Object {
+
+	switch fn := fn.(type) {
+	case *object.Function:
+		return nil
+	case *object.String:
+		if _, ok := env.GetFunction(fn.Value); ok {
+			return nil
+		}
+		return &object.Error{Message: fmt.Sprintf("%s expects a function, but the function %s does not exist", name, fn.Value)}
+	}
+
+	return &object.Error{Message: fmt.Sprintf("%s expects a function, got %s", name, fn.Type())}
+}
+
+// call invokes the given function, via our caller.
+func (e *Environment) call(fn object.Object, args ...object.Object) (object.Object, error) {
+	if e.caller == nil {
+		return nil, fmt.Errorf("functions cannot be called outside the virtual machine")
+	}
+	return e.caller(fn, args)
+}
+
+// fnFilter is the implementation of our `filter` function.
+//
+// It returns a new array, containing the elements of the given array
+// for which the function returns a true value.  Strings are filtered
+// character by character.
+func fnFilter(env *Environment, args []object.Object) (object.Object, error) {
+
+	arr, err := sequenceArgument("filter", args, 2)
+	if err != nil {
+		return err, nil
+	}
+	if err := functionArgument(env, "filter", args[1]); err != nil {
+		return err, nil
+	}
+
+	elements := make([]object.Object, 0, len(arr.Elements))
+	for _, el := range arr.Elements {
+		res, err := env.call(args[1], el)
+		if err != nil {
+			return nil, err
+		}
+		if res.True() {
+			elements = append(elements, el)
+		}
+	}
+
+	return &object.Array{Elements: elements}, nil
+}
+
+// fnMap is the implementation of our `map` function.
+//
+// It returns a new array, containing the result of calling the function
+// with each element of the given array.
+func fnMap(env *Environment, args []object.Object) (object.Object, error) {
+
+	arr, err := sequenceArgument("map", args, 2)
+	if err != nil {
+		return err, nil
+	}
+	if err := functionArgument(env, "map", args[1]); err != nil {
+		return err, nil
+	}
+
+	elements := make([]object.Object, len(arr.Elements))
+	for i, el := range arr.Elements {
+		res, err := env.call(args[1], el)
+		if err != nil {
+			return nil, err
+		}
+		elements[i] = res
+	}
+
+	return &object.Array{Elements: elements}, nil
+}
+
+// fnReduce is the implementation of our `reduce` function.
+//
+// It calls the function with the initial value and the first element
+// of the array, then with that result and the second element, and so
+// on, returning the final result.  If the array is empty the initial
+// value is returned.
+func fnReduce(env *Environment, args []object.Object) (object.Object, error) {
+
+	arr, err := sequenceArgument("reduce", args, 3)
+	if err != nil {
+		return err, nil
+	}
+	if err := functionArgument(env, "reduce", args[1]); err != nil {
+		return err, nil
+	}
+
+	acc := args[2]
+	for _, el := range arr.Elements {
+		res, err := env.call(args[1], acc, el)
+		if err != nil {
+			return nil, err
+		}
+		acc = res
+	}
+
+	return acc, nil
+}
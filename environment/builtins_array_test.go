@@ -0,0 +1,174 @@
+package environment
+
+import (
+	"testing"
+
+	"github.com/skx/evalfilter/v2/object"
+)
+
+// array is a helper to create an array of the given objects.
+func array(elements ...object.Object) *object.Array {
+	return &object.Array{Elements: elements}
+}
+
+// Test the array functions.
+func TestArrayFunctions(t *testing.T) {
+
+	one := &object.Integer{Value: 1}
+	two := &object.Integer{Value: 2}
+	half := &object.Float{Value: 0.5}
+	str := &object.String{Value: "steve"}
+	yes := &object.Boolean{Value: true}
+	no := &object.Boolean{Value: false}
+	null := &object.Null{}
+
+	type TestCase struct {
+		Function func(args []object.Object) object.Object
+		Input    []object.Object
+		Result   string
+	}
+
+	tests := []TestCase{
+		// push
+		{Function: fnPush, Input: []object.Object{array(), one}, Result: "[1]"},
+		{Function: fnPush, Input: []object.Object{array(one), two}, Result: "[1, 2]"},
+
+		// pop
+		{Function: fnPop, Input: []object.Object{array()}, Result: "null"},
+		{Function: fnPop, Input: []object.Object{array(one)}, Result: "1"},
+		{Function: fnPop, Input: []object.Object{array(one, two)}, Result: "2"},
+
+		// reverse
+		{Function: fnReverse, Input: []object.Object{array()}, Result: "[]"},
+		{Function: fnReverse, Input: []object.Object{array(one)}, Result: "[1]"},
+		{Function: fnReverse, Input: []object.Object{array(one, two, str)}, Result: "[steve, 2, 1]"},
+		{Function: fnReverse, Input: []object.Object{str}, Result: "evets"},
+		{Function: fnReverse, Input: []object.Object{&object.String{Value: "héllo 👋"}}, Result: "👋 olléh"},
+		{Function: fnReverse, Input: []object.Object{&object.String{Value: ""}}, Result: ""},
+
+		// sort
+		{Function: fnSort, Input: []object.Object{array()}, Result: "[]"},
+		{Function: fnSort, Input: []object.Object{array(one)}, Result: "[1]"},
+		{Function: fnSort, Input: []object.Object{array(two, half, one)}, Result: "[0.5, 1, 2]"},
+		{Function: fnSort, Input: []object.Object{array(str, two, yes, null, no, one)}, Result: "[null, false, true, 1, 2, steve]"},
+
+		// contains
+		{Function: fnContains, Input: []object.Object{array(), one}, Result: "false"},
+		{Function: fnContains, Input: []object.Object{array(one), one}, Result: "true"},
+		{Function: fnContains, Input: []object.Object{array(one, two), str}, Result: "false"},
+		{Function: fnContains, Input: []object.Object{array(one, &object.String{Value: "2"}), two}, Result: "false"},
+	}
+
+	for _, test := range tests {
+		out := test.Function(test.Input)
+		if out.Inspect() != test.Result {
+			t.Errorf("Invalid result for %s: got %s, expected %s", test.Input[0].Inspect(), out.Inspect(), test.Result)
+		}
+	}
+
+	// The functions don't modify their input.
+	in := array(two, one)
+	fnPush([]object.Object{in, str})
+	fnSort([]object.Object{in})
+	fnReverse([]object.Object{in})
+	if in.Inspect() != "[2, 1]" {
+		t.Errorf("The input array was modified: %s", in.Inspect())
+	}
+
+	// Error cases: wrong argument counts, and non-arrays.
+	errors := []struct {
+		Function func(args []object.Object) object.Object
+		Input    []object.Object
+	}{
+		{Function: fnPush, Input: []object.Object{array()}},
+		{Function: fnPush, Input: []object.Object{one, two}},
+		{Function: fnPop, Input: []object.Object{}},
+		{Function: fnPop, Input: []object.Object{str}},
+		{Function: fnReverse, Input: []object.Object{one}},
+		{Function: fnSort, Input: []object.Object{array(), array()}},
+		{Function: fnContains, Input: []object.Object{array()}},
+	}
+	for _, test := range errors {
+		out := test.Function(test.Input)
+		if out.Type() != object.ERROR {
+			t.Errorf("Expected an error, got %s", out.Inspect())
+		}
+	}
+}
+
+// Test the functions which call other functions.
+func TestCallbackFunctions(t *testing.T) {
+
+	one := &object.Integer{Value: 1}
+	two := &object.Integer{Value: 2}
+	three := &object.Integer{Value: 3}
+
+	env := New()
+	env.SetFunction("double", func(args []object.Object) object.Object {
+		return &object.Integer{Value: args[0].(*object.Integer).Value * 2}
+	})
+	env.SetFunction("odd", func(args []object.Object) object.Object {
+		return &object.Boolean{Value: args[0].(*object.Integer).Value%2 == 1}
+	})
+	env.SetFunction("add", func(args []object.Object) object.Object {
+		return &object.Integer{Value: args[0].(*object.Integer).Value + args[1].(*object.Integer).Value}
+	})
+	env.SetFunction("wave", func(args []object.Object) object.Object {
+		return &object.Boolean{Value: args[0].Inspect() == "👋"}
+	})
+	env.SetFunction("concat", func(args []object.Object) object.Object {
+		return &object.String{Value: args[0].Inspect() + args[1].Inspect()}
+	})
+
+	// Without a caller functions can't be called.
+	_, err := fnMap(env, []object.Object{array(one), &object.String{Value: "double"}})
+	if err == nil {
+		t.Fatalf("expected an error calling a function without a caller")
+	}
+
+	// Our caller looks up the named golang function.
+	env.SetCaller(func(fn object.Object, args []object.Object) (object.Object, error) {
+		f, _ := env.GetFunction(fn.Inspect())
+		return f.(func(args []object.Object) object.Object)(args), nil
+	})
+
+	type TestCase struct {
+		Function callback
+		Input    []object.Object
+		Result   string
+	}
+
+	tests := []TestCase{
+		{Function: fnMap, Input: []object.Object{array(), &object.String{Value: "double"}}, Result: "[]"},
+		{Function: fnMap, Input: []object.Object{array(one, two, three), &object.String{Value: "double"}}, Result: "[2, 4, 6]"},
+		{Function: fnFilter, Input: []object.Object{array(), &object.String{Value: "odd"}}, Result: "[]"},
+		{Function: fnFilter, Input: []object.Object{array(one, two, three), &object.String{Value: "odd"}}, Result: "[1, 3]"},
+		{Function: fnReduce, Input: []object.Object{array(), &object.String{Value: "add"}, three}, Result: "3"},
+		{Function: fnReduce, Input: []object.Object{array(one, two, three), &object.String{Value: "add"}, one}, Result: "7"},
+
+		// Strings are treated as arrays of their characters.
+		{Function: fnMap, Input: []object.Object{&object.String{Value: "héllo"}, &object.String{Value: "upper"}}, Result: "[H, É, L, L, O]"},
+		{Function: fnMap, Input: []object.Object{&object.String{Value: ""}, &object.String{Value: "upper"}}, Result: "[]"},
+		{Function: fnFilter, Input: []object.Object{&object.String{Value: "a👋b"}, &object.String{Value: "wave"}}, Result: "[👋]"},
+		{Function: fnReduce, Input: []object.Object{&object.String{Value: "añb"}, &object.String{Value: "concat"}, &object.String{Value: ">"}}, Result: ">añb"},
+
+		// Errors
+		{Function: fnMap, Input: []object.Object{array(one)}, Result: "error: map expects 2 argument(s), got 1"},
+		{Function: fnMap, Input: []object.Object{one, &object.String{Value: "double"}}, Result: "error: map expects an array or a string, got INTEGER"},
+		{Function: fnMap, Input: []object.Object{array(one), one}, Result: "error: map expects a function, got INTEGER"},
+		{Function: fnFilter, Input: []object.Object{array(one), &object.String{Value: "bogus"}}, Result: "error: filter expects a function, but the function bogus does not exist"},
+		{Function: fnReduce, Input: []object.Object{array(one), &object.String{Value: "add"}}, Result: "error: reduce expects 3 argument(s), got 2"},
+	}
+
+	for _, test := range tests {
+
+		out, err := test.Function(env, test.Input)
+		if err != nil {
+			t.Errorf("Unexpected error for %v: %s", test.Input, err)
+			continue
+		}
+		if out.Inspect() != test.Result {
+			t.Errorf("Invalid result for %v: got '%s', expected '%s'", test.Input, out.Inspect(), test.Result)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+// builtins_format.go contains our in-built formatting functions.
+
+package environment
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/skx/evalfilter/v2/object"
+)
+
+// formatValue returns the golang value to pass to fmt.Sprintf for the
+// given object, and verb.
+//
+// If the verb cannot be used with the type of object an error is
+// returned instead.
+func formatValue(verb byte, obj object.Object) (interface{}, error) {
+
+	switch verb {
+
+	case 's', 'q':
+		if str, ok := obj.(*object.String); ok {
+			return str.Value, nil
+		}
+		return obj.Inspect(), nil
+
+	case 'v':
+		switch obj := obj.(type) {
+		case *object.Integer:
+			return obj.Value, nil
+		case *object.Float:
+			return obj.Value, nil
+		case *object.Boolean:
+			return obj.Value, nil
+		case *object.String:
+			return obj.Value, nil
+		}
+		return obj.Inspect(), nil
+
+	case 'd', 'x', 'X', 'o', 'b':
+		if i, ok := obj.(*object.Integer); ok {
+			return i.Value, nil
+		}
+		return nil, fmt.Errorf("%%%c expects an integer, got %s", verb, obj.Type())
+
+	case 'f', 'e', 'g':
+		if f, ok := numericValue(obj); ok {
+			return f, nil
+		}
+		return nil, fmt.Errorf("%%%c expects a number, got %s", verb, obj.Type())
+
+	case 't':
+		if b, ok := obj.(*object.Boolean); ok {
+			return b.Value, nil
+		}
+		return nil, fmt.Errorf("%%%c expects a boolean, got %s", verb, obj.Type())
+	}
+
+	return nil, fmt.Errorf("unknown format verb %%%c", verb)
+}
+
+// format formats the given arguments, the first of which is the
+// format-string.
+//
+// We parse the format-string ourselves so that each argument can be
+// converted to the golang type the verb expects, and so that mismatches
+// result in a readable error rather than output such as `%!d(string=x)`.
+func format(name string, args []object.Object) (string, *object.Error) {
+
+	if len(args) < 1 {
+		return "", &object.Error{Message: fmt.Sprintf("%s expects at least 1 argument, got %d", name, len(args))}
+	}
+
+	str, ok := args[0].(*object.String)
+	if !ok {
+		return "", &object.Error{Message: fmt.Sprintf("%s expects a format string, got %s", name, args[0].Type())}
+	}
+
+	var out strings.Builder
+
+	f := str.Value
+	rest := args[1:]
+
+	for i := 0; i < len(f); i++ {
+
+		if f[i] != '%' {
+			out.WriteByte(f[i])
+			continue
+		}
+
+		//
+		// Find the verb, skipping any flags, width, or
+		// precision.
+		//
+		start := i
+		i++
+		for i < len(f) && strings.IndexByte("+-# 0123456789.", f[i]) >= 0 {
+			i++
+		}
+		if i >= len(f) {
+			return "", &object.Error{Message: fmt.Sprintf("%s: incomplete format verb at the end of %q", name, f)}
+		}
+
+		verb := f[i]
+		if verb == '%' {
+			out.WriteByte('%')
+			continue
+		}
+
+		if len(rest) == 0 {
+			return "", &object.Error{Message: fmt.Sprintf("%s: missing argument for %s", name, f[start:i+1])}
+		}
+
+		val, err := formatValue(verb, rest[0])
+		if err != nil {
+			return "", &object.Error{Message: fmt.Sprintf("%s: %s", name, err)}
+		}
+		rest = rest[1:]
+
+		out.WriteString(fmt.Sprintf(f[start:i+1], val))
+	}
+
+	if len(rest) != 0 {
+		return "", &object.Error{Message: fmt.Sprintf("%s: %d unused argument(s)", name, len(rest))}
+	}
+
+	return out.String(), nil
+}
+
+// fnSprintf is the implementation of our `sprintf` function.
+func fnSprintf(args []object.Object) object.Object {
+
+	str, err := format("sprintf", args)
+	if err != nil {
+		return err
+	}
+	return &object.String{Value: str}
+}
+
+// fnPrintf is the implementation of our `printf` function.
+//
+// Output is written to the environment's output, just like `print`.
+func fnPrintf(env *Environment, args []object.Object) object.Object {
+
+	str, err := format("printf", args)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprint(env.output, str)
+	return &object.Integer{Value: 0}
+}
@@ -0,0 +1,81 @@
+package environment
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/skx/evalfilter/v2/object"
+)
+
+// Test sprintf.
+func TestSprintf(t *testing.T) {
+
+	type TestCase struct {
+		Input  []object.Object
+		Type   object.Type
+		Result string
+	}
+
+	str := func(s string) object.Object { return &object.String{Value: s} }
+	num := func(i int64) object.Object { return &object.Integer{Value: i} }
+
+	tests := []TestCase{
+		{Input: []object.Object{str("plain")}, Type: object.STRING, Result: "plain"},
+		{Input: []object.Object{str("%s is %d"), str("Steve"), num(42)}, Type: object.STRING, Result: "Steve is 42"},
+		{Input: []object.Object{str("%5d|%-5s|"), num(3), str("ab")}, Type: object.STRING, Result: "    3|ab   |"},
+		{Input: []object.Object{str("%.2f"), &object.Float{Value: 3.14159}}, Type: object.STRING, Result: "3.14"},
+		{Input: []object.Object{str("%.1f"), num(3)}, Type: object.STRING, Result: "3.0"},
+		{Input: []object.Object{str("%t"), &object.Boolean{Value: true}}, Type: object.STRING, Result: "true"},
+		{Input: []object.Object{str("%v %v %v"), num(1), str("two"), &object.Float{Value: 3.5}}, Type: object.STRING, Result: "1 two 3.5"},
+		{Input: []object.Object{str("%s"), &object.Array{Elements: []object.Object{num(1), num(2)}}}, Type: object.STRING, Result: "[1, 2]"},
+		{Input: []object.Object{str("%x %q"), num(255), str("a")}, Type: object.STRING, Result: `ff "a"`},
+		{Input: []object.Object{str("100%%")}, Type: object.STRING, Result: "100%"},
+
+		// Errors
+		{Input: []object.Object{}, Type: object.ERROR, Result: "error: sprintf expects at least 1 argument, got 0"},
+		{Input: []object.Object{num(3)}, Type: object.ERROR, Result: "error: sprintf expects a format string, got INTEGER"},
+		{Input: []object.Object{str("%d"), str("steve")}, Type: object.ERROR, Result: "error: sprintf: %d expects an integer, got STRING"},
+		{Input: []object.Object{str("%f"), str("steve")}, Type: object.ERROR, Result: "error: sprintf: %f expects a number, got STRING"},
+		{Input: []object.Object{str("%t"), num(1)}, Type: object.ERROR, Result: "error: sprintf: %t expects a boolean, got INTEGER"},
+		{Input: []object.Object{str("%d %d"), num(1)}, Type: object.ERROR, Result: "error: sprintf: missing argument for %d"},
+		{Input: []object.Object{str("%d"), num(1), num(2)}, Type: object.ERROR, Result: "error: sprintf: 1 unused argument(s)"},
+		{Input: []object.Object{str("%z"), num(1)}, Type: object.ERROR, Result: "error: sprintf: unknown format verb %z"},
+		{Input: []object.Object{str("oops %")}, Type: object.ERROR, Result: `error: sprintf: incomplete format verb at the end of "oops %"`},
+	}
+
+	for _, test := range tests {
+
+		out := fnSprintf(test.Input)
+		if out.Type() != test.Type {
+			t.Errorf("Invalid type for %v: %s", test.Input, out.Type())
+		}
+		if out.Inspect() != test.Result {
+			t.Errorf("Invalid result for %v: got '%s', expected '%s'", test.Input, out.Inspect(), test.Result)
+		}
+	}
+}
+
+// Test printf writes to the output.
+func TestPrintf(t *testing.T) {
+	var out bytes.Buffer
+
+	env := New()
+	env.SetOutput(&out)
+
+	res := fnPrintf(env, []object.Object{&object.String{Value: "%s=%d\n"}, &object.String{Value: "a"}, &object.Integer{Value: 1}})
+	if res.Type() != object.INTEGER {
+		t.Errorf("unexpected result: %s", res.Inspect())
+	}
+	if out.String() != "a=1\n" {
+		t.Errorf("unexpected output: '%s'", out.String())
+	}
+
+	// Errors are returned, and nothing is written.
+	res = fnPrintf(env, []object.Object{&object.String{Value: "%d"}})
+	if res.Type() != object.ERROR {
+		t.Errorf("expected an error, got %s", res.Inspect())
+	}
+	if out.String() != "a=1\n" {
+		t.Errorf("unexpected output: '%s'", out.String())
+	}
+}
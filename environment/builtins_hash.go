@@ -0,0 +1,63 @@
+// builtins_hash.go contains our in-built functions for working with hashes.
+
+package environment
+
+import (
+	"fmt"
+
+	"github.com/skx/evalfilter/v2/object"
+)
+
+// hashArgument returns the only argument of a hash-function, which
+// must be a hash, or an error-object if it isn't.
+func hashArgument(name string, args []object.Object) (*object.Hash, object.Object) {
+
+	if len(args) != 1 {
+		return nil, &object.Error{Message: fmt.Sprintf("%s expects 1 argument, got %d", name, len(args))}
+	}
+
+	hash, ok := args[0].(*object.Hash)
+	if !ok {
+		return nil, &object.Error{Message: fmt.Sprintf("%s expects a hash, got %s", name, args[0].Type())}
+	}
+
+	return hash, nil
+}
+
+// fnKeys is the implementation of our `keys` function.
+//
+// It returns an array of the keys of the hash, in the same sorted
+// order used when the hash is displayed.
+func fnKeys(args []object.Object) object.Object {
+
+	hash, err := hashArgument("keys", args)
+	if err != nil {
+		return err
+	}
+
+	elements := make([]object.Object, 0, len(hash.Pairs))
+	for _, key := range hash.SortedKeys() {
+		elements = append(elements, hash.Pairs[key].Key)
+	}
+
+	return &object.Array{Elements: elements}
+}
+
+// fnValues is the implementation of our `values` function.
+//
+// It returns an array of the values of the hash, in the same order
+// as the keys returned by `keys`.
+func fnValues(args []object.Object) object.Object {
+
+	hash, err := hashArgument("values", args)
+	if err != nil {
+		return err
+	}
+
+	elements := make([]object.Object, 0, len(hash.Pairs))
+	for _, key := range hash.SortedKeys() {
+		elements = append(elements, hash.Pairs[key].Value)
+	}
+
+	return &object.Array{Elements: elements}
+}
@@ -0,0 +1,65 @@
+package environment
+
+import (
+	"testing"
+
+	"github.com/skx/evalfilter/v2/object"
+)
+
+// hash is a helper to create a hash of the given keys and values.
+func hash(pairs ...object.Object) *object.Hash {
+	h := &object.Hash{Pairs: make(map[object.HashKey]object.HashPair)}
+	for i := 0; i+1 < len(pairs); i += 2 {
+		key := pairs[i].(object.Hashable).HashKey()
+		h.Pairs[key] = object.HashPair{Key: pairs[i], Value: pairs[i+1]}
+	}
+	return h
+}
+
+// Test the hash functions.
+func TestHashFunctions(t *testing.T) {
+
+	one := &object.Integer{Value: 1}
+	two := &object.Integer{Value: 2}
+	a := &object.String{Value: "a"}
+	b := &object.String{Value: "b"}
+	str := &object.String{Value: "1"}
+
+	type TestCase struct {
+		Function func(args []object.Object) object.Object
+		Input    []object.Object
+		Result   string
+	}
+
+	tests := []TestCase{
+		// keys
+		{Function: fnKeys, Input: []object.Object{hash()}, Result: "[]"},
+		{Function: fnKeys, Input: []object.Object{hash(b, one, a, two)}, Result: "[a, b]"},
+		{Function: fnKeys, Input: []object.Object{hash(str, a, one, b)}, Result: "[1, 1]"},
+
+		// values
+		{Function: fnValues, Input: []object.Object{hash()}, Result: "[]"},
+		{Function: fnValues, Input: []object.Object{hash(b, one, a, two)}, Result: "[2, 1]"},
+		{Function: fnValues, Input: []object.Object{hash(str, a, one, b)}, Result: "[b, a]"},
+	}
+
+	for _, test := range tests {
+		out := test.Function(test.Input)
+		if out.Type() != object.ARRAY {
+			t.Errorf("expected an array, got %s", out.Type())
+		}
+		if out.Inspect() != test.Result {
+			t.Errorf("expected %s, got %s", test.Result, out.Inspect())
+		}
+	}
+
+	// Non-hashes, and the wrong number of arguments, are errors.
+	for _, fn := range []func(args []object.Object) object.Object{fnKeys, fnValues} {
+		for _, input := range [][]object.Object{{}, {one}, {array(a)}, {hash(), hash()}} {
+			out := fn(input)
+			if out.Type() != object.ERROR {
+				t.Errorf("expected an error, got %s", out.Inspect())
+			}
+		}
+	}
+}
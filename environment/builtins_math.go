@@ -0,0 +1,219 @@
+// builtins_math.go contains our in-built mathematical functions.
+
+package environment
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/skx/evalfilter/v2/object"
+)
+
+// MathError is returned by the maths functions which fail in the same way
+// as the equivalent operator, so that the failure aborts the script with
+// the same error - e.g. `abs` of the smallest integer overflows, just as
+// negating it does, and `sqrt(-1)` fails just as `√-1` does.
+type MathError struct {
+	// Overflow is true if the result cannot be represented, otherwise
+	// the value was one which cannot be handled.
+	Overflow bool
+
+	// Message describes the failure.
+	Message string
+}
+
+// Error returns the message.
+func (m *MathError) Error() string {
+	return m.Message
+}
+
+// numericValue returns the value of the given object as a float, along
+// with a flag to indicate whether it was actually numeric.
+func numericValue(obj object.Object) (float64, bool) {
+	switch obj := obj.(type) {
+	case *object.Integer:
+		return float64(obj.Value), true
+	case *object.Float:
+		return obj.Value, true
+	}
+	return 0, false
+}
+
+// mathFunction applies the given operation to the single numeric argument
+// of a maths-function.
+//
+// Integer arguments are returned unchanged, because they're already
+// whole numbers, while floats have the operation applied to them.
+func mathFunction(name string, args []object.Object, fn func(float64) float64) object.Object {
+
+	// We expect one argument
+	if len(args) != 1 {
+		return &object.Error{Message: fmt.Sprintf("%s expects 1 argument, got %d", name, len(args))}
+	}
+
+	switch arg := args[0].(type) {
+	case *object.Integer:
+		return arg
+	case *object.Float:
+		return &object.Float{Value: fn(arg.Value)}
+	}
+
+	return &object.Error{Message: fmt.Sprintf("%s expects a number, got %s", name, args[0].Type())}
+}
+
+// fnAbs is the implementation of our `abs` function.
+//
+// The absolute value of the smallest integer can't be represented, so
+// that aborts the script with a MathError - as negating it would.
+func fnAbs(args []object.Object) (object.Object, error) {
+
+	// We expect one argument
+	if len(args) != 1 {
+		return &object.Error{Message: fmt.Sprintf("abs expects 1 argument, got %d", len(args))}, nil
+	}
+
+	switch arg := args[0].(type) {
+	case *object.Integer:
+		if arg.Value == math.MinInt64 {
+			return nil, &MathError{Overflow: true, Message: fmt.Sprintf("integer overflow negating %d", arg.Value)}
+		}
+		if arg.Value < 0 {
+			return &object.Integer{Value: -arg.Value}, nil
+		}
+		return arg, nil
+	case *object.Float:
+		return &object.Float{Value: math.Abs(arg.Value)}, nil
+	}
+
+	return &object.Error{Message: fmt.Sprintf("abs expects a number, got %s", args[0].Type())}, nil
+}
+
+// fnCeil is the implementation of our `ceil` function.
+func fnCeil(args []object.Object) object.Object {
+	return mathFunction("ceil", args, math.Ceil)
+}
+
+// fnFloor is the implementation of our `floor` function.
+func fnFloor(args []object.Object) object.Object {
+	return mathFunction("floor", args, math.Floor)
+}
+
+// fnRound is the implementation of our `round` function.
+//
+// Halfway values are rounded away from zero.  An optional second
+// argument gives the number of decimal places to round floats to,
+// which is useful for presenting results such as `0.1 + 0.2`.
+func fnRound(args []object.Object) object.Object {
+
+	if len(args) == 1 {
+		return mathFunction("round", args, math.Round)
+	}
+	if len(args) != 2 {
+		return &object.Error{Message: fmt.Sprintf("round expects 1 or 2 arguments, got %d", len(args))}
+	}
+
+	places, ok := args[1].(*object.Integer)
+	if !ok {
+		return &object.Error{Message: fmt.Sprintf("round expects an integer number of places, got %s", args[1].Type())}
+	}
+	if places.Value < 0 {
+		return &object.Error{Message: fmt.Sprintf("round expects a non-negative number of places, got %d", places.Value)}
+	}
+
+	switch arg := args[0].(type) {
+	case *object.Integer:
+		return arg
+	case *object.Float:
+		pow := math.Pow(10, float64(places.Value))
+		val := math.Round(arg.Value*pow) / pow
+		if math.IsInf(val, 0) || math.IsNaN(val) {
+			// Already more precise than the places requested.
+			return arg
+		}
+		return &object.Float{Value: val}
+	}
+
+	return &object.Error{Message: fmt.Sprintf("round expects a number, got %s", args[0].Type())}
+}
+
+// SquareRoot returns the square root of the given value.
+//
+// The square root of a negative number, or of NaN, is a MathError rather
+// than NaN, so that it cannot silently make later comparisons false.  It
+// is shared by the `sqrt` function, and the `√` operator.
+func SquareRoot(val float64) (float64, error) {
+	if val < 0 || math.IsNaN(val) {
+		return 0, &MathError{Message: fmt.Sprintf("attempted square-root of %v", val)}
+	}
+	return math.Sqrt(val), nil
+}
+
+// fnSqrt is the implementation of our `sqrt` function.
+//
+// The result is always a float, and the square root of a negative
+// number aborts the script - as it does for the `√` operator.
+func fnSqrt(args []object.Object) (object.Object, error) {
+
+	// We expect one argument
+	if len(args) != 1 {
+		return &object.Error{Message: fmt.Sprintf("sqrt expects 1 argument, got %d", len(args))}, nil
+	}
+
+	val, ok := numericValue(args[0])
+	if !ok {
+		return &object.Error{Message: fmt.Sprintf("sqrt expects a number, got %s", args[0].Type())}, nil
+	}
+
+	res, err := SquareRoot(val)
+	if err != nil {
+		return nil, err
+	}
+	return &object.Float{Value: res}, nil
+}
+
+// minMax is the shared implementation of our `min` and `max` functions.
+//
+// The values to compare are either the arguments, of which there must be
+// at least two, or the members of a single array argument.  The value
+// with the lowest or highest value, as appropriate, is returned unchanged.
+func minMax(name string, args []object.Object, better func(a, b float64) bool) object.Object {
+
+	values := args
+	if len(args) == 1 {
+		arr, ok := args[0].(*object.Array)
+		if !ok {
+			return &object.Error{Message: fmt.Sprintf("%s expects an array, or at least 2 arguments", name)}
+		}
+		values = arr.Elements
+		if len(values) == 0 {
+			return &object.Error{Message: fmt.Sprintf("%s called with an empty array", name)}
+		}
+	}
+	if len(values) == 0 {
+		return &object.Error{Message: fmt.Sprintf("%s expects an array, or at least 2 arguments", name)}
+	}
+
+	var result object.Object
+	var best float64
+	for _, val := range values {
+		num, ok := numericValue(val)
+		if !ok {
+			return &object.Error{Message: fmt.Sprintf("%s expects numbers, got %s", name, val.Type())}
+		}
+		if result == nil || better(num, best) {
+			result = val
+			best = num
+		}
+	}
+	return result
+}
+
+// fnMax is the implementation of our `max` function.
+func fnMax(args []object.Object) object.Object {
+	return minMax("max", args, func(a, b float64) bool { return a > b })
+}
+
+// fnMin is the implementation of our `min` function.
+func fnMin(args []object.Object) object.Object {
+	return minMax("min", args, func(a, b float64) bool { return a < b })
+}
@@ -0,0 +1,185 @@
+package environment
+
+import (
+	"math"
+	"testing"
+
+	"github.com/skx/evalfilter/v2/object"
+)
+
+// failable adapts a function which may abort the script, for the tables
+// of tests which expect their results to be objects.
+func failable(fn func(args []object.Object) (object.Object, error)) func(args []object.Object) object.Object {
+	return func(args []object.Object) object.Object {
+		out, err := fn(args)
+		if err != nil {
+			return &object.Error{Message: "aborted: " + err.Error()}
+		}
+		return out
+	}
+}
+
+// Test the functions which abort the script, rather than returning an
+// error value, as the equivalent operator would.
+func TestMathErrors(t *testing.T) {
+
+	_, err := fnAbs([]object.Object{&object.Integer{Value: math.MinInt64}})
+	m, ok := err.(*MathError)
+	if !ok || !m.Overflow || m.Error() != "integer overflow negating -9223372036854775808" {
+		t.Errorf("Unexpected error for abs: %v", err)
+	}
+
+	for _, val := range []object.Object{&object.Integer{Value: -1}, &object.Float{Value: -2.5}, &object.Float{Value: math.NaN()}} {
+		_, err = fnSqrt([]object.Object{val})
+		m, ok = err.(*MathError)
+		if !ok || m.Overflow || m.Error() != "attempted square-root of "+val.Inspect() {
+			t.Errorf("Unexpected error for sqrt(%s): %v", val.Inspect(), err)
+		}
+	}
+}
+
+// Test the single-argument maths functions.
+func TestMathFunctions(t *testing.T) {
+
+	type TestCase struct {
+		Function func(args []object.Object) object.Object
+		Input    object.Object
+		Type     object.Type
+		Result   string
+	}
+
+	tests := []TestCase{
+		{Function: failable(fnAbs), Input: &object.Integer{Value: -3}, Type: object.INTEGER, Result: "3"},
+		{Function: failable(fnAbs), Input: &object.Integer{Value: 3}, Type: object.INTEGER, Result: "3"},
+		{Function: failable(fnAbs), Input: &object.Float{Value: -3.5}, Type: object.FLOAT, Result: "3.5"},
+
+		{Function: fnCeil, Input: &object.Integer{Value: 3}, Type: object.INTEGER, Result: "3"},
+		{Function: fnCeil, Input: &object.Float{Value: 3.2}, Type: object.FLOAT, Result: "4"},
+		{Function: fnCeil, Input: &object.Float{Value: -3.2}, Type: object.FLOAT, Result: "-3"},
+
+		{Function: fnFloor, Input: &object.Integer{Value: 3}, Type: object.INTEGER, Result: "3"},
+		{Function: fnFloor, Input: &object.Float{Value: 3.7}, Type: object.FLOAT, Result: "3"},
+		{Function: fnFloor, Input: &object.Float{Value: -3.2}, Type: object.FLOAT, Result: "-4"},
+
+		{Function: fnRound, Input: &object.Integer{Value: 3}, Type: object.INTEGER, Result: "3"},
+		{Function: fnRound, Input: &object.Float{Value: 3.5}, Type: object.FLOAT, Result: "4"},
+		{Function: fnRound, Input: &object.Float{Value: 3.49}, Type: object.FLOAT, Result: "3"},
+
+		{Function: failable(fnSqrt), Input: &object.Integer{Value: 9}, Type: object.FLOAT, Result: "3"},
+		{Function: failable(fnSqrt), Input: &object.Float{Value: 2.25}, Type: object.FLOAT, Result: "1.5"},
+
+		// Errors
+		{Function: failable(fnSqrt), Input: &object.String{Value: "steve"}, Type: object.ERROR, Result: "error: sqrt expects a number, got STRING"},
+		{Function: failable(fnAbs), Input: &object.String{Value: "steve"}, Type: object.ERROR, Result: "error: abs expects a number, got STRING"},
+		{Function: fnFloor, Input: &object.Null{}, Type: object.ERROR, Result: "error: floor expects a number, got NULL"},
+	}
+
+	for _, test := range tests {
+
+		out := test.Function([]object.Object{test.Input})
+		if out.Type() != test.Type {
+			t.Errorf("Invalid type for %s: %s", test.Input.Inspect(), out.Type())
+		}
+		if out.Inspect() != test.Result {
+			t.Errorf("Invalid result for %s: %s", test.Input.Inspect(), out.Inspect())
+		}
+	}
+
+	// Calling the functions with the wrong number of arguments
+	// should return an error.
+	for _, fn := range []func(args []object.Object) object.Object{failable(fnAbs), fnCeil, fnFloor, fnRound, failable(fnSqrt)} {
+		var args []object.Object
+		out := fn(args)
+		if out.Type() != object.ERROR {
+			t.Errorf("no arguments returns a weird result")
+		}
+	}
+}
+
+// Test rounding to a number of decimal places.
+func TestRoundPlaces(t *testing.T) {
+
+	type TestCase struct {
+		Input  []object.Object
+		Type   object.Type
+		Result string
+	}
+
+	num := func(f float64) object.Object { return &object.Float{Value: f} }
+	places := func(i int64) object.Object { return &object.Integer{Value: i} }
+
+	tests := []TestCase{
+		{Input: []object.Object{num(0.1 + 0.2), places(2)}, Type: object.FLOAT, Result: "0.3"},
+		{Input: []object.Object{num(3.14159), places(3)}, Type: object.FLOAT, Result: "3.142"},
+		{Input: []object.Object{num(0.125), places(2)}, Type: object.FLOAT, Result: "0.13"},
+		{Input: []object.Object{num(-2.5), places(0)}, Type: object.FLOAT, Result: "-3"},
+		{Input: []object.Object{num(1.5), places(400)}, Type: object.FLOAT, Result: "1.5"},
+		{Input: []object.Object{places(7), places(2)}, Type: object.INTEGER, Result: "7"},
+
+		// Errors
+		{Input: []object.Object{num(1.5), num(2)}, Type: object.ERROR, Result: "error: round expects an integer number of places, got FLOAT"},
+		{Input: []object.Object{num(1.5), places(-1)}, Type: object.ERROR, Result: "error: round expects a non-negative number of places, got -1"},
+		{Input: []object.Object{&object.String{Value: "steve"}, places(1)}, Type: object.ERROR, Result: "error: round expects a number, got STRING"},
+		{Input: []object.Object{num(1.5), places(1), places(1)}, Type: object.ERROR, Result: "error: round expects 1 or 2 arguments, got 3"},
+	}
+
+	for _, test := range tests {
+
+		out := fnRound(test.Input)
+		if out.Type() != test.Type {
+			t.Errorf("Invalid type for %v: %s", test.Input, out.Type())
+		}
+		if out.Inspect() != test.Result {
+			t.Errorf("Invalid result for %v: got '%s', expected '%s'", test.Input, out.Inspect(), test.Result)
+		}
+	}
+}
+
+// Test min and max.
+func TestMinMax(t *testing.T) {
+
+	one := &object.Integer{Value: 1}
+	two := &object.Float{Value: 2.5}
+	three := &object.Integer{Value: 3}
+
+	type TestCase struct {
+		Input []object.Object
+		Min   string
+		Max   string
+	}
+
+	tests := []TestCase{
+		{Input: []object.Object{one, two}, Min: "1", Max: "2.5"},
+		{Input: []object.Object{three, one, two}, Min: "1", Max: "3"},
+		{Input: []object.Object{&object.Array{Elements: []object.Object{two, three, one}}}, Min: "1", Max: "3"},
+		{Input: []object.Object{&object.Array{Elements: []object.Object{two}}}, Min: "2.5", Max: "2.5"},
+	}
+
+	for _, test := range tests {
+
+		out := fnMin(test.Input)
+		if out.Inspect() != test.Min {
+			t.Errorf("Invalid min: %s", out.Inspect())
+		}
+		out = fnMax(test.Input)
+		if out.Inspect() != test.Max {
+			t.Errorf("Invalid max: %s", out.Inspect())
+		}
+	}
+
+	// Error cases.
+	errors := [][]object.Object{
+		{},
+		{one},
+		{&object.Array{}},
+		{one, &object.String{Value: "steve"}},
+	}
+	for _, args := range errors {
+		if fnMin(args).Type() != object.ERROR {
+			t.Errorf("Expected an error from min")
+		}
+		if fnMax(args).Type() != object.ERROR {
+			t.Errorf("Expected an error from max")
+		}
+	}
+}
@@ -1,11 +1,154 @@
 package environment
 
 import (
+	"bytes"
+	"math"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/skx/evalfilter/v2/object"
 )
 
+// Test case-insensitive comparison.
+func TestBool(t *testing.T) {
+
+	values := map[object.Object]bool{
+		&object.Null{}:                 false,
+		&object.Integer{Value: 0}:      false,
+		&object.Integer{Value: 3}:      true,
+		&object.Float{Value: 0}:        false,
+		&object.String{Value: ""}:      false,
+		&object.String{Value: "false"}: true,
+		&object.Array{}:                false,
+		&object.Boolean{Value: true}:   true,
+	}
+
+	for val, expected := range values {
+		out := fnBool([]object.Object{val})
+		if out.(*object.Boolean).Value != expected {
+			t.Errorf("unexpected result for %s %s: %s", val.Type(), val.Inspect(), out.Inspect())
+		}
+	}
+
+	// The wrong number of arguments is an error
+	out := fnBool([]object.Object{})
+	if out.Type() != object.ERROR {
+		t.Errorf("expected an error, got %s", out.Inspect())
+	}
+}
+
+func TestDefault(t *testing.T) {
+
+	fallback := &object.String{Value: "fallback"}
+
+	out := fnDefault([]object.Object{&object.Null{}, fallback})
+	if out != fallback {
+		t.Errorf("expected the fallback, got %s", out.Inspect())
+	}
+
+	out = fnDefault([]object.Object{&object.Boolean{Value: false}, fallback})
+	if out.Inspect() != "false" {
+		t.Errorf("expected the value, got %s", out.Inspect())
+	}
+
+	// The wrong number of arguments is an error
+	out = fnDefault([]object.Object{fallback})
+	if out.Type() != object.ERROR {
+		t.Errorf("expected an error, got %s", out.Inspect())
+	}
+}
+
+func TestCoalesce(t *testing.T) {
+
+	null := &object.Null{}
+	fallback := &object.String{Value: "fallback"}
+
+	out := fnCoalesce([]object.Object{null, null, fallback, &object.Integer{Value: 3}})
+	if out != fallback {
+		t.Errorf("expected the fallback, got %s", out.Inspect())
+	}
+
+	out = fnCoalesce([]object.Object{null, &object.Integer{Value: 0}, fallback})
+	if out.Inspect() != "0" {
+		t.Errorf("expected the zero, got %s", out.Inspect())
+	}
+
+	out = fnCoalesce([]object.Object{null, null})
+	if out.Type() != object.NULL {
+		t.Errorf("expected null, got %s", out.Inspect())
+	}
+
+	// At least one argument is required
+	out = fnCoalesce([]object.Object{})
+	if out.Type() != object.ERROR {
+		t.Errorf("expected an error, got %s", out.Inspect())
+	}
+}
+
+func TestExists(t *testing.T) {
+
+	env := New()
+
+	// Without a lookup function nothing exists.
+	out := fnExists(env, []object.Object{&object.String{Value: "name"}})
+	if out.(*object.Boolean).Value {
+		t.Errorf("expected false, got %s", out.Inspect())
+	}
+
+	env.SetFieldLookup(func(name string) (object.Object, bool) {
+		return &object.Null{}, name == "name"
+	})
+
+	out = fnExists(env, []object.Object{&object.String{Value: "name"}})
+	if !out.(*object.Boolean).Value {
+		t.Errorf("expected true, got %s", out.Inspect())
+	}
+	out = fnExists(env, []object.Object{&object.String{Value: "age"}})
+	if out.(*object.Boolean).Value {
+		t.Errorf("expected false, got %s", out.Inspect())
+	}
+
+	// The wrong number of arguments is an error
+	out = fnExists(env, []object.Object{})
+	if out.Type() != object.ERROR {
+		t.Errorf("expected an error, got %s", out.Inspect())
+	}
+}
+
+func TestEqFold(t *testing.T) {
+
+	type TestCase struct {
+		A      object.Object
+		B      object.Object
+		Result bool
+	}
+
+	tests := []TestCase{
+		{A: &object.String{Value: "STEVE"}, B: &object.String{Value: "steve"}, Result: true},
+		{A: &object.String{Value: "Straße"}, B: &object.String{Value: "STRASSE"}, Result: false},
+		{A: &object.String{Value: "ΣΊΣΥΦΟΣ"}, B: &object.String{Value: "σίσυφος"}, Result: true},
+		{A: &object.String{Value: "σ"}, B: &object.String{Value: "ς"}, Result: true},
+		{A: &object.String{Value: "K"}, B: &object.String{Value: "\u212a"}, Result: true},
+		{A: &object.String{Value: "steve"}, B: &object.String{Value: "kemp"}, Result: false},
+		{A: &object.Boolean{Value: true}, B: &object.String{Value: "TRUE"}, Result: true},
+	}
+
+	for _, test := range tests {
+
+		out := fnEqFold([]object.Object{test.A, test.B})
+		if out.(*object.Boolean).Value != test.Result {
+			t.Errorf("Invalid result for %s, %s", test.A.Inspect(), test.B.Inspect())
+		}
+	}
+
+	// The wrong number of arguments is an error
+	out := fnEqFold([]object.Object{&object.String{Value: "steve"}})
+	if out.Type() != object.ERROR {
+		t.Errorf("expected an error, got %s", out.Inspect())
+	}
+}
+
 // Test float-conversion.
 func TestFloat(t *testing.T) {
 
@@ -14,41 +157,40 @@ func TestFloat(t *testing.T) {
 		Result object.Object
 	}
 
+	now := time.Unix(1234, 0)
+
 	tests := []TestCase{
-		{Input: &object.String{Value: "π"}, Result: &object.Null{}},
-		{Input: &object.String{Value: "Steve"}, Result: &object.Null{}},
-		{Input: &object.Integer{Value: 3}, Result: &object.Float{Value: 3}},
+		{Input: &object.String{Value: "π"}, Result: &object.Error{Message: `float: cannot convert "π" to a float`}},
+		{Input: &object.String{Value: "Steve"}, Result: &object.Error{Message: `float: cannot convert "Steve" to a float`}},
+		{Input: &object.String{Value: "NaN"}, Result: &object.Error{Message: `float: cannot convert "NaN" to a float`}},
+		{Input: &object.String{Value: "Inf"}, Result: &object.Error{Message: `float: cannot convert "Inf" to a float`}},
+		{Input: &object.String{Value: "-infinity"}, Result: &object.Error{Message: `float: cannot convert "-infinity" to a float`}},
+		{Input: &object.String{Value: "1e400"}, Result: &object.Error{Message: `float: cannot convert "1e400" to a float`}},
 		{Input: &object.String{Value: "3.21"}, Result: &object.Float{Value: 3.21}},
-		{Input: &object.Boolean{Value: true}, Result: &object.Null{}},
+		{Input: &object.String{Value: " -7 "}, Result: &object.Float{Value: -7}},
+		{Input: &object.Integer{Value: 3}, Result: &object.Float{Value: 3}},
+		{Input: &object.Float{Value: 1.5}, Result: &object.Float{Value: 1.5}},
+		{Input: &object.Boolean{Value: true}, Result: &object.Float{Value: 1}},
+		{Input: &object.Boolean{Value: false}, Result: &object.Float{Value: 0}},
+		{Input: &object.Time{Value: now}, Result: &object.Float{Value: 1234}},
+		{Input: &object.Null{}, Result: &object.Error{Message: "float: cannot convert null to a float"}},
+		{Input: &object.Array{}, Result: &object.Error{Message: "float: cannot convert array to a float"}},
 	}
 
 	// For each test
 	for _, test := range tests {
 
-		var args []object.Object
-		args = append(args, test.Input)
-
-		x := fnFloat(args)
-
-		if x.Type() != test.Result.Type() {
-			t.Errorf("Invalid type result for '%s', got %s, expected %s", test.Input, x.Type(), test.Result.Type())
-		}
+		x := fnFloat([]object.Object{test.Input})
 
-		switch x.(type) {
-		case *object.Float:
-			if x.(*object.Float).Value != test.Result.(*object.Float).Value {
-				t.Errorf("invalid float result")
-			}
-		case *object.Null:
-		default:
-			t.Errorf("unknown type")
+		if x.Type() != test.Result.Type() || x.Inspect() != test.Result.Inspect() {
+			t.Errorf("Invalid result for '%s', got %s, expected %s", test.Input.Inspect(), x.Inspect(), test.Result.Inspect())
 		}
 	}
 
 	// ensure that zero arguments are handled
 	var tmp []object.Object
 	out := fnFloat(tmp)
-	if out.Type() != "NULL" {
+	if out.Type() != object.ERROR {
 		t.Errorf("Invalid result for no args:%s", out.Type())
 	}
 }
@@ -61,41 +203,42 @@ func TestInt(t *testing.T) {
 		Result object.Object
 	}
 
+	now := time.Unix(1234, 0)
+
 	tests := []TestCase{
-		{Input: &object.String{Value: "π"}, Result: &object.Null{}},
-		{Input: &object.String{Value: "Steve"}, Result: &object.Null{}},
-		{Input: &object.Integer{Value: 3}, Result: &object.Integer{Value: 3}},
+		{Input: &object.String{Value: "π"}, Result: &object.Error{Message: `int: cannot convert "π" to an integer`}},
+		{Input: &object.String{Value: "abc"}, Result: &object.Error{Message: `int: cannot convert "abc" to an integer`}},
+		{Input: &object.String{Value: "3.5"}, Result: &object.Error{Message: `int: cannot convert "3.5" to an integer`}},
 		{Input: &object.String{Value: "3"}, Result: &object.Integer{Value: 3}},
-		{Input: &object.Boolean{Value: true}, Result: &object.Null{}},
+		{Input: &object.String{Value: " -12 "}, Result: &object.Integer{Value: -12}},
+		{Input: &object.String{Value: "0"}, Result: &object.Integer{Value: 0}},
+		{Input: &object.Integer{Value: 3}, Result: &object.Integer{Value: 3}},
+		{Input: &object.Float{Value: 3.9}, Result: &object.Integer{Value: 3}},
+		{Input: &object.Float{Value: -3.9}, Result: &object.Integer{Value: -3}},
+		{Input: &object.Float{Value: math.Inf(1)}, Result: &object.Error{Message: "int: cannot convert +Inf to an integer"}},
+		{Input: &object.Float{Value: math.NaN()}, Result: &object.Error{Message: "int: cannot convert NaN to an integer"}},
+		{Input: &object.Float{Value: 1e19}, Result: &object.Error{Message: "int: cannot convert 10000000000000000000 to an integer"}},
+		{Input: &object.Boolean{Value: true}, Result: &object.Integer{Value: 1}},
+		{Input: &object.Boolean{Value: false}, Result: &object.Integer{Value: 0}},
+		{Input: &object.Time{Value: now}, Result: &object.Integer{Value: 1234}},
+		{Input: &object.Null{}, Result: &object.Error{Message: "int: cannot convert null to an integer"}},
+		{Input: &object.Hash{}, Result: &object.Error{Message: "int: cannot convert hash to an integer"}},
 	}
 
 	// For each test
 	for _, test := range tests {
 
-		var args []object.Object
-		args = append(args, test.Input)
+		x := fnInt([]object.Object{test.Input})
 
-		x := fnInt(args)
-
-		if x.Type() != test.Result.Type() {
-			t.Errorf("Invalid type result for return")
-		}
-
-		switch x.(type) {
-		case *object.Integer:
-			if x.(*object.Integer).Value != test.Result.(*object.Integer).Value {
-				t.Errorf("Invalid integer result")
-			}
-		case *object.Null:
-		default:
-			t.Errorf("unknown type")
+		if x.Type() != test.Result.Type() || x.Inspect() != test.Result.Inspect() {
+			t.Errorf("Invalid result for '%s', got %s, expected %s", test.Input.Inspect(), x.Inspect(), test.Result.Inspect())
 		}
 	}
 
 	// ensure that zero arguments are handled
 	var tmp []object.Object
 	out := fnInt(tmp)
-	if out.Type() != "NULL" {
+	if out.Type() != object.ERROR {
 		t.Errorf("Invalid result for no args:%s", out.Type())
 	}
 }
@@ -105,43 +248,38 @@ func TestString(t *testing.T) {
 
 	type TestCase struct {
 		Input  object.Object
-		Result object.Object
+		Result string
 	}
 
 	tests := []TestCase{
-		{Input: &object.String{Value: "π"}, Result: &object.String{Value: "π"}},
-		{Input: &object.String{Value: "Steve"}, Result: &object.String{Value: "Steve"}},
-		{Input: &object.Integer{Value: 3}, Result: &object.String{Value: "3"}},
-		{Input: &object.Boolean{Value: true}, Result: &object.String{Value: "true"}},
+		{Input: &object.String{Value: "π"}, Result: "π"},
+		{Input: &object.String{Value: "Steve"}, Result: "Steve"},
+		{Input: &object.Integer{Value: 3}, Result: "3"},
+		{Input: &object.Float{Value: 3.25}, Result: "3.25"},
+		{Input: &object.Boolean{Value: true}, Result: "true"},
+		{Input: &object.Null{}, Result: "null"},
+		{Input: &object.Array{Elements: []object.Object{&object.Integer{Value: 1}}}, Result: "[1]"},
 	}
 
 	// For each test
 	for _, test := range tests {
 
-		var args []object.Object
-		args = append(args, test.Input)
+		x := fnString([]object.Object{test.Input})
 
-		x := fnString(args)
-
-		if x.Type() != test.Result.Type() {
-			t.Errorf("Invalid type result for return")
+		str, ok := x.(*object.String)
+		if !ok {
+			t.Errorf("Invalid type result for '%s': %s", test.Input.Inspect(), x.Type())
+			continue
 		}
-
-		switch x.(type) {
-		case *object.String:
-			if x.(*object.String).Value != test.Result.(*object.String).Value {
-				t.Errorf("Invalid string result")
-			}
-		case *object.Null:
-		default:
-			t.Errorf("unknown type")
+		if str.Value != test.Result {
+			t.Errorf("Invalid string result, got %s, expected %s", str.Value, test.Result)
 		}
 	}
 
 	// ensure that zero arguments are handled
 	var tmp []object.Object
 	out := fnString(tmp)
-	if out.Type() != "NULL" {
+	if out.Type() != object.ERROR {
 		t.Errorf("Invalid result for no args:%s", out.Type())
 	}
 }
@@ -170,6 +308,15 @@ func TestLen(t *testing.T) {
 		{Input: &object.Array{Elements: []object.Object{
 			&object.String{Value: "steve"}}},
 			Result: 1},
+
+		// Hashes
+		{Input: &object.Hash{Pairs: map[object.HashKey]object.HashPair{
+			{Type: object.STRING, Value: "a"}: {Key: &object.String{Value: "a"}, Value: &object.Integer{Value: 1}},
+			{Type: object.STRING, Value: "b"}: {Key: &object.String{Value: "b"}, Value: &object.Integer{Value: 2}}}},
+			Result: 2},
+
+		// Null
+		{Input: &object.Null{}, Result: 0},
 	}
 
 	// For each test
@@ -190,6 +337,12 @@ func TestLen(t *testing.T) {
 	if out.Type() != object.NULL {
 		t.Errorf("no arguments returns a weird result")
 	}
+
+	// As should calling it with more than one.
+	out = fnLen([]object.Object{&object.String{Value: "a"}, &object.String{Value: "b"}})
+	if out.Type() != object.NULL {
+		t.Errorf("multiple arguments returns a weird result")
+	}
 }
 
 // Test lower-casing strings
@@ -229,6 +382,92 @@ func TestLower(t *testing.T) {
 	}
 }
 
+// Test splitting strings
+func TestSplit(t *testing.T) {
+
+	type TestCase struct {
+		Input  string
+		Sep    string
+		Result []string
+	}
+
+	tests := []TestCase{
+		{Input: "a,b,c", Sep: ",", Result: []string{"a", "b", "c"}},
+		{Input: "steve kemp", Sep: " ", Result: []string{"steve", "kemp"}},
+		{Input: "abc", Sep: "-", Result: []string{"abc"}},
+		{Input: "aπc", Sep: "", Result: []string{"a", "π", "c"}},
+	}
+
+	// For each test
+	for _, test := range tests {
+
+		args := []object.Object{
+			&object.String{Value: test.Input},
+			&object.String{Value: test.Sep},
+		}
+
+		x := fnSplit(args)
+		arr, ok := x.(*object.Array)
+		if !ok {
+			t.Fatalf("Expected an array, got %s", x.Type())
+		}
+		if len(arr.Elements) != len(test.Result) {
+			t.Fatalf("Invalid result for %s: %s", test.Input, x.Inspect())
+		}
+		for i, el := range arr.Elements {
+			if el.(*object.String).Value != test.Result[i] {
+				t.Errorf("Invalid element %d for %s: %s", i, test.Input, el.Inspect())
+			}
+		}
+	}
+
+	// Non-strings are coerced.
+	out := fnSplit([]object.Object{&object.Integer{Value: 123}, &object.String{Value: ""}})
+	if out.Inspect() != "[1, 2, 3]" {
+		t.Errorf("Invalid result splitting an integer: %s", out.Inspect())
+	}
+
+	// Calling the function with the wrong arguments should return an error
+	out = fnSplit([]object.Object{&object.String{Value: "a"}})
+	if out.Type() != object.ERROR {
+		t.Errorf("one argument returns a weird result")
+	}
+	if !strings.Contains(out.Inspect(), "split expects 2 arguments") {
+		t.Errorf("unexpected error message: %s", out.Inspect())
+	}
+}
+
+// Test replacing text in strings
+func TestReplace(t *testing.T) {
+
+	type TestCase struct {
+		Input  []object.Object
+		Result string
+	}
+
+	tests := []TestCase{
+		{Input: []object.Object{&object.String{Value: "a-b-c"}, &object.String{Value: "-"}, &object.String{Value: "+"}}, Result: "a+b+c"},
+		{Input: []object.Object{&object.String{Value: "Steve"}, &object.String{Value: "x"}, &object.String{Value: "y"}}, Result: "Steve"},
+		{Input: []object.Object{&object.Integer{Value: 1001}, &object.Integer{Value: 0}, &object.Integer{Value: 2}}, Result: "1221"},
+	}
+
+	// For each test
+	for _, test := range tests {
+
+		x := fnReplace(test.Input)
+		if x.(*object.String).Value != test.Result {
+			t.Errorf("Invalid result for %s: %s", test.Input[0].Inspect(), x.Inspect())
+		}
+	}
+
+	// Calling the function with the wrong arguments should return an error
+	var args []object.Object
+	out := fnReplace(args)
+	if out.Type() != object.ERROR {
+		t.Errorf("no arguments returns a weird result")
+	}
+}
+
 // Test regexp-matching
 func TestMatch(t *testing.T) {
 
@@ -329,6 +568,10 @@ func TestType(t *testing.T) {
 		{Input: &object.Float{Value: 3.2}, Result: "float"},
 		{Input: &object.Boolean{Value: true}, Result: "boolean"},
 		{Input: &object.Null{}, Result: "null"},
+		{Input: &object.Array{}, Result: "array"},
+		{Input: &object.Hash{}, Result: "hash"},
+		{Input: &object.Error{Message: "bogus"}, Result: "error"},
+		{Input: &object.Function{Name: "foo"}, Result: "function"},
 	}
 
 	// For each test
@@ -350,6 +593,12 @@ func TestType(t *testing.T) {
 		t.Errorf("no arguments returns a weird result")
 	}
 
+	// As should calling it with more than one.
+	out = fnType([]object.Object{&object.Null{}, &object.Null{}})
+	if out.Type() != object.NULL {
+		t.Errorf("multiple arguments returns a weird result")
+	}
+
 }
 
 // Test upper-casing strings
@@ -389,13 +638,46 @@ func TestUpper(t *testing.T) {
 	}
 }
 
-// NOP-test
+// TestPrint tests that print, and println, write to the output.
 func TestPrint(t *testing.T) {
+	var out bytes.Buffer
+
+	env := New()
+	env.SetOutput(&out)
+
 	var args []object.Object
-	fnPrint(args)
+	fnPrint(env, args)
+	if out.String() != "" {
+		t.Errorf("unexpected output: '%s'", out.String())
+	}
 
-	args = append(args, &object.String{Value: ""})
-	fnPrint(args)
+	args = append(args, &object.String{Value: "Steve "}, &object.Integer{Value: 3})
+	fnPrint(env, args)
+	fnPrintln(env, args)
+	if out.String() != "Steve 3Steve 3\n" {
+		t.Errorf("unexpected output: '%s'", out.String())
+	}
+
+	//
+	// Retrieving the function binds it to the environment, and
+	// clones get their own output.
+	//
+	clone := env.Clone()
+	var cloned bytes.Buffer
+	clone.SetOutput(&cloned)
+
+	fn, ok := clone.GetFunction("println")
+	if !ok {
+		t.Fatalf("failed to find println")
+	}
+	fn.(func(args []object.Object) object.Object)(args)
+
+	if cloned.String() != "Steve 3\n" {
+		t.Errorf("unexpected output: '%s'", cloned.String())
+	}
+	if out.String() != "Steve 3Steve 3\n" {
+		t.Errorf("unexpected output: '%s'", out.String())
+	}
 }
 
 // TestTime performs *minimal* invocation of time-fields
@@ -484,4 +766,138 @@ func TestTime(t *testing.T) {
 		t.Errorf("unexpected value passing bogus argument")
 	}
 
+	//
+	// Time objects work too, and keep their own timezone.
+	//
+	var tm []object.Object
+	tm = append(tm, &object.Time{Value: time.Date(1976, 3, 10, 14, 15, 16, 0, time.FixedZone("custom", 3600))})
+
+	if fnHour(tm).(*object.Integer).Value != 14 {
+		t.Errorf("Failed to get the correct time")
+	}
+	if fnWeekday(tm).(*object.String).Value != "Wednesday" {
+		t.Errorf("Failed to get the correct date")
+	}
+}
+
+// TestParseTime tests parse_time.
+func TestParseTime(t *testing.T) {
+
+	type TestCase struct {
+		Input  []object.Object
+		Type   object.Type
+		Result string
+	}
+
+	str := func(s string) object.Object { return &object.String{Value: s} }
+
+	tests := []TestCase{
+		{Input: []object.Object{str("1976-03-10T14:15:16Z")}, Type: object.TIME, Result: "1976-03-10T14:15:16Z"},
+		{Input: []object.Object{str("1976-03-10T14:15:16.5+01:00")}, Type: object.TIME, Result: "1976-03-10T14:15:16.5+01:00"},
+		{Input: []object.Object{str("10/03/1976"), str("02/01/2006")}, Type: object.TIME, Result: "1976-03-10T00:00:00Z"},
+
+		// Errors
+		{Input: []object.Object{}, Type: object.ERROR, Result: "error: parse_time expects 1 or 2 arguments, got 0"},
+		{Input: []object.Object{&object.Integer{Value: 3}}, Type: object.ERROR, Result: "error: parse_time expects a string, got INTEGER"},
+		{Input: []object.Object{str("10/03/1976"), &object.Integer{Value: 3}}, Type: object.ERROR, Result: "error: parse_time expects a string layout, got INTEGER"},
+		{Input: []object.Object{str("10/03/1976"), str("2006-01-02")}, Type: object.ERROR, Result: `error: parse_time failed: parsing time "10/03/1976" as "2006-01-02": cannot parse "10/03/1976" as "2006"`},
+	}
+
+	for _, test := range tests {
+
+		out := fnParseTime(test.Input)
+		if out.Type() != test.Type {
+			t.Errorf("Invalid type for %v: %s", test.Input, out.Type())
+		}
+		if out.Inspect() != test.Result {
+			t.Errorf("Invalid result for %v: got '%s', expected '%s'", test.Input, out.Inspect(), test.Result)
+		}
+	}
+
+	// now takes no arguments.
+	if fnNow([]object.Object{str("x")}).Type() != object.ERROR {
+		t.Errorf("expected an error calling now with arguments")
+	}
+	if fnNow(nil).Type() != object.TIME {
+		t.Errorf("now did not return a time")
+	}
+}
+
+// Test the functions which look for substrings.
+func TestSubstrings(t *testing.T) {
+
+	type TestCase struct {
+		Function func(args []object.Object) object.Object
+		A        object.Object
+		B        object.Object
+		Result   bool
+	}
+
+	str := func(s string) object.Object { return &object.String{Value: s} }
+
+	tests := []TestCase{
+		{Function: fnStartsWith, A: str("steve"), B: str("st"), Result: true},
+		{Function: fnStartsWith, A: str("steve"), B: str("ve"), Result: false},
+		{Function: fnStartsWith, A: str("steve"), B: str(""), Result: true},
+		{Function: fnStartsWith, A: str(""), B: str(""), Result: true},
+		{Function: fnStartsWith, A: str("st"), B: str("steve"), Result: false},
+		{Function: fnStartsWith, A: str("Ωmega"), B: str("Ω"), Result: true},
+		{Function: fnStartsWith, A: &object.Integer{Value: 123}, B: &object.Integer{Value: 12}, Result: true},
+
+		{Function: fnEndsWith, A: str("steve"), B: str("ve"), Result: true},
+		{Function: fnEndsWith, A: str("steve"), B: str("st"), Result: false},
+		{Function: fnEndsWith, A: str("steve"), B: str(""), Result: true},
+		{Function: fnEndsWith, A: str("café"), B: str("é"), Result: true},
+		{Function: fnEndsWith, A: str("café"), B: str("e"), Result: false},
+		{Function: fnEndsWith, A: &object.Float{Value: 2.5}, B: str(".5"), Result: true},
+
+		{Function: fnContains, A: str("steve"), B: str("tev"), Result: true},
+		{Function: fnContains, A: str("steve"), B: str("kemp"), Result: false},
+		{Function: fnContains, A: str("steve"), B: str(""), Result: true},
+		{Function: fnContains, A: str("日本語"), B: str("本"), Result: true},
+		{Function: fnContains, A: &object.Integer{Value: 1234}, B: &object.Integer{Value: 23}, Result: true},
+	}
+
+	for _, test := range tests {
+
+		out := test.Function([]object.Object{test.A, test.B})
+		if out.(*object.Boolean).Value != test.Result {
+			t.Errorf("Invalid result for %s, %s", test.A.Inspect(), test.B.Inspect())
+		}
+	}
+
+	// The wrong number of arguments is an error
+	for _, fn := range []func(args []object.Object) object.Object{fnStartsWith, fnEndsWith, fnContains} {
+		out := fn([]object.Object{str("steve")})
+		if out.Type() != object.ERROR {
+			t.Errorf("expected an error, got %s", out.Inspect())
+		}
+	}
+}
+
+func TestAssert(t *testing.T) {
+
+	// Wrong number of arguments
+	out, err := fnAssert([]object.Object{})
+	if err != nil || out.Type() != object.ERROR {
+		t.Errorf("expected an error-object, got %v %v", out, err)
+	}
+
+	// Truthy conditions continue
+	for _, cond := range []object.Object{&object.Boolean{Value: true}, &object.Integer{Value: 3}, &object.String{Value: "steve"}} {
+		out, err = fnAssert([]object.Object{cond, &object.String{Value: "unused"}})
+		if err != nil || !out.True() {
+			t.Errorf("unexpected result asserting %s: %v %v", cond.Inspect(), out, err)
+		}
+	}
+
+	// Falsy conditions fail, with the message
+	_, err = fnAssert([]object.Object{&object.Integer{Value: 0}, &object.String{Value: "zero"}})
+	if err == nil || err.Error() != "assertion failed: zero" {
+		t.Errorf("unexpected error %v", err)
+	}
+	_, err = fnAssert([]object.Object{&object.Null{}})
+	if err == nil || err.Error() != "assertion failed" {
+		t.Errorf("unexpected error %v", err)
+	}
 }
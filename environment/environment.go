@@ -2,17 +2,210 @@
 package environment
 
 import (
+	"io"
+	"os"
+	"sort"
+
 	"github.com/skx/evalfilter/v2/object"
 )
 
+// builtin is the signature of the built-in functions which need access
+// to the environment they're running within, such as `print`.
+//
+// These are bound to the environment when they are retrieved, so they
+// look like any other golang function to the caller.
+type builtin func(env *Environment, args []object.Object) object.Object
+
+// callback is the signature of the built-in functions which call other
+// functions, such as `map`.
+//
+// These are bound to the environment in the same way as a builtin, but
+// they may fail, which aborts execution, if the function they call fails.
+type callback func(env *Environment, args []object.Object) (object.Object, error)
+
+// Caller is the signature of the function which is used to call other
+// functions, on behalf of built-in functions such as `map`.
+//
+// The function to call is either an object.Function, or a string
+// containing the name of a function.
+type Caller func(fn object.Object, args []object.Object) (object.Object, error)
+
+// FieldLookup is the signature of the function which is used to find
+// the fields of the object a script is running against, on behalf of
+// the built-in function `exists`.
+//
+// It returns the value of the named field, and whether it is present.
+type FieldLookup func(name string) (object.Object, bool)
+
+// arity holds the minimum, and maximum, number of arguments a function
+// expects.  A maximum of -1 means there is no maximum.
+type arity struct {
+	min int
+	max int
+}
+
+// functions holds our default functions, which are registered in each
+// new environment, and restored by RemoveFunction.
+var functions = map[string]interface{}{
+	"assert":     fnAssert,
+	"bool":       fnBool,
+	"coalesce":   fnCoalesce,
+	"default":    fnDefault,
+	"endswith":   fnEndsWith,
+	"eq_fold":    fnEqFold,
+	"exists":     builtin(fnExists),
+	"len":        fnLen,
+	"lower":      fnLower,
+	"match":      fnMatch,
+	"print":      builtin(fnPrint),
+	"println":    builtin(fnPrintln),
+	"printf":     builtin(fnPrintf),
+	"sprintf":    fnSprintf,
+	"replace":    fnReplace,
+	"split":      fnSplit,
+	"startswith": fnStartsWith,
+	"trim":       fnTrim,
+	"type":       fnType,
+	"upper":      fnUpper,
+	"string":     fnString,
+	"int":        fnInt,
+	"float":      fnFloat,
+
+	// Maths.
+	"abs":   fnAbs,
+	"ceil":  fnCeil,
+	"floor": fnFloor,
+	"max":   fnMax,
+	"min":   fnMin,
+	"round": fnRound,
+	"sqrt":  fnSqrt,
+
+	// Arrays.
+	"contains": fnContains,
+	"filter":   callback(fnFilter),
+	"map":      callback(fnMap),
+	"pop":      fnPop,
+	"push":     fnPush,
+	"reduce":   callback(fnReduce),
+	"reverse":  fnReverse,
+	"sort":     fnSort,
+
+	// Hashes.
+	"keys":   fnKeys,
+	"values": fnValues,
+
+	// Times.
+	"now":        fnNow,
+	"parse_time": fnParseTime,
+
+	//
+	// These all refer to time.Time fields.
+	//
+	// (Though they will work on any object which
+	// is an integer, as well as on times.  Because
+	// when we examine time.Time fields via reflection
+	// we convert them to Unix epoch seconds.)
+	//
+
+	// 10:11:12, etc.
+	"hour":    fnHour,
+	"minute":  fnMinute,
+	"seconds": fnSeconds,
+
+	// 10/03/1976, etc.
+	"day":   fnDay,
+	"month": fnMonth,
+	"year":  fnYear,
+
+	// "Saturday", "Sunday", etc.
+	"weekday": fnWeekday,
+}
+
+// arities holds the number of arguments our default functions expect,
+// which allows scripts calling them incorrectly to be rejected when
+// they're compiled.
+var arities = map[string]arity{
+	"assert":     {1, 2},
+	"bool":       {1, 1},
+	"coalesce":   {1, -1},
+	"default":    {2, 2},
+	"endswith":   {2, 2},
+	"eq_fold":    {2, 2},
+	"exists":     {1, 1},
+	"len":        {1, 1},
+	"lower":      {1, 1},
+	"match":      {2, 2},
+	"print":      {0, -1},
+	"println":    {0, -1},
+	"printf":     {1, -1},
+	"sprintf":    {1, -1},
+	"replace":    {3, 3},
+	"split":      {2, 2},
+	"startswith": {2, 2},
+	"trim":       {1, 1},
+	"type":       {1, 1},
+	"upper":      {1, 1},
+	"string":     {1, 1},
+	"int":        {1, 1},
+	"float":      {1, 1},
+	"abs":        {1, 1},
+	"ceil":       {1, 1},
+	"floor":      {1, 1},
+	"max":        {1, -1},
+	"min":        {1, -1},
+	"round":      {1, 2},
+	"sqrt":       {1, 1},
+	"contains":   {2, 2},
+	"filter":     {2, 2},
+	"map":        {2, 2},
+	"pop":        {1, 1},
+	"push":       {2, 2},
+	"reduce":     {3, 3},
+	"reverse":    {1, 1},
+	"sort":       {1, 1},
+	"keys":       {1, 1},
+	"values":     {1, 1},
+	"now":        {0, 0},
+	"parse_time": {1, 2},
+	"hour":       {1, 1},
+	"minute":     {1, 1},
+	"seconds":    {1, 1},
+	"day":        {1, 1},
+	"month":      {1, 1},
+	"year":       {1, 1},
+	"weekday":    {1, 1},
+}
+
 // Environment stores our functions, variables, constants, etc.
 type Environment struct {
 	// store holds variables set by the user-script.
 	store map[string]object.Object
 
+	// constants holds the names of the variables which are constants,
+	// and so may not be changed by the script.
+	constants map[string]bool
+
 	// functions holds golang function pointers, as set by
 	// by the host-application.
 	functions map[string]interface{}
+
+	// arity holds the number of arguments functions expect, for
+	// those functions which have declared it.
+	arity map[string]arity
+
+	// output is where the output of `print` is written.
+	output io.Writer
+
+	// caller is used to call functions on behalf of built-in
+	// functions, such as `map`.
+	caller Caller
+
+	// fieldLookup is used to find the fields of the object a
+	// script is running against.
+	fieldLookup FieldLookup
+
+	// version is changed whenever a function is added, or removed.
+	version int
 }
 
 // New creates a new environment, which is used for storing variable
@@ -27,44 +220,82 @@ func New() *Environment {
 	fun := make(map[string]interface{})
 
 	// Create the environment object
-	env := &Environment{store: str, functions: fun}
+	env := &Environment{store: str, constants: make(map[string]bool), functions: fun, arity: make(map[string]arity), output: os.Stdout}
 
 	// Register our default functions.
-	env.SetFunction("len", fnLen)
-	env.SetFunction("lower", fnLower)
-	env.SetFunction("match", fnMatch)
-	env.SetFunction("print", fnPrint)
-	env.SetFunction("trim", fnTrim)
-	env.SetFunction("type", fnType)
-	env.SetFunction("upper", fnUpper)
-	env.SetFunction("string", fnString)
-	env.SetFunction("int", fnInt)
-	env.SetFunction("float", fnFloat)
+	for name, fn := range functions {
+		env.functions[name] = fn
+	}
 
-	//
-	// These all refer to time.Time fields.
-	//
-	// (Though they will work on any object which
-	// is an integer.  Because when we examine time.Time
-	// fields via reflection we convert them to Unix epoch
-	// seconds.)
-	//
+	// Record how many arguments they all expect.
+	for name, a := range arities {
+		env.arity[name] = a
+	}
 
-	// 10:11:12, etc.
-	env.SetFunction("hour", fnHour)
-	env.SetFunction("minute", fnMinute)
-	env.SetFunction("seconds", fnSeconds)
+	// All done.
+	return env
+}
 
-	// 10/03/1976, etc.
-	env.SetFunction("day", fnDay)
-	env.SetFunction("month", fnMonth)
-	env.SetFunction("year", fnYear)
+// Clone returns a copy of the environment, containing the same variables
+// and functions.
+//
+// Changes made to the copy do not affect the original, and vice versa.
+func (e *Environment) Clone() *Environment {
 
-	// "Saturday", "Sunday", etc.
-	env.SetFunction("weekday", fnWeekday)
+	str := make(map[string]object.Object, len(e.store))
+	for k, v := range e.store {
+		str[k] = v
+	}
 
-	// All done.
-	return env
+	fun := make(map[string]interface{}, len(e.functions))
+	for k, v := range e.functions {
+		fun[k] = v
+	}
+
+	ar := make(map[string]arity, len(e.arity))
+	for k, v := range e.arity {
+		ar[k] = v
+	}
+
+	con := make(map[string]bool, len(e.constants))
+	for k, v := range e.constants {
+		con[k] = v
+	}
+
+	return &Environment{store: str, constants: con, functions: fun, arity: ar, output: e.output}
+}
+
+// Clear removes all variables, and constants, but leaves the functions
+// in place.
+func (e *Environment) Clear() {
+	e.store = make(map[string]object.Object)
+	e.constants = make(map[string]bool)
+}
+
+// SetOutput sets the writer which the `print` functions will write to.
+func (e *Environment) SetOutput(w io.Writer) {
+	e.output = w
+}
+
+// SetCaller sets the function which is used to call other functions on
+// behalf of built-in functions, such as `map`.
+//
+// This is set by the virtual machine which uses the environment.
+func (e *Environment) SetCaller(caller Caller) {
+	e.caller = caller
+}
+
+// SetFieldLookup sets the function which is used to find the fields of
+// the object a script is running against, on behalf of `exists`.
+//
+// This is set by the virtual machine which uses the environment.
+func (e *Environment) SetFieldLookup(lookup FieldLookup) {
+	e.fieldLookup = lookup
+}
+
+// Output returns the writer which the `print` functions will write to.
+func (e *Environment) Output() io.Writer {
+	return e.output
 }
 
 // Get returns the value of a given variable, by name.
@@ -74,23 +305,122 @@ func (e *Environment) Get(name string) (object.Object, bool) {
 }
 
 // Set stores the value of a variable, by name.
+//
+// If there was a constant with the same name it is replaced by the
+// variable.
 func (e *Environment) Set(name string, val object.Object) object.Object {
 	e.store[name] = val
+	delete(e.constants, name)
 	return val
 }
 
+// SetConstant stores the value of a constant, by name.
+//
+// Constants are looked up in the same way as variables, but the virtual
+// machine won't allow scripts to change them.
+func (e *Environment) SetConstant(name string, val object.Object) {
+	e.store[name] = val
+	e.constants[name] = true
+}
+
+// IsConstant returns true if the named value is a constant.
+func (e *Environment) IsConstant(name string) bool {
+	return e.constants[name]
+}
+
+// Variables returns a copy of all the variables, by name.
+//
+// Changes made to the returned map do not affect the environment.
+func (e *Environment) Variables() map[string]object.Object {
+	out := make(map[string]object.Object, len(e.store))
+	for k, v := range e.store {
+		out[k] = v
+	}
+	return out
+}
+
+// Functions returns the names of all the functions which are available,
+// sorted alphabetically.
+func (e *Environment) Functions() []string {
+	out := make([]string, 0, len(e.functions))
+	for k := range e.functions {
+		out = append(out, k)
+	}
+	sort.Strings(out)
+	return out
+}
+
 // SetFunction makes a (golang) function available to the scripting
 // environment.
+//
+// Any number of arguments recorded for a previous function with the
+// same name, via SetArity, is forgotten.
 func (e *Environment) SetFunction(name string, fun interface{}) interface{} {
 	e.functions[name] = fun
+	delete(e.arity, name)
+	e.version++
 	return fun
 }
 
+// RemoveFunction removes the named function, along with any number of
+// arguments recorded for it.
+//
+// If there is a built-in function with the same name then it is restored
+// in its place.
+func (e *Environment) RemoveFunction(name string) {
+	delete(e.functions, name)
+	delete(e.arity, name)
+	e.version++
+
+	if fun, ok := functions[name]; ok {
+		e.functions[name] = fun
+	}
+	if a, ok := arities[name]; ok {
+		e.arity[name] = a
+	}
+}
+
+// SetArity records the minimum, and maximum, number of arguments the
+// named function expects.  A maximum of -1 means there is no maximum.
+//
+// This allows calls with the wrong number of arguments to be reported
+// when a script is compiled, rather than when it is executed.
+func (e *Environment) SetArity(name string, min, max int) {
+	e.arity[name] = arity{min: min, max: max}
+}
+
+// Arity returns the minimum, and maximum, number of arguments the named
+// function expects, if that has been recorded.
+func (e *Environment) Arity(name string) (int, int, bool) {
+	a, ok := e.arity[name]
+	return a.min, a.max, ok
+}
+
+// Version returns a number which changes whenever a function is added to,
+// or removed from, the environment.
+//
+// This allows the functions returned by GetFunction to be cached, until
+// the version changes.
+func (e *Environment) Version() int {
+	return e.version
+}
+
 // GetFunction allows a function to be retrieved, by name.
 //
 // Functions retrieved are only those which have been previously added
 // via `SetFunction`.
 func (e *Environment) GetFunction(name string) (interface{}, bool) {
 	fun, ok := e.functions[name]
+
+	if b, isBuiltin := fun.(builtin); isBuiltin {
+		return func(args []object.Object) object.Object {
+			return b(e, args)
+		}, true
+	}
+	if c, isCallback := fun.(callback); isCallback {
+		return func(args []object.Object) (object.Object, error) {
+			return c(e, args)
+		}, true
+	}
 	return fun, ok
 }
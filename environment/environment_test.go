@@ -1,6 +1,7 @@
 package environment
 
 import (
+	"sort"
 	"testing"
 
 	"github.com/skx/evalfilter/v2/object"
@@ -27,6 +28,26 @@ func TestFunctions(t *testing.T) {
 			t.Errorf("Found function %s which should not exist", fn)
 		}
 	}
+
+	// All the built-in functions are listed, in order.
+	list := env.Functions()
+	if len(list) != len(arities) {
+		t.Errorf("Expected %d functions, got %d", len(arities), len(list))
+	}
+	if !sort.StringsAreSorted(list) {
+		t.Errorf("The functions are not sorted: %v", list)
+	}
+	for _, fn := range list {
+		if _, ok := arities[fn]; !ok {
+			t.Errorf("Found unexpected function %s", fn)
+		}
+	}
+
+	// Including those which are added.
+	env.SetFunction("aaa", fnLen)
+	if list := env.Functions(); list[0] != "aaa" || len(list) != len(arities)+1 {
+		t.Errorf("Unexpected functions: %v", list)
+	}
 }
 
 func TestGetSet(t *testing.T) {
@@ -56,3 +77,127 @@ func TestMissingSet(t *testing.T) {
 		t.Errorf("lookup of a missing value worked, bogus.")
 	}
 }
+
+func TestVariables(t *testing.T) {
+
+	env := New()
+	env.Set("foo", &object.String{Value: "bar"})
+	env.Set("count", &object.Integer{Value: 3})
+
+	vars := env.Variables()
+	if len(vars) != 2 {
+		t.Errorf("unexpected number of variables: %d", len(vars))
+	}
+	if vars["foo"].Inspect() != "bar" || vars["count"].Inspect() != "3" {
+		t.Errorf("unexpected variables: %v", vars)
+	}
+
+	// Changing the copy doesn't change the environment.
+	delete(vars, "foo")
+	vars["new"] = &object.Boolean{Value: true}
+
+	if _, ok := env.Get("foo"); !ok {
+		t.Errorf("deleting from the copy changed the environment")
+	}
+	if _, ok := env.Get("new"); ok {
+		t.Errorf("adding to the copy changed the environment")
+	}
+}
+
+func TestArity(t *testing.T) {
+
+	env := New()
+
+	// Every default function has a known arity.
+	for name := range env.functions {
+		if _, _, ok := env.Arity(name); !ok {
+			t.Errorf("the function %s has no arity", name)
+		}
+	}
+	for name := range arities {
+		if _, ok := env.GetFunction(name); !ok {
+			t.Errorf("arity recorded for the missing function %s", name)
+		}
+	}
+
+	min, max, ok := env.Arity("print")
+	if !ok || min != 0 || max != -1 {
+		t.Errorf("unexpected arity for print: %d %d", min, max)
+	}
+
+	// Replacing a function forgets its arity.
+	env.SetFunction("len", func(args []object.Object) object.Object { return &object.Null{} })
+	if _, _, ok := env.Arity("len"); ok {
+		t.Errorf("the arity of a replaced function was retained")
+	}
+
+	env.SetArity("len", 1, 3)
+	min, max, ok = env.Arity("len")
+	if !ok || min != 1 || max != 3 {
+		t.Errorf("unexpected arity for len: %d %d", min, max)
+	}
+
+	// Clones have their own copy.
+	clone := env.Clone()
+	clone.SetArity("len", 2, 2)
+	if min, _, _ := env.Arity("len"); min != 1 {
+		t.Errorf("changing the clone changed the original")
+	}
+}
+
+func TestRemoveFunction(t *testing.T) {
+
+	env := New()
+
+	// Removing a function added later means it no longer exists.
+	env.SetFunction("custom", func(args []object.Object) object.Object { return &object.Null{} })
+	env.SetArity("custom", 1, 1)
+	env.RemoveFunction("custom")
+
+	if _, ok := env.GetFunction("custom"); ok {
+		t.Errorf("a removed function still exists")
+	}
+	if _, _, ok := env.Arity("custom"); ok {
+		t.Errorf("the arity of a removed function was retained")
+	}
+
+	// Removing a replacement for a built-in restores the built-in.
+	env.SetFunction("len", func(args []object.Object) object.Object { return &object.Null{} })
+	env.RemoveFunction("len")
+
+	fn, ok := env.GetFunction("len")
+	if !ok {
+		t.Fatalf("the built-in function wasn't restored")
+	}
+	out := fn.(func([]object.Object) object.Object)([]object.Object{&object.String{Value: "abc"}})
+	if out.Inspect() != "3" {
+		t.Errorf("unexpected result from the restored function: %s", out.Inspect())
+	}
+	if min, max, ok := env.Arity("len"); !ok || min != 1 || max != 1 {
+		t.Errorf("unexpected arity for the restored function: %d %d", min, max)
+	}
+}
+
+func TestVersion(t *testing.T) {
+
+	env := New()
+	v := env.Version()
+
+	// Variables don't change the version.
+	env.Set("name", &object.String{Value: "steve"})
+	if env.Version() != v {
+		t.Errorf("setting a variable changed the version")
+	}
+
+	// Functions do.
+	env.SetFunction("custom", func(args []object.Object) object.Object { return &object.Null{} })
+	if env.Version() == v {
+		t.Errorf("adding a function didn't change the version")
+	}
+
+	v = env.Version()
+	env.RemoveFunction("custom")
+	if env.Version() == v {
+		t.Errorf("removing a function didn't change the version")
+	}
+}
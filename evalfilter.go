@@ -8,10 +8,16 @@
 package evalfilter
 
 import (
-	"encoding/binary"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"sort"
 	"strings"
 
+	"github.com/skx/evalfilter/v2/ast"
 	"github.com/skx/evalfilter/v2/code"
 	"github.com/skx/evalfilter/v2/environment"
 	"github.com/skx/evalfilter/v2/lexer"
@@ -24,9 +30,93 @@ import (
 const (
 	// Don't run the optimizer when generating bytecode.
 	NoOptimize byte = iota
+
+	// Look for variables which are read before they're assigned,
+	// and report them via Warnings.
+	WarnUnassigned
+
+	// Scope variables which are first assigned within a block to
+	// that block, so that they're discarded when it ends.
+	//
+	// An assignment updates the variable of that name in the nearest
+	// enclosing block, or the top-level, which already has one.  If
+	// there is none the variable is created in the current block.
+	//
+	// This is opt-in because it changes the meaning of existing
+	// scripts: `if (c) { r = 1; } else { r = 2; } return r;` returns
+	// null when blocks are scoped, as `r` is discarded by each branch.
+	BlockScope
+)
+
+// ErrInstructionLimit is returned when a script executes more instructions
+// than the limit configured via SetMaxInstructions.
+var ErrInstructionLimit = vm.ErrInstructionLimit
+
+// RuntimeError is the error returned when a script fails at run-time.
+//
+// Use errors.As to retrieve it from the error returned by Run, or
+// Execute, and examine its Code to see what went wrong.
+type RuntimeError = vm.RuntimeError
+
+// Lookupable may be implemented by the object a script is executed
+// against, or by values within it, to look up their fields directly
+// rather than via reflection.
+type Lookupable = vm.Lookupable
+
+// Indexable may be implemented by values to give them custom behaviour
+// when they're indexed by a script.
+type Indexable = vm.Indexable
+
+// ErrorCode identifies the kind of problem which caused a RuntimeError.
+type ErrorCode = vm.ErrorCode
+
+// The kinds of run-time error, see the vm package for details.
+const (
+	ErrInternal        = vm.ErrInternal
+	ErrTypeMismatch    = vm.ErrTypeMismatch
+	ErrDivByZero       = vm.ErrDivByZero
+	ErrOverflow        = vm.ErrOverflow
+	ErrIndex           = vm.ErrIndex
+	ErrUnknownFunction = vm.ErrUnknownFunction
+	ErrArgumentCount   = vm.ErrArgumentCount
+	ErrFunctionFailed  = vm.ErrFunctionFailed
+	ErrStackOverflow   = vm.ErrStackOverflow
+	ErrMissingReturn   = vm.ErrMissingReturn
+	ErrInvalidValue    = vm.ErrInvalidValue
+	ErrConstant        = vm.ErrConstant
+	ErrThrown          = vm.ErrThrown
+	ErrUnknownField    = vm.ErrUnknownField
 )
 
+// CompileError is an error found in a script before it is run, by the
+// parser or the compiler.
+//
+// Validate returns a CompileError for each of the problems it finds,
+// and Prepare returns one for problems found by the compiler.
+type CompileError struct {
+	// Position is the location of the problem within the script, it
+	// holds zero values if the location isn't known.
+	Position code.Position
+
+	// Message describes the problem.
+	Message string
+}
+
+// Error returns the message, prefixed with the line and column if
+// they're known.
+func (c *CompileError) Error() string {
+	if c.Position.Line == 0 {
+		return c.Message
+	}
+	return fmt.Sprintf("%d:%d: %s", c.Position.Line, c.Position.Column, c.Message)
+}
+
 // Eval is our public-facing structure which stores our state.
+//
+// An Eval is not safe for concurrent use, because running a script
+// modifies its state: the variables it sets, for example.  If you
+// wish to run a prepared script from multiple goroutines then use
+// Clone to create a copy for each of them.
 type Eval struct {
 	// Script holds the script the user submitted in our constructor.
 	Script string
@@ -37,11 +127,114 @@ type Eval struct {
 	// constants compiled
 	constants []object.Object
 
+	// constantIndex maps the keys of our constants to their offsets,
+	// so that duplicates may be found quickly.
+	constantIndex map[string]int
+
 	// bytecode we generate
 	instructions code.Instructions
 
+	// positions holds the source-positions of our instructions.
+	positions code.Positions
+
+	// position is the source-position of the node we're compiling.
+	position code.Position
+
+	// loops holds the state of the loops we're compiling, which is
+	// used to handle `break` and `continue`.
+	loops []*loop
+
+	// blockScope is true if variables first assigned within a block
+	// are scoped to that block, as requested by the BlockScope flag.
+	blockScope bool
+
+	// scopes is the number of block-scopes which are open at the
+	// point we're compiling.
+	scopes int
+
+	// tries is the number of try-blocks which are open at the point
+	// we're compiling.
+	tries int
+
+	// wideJumps is true if the jumps we generate should be wide,
+	// because the program is too large for them to be otherwise.
+	wideJumps bool
+
+	// tooLarge is set if a jump was too far for its argument.
+	tooLarge bool
+
+	// functions holds the functions defined within the script.
+	functions []*object.Function
+
+	// calls holds the function-calls made by the script, which are
+	// checked once it has been compiled.
+	calls []call
+
+	// errors holds the errors found by the compiler, so that all of
+	// them may be reported.
+	errors []error
+
+	// warnings holds the problems found when the script was prepared
+	// which don't prevent it from being run.
+	warnings []string
+
+	// knownFields holds the fields the object the script is executed
+	// against is declared to have, if they've been declared.
+	knownFields map[string]bool
+
 	// the machine we drive
 	machine *vm.VM
+
+	// maxDepth is the nesting-limit to apply to the parser, zero
+	// means unlimited.
+	maxDepth int
+
+	// maxInstructions is the instruction-limit to apply to the
+	// machine, zero means unlimited.
+	maxInstructions int
+
+	// maxStackDepth is the stack-depth limit to apply to the machine,
+	// zero means unlimited.
+	maxStackDepth int
+
+	// resolver is the field-resolver to apply to the machine, if any.
+	resolver vm.FieldResolver
+
+	// tracer is the tracer to apply to the machine, if any.
+	tracer vm.Tracer
+
+	// wrap is true if integer arithmetic should wrap around on
+	// overflow, rather than being an error.
+	wrap bool
+
+	// strict is true if referring to an unknown field should be an
+	// error, rather than resulting in null.
+	strict bool
+
+	// inputName is the name of the variable which holds the object
+	// the script is executed against.
+	inputName string
+
+	// variables holds the variables which were set by the host
+	// application, so that they may be restored by Reset.
+	variables map[string]object.Object
+
+	// hostConstants holds the constants which were set by the host
+	// application, so that they may be restored by Reset.
+	hostConstants map[string]object.Object
+
+	// hostFunctions holds the functions which were added by the host
+	// application, so that they may be restored if the script which
+	// replaced them is recompiled.
+	hostFunctions map[string]hostFunction
+}
+
+// hostFunction is a function added by the host application, along with
+// the number of arguments it expects, if that was given.
+type hostFunction struct {
+	fun      interface{}
+	min, max int
+	arity    bool
 }
 
 // New creates a new instance of the evaluator.
@@ -51,8 +244,14 @@ func New(script string) *Eval {
 	// Create our object.
 	//
 	e := &Eval{
-		environment: environment.New(),
-		Script:      script,
+		environment:   environment.New(),
+		Script:        script,
+		variables:     make(map[string]object.Object),
+		hostConstants: make(map[string]object.Object),
+		hostFunctions: make(map[string]hostFunction),
+		maxDepth:      parser.DefaultMaxDepth,
+		maxStackDepth: vm.DefaultMaxStackDepth,
+		inputName:     vm.DefaultInputName,
 	}
 
 	//
@@ -66,59 +265,65 @@ func New(script string) *Eval {
 //
 // Internally this compilation process walks through the usual steps,
 // lexing, parsing, and bytecode-compilation.
+//
+// Prepare may be called again after changing the Script, for example in
+// a REPL, to replace the program which was compiled previously.  The
+// functions and variables added by the host application are kept, but
+// the functions defined by the previous script are removed.  If Prepare
+// fails the script cannot be executed until it succeeds.
 func (e *Eval) Prepare(flags ...[]byte) error {
 
 	//
-	// Default to optimizing the bytecode.
+	// Forget the results of any previous compilation.
+	//
+	e.forget()
+
+	//
+	// Default to optimizing the bytecode, without warnings.
 	//
 	optimize := true
+	warn := false
+	e.blockScope = false
 
 	//
 	// But let flags change our behaviour.
 	//
 	for _, arg := range flags {
 		for _, val := range arg {
-			if val == NoOptimize {
+			switch val {
+			case NoOptimize:
 				optimize = false
+			case WarnUnassigned:
+				warn = true
+			case BlockScope:
+				e.blockScope = true
 			}
 		}
 	}
 
-	//
-	// Create a lexer.
-	//
-	l := lexer.New(e.Script)
-
-	//
-	// Create a parser using the lexer.
-	//
-	p := parser.New(l)
-
 	//
 	// Parse the program into an AST.
 	//
-	program := p.ParseProgram()
-
-	//
-	// Were there any errors produced by the parser?
-	//
-	// If so report that.
-	//
-	if len(p.Errors()) > 0 {
-		return fmt.Errorf("\nErrors parsing script:\n" +
-			strings.Join(p.Errors(), "\n"))
+	program, err := e.parse()
+	if err != nil {
+		return err
 	}
 
 	//
-	// Compile the program to bytecode
+	// Compile the program to bytecode, and if there were errors
+	// then return the first of them.
 	//
-	err := e.compile(program)
+	errs := e.compileProgram(program)
+	if len(errs) > 0 {
+		return errs[0]
+	}
 
 	//
-	// If there were errors then return them.
+	// Look for variables which are read before they're assigned,
+	// now that the functions the script defines are known.
 	//
-	if err != nil {
-		return err
+	if warn {
+		e.warnings = e.unassigned(program)
 	}
 
 	//
@@ -130,6 +335,18 @@ func (e *Eval) Prepare(flags ...[]byte) error {
 	//
 	if optimize {
 		e.optimize()
+
+		//
+		// The bodies of any user-defined functions are
+		// optimized in the same way.
+		//
+		program, positions := e.instructions, e.positions
+		for _, fn := range e.functions {
+			e.instructions, e.positions = fn.Instructions, fn.Positions
+			e.optimize()
+			fn.Instructions, fn.Positions = e.instructions, e.positions
+		}
+		e.instructions, e.positions = program, positions
 	}
 
 	//
@@ -138,6 +355,14 @@ func (e *Eval) Prepare(flags ...[]byte) error {
 	// which we were given.
 	//
 	e.machine = vm.New(e.constants, e.instructions, e.environment)
+	e.machine.SetMaxInstructions(e.maxInstructions)
+	e.machine.SetMaxStackDepth(e.maxStackDepth)
+	e.machine.SetFieldResolver(e.resolver)
+	e.machine.SetTracer(e.tracer)
+	e.machine.SetWrapArithmetic(e.wrap)
+	e.machine.SetStrictFields(e.strict)
+	e.machine.SetInputName(e.inputName)
+	e.machine.SetPositions(e.positions)
 
 	//
 	// All done; no errors.
@@ -145,19 +370,232 @@ func (e *Eval) Prepare(flags ...[]byte) error {
 	return nil
 }
 
+// forget discards the program compiled by a previous call to Prepare,
+// and removes the functions it defined.
+func (e *Eval) forget() {
+
+	for _, fn := range e.functions {
+		if cur, ok := e.environment.GetFunction(fn.Name); !ok || cur != interface{}(fn) {
+			continue
+		}
+
+		e.environment.RemoveFunction(fn.Name)
+
+		// Restore any function of the host's which it replaced.
+		if host, ok := e.hostFunctions[fn.Name]; ok {
+			e.environment.SetFunction(fn.Name, host.fun)
+			if host.arity {
+				e.environment.SetArity(fn.Name, host.min, host.max)
+			}
+		}
+	}
+
+	e.constants = nil
+	e.constantIndex = nil
+	e.functions = nil
+	e.warnings = nil
+	e.machine = nil
+}
+
+// Validate checks the script for errors, without preparing it to be run.
+//
+// Prepare stops at the first problem it finds, but Validate reports all
+// of those it can, each as a *CompileError which gives its position.  If
+// the script cannot be parsed then it cannot be compiled, so only the
+// errors found by the parser are reported.
+//
+// The state of the Eval isn't changed, so a script which was prepared
+// previously may still be executed.
+func (e *Eval) Validate() []error {
+
+	v := e.Clone()
+	v.forget()
+
+	p := parser.New(lexer.New(v.Script))
+	p.SetMaxDepth(v.maxDepth)
+	program := p.ParseProgram()
+
+	if len(p.ErrorList()) > 0 {
+		var errs []error
+		for _, err := range p.ErrorList() {
+			errs = append(errs, &CompileError{
+				Position: code.Position{Line: err.Line, Column: err.Column},
+				Message:  err.Message,
+			})
+		}
+		return errs
+	}
+
+	return v.compileProgram(program)
+}
+
+// AST parses the script, and returns the abstract syntax tree which
+// represents it.
+//
+// This allows tools to examine a script without running it, for example
+// to discover which fields it refers to.  Use ast.Walk to visit each of
+// the nodes in the tree.
+//
+// A new tree is returned each time this is called, so it may be modified
+// freely by the caller.
+func (e *Eval) AST() (ast.Node, error) {
+	return e.parse()
+}
+
+// parse lexes and parses our script, returning the program it contains.
+func (e *Eval) parse() (*ast.Program, error) {
+
+	//
+	// Create a lexer.
+	//
+	l := lexer.New(e.Script)
+
+	//
+	// Create a parser using the lexer.
+	//
+	p := parser.New(l)
+	p.SetMaxDepth(e.maxDepth)
+
+	//
+	// Parse the program into an AST.
+	//
+	program := p.ParseProgram()
+
+	//
+	// Were there any errors produced by the parser?
+	//
+	// If so report that.
+	//
+	if len(p.Errors()) > 0 {
+		return nil, fmt.Errorf("\nErrors parsing script:\n" +
+			strings.Join(p.Errors(), "\n"))
+	}
+
+	return program, nil
+}
+
 // Dump causes our bytecode to be dumped.
 //
 // This is used by the `evalfilter` CLI-utility, but it might be useful
 // to consumers of our library.
+//
+// If you wish to capture the output, rather than have it printed to
+// STDOUT, then use Disassemble instead.
 func (e *Eval) Dump() error {
 
-	i := 0
-	fmt.Printf("Bytecode:\n")
+	out, err := e.Disassemble()
+	if err != nil {
+		return err
+	}
+
+	fmt.Print(out)
+	return nil
+}
+
+// Disassemble returns a human-readable listing of our bytecode, and
+// the constants it refers to.
+//
+// This is the same output which is printed by Dump.
+func (e *Eval) Disassemble() (string, error) {
+
+	var out bytes.Buffer
+
+	out.WriteString("Bytecode:\n")
+	e.disassembleInstructions(&out, e.instructions)
+
+	// Show the bodies of any functions.
+	for _, fn := range e.functions {
+		fmt.Fprintf(&out, "\n\nFunction %s(%s):\n", fn.Name, strings.Join(fn.Parameters, ", "))
+		e.disassembleInstructions(&out, fn.Instructions)
+	}
+
+	// Show constants, if any are present.
+	if len(e.constants) > 0 {
+		out.WriteString("\n\nConstants:\n")
+		for i, n := range e.constants {
+
+			s := strings.ReplaceAll(n.Inspect(), "\n", "\\n")
+
+			fmt.Fprintf(&out, "  %06d Type:%s Value:\"%s\"\n", i, n.Type(), s)
+		}
+	}
+
+	return out.String(), nil
+}
+
+// Stats describes the bytecode of a prepared script, to help explain why
+// it is large, or slow.
+//
+// The bodies of the functions defined by the script are included.
+type Stats struct {
+	// Bytes is the size of the bytecode, in bytes.
+	Bytes int
+
+	// Instructions is the number of instructions.
+	Instructions int
+
+	// Constants is the number of constants.
+	Constants int
 
-	for i < len(e.instructions) {
+	// Functions is the number of functions defined by the script.
+	Functions int
+
+	// Jumps is the number of jump instructions.
+	Jumps int
+
+	// Opcodes maps the name of each opcode, as returned by code.String,
+	// to the number of times it is used.
+	Opcodes map[string]int
+}
+
+// Stats returns statistics about the bytecode of the script, which must
+// have been prepared.
+//
+// For example a script which performs many lookups of the same field
+// might be made faster by storing that field in a variable.
+func (e *Eval) Stats() Stats {
+
+	stats := Stats{
+		Constants: len(e.constants),
+		Functions: len(e.functions),
+		Opcodes:   make(map[string]int),
+	}
+
+	all := []code.Instructions{e.instructions}
+	for _, fn := range e.functions {
+		all = append(all, fn.Instructions)
+	}
+
+	for _, instructions := range all {
+
+		stats.Bytes += len(instructions)
+
+		i := 0
+		for i < len(instructions) {
+			op := code.Opcode(instructions[i])
+
+			stats.Instructions++
+			stats.Opcodes[code.String(op)]++
+			if code.IsJump(op) {
+				stats.Jumps++
+			}
+
+			i += code.Length(op)
+		}
+	}
+
+	return stats
+}
+
+// disassembleInstructions writes the given bytecode, in a human-readable
+// form, to the specified buffer.
+func (e *Eval) disassembleInstructions(out *bytes.Buffer, instructions code.Instructions) {
+
+	i := 0
+	for i < len(instructions) {
 
 		// opcode
-		op := e.instructions[i]
+		op := instructions[i]
 
 		// opcode length
 		opLen := code.Length(code.Opcode(op))
@@ -165,50 +603,40 @@ func (e *Eval) Dump() error {
 		// opcode as a string
 		str := code.String(code.Opcode(op))
 
-		fmt.Printf("  %06d\t%14s", i, str)
+		// the opcode, ignoring whether it is wide
+		base := code.Opcode(op) &^ code.Wide
+
+		fmt.Fprintf(out, "  %06d\t%14s", i, str)
 
 		// show arg
-		if op < byte(code.OpCodeSingleArg) {
+		if opLen > 1 {
 
-			arg := binary.BigEndian.Uint16(e.instructions[i+1 : i+3])
-			fmt.Printf("\t%d", arg)
+			arg := code.Operand(instructions, i)
+			fmt.Fprintf(out, "\t%d", arg)
 
 			//
 			// Show the values, as comments, to make the
 			// bytecode more human-readable.
 			//
-			if code.Opcode(op) == code.OpConstant {
+			if base == code.OpConstant {
 
 				v := e.constants[arg]
 				s := strings.ReplaceAll(v.Inspect(), "\n", "\\n")
 
-				fmt.Printf("\t// load constant: \"%s\"", s)
+				fmt.Fprintf(out, "\t// load constant: \"%s\"", s)
 			}
-			if code.Opcode(op) == code.OpLookup {
-				fmt.Printf("\t// lookup field: %v", e.constants[arg])
+			if base == code.OpLookup {
+				fmt.Fprintf(out, "\t// lookup field: %v", e.constants[arg])
 			}
-			if code.Opcode(op) == code.OpCall {
-				fmt.Printf("\t// call function with %d arg(s)", arg)
+			if base == code.OpCall {
+				fmt.Fprintf(out, "\t// call function with %d arg(s)", arg)
 			}
 		}
 
-		fmt.Printf("\n")
+		out.WriteString("\n")
 
 		i += opLen
 	}
-
-	// Show constants, if any are present.
-	if len(e.constants) > 0 {
-		fmt.Printf("\n\nConstants:\n")
-		for i, n := range e.constants {
-
-			s := strings.ReplaceAll(n.Inspect(), "\n", "\\n")
-
-			fmt.Printf("  %06d Type:%s Value:\"%s\"\n", i, n.Type(), s)
-		}
-	}
-
-	return nil
 }
 
 // Execute executes the program which the user passed in the constructor,
@@ -219,13 +647,52 @@ func (e *Eval) Dump() error {
 // the actual object your script returned with.
 //
 // Use of this method allows you to receive the `3` that a script
-// such as `return 1 + 2;` would return.
+// such as `return 1 + 2;` would return.  A script which ends with an
+// expression, rather than a return-statement, returns the value of
+// that expression, so `1 + 2;` returns `3` too.
 func (e *Eval) Execute(obj interface{}) (object.Object, error) {
+	return e.ExecuteContext(context.Background(), obj)
+}
+
+// ExecuteContext is identical to Execute, except that execution will be
+// aborted if the supplied context is cancelled, or its deadline expires.
+//
+// This allows you to protect your host application against scripts
+// which would otherwise run forever.
+//
+// If the object is a JSON document, as either `[]byte` or
+// `json.RawMessage`, then it is decoded before the script is run.
+func (e *Eval) ExecuteContext(ctx context.Context, obj interface{}) (object.Object, error) {
+
+	//
+	// Decode JSON input.
+	//
+	switch doc := obj.(type) {
+	case []byte:
+		decoded, err := decodeJSON(doc)
+		if err != nil {
+			return &object.Null{}, err
+		}
+		obj = decoded
+	case json.RawMessage:
+		decoded, err := decodeJSON(doc)
+		if err != nil {
+			return &object.Null{}, err
+		}
+		obj = decoded
+	}
+
+	//
+	// We can't run a script which hasn't been compiled.
+	//
+	if e.machine == nil {
+		return &object.Null{}, fmt.Errorf("the script has not been prepared")
+	}
 
 	//
 	// Launch the program in the VM.
 	//
-	out, err := e.machine.Run(obj)
+	out, err := e.machine.RunContext(ctx, obj)
 
 	//
 	// Error executing?  Report that.
@@ -240,6 +707,100 @@ func (e *Eval) Execute(obj interface{}) (object.Object, error) {
 	return out, nil
 }
 
+// ExecuteInto is identical to Execute, except the object the script
+// finished with is stored in the given location, rather than returned.
+//
+// This is intended for running a prepared script against many objects
+// in a loop, with the result kept in a single variable which the caller
+// owns.  If the script fails the location is left unchanged, rather than
+// being set to null.
+//
+// ExecuteInto makes no allocations of its own.  The stack, and the memory
+// used to discover the fields of the object, are kept from one run to the
+// next, so a run only allocates the values of the fields the script reads
+// and the values it computes.  Execute reuses the same memory, so this is
+// a convenience rather than a faster path; Benchmark_evalfilter_reuse
+// compares the two.
+func (e *Eval) ExecuteInto(obj interface{}, out *object.Object) error {
+
+	result, err := e.ExecuteContext(context.Background(), obj)
+	if err != nil {
+		return err
+	}
+
+	*out = result
+	return nil
+}
+
+// ExecuteValue is identical to Execute, except the object the script
+// finished with is converted to the natural golang value:
+//
+//   - Integers become int64, and floats become float64.
+//   - Strings become string, and booleans become bool.
+//   - Null becomes nil.
+//   - Arrays become []interface{}, with their elements converted.
+//   - Hashes become map[string]interface{}, with their values converted
+//     and their keys converted to strings.
+//   - Times become time.Time.
+//   - The objects which wrap your own values, such as `self`, become
+//     the original values.
+//
+// Anything else, such as a function defined by the script, is returned
+// as the object itself.
+func (e *Eval) ExecuteValue(obj interface{}) (interface{}, error) {
+
+	result, err := e.ExecuteContext(context.Background(), obj)
+	if err != nil {
+		return nil, err
+	}
+
+	return goValue(result), nil
+}
+
+// ExecuteCollect executes the program, in the same way as Execute, and
+// returns an array of the values the script yielded via `yield`, in the
+// order they were yielded.
+//
+// Because the values are collected a script needn't return anything, so
+// reaching the end of the script is not an error.  A `return` still ends
+// the script early, but the value it returns is ignored.
+func (e *Eval) ExecuteCollect(obj interface{}) (*object.Array, error) {
+
+	_, err := e.ExecuteContext(context.Background(), obj)
+
+	var re *RuntimeError
+	if err != nil && !(errors.As(err, &re) && re.Code == ErrMissingReturn) {
+		return nil, err
+	}
+
+	return &object.Array{Elements: e.Yielded()}, nil
+}
+
+// Yielded returns the values yielded by the script, via `yield`, during
+// the most recent run - regardless of how it was run.
+func (e *Eval) Yielded() []object.Object {
+	if e.machine == nil {
+		return nil
+	}
+	return e.machine.Yielded()
+}
+
+// decodeJSON decodes the given JSON document.
+//
+// Numbers are decoded as json.Number, rather than float64, so that
+// integers remain integers within the script.
+func decodeJSON(doc []byte) (interface{}, error) {
+
+	var out interface{}
+
+	dec := json.NewDecoder(bytes.NewReader(doc))
+	dec.UseNumber()
+	if err := dec.Decode(&out); err != nil {
+		return nil, fmt.Errorf("failed to decode JSON input: %s", err)
+	}
+	return out, nil
+}
+
 // Run executes the program which the user passed in the constructor.
 //
 // The return value, assuming no error, is a binary/boolean result which
@@ -249,12 +810,18 @@ func (e *Eval) Execute(obj interface{}) (object.Object, error) {
 // use the `Execute` method instead.  That doesn't attempt to determine whether
 // the result of the script was "true" or not.
 func (e *Eval) Run(obj interface{}) (bool, error) {
+	return e.RunContext(context.Background(), obj)
+}
+
+// RunContext is identical to Run, except that execution will be aborted
+// if the supplied context is cancelled, or its deadline expires.
+func (e *Eval) RunContext(ctx context.Context, obj interface{}) (bool, error) {
 
 	//
 	// Execute the script, getting the resulting error
 	// and return object.
 	//
-	out, err := e.Execute(obj)
+	out, err := e.ExecuteContext(ctx, obj)
 
 	//
 	// Error? Then return that.
@@ -270,20 +837,301 @@ func (e *Eval) Run(obj interface{}) (bool, error) {
 	return out.True(), nil
 }
 
+// Clone returns a copy of the evaluator, which may be run independently
+// of the original - for example from a different goroutine.
+//
+// The copy shares the compiled bytecode and constants with the original,
+// which are never modified once Prepare has completed, so cloning is
+// cheap.  However the copy has its own virtual machine, and its own
+// copy of the variables and functions which were present when Clone
+// was called.
+//
+// Clone should be called after Prepare.
+func (e *Eval) Clone() *Eval {
+
+	c := &Eval{
+		Script:          e.Script,
+		environment:     e.environment.Clone(),
+		constants:       e.constants,
+		instructions:    e.instructions,
+		positions:       e.positions,
+		functions:       e.functions,
+		warnings:        e.warnings,
+		blockScope:      e.blockScope,
+		knownFields:     e.knownFields,
+		maxDepth:        e.maxDepth,
+		maxInstructions: e.maxInstructions,
+		maxStackDepth:   e.maxStackDepth,
+		resolver:        e.resolver,
+		tracer:          e.tracer,
+		wrap:            e.wrap,
+		strict:          e.strict,
+		inputName:       e.inputName,
+		variables:       make(map[string]object.Object),
+		hostConstants:   make(map[string]object.Object),
+		hostFunctions:   make(map[string]hostFunction),
+	}
+
+	for k, v := range e.variables {
+		c.variables[k] = v
+	}
+	for k, v := range e.hostConstants {
+		c.hostConstants[k] = v
+	}
+	for k, v := range e.hostFunctions {
+		c.hostFunctions[k] = v
+	}
+
+	if e.machine != nil {
+		c.machine = vm.New(c.constants, c.instructions, c.environment)
+		c.machine.SetMaxInstructions(c.maxInstructions)
+		c.machine.SetMaxStackDepth(c.maxStackDepth)
+		c.machine.SetFieldResolver(c.resolver)
+		c.machine.SetTracer(c.tracer)
+		c.machine.SetWrapArithmetic(c.wrap)
+		c.machine.SetStrictFields(c.strict)
+		c.machine.SetInputName(c.inputName)
+		c.machine.SetPositions(c.positions)
+	}
+
+	return c
+}
+
+// SetMaxDepth sets the maximum depth to which expressions, and blocks,
+// may be nested within each other, for example `((((1))))` has a depth
+// of five.
+//
+// Scripts which exceed the limit fail to compile with the error
+// "expression nesting too deep", rather than exhausting the stack,
+// which protects your host application from malicious scripts.  The
+// default is parser.DefaultMaxDepth, and a limit of zero means there
+// is no limit.
+//
+// The limit applies when the script is next prepared.
+func (e *Eval) SetMaxDepth(n int) {
+	e.maxDepth = n
+}
+
+// SetMaxInstructions sets the maximum number of bytecode instructions a
+// single execution of the script may perform.
+//
+// If the limit is exceeded execution is aborted and ErrInstructionLimit
+// is returned.  Calls to golang functions count as a single instruction,
+// but the instructions of functions defined by the script count towards
+// the limit, even when they're invoked by built-in functions such as
+// `map`.  The default limit of zero means there is no limit.
+func (e *Eval) SetMaxInstructions(n int) {
+	e.maxInstructions = n
+	if e.machine != nil {
+		e.machine.SetMaxInstructions(n)
+	}
+}
+
+// SetMaxStackDepth sets the maximum depth of nested function calls, and
+// the maximum number of values upon the stack, for a single execution of
+// the script.
+//
+// If either limit is exceeded, for example by runaway recursion,
+// execution is aborted with a "stack overflow" error.  The default is
+// vm.DefaultMaxStackDepth, and a limit of zero means there is no limit.
+func (e *Eval) SetMaxStackDepth(n int) {
+	e.maxStackDepth = n
+	if e.machine != nil {
+		e.machine.SetMaxStackDepth(n)
+	}
+}
+
+// SetStrictFields controls what happens if the script refers to a field
+// which the object it is executed against doesn't have.
+//
+// By default the result is null, which means a typo such as `recrod.id`
+// quietly evaluates to null.  If strict is true then execution is aborted
+// with an error whose code is ErrUnknownField, and whose message names
+// the field.  Variables set by the script, or by the host application,
+// are found as usual.
+func (e *Eval) SetStrictFields(strict bool) {
+	e.strict = strict
+	if e.machine != nil {
+		e.machine.SetStrictFields(strict)
+	}
+}
+
+// SetInputName sets the name of the variable which holds the whole of the
+// object the script is executed against, by default this is `self`.
+//
+// Maps are available as hashes, and other values are passed through the
+// script unchanged, as object.Native values.  This allows the object to
+// be passed to functions in your host application, e.g. `log(self)`.
+func (e *Eval) SetInputName(name string) {
+	e.inputName = name
+	if e.machine != nil {
+		e.machine.SetInputName(name)
+	}
+}
+
+// SetWrapArithmetic controls what happens when integer arithmetic
+// overflows.
+//
+// By default overflow aborts the script with an error, such as
+// "integer overflow in multiplication".  If wrap is true then the
+// result silently wraps around instead, as it does in golang.
+func (e *Eval) SetWrapArithmetic(wrap bool) {
+	e.wrap = wrap
+	if e.machine != nil {
+		e.machine.SetWrapArithmetic(wrap)
+	}
+}
+
+// SetFieldResolver sets a function which is used to lookup the fields
+// of the object the script is executed against.
+//
+// The resolver is consulted before the fields are discovered via
+// reflection, which allows virtual, or computed, fields to be exposed
+// to the script.  If the resolver returns false the reflection-based
+// lookup is used as normal.  Variables set by the script, or via
+// SetVariable, take precedence over both.
+func (e *Eval) SetFieldResolver(resolver func(obj interface{}, field string) (object.Object, bool)) {
+	e.resolver = resolver
+	if e.machine != nil {
+		e.machine.SetFieldResolver(resolver)
+	}
+}
+
+// SetTracer sets a function which is called before each bytecode
+// instruction is executed, which allows execution to be observed, or
+// paused, by a debugger.
+//
+// The function receives the offset of the instruction, the opcode, and
+// the contents of the stack - with the top of the stack last.  The stack
+// is not a copy, and modifying it is unsupported.  Passing nil disables
+// tracing, which is the default.
+func (e *Eval) SetTracer(tracer func(ip int, op code.Opcode, stack []object.Object)) {
+	e.tracer = tracer
+	if e.machine != nil {
+		e.machine.SetTracer(tracer)
+	}
+}
+
+// SetOutput sets the writer which the `print` and `println` functions
+// will write to.  By default this is STDOUT.
+func (e *Eval) SetOutput(w io.Writer) {
+	e.environment.SetOutput(w)
+}
+
 // AddFunction exposes a golang function from your host application
 // to the scripting environment.
 //
 // Once a function has been added it may be used by the filter script.
+//
+// If the function panics when it is called then the panic is recovered,
+// and execution of the script is aborted with an error.
 func (e *Eval) AddFunction(name string, fun interface{}) {
+	e.hostFunctions[name] = hostFunction{fun: fun}
+	e.environment.SetFunction(name, fun)
+}
+
+// AddFunctionArity exposes a golang function from your host application
+// to the scripting environment, in the same way as AddFunction, along
+// with the minimum and maximum number of arguments it expects.
+//
+// If the script calls the function with the wrong number of arguments
+// then Prepare reports an error.  A maximum of -1 means the function
+// accepts any number of arguments, like `print`.
+//
+// The arity must be declared before Prepare is called.
+func (e *Eval) AddFunctionArity(name string, fun interface{}, min, max int) {
+	e.hostFunctions[name] = hostFunction{fun: fun, min: min, max: max, arity: true}
 	e.environment.SetFunction(name, fun)
+	e.environment.SetArity(name, min, max)
+}
+
+// HasFunction returns true if a function with the given name is available
+// to the script.
+//
+// This includes the built-in functions, those added by the host, and
+// those defined by the script which was most recently prepared.  It
+// allows a host which composes sets of functions to avoid replacing
+// one by accident, because AddFunction replaces any existing function
+// with the same name.
+func (e *Eval) HasFunction(name string) bool {
+	_, ok := e.environment.GetFunction(name)
+	return ok
+}
+
+// Functions returns the names of all the functions which are available
+// to the script, sorted alphabetically.
+//
+// As with HasFunction this includes the built-in functions, those added
+// by the host, and those defined by the script which was most recently
+// prepared.  Each name appears once, even if the host has replaced a
+// built-in function.
+func (e *Eval) Functions() []string {
+	return e.environment.Functions()
+}
+
+// RemoveFunction removes a function which was added by AddFunction,
+// AddFunctionArity, or AddTypedFunction.
+//
+// Built-in functions, such as `print`, may be replaced by adding a
+// function with the same name, and removing that function restores the
+// built-in.  The built-in functions themselves cannot be removed.
+//
+// A function defined by the prepared script, which replaced the host's
+// function, is unaffected until the script is prepared again.
+func (e *Eval) RemoveFunction(name string) {
+	delete(e.hostFunctions, name)
+
+	if cur, ok := e.environment.GetFunction(name); ok {
+		for _, fn := range e.functions {
+			if fn.Name == name && cur == interface{}(fn) {
+				return
+			}
+		}
+	}
+	e.environment.RemoveFunction(name)
 }
 
 // SetVariable adds, or updates a variable which will be available
 // to the filter script.
 func (e *Eval) SetVariable(name string, value object.Object) {
+	delete(e.hostConstants, name)
+	e.variables[name] = value
 	e.environment.Set(name, value)
 }
 
+// SetConstant adds, or updates, a constant which will be available to
+// the filter script, such as a status code.
+//
+// Scripts refer to constants in the same way as variables, but a script
+// which attempts to assign to one fails with a RuntimeError whose code
+// is ErrConstant.  The parameters, and local variables, of functions
+// defined by the script may still use the same name.
+func (e *Eval) SetConstant(name string, value object.Object) {
+	delete(e.variables, name)
+	e.hostConstants[name] = value
+	e.environment.SetConstant(name, value)
+}
+
+// Reset removes any variables which were set by the script, so that the
+// next run starts from a clean state.
+//
+// Variables set by the script are not removed automatically, they persist
+// from one run to the next until Reset is called.  This allows scripts to
+// maintain state, such as a counter, if they wish to.
+//
+// Variables set via SetVariable, and constants set via SetConstant, are
+// restored to the values they were given, and functions added via
+// AddFunction are left in place.
+func (e *Eval) Reset() {
+	e.environment.Clear()
+	for k, v := range e.variables {
+		e.environment.Set(k, v)
+	}
+	for k, v := range e.hostConstants {
+		e.environment.SetConstant(k, v)
+	}
+}
+
 // GetVariable retrieves the contents of a variable which has been
 // set within a user-script.
 //
@@ -295,3 +1143,337 @@ func (e *Eval) GetVariable(name string) object.Object {
 	}
 	return &object.Null{}
 }
+
+// Variables returns all the variables which are currently defined, by
+// name.
+//
+// This includes those set via SetVariable, as well as those set by the
+// script when it was most recently run.  Variables local to functions
+// defined within the script are not included.
+//
+// The map returned is a copy, so changing it won't affect the
+// variables the script sees.
+func (e *Eval) Variables() map[string]object.Object {
+	return e.environment.Variables()
+}
+
+// ReferencedFields returns the names of the fields, of the object the
+// script is executed against, which the script refers to.
+//
+// This must be called after Prepare.  The names are found from the
+// script's AST, so the variables the script has assigned, the parameters
+// of its functions, and the names of functions are excluded, as are any
+// variables which have been set by the host application.  If the script
+// was prepared with the BlockScope flag then variables which are assigned
+// within a block are only excluded within that block, because they're
+// discarded when it ends.
+//
+// Fields which are accessed via the object itself, as in `self.Name`, are
+// included, as are those tested by `exists("Name")`.  If the object is
+// used as a whole, for example `keys(self)`, then the name of the object
+// (`self`, unless changed by SetInputName) is included too, to show that
+// any field may be needed.
+//
+// The names are returned in sorted order.
+func (e *Eval) ReferencedFields() []string {
+
+	program, err := e.parse()
+	if err != nil {
+		return []string{}
+	}
+
+	scan := e.scan(program)
+
+	fields := []string{}
+	for name := range scan.read {
+		if _, ok := e.environment.GetFunction(name); ok {
+			continue
+		}
+		if _, ok := e.environment.Get(name); ok {
+			continue
+		}
+		fields = append(fields, name)
+	}
+
+	sort.Strings(fields)
+	return fields
+}
+
+// Warnings returns the problems found when the script was prepared, which
+// don't prevent it from being run.
+//
+// At the moment the only warnings are those given by the WarnUnassigned
+// flag, e.g. `Prepare([]byte{WarnUnassigned})`, which reports variables
+// the script reads before they're assigned.  Such variables are null, so
+// reading one is usually a mistake.
+//
+// Without knowing the fields of the object the script is executed against
+// a misspelled name, such as `cuont`, looks just like a field.  So unless
+// the fields have been declared via SetKnownFields only the names which
+// the script assigns somewhere are reported, e.g. reading `count` before
+// `count = 1`.  Once they have been declared any other name which is read,
+// but never assigned, is reported too.  Variables, and functions, which
+// were added by the host application are never reported.
+//
+// Each warning gives the position of the variable, in the same way as a
+// CompileError, e.g. "3:12: count is read before it is assigned".
+func (e *Eval) Warnings() []string {
+	return e.warnings
+}
+
+// SetKnownFields declares the names of the fields of the object the script
+// is executed against.
+//
+// This is used by the WarnUnassigned flag, so that reading a name which is
+// neither a known field, nor a variable, may be reported - catching typos
+// such as `return cuont;`.  It must be called before Prepare, and passing
+// nil forgets any fields which were declared previously.
+func (e *Eval) SetKnownFields(fields []string) {
+	if fields == nil {
+		e.knownFields = nil
+		return
+	}
+
+	e.knownFields = make(map[string]bool, len(fields))
+	for _, name := range fields {
+		e.knownFields[name] = true
+	}
+}
+
+// unassigned returns warnings for the variables which the given program
+// reads before they're assigned.
+func (e *Eval) unassigned(program *ast.Program) []string {
+
+	scan := e.scan(program)
+
+	// Functions are examined after the main program, so sort the
+	// identifiers into the order they appear within the script.
+	ids := scan.unassigned
+	sort.SliceStable(ids, func(i, j int) bool {
+		if ids[i].Token.Line != ids[j].Token.Line {
+			return ids[i].Token.Line < ids[j].Token.Line
+		}
+		return ids[i].Token.Column < ids[j].Token.Column
+	})
+
+	var warnings []string
+	for _, id := range ids {
+		name := strings.TrimPrefix(id.Value, "$")
+		if name == e.inputName || name == "null" {
+			continue
+		}
+		if _, ok := e.environment.GetFunction(name); ok {
+			continue
+		}
+		if _, ok := e.environment.Get(name); ok {
+			continue
+		}
+
+		msg := "%d:%d: %s is read before it is assigned"
+		if !scan.assigned[name] {
+			// Without declared fields this might be one.
+			if e.knownFields == nil || e.knownFields[name] {
+				continue
+			}
+			msg = "%d:%d: %s is never assigned, and is not a known field"
+		}
+		warnings = append(warnings, fmt.Sprintf(msg, id.Token.Line, id.Token.Column, name))
+	}
+	return warnings
+}
+
+// scan walks the given program, and the functions it defines, recording
+// the names it reads and assigns.
+func (e *Eval) scan(program *ast.Program) *fieldScan {
+
+	globals := make(map[string]bool)
+	scan := &fieldScan{
+		scopes:   []map[string]bool{globals},
+		globals:  globals,
+		read:     make(map[string]bool),
+		assigned: make(map[string]bool),
+		input:    e.inputName,
+		blocks:   e.blockScope,
+	}
+	ast.Walk(program, scan.visit)
+
+	// Functions see their parameters, and the variables of the main
+	// program, but not those of any block they're called from.
+	for i := 0; i < len(scan.functions); i++ {
+		fn := scan.functions[i]
+
+		params := make(map[string]bool)
+		for _, param := range fn.Parameters {
+			params[param.Value] = true
+		}
+		scan.scopes = []map[string]bool{params}
+
+		for _, stmt := range fn.Body.Statements {
+			ast.Walk(stmt, scan.visit)
+		}
+	}
+
+	return scan
+}
+
+// fieldScan holds the state of ReferencedFields, as it walks the AST of
+// the script looking for the names it reads.
+type fieldScan struct {
+	// scopes holds the names which have been assigned in each of the
+	// scopes which are open, the innermost being the last.
+	scopes []map[string]bool
+
+	// globals holds the names assigned by the main program, outside
+	// of any block, which functions can see too.
+	globals map[string]bool
+
+	// read holds the names which are read before being assigned.
+	read map[string]bool
+
+	// unassigned holds the identifiers which are read before being
+	// assigned, in the order they appear.
+	unassigned []*ast.Identifier
+
+	// assigned holds all the names which are assigned, anywhere.
+	assigned map[string]bool
+
+	// functions holds the functions the script defines, which are
+	// examined once the main program has been.
+	functions []*ast.FunctionStatement
+
+	// input holds the name of the variable which holds the object.
+	input string
+
+	// blocks is true if blocks have scopes of their own, because the
+	// script was prepared with the BlockScope flag.
+	blocks bool
+}
+
+// visit is called for each node of the AST, and returns false for those
+// whose children it has dealt with itself.
+func (f *fieldScan) visit(node ast.Node) bool {
+
+	switch node := node.(type) {
+	case *ast.FunctionStatement:
+		f.functions = append(f.functions, node)
+		return false
+
+	case *ast.BlockStatement:
+		// Blocks which assign have a scope of their own, in the
+		// same way as when they're compiled.
+		scoped := f.blocks && assigns(node)
+		if scoped {
+			f.scopes = append(f.scopes, make(map[string]bool))
+		}
+		for _, stmt := range node.Statements {
+			ast.Walk(stmt, f.visit)
+		}
+		if scoped {
+			f.scopes = f.scopes[:len(f.scopes)-1]
+		}
+		return false
+
+	case *ast.TryStatement:
+		// Without block-scoping the error is an ordinary
+		// variable.
+		ast.Walk(node.Body, f.visit)
+		if !f.blocks {
+			if node.Name != nil {
+				f.assign(node.Name.Value)
+			}
+			ast.Walk(node.Catch, f.visit)
+			return false
+		}
+
+		// Otherwise the catch-block has a scope of its own,
+		// which holds the error.
+		scope := make(map[string]bool)
+		if node.Name != nil {
+			scope[node.Name.Value] = true
+		}
+		f.scopes = append(f.scopes, scope)
+		for _, stmt := range node.Catch.Statements {
+			ast.Walk(stmt, f.visit)
+		}
+		f.scopes = f.scopes[:len(f.scopes)-1]
+		return false
+
+	case *ast.AssignStatement:
+		ast.Walk(node.Value, f.visit)
+		if node.Name != nil {
+			f.assign(node.Name.Value)
+		}
+		for _, name := range node.Names {
+			f.assign(name.Value)
+		}
+		return false
+
+	case *ast.CallExpression:
+		// The name of the function isn't a variable.
+		fn, ok := node.Function.(*ast.Identifier)
+		if !ok {
+			ast.Walk(node.Function, f.visit)
+		}
+
+		// `exists` tests for a field, rather than a variable.
+		if ok && fn.Value == "exists" && len(node.Arguments) == 1 {
+			if str, ok := node.Arguments[0].(*ast.StringLiteral); ok {
+				f.read[str.Value] = true
+			}
+		}
+		for _, arg := range node.Arguments {
+			ast.Walk(arg, f.visit)
+		}
+		return false
+
+	case *ast.IndexExpression:
+		// `self.Name`, and `self["Name"]`, read a single field.
+		if f.object(node.Left) {
+			if str, ok := node.Index.(*ast.StringLiteral); ok {
+				f.read[str.Value] = true
+				return false
+			}
+		}
+
+	case *ast.Identifier:
+		name := strings.TrimPrefix(node.Value, "$")
+		if !f.defined(name) {
+			f.read[name] = true
+			f.unassigned = append(f.unassigned, node)
+		}
+		return false
+	}
+
+	return true
+}
+
+// assign records that the given variable has been assigned, in the
+// innermost scope - unless it is already in scope, in which case the
+// existing variable is updated.
+func (f *fieldScan) assign(name string) {
+	name = strings.TrimPrefix(name, "$")
+	f.assigned[name] = true
+	if !f.defined(name) {
+		f.scopes[len(f.scopes)-1][name] = true
+	}
+}
+
+// object returns true if the given expression is the object the script
+// is executed against.
+func (f *fieldScan) object(node ast.Expression) bool {
+	id, ok := node.(*ast.Identifier)
+	return ok && id.Value == f.input && !f.defined(f.input)
+}
+
+// defined returns true if the given variable is in scope.
+func (f *fieldScan) defined(name string) bool {
+	if f.globals[name] {
+		return true
+	}
+	for _, scope := range f.scopes {
+		if scope[name] {
+			return true
+		}
+	}
+	return false
+}
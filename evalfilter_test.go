@@ -1,8 +1,20 @@
 package evalfilter
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/skx/evalfilter/v2/ast"
+	"github.com/skx/evalfilter/v2/code"
 	"github.com/skx/evalfilter/v2/object"
 )
 
@@ -326,7 +338,7 @@ func TestFunctionString(t *testing.T) {
 		{Input: `if ( EmptyStr() ) { return true; } return false;`, Result: false},
 		{Input: `if ( EmptyStr() == "Steve" ) { return true; } return false;`, Result: false},
 		{Input: `if ( EmptyStr() == "" ) { return true; } return false;`, Result: true},
-		{Input: `if ( ! EmptyStr() ) { return true; } else { return false; }`, Result: false},
+		{Input: `if ( ! EmptyStr() ) { return true; } else { return false; }`, Result: true},
 	}
 
 	for _, tst := range tests {
@@ -358,6 +370,155 @@ func TestFunctionString(t *testing.T) {
 	}
 }
 
+// TestFunctionPanic checks that a function which panics results in an
+// error, rather than crashing the host.
+func TestFunctionPanic(t *testing.T) {
+
+	obj := New(`return Explode( 1 );`)
+
+	p := obj.Prepare()
+	if p != nil {
+		t.Fatalf("Failed to compile")
+	}
+
+	obj.AddFunction("Explode",
+		func(args []object.Object) object.Object {
+			var arr []object.Object
+			return arr[len(args)]
+		})
+
+	_, err := obj.Run(nil)
+	if err == nil {
+		t.Fatalf("Expected an error, got none")
+	}
+	if !strings.Contains(err.Error(), "Explode") {
+		t.Fatalf("Error didn't mention the function: %s", err)
+	}
+	if !strings.Contains(err.Error(), "index out of range") {
+		t.Fatalf("Error didn't contain the panic: %s", err)
+	}
+}
+
+// TestTypedFunction checks that functions with ordinary golang
+// signatures may be called.
+func TestTypedFunction(t *testing.T) {
+
+	type Test struct {
+		Input  string
+		Result string
+	}
+
+	tests := []Test{
+		{Input: `return repeat( "ab", 3 );`, Result: "ababab"},
+		{Input: `return half( 5 );`, Result: "2.5"},
+		{Input: `return half( 5.0 );`, Result: "2.5"},
+		{Input: `return negate( true );`, Result: "false"},
+		{Input: `return count( 3 );`, Result: "[0, 1, 2]"},
+		{Input: `return kind( "steve" );`, Result: "STRING"},
+		{Input: `noop(); return "ok";`, Result: "ok"},
+		{Input: `return small( 200 );`, Result: "200"},
+		{Input: `return checked( 3 );`, Result: "3"},
+		{Input: `return unsigned( 9223372036854775807 );`, Result: "9223372036854775807"},
+	}
+
+	errors := []Test{
+		{Input: `return repeat( "ab" );`, Result: "expects 2 argument(s), got 1"},
+		{Input: `return repeat( 3, 3 );`, Result: "argument 1 to the function repeat: expected a string, got INTEGER"},
+		{Input: `return half( "steve" );`, Result: "expected a number, got STRING"},
+		{Input: `return small( 300 );`, Result: "out of range for uint8"},
+		{Input: `return small( -1 );`, Result: "out of range for uint8"},
+		{Input: `return checked( -3 );`, Result: "the function checked failed: negative value"},
+		{Input: `return huge();`, Result: "the result of the function huge: the integer 18446744073709551615 is out of range for int64"},
+		{Input: `return huges();`, Result: "the result of the function huges: element 1: the integer 9223372036854775808 is out of range for int64"},
+	}
+
+	register := func(obj *Eval) {
+		funcs := map[string]interface{}{
+			"repeat": func(s string, n int) string { return strings.Repeat(s, n) },
+			"half":   func(f float64) float64 { return f / 2 },
+			"negate": func(b bool) bool { return !b },
+			"count": func(n int) []int {
+				var out []int
+				for i := 0; i < n; i++ {
+					out = append(out, i)
+				}
+				return out
+			},
+			"kind":     func(o object.Object) string { return string(o.Type()) },
+			"noop":     func() {},
+			"small":    func(n uint8) uint8 { return n },
+			"unsigned": func(n uint64) uint64 { return n },
+			"huge":     func() uint64 { return math.MaxUint64 },
+			"huges":    func() []uint64 { return []uint64{1, math.MaxInt64 + 1} },
+			"checked": func(n int) (int, error) {
+				if n < 0 {
+					return 0, fmt.Errorf("negative value")
+				}
+				return n, nil
+			},
+		}
+		for name, fn := range funcs {
+			if err := obj.AddTypedFunction(name, fn); err != nil {
+				t.Fatalf("Failed to register %s: %s", name, err)
+			}
+		}
+	}
+
+	for _, tst := range tests {
+		obj := New(tst.Input)
+		register(obj)
+
+		p := obj.Prepare()
+		if p != nil {
+			t.Fatalf("Failed to compile %s: %s", tst.Input, p.Error())
+		}
+
+		ret, err := obj.Execute(nil)
+		if err != nil {
+			t.Fatalf("Found unexpected error running script '%s': %s", tst.Input, err)
+		}
+		if ret.Inspect() != tst.Result {
+			t.Fatalf("Found unexpected result running script '%s': got %s, expected %s", tst.Input, ret.Inspect(), tst.Result)
+		}
+	}
+
+	// Calls with the wrong number of arguments are rejected by
+	// Prepare, other errors happen at run-time.
+	for _, tst := range errors {
+		obj := New(tst.Input)
+		register(obj)
+
+		err := obj.Prepare()
+		if err == nil {
+			_, err = obj.Execute(nil)
+		}
+		if err == nil {
+			t.Fatalf("Expected an error running '%s', got none", tst.Input)
+		}
+		if !strings.Contains(err.Error(), tst.Result) {
+			t.Fatalf("Expected error '%s' running '%s', got '%s'", tst.Result, tst.Input, err)
+		}
+	}
+
+	//
+	// Unsupported signatures are rejected when they are added.
+	//
+	bad := []interface{}{
+		"not a function",
+		nil,
+		func(s ...string) {},
+		func(m map[string]string) {},
+		func() (int, int) { return 0, 0 },
+		func() (int, int, error) { return 0, 0, nil },
+		func() chan int { return nil },
+	}
+	for _, fn := range bad {
+		if New("").AddTypedFunction("bad", fn) == nil {
+			t.Fatalf("Expected an error adding %T", fn)
+		}
+	}
+}
+
 // TestBool tests a struct-member can be boolean
 func TestBool(t *testing.T) {
 
@@ -842,6 +1003,149 @@ return false;
 
 }
 
+// TestConstantFolding checks that integer arithmetic upon constants
+// is collapsed by our optimizer, without changing the result.
+func TestConstantFolding(t *testing.T) {
+
+	type Test struct {
+		Input  string
+		Result string
+	}
+
+	tests := []Test{
+		{Input: `return 60 * 60 * 24;`, Result: "86400"},
+		{Input: `return 1 + 2 * 3;`, Result: "7"},
+		{Input: `return 10 - 20;`, Result: "-10"},
+		{Input: `return 17 / 5;`, Result: "3"},
+		{Input: `return 17 % 5;`, Result: "2"},
+		{Input: `return 2 ** 10;`, Result: "1024"},
+		{Input: `return 70000 + 1;`, Result: "70001"},
+		{Input: `return ( 1 + 2 ) * ( 3 + 4 );`, Result: "21"},
+	}
+
+	for _, tst := range tests {
+		for _, flags := range [][]byte{{}, {NoOptimize}} {
+
+			obj := New(tst.Input)
+
+			p := obj.Prepare(flags)
+			if p != nil {
+				t.Fatalf("Failed to compile %s: %s", tst.Input, p.Error())
+			}
+
+			ret, err := obj.Execute(nil)
+			if err != nil {
+				t.Fatalf("Found unexpected error running script '%s': %s", tst.Input, err)
+			}
+			if ret.Inspect() != tst.Result {
+				t.Fatalf("Found unexpected result running script '%s': got %s, expected %s", tst.Input, ret.Inspect(), tst.Result)
+			}
+
+			if len(flags) != 0 {
+				continue
+			}
+
+			//
+			// When optimized there should be no maths left.
+			//
+			out, err := obj.Disassemble()
+			if err != nil {
+				t.Fatalf("Failed to disassemble: %s", err)
+			}
+			for _, op := range []string{"OpAdd", "OpSub", "OpMul", "OpDiv", "OpMod", "OpPower"} {
+				if strings.Contains(out, op) {
+					t.Fatalf("Found %s in optimized script '%s':\n%s", op, tst.Input, out)
+				}
+			}
+		}
+	}
+
+	//
+	// Division by zero must be left for the run-time to report.
+	//
+	for _, src := range []string{`return 1 / 0;`, `a = 3; return 1 / ( a - 3 );`} {
+		obj := New(src)
+
+		p := obj.Prepare()
+		if p != nil {
+			t.Fatalf("Failed to compile %s: %s", src, p.Error())
+		}
+
+		_, err := obj.Execute(nil)
+		if err == nil {
+			t.Fatalf("Expected an error running '%s', got none", src)
+		}
+	}
+}
+
+// TestUnreachable checks that statements following a `return` are
+// not compiled.
+func TestUnreachable(t *testing.T) {
+
+	src := `
+if ( Count > 1 ) {
+   return "big";
+   print( "unreachable if" );
+} else {
+   return "small";
+   print( "unreachable else" );
+}
+return "never";
+print( "unreachable top-level" );
+`
+
+	for _, flags := range [][]byte{{}, {NoOptimize}} {
+		obj := New(src)
+
+		p := obj.Prepare(flags)
+		if p != nil {
+			t.Fatalf("Failed to compile: %s", p.Error())
+		}
+
+		out, err := obj.Disassemble()
+		if err != nil {
+			t.Fatalf("Failed to disassemble: %s", err)
+		}
+		if strings.Contains(out, "unreachable") {
+			t.Fatalf("Found unreachable code in the output:\n%s", out)
+		}
+
+		// Both branches must still be present.
+		for _, str := range []string{"big", "small"} {
+			if !strings.Contains(out, str) {
+				t.Fatalf("Missing %s in the output:\n%s", str, out)
+			}
+		}
+
+		ret, err := obj.Execute(struct{ Count int }{Count: 3})
+		if err != nil {
+			t.Fatalf("Found unexpected error running script: %s", err)
+		}
+		if ret.Inspect() != "big" {
+			t.Fatalf("Found unexpected result running script: got %s", ret.Inspect())
+		}
+	}
+
+	//
+	// Functions may be defined after a return, since they can
+	// be called before their definition.
+	//
+	obj := New(`return double(21); function double(n) { return n * 2; }`)
+
+	p := obj.Prepare()
+	if p != nil {
+		t.Fatalf("Failed to compile: %s", p.Error())
+	}
+
+	ret, err := obj.Execute(nil)
+	if err != nil {
+		t.Fatalf("Found unexpected error running script: %s", err)
+	}
+	if ret.Inspect() != "42" {
+		t.Fatalf("Found unexpected result running script: got %s, expected 42", ret.Inspect())
+	}
+}
+
 // TestArrayIn checks our array-inclusion functionality is sane.
 func TestArrayIn(t *testing.T) {
 
@@ -867,7 +1171,15 @@ if ( "Steve" in names ) {
 return( "Steve" in [ "Steve", "Blah", "Kemp" ] );
 `,
 			Result: true},
-		{Input: `return( "Steve" in "Steve" );`, Error: true},
+		{Input: `return( "Steve" in "Steve" );`, Result: true},
+		{Input: `return( "ell" in "hello" );`, Result: true},
+		{Input: `return( "" in "hello" );`, Result: true},
+		{Input: `return( "" in "" );`, Result: true},
+		{Input: `return( "ELL" in "hello" );`, Result: false},
+		{Input: `return( "hello!" in "hello" );`, Result: false},
+		{Input: `return( "ïc" in "ünïcödé" );`, Result: true},
+		{Input: `return( 3 in "a3" );`, Error: true},
+		{Input: `return( "Steve" in 3 );`, Error: true},
 	}
 
 	for _, tst := range tests {
@@ -890,4 +1202,5183 @@ return( "Steve" in [ "Steve", "Blah", "Kemp" ] );
 			t.Fatalf("Found unexpected result running script: %s", tst.Input)
 		}
 	}
+
+	// The error blames the operand which is wrong.
+	errs := map[string]string{
+		`return( 1 in "hello" );`:   "left operand for 'in' must be a string when searching a string, not INTEGER",
+		`return( "Steve" in 3 );`:   "operand for 'in' must be an array, or a string, not INTEGER",
+		`return( [1] in "hello" );`: "not ARRAY",
+	}
+	for src, msg := range errs {
+		obj := New(src)
+		if err := obj.Prepare(); err != nil {
+			t.Fatalf("Failed to compile %s: %s", src, err)
+		}
+		_, err := obj.Run(nil)
+		if err == nil || !strings.Contains(err.Error(), msg) {
+			t.Fatalf("Expected error '%s' running '%s', got %v", msg, src, err)
+		}
+	}
+}
+
+// TestHash tests that hash literals, and hash indexing, work.
+func TestHash(t *testing.T) {
+
+	type Test struct {
+		Input  string
+		Result string
+	}
+
+	tests := []Test{
+		{Input: `h = { "name": "Steve", "score": 42 }; return h["name"];`, Result: "Steve"},
+		{Input: `h = { "name": "Steve", "score": 42 }; return h["score"];`, Result: "42"},
+		{Input: `h = { "name": "Steve" }; return h["missing"];`, Result: "null"},
+		{Input: `h = { 1: "one", "1": "string-one" }; return h[1];`, Result: "one"},
+		{Input: `h = { 1: "one", "1": "string-one" }; return h["1"];`, Result: "string-one"},
+		{Input: `h = { true: "yes", false: "no" }; return h[1 == 1];`, Result: "yes"},
+		{Input: `return { "b": 2, "a": 1, "c": [1, 2] };`, Result: "{a: 1, b: 2, c: [1, 2]}"},
+		{Input: `return {};`, Result: "{}"},
+		{Input: `name = "Steve"; return { "name": name, "len": len(name) };`, Result: "{len: 5, name: Steve}"},
+	}
+
+	for _, tst := range tests {
+
+		obj := New(tst.Input)
+
+		p := obj.Prepare()
+		if p != nil {
+			t.Fatalf("Failed to compile '%s': %s", tst.Input, p.Error())
+		}
+
+		ret, err := obj.Execute(nil)
+		if err != nil {
+			t.Fatalf("Found unexpected error running test '%s' - %s\n", tst.Input, err.Error())
+		}
+
+		if ret.Inspect() != tst.Result {
+			t.Fatalf("Found unexpected result running script '%s': got %s, expected %s", tst.Input, ret.Inspect(), tst.Result)
+		}
+	}
+
+	// Invalid keys and missing colons are errors
+	errors := []string{
+		`return { [1]: 2 };`,
+		`h = { "a": 1 }; return h[[1]];`,
+	}
+	for _, src := range errors {
+		obj := New(src)
+		p := obj.Prepare()
+		if p != nil {
+			t.Fatalf("Failed to compile '%s': %s", src, p.Error())
+		}
+		_, err := obj.Execute(nil)
+		if err == nil {
+			t.Fatalf("Expected an error running '%s'", src)
+		}
+	}
+
+	obj := New(`return { "a" 1 };`)
+	if obj.Prepare() == nil {
+		t.Fatalf("Expected a parse-error for a hash with no colon")
+	}
+}
+
+// TestBreakContinue tests that `break` and `continue` work within loops.
+func TestBreakContinue(t *testing.T) {
+
+	type Test struct {
+		Input  string
+		Result string
+	}
+
+	tests := []Test{
+		{Input: `i = 0; while ( true ) { i = i + 1; if ( i == 5 ) { break; } } return i;`, Result: "5"},
+		{Input: `i = 0; sum = 0; while ( i < 10 ) { i = i + 1; if ( i % 2 == 0 ) { continue; } sum = sum + i; } return sum;`, Result: "25"},
+		{Input: `i = 0; n = 0; while ( i < 3 ) { i = i + 1; j = 0; while ( true ) { j = j + 1; n = n + 1; if ( j == 2 ) { break; } } } return n;`, Result: "6"},
+		{Input: `i = 0; while ( i < 3 ) { i = i + 1; continue; i = 100; } return i;`, Result: "3"},
+	}
+
+	for _, tst := range tests {
+
+		obj := New(tst.Input)
+
+		p := obj.Prepare()
+		if p != nil {
+			t.Fatalf("Failed to compile '%s': %s", tst.Input, p.Error())
+		}
+
+		ret, err := obj.Execute(nil)
+		if err != nil {
+			t.Fatalf("Found unexpected error running test '%s' - %s\n", tst.Input, err.Error())
+		}
+
+		if ret.Inspect() != tst.Result {
+			t.Fatalf("Found unexpected result running script '%s': got %s, expected %s", tst.Input, ret.Inspect(), tst.Result)
+		}
+	}
+
+	// Using these outside a loop is a compile-time error.
+	for _, src := range []string{`break; return true;`, `if ( true ) { continue; } return true;`} {
+		obj := New(src)
+		err := obj.Prepare()
+		if err == nil {
+			t.Fatalf("Expected a compile-error for '%s'", src)
+		}
+		if !strings.Contains(err.Error(), "outside of a loop") {
+			t.Fatalf("Unexpected error for '%s': %s", src, err.Error())
+		}
+	}
+}
+
+// TestContext tests that a context can be used to abort a script.
+func TestContext(t *testing.T) {
+
+	obj := New(`while ( true ) { } return true;`)
+
+	p := obj.Prepare()
+	if p != nil {
+		t.Fatalf("Failed to compile: %s", p.Error())
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	_, err := obj.RunContext(ctx, nil)
+	if err == nil {
+		t.Fatalf("Expected an error, got none")
+	}
+	if err != context.DeadlineExceeded {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+
+	// A script which terminates will work as normal.
+	obj = New(`i = 0; while ( i < 5000 ) { i = i + 1; } return i;`)
+
+	p = obj.Prepare()
+	if p != nil {
+		t.Fatalf("Failed to compile: %s", p.Error())
+	}
+
+	ret, err := obj.ExecuteContext(context.Background(), nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if ret.Inspect() != "5000" {
+		t.Fatalf("Unexpected result: %s", ret.Inspect())
+	}
+}
+
+// TestMaxInstructions tests that an instruction-limit may be applied.
+func TestMaxInstructions(t *testing.T) {
+
+	// An infinite loop is aborted.
+	obj := New(`while ( true ) { } return true;`)
+	obj.SetMaxInstructions(100)
+
+	p := obj.Prepare()
+	if p != nil {
+		t.Fatalf("Failed to compile: %s", p.Error())
+	}
+
+	_, err := obj.Run(nil)
+	if err != ErrInstructionLimit {
+		t.Fatalf("Expected the instruction-limit error, got %v", err)
+	}
+
+	// Raising the limit after Prepare is honoured, and zero
+	// means unlimited.
+	obj = New(`i = 0; while ( i < 100 ) { i = i + 1; } return i;`)
+
+	p = obj.Prepare()
+	if p != nil {
+		t.Fatalf("Failed to compile: %s", p.Error())
+	}
+
+	obj.SetMaxInstructions(10)
+	_, err = obj.Run(nil)
+	if err != ErrInstructionLimit {
+		t.Fatalf("Expected the instruction-limit error, got %v", err)
+	}
+
+	obj.SetMaxInstructions(0)
+	ret, err := obj.Execute(nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if ret.Inspect() != "100" {
+		t.Fatalf("Unexpected result: %s", ret.Inspect())
+	}
+
+	// A function-call is a single instruction, no matter how
+	// long the function takes to run.
+	obj = New(`return slow();`)
+	obj.AddFunction("slow", func(args []object.Object) object.Object {
+		time.Sleep(10 * time.Millisecond)
+		return &object.Boolean{Value: true}
+	})
+
+	p = obj.Prepare([]byte{NoOptimize})
+	if p != nil {
+		t.Fatalf("Failed to compile: %s", p.Error())
+	}
+
+	// constant, call, return
+	obj.SetMaxInstructions(3)
+	res, err := obj.Run(nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if !res {
+		t.Fatalf("Unexpected result")
+	}
+}
+
+// TestFunctions tests functions defined within scripts.
+func TestFunctions(t *testing.T) {
+
+	type Test struct {
+		Input  string
+		Result string
+	}
+
+	tests := []Test{
+		{Input: `function double(x) { return x * 2; } return double(21);`, Result: "42"},
+		{Input: `return add(1, 2); function add(a, b) { return a + b; }`, Result: "3"},
+		{Input: `function fib(n) { if ( n < 2 ) { return n; } return fib(n-1) + fib(n-2); } return fib(10);`, Result: "55"},
+		{Input: `function nothing() { } return type(nothing());`, Result: "null"},
+		{Input: `x = 1; function f(x) { x = 10; return x; } return f(3) + x;`, Result: "11"},
+		{Input: `total = 0; function bump(n) { total = total + n; } bump(3); bump(4); return total;`, Result: "7"},
+		{Input: `function f() { tmp = 3; return tmp; } f(); return type(tmp);`, Result: "null"},
+		{Input: `function first(arr) { i = 0; while ( i < len(arr) ) { if ( arr[i] > 2 ) { return arr[i]; } i = i + 1; } return -1; } return first([1,2,3,4]);`, Result: "3"},
+	}
+
+	for _, tst := range tests {
+
+		obj := New(tst.Input)
+
+		p := obj.Prepare()
+		if p != nil {
+			t.Fatalf("Failed to compile '%s': %s", tst.Input, p.Error())
+		}
+
+		ret, err := obj.Execute(nil)
+		if err != nil {
+			t.Fatalf("Found unexpected error running test '%s' - %s\n", tst.Input, err.Error())
+		}
+
+		if ret.Inspect() != tst.Result {
+			t.Fatalf("Found unexpected result running script '%s': got %s, expected %s", tst.Input, ret.Inspect(), tst.Result)
+		}
+	}
+
+	// Calling a function with the wrong number of arguments
+	// is a compile-time error.
+	obj := New(`function double(x) { return x * 2; } return double(1, 2);`)
+
+	p := obj.Prepare()
+	if p == nil {
+		t.Fatalf("Expected an error calling a function with the wrong arguments")
+	}
+	if !strings.Contains(p.Error(), "1:45: the function double expects 1 argument(s), got 2") {
+		t.Fatalf("Unexpected error: %s", p.Error())
+	}
+
+	// Unless it is called indirectly, in which case it is a
+	// runtime error.
+	obj = New(`function double(x) { return x * 2; } return reduce([1], double, 0);`)
+
+	p = obj.Prepare()
+	if p != nil {
+		t.Fatalf("Failed to compile: %s", p.Error())
+	}
+
+	_, err := obj.Execute(nil)
+	if err == nil {
+		t.Fatalf("Expected an error calling a function with the wrong arguments")
+	}
+	if !strings.Contains(err.Error(), "double") {
+		t.Fatalf("Error didn't name the function: %s", err.Error())
+	}
+
+	// `break` cannot escape a function.
+	obj = New(`function f() { break; } while ( true ) { f(); } return true;`)
+	if obj.Prepare() == nil {
+		t.Fatalf("Expected a compile-error using break within a function")
+	}
+}
+
+// TestDisassemble tests that our bytecode may be retrieved as a string.
+func TestDisassemble(t *testing.T) {
+
+	obj := New(`name = "Steve"; return Name == name;`)
+
+	p := obj.Prepare()
+	if p != nil {
+		t.Fatalf("Failed to compile: %s", p.Error())
+	}
+
+	out, err := obj.Disassemble()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+
+	expected := []string{
+		"Bytecode:\n",
+		"  000000\t    OpConstant\t0\t// load constant: \"Steve\"\n",
+		"OpLookup\t2\t// lookup field: ",
+		"\n\nConstants:\n",
+		"  000000 Type:STRING Value:\"Steve\"\n",
+	}
+	for _, str := range expected {
+		if !strings.Contains(out, str) {
+			t.Fatalf("Output didn't contain '%s':\n%s", str, out)
+		}
+	}
+}
+
+// TestType tests the `type` function against literals and fields.
+func TestType(t *testing.T) {
+
+	type Input struct {
+		Name  string
+		Age   int
+		Score float64
+		Tags  []string
+		Alive bool
+	}
+
+	in := Input{Name: "Steve", Age: 44, Score: 3.5, Tags: []string{"a"}, Alive: true}
+
+	type Test struct {
+		Input  string
+		Result string
+	}
+
+	tests := []Test{
+		{Input: `return type(Name);`, Result: "string"},
+		{Input: `return type(Age);`, Result: "integer"},
+		{Input: `return type(Score);`, Result: "float"},
+		{Input: `return type(Tags);`, Result: "array"},
+		{Input: `return type(Alive);`, Result: "boolean"},
+		{Input: `return type(Missing);`, Result: "null"},
+		{Input: `return type("steve");`, Result: "string"},
+		{Input: `return type(3);`, Result: "integer"},
+		{Input: `return type({});`, Result: "hash"},
+		{Input: `return type(sqrt("steve"));`, Result: "error"},
+		{Input: `if ( type(Name) == "string" ) { return "yes"; } return "no";`, Result: "yes"},
+	}
+
+	for _, tst := range tests {
+
+		obj := New(tst.Input)
+
+		p := obj.Prepare()
+		if p != nil {
+			t.Fatalf("Failed to compile '%s': %s", tst.Input, p.Error())
+		}
+
+		ret, err := obj.Execute(in)
+		if err != nil {
+			t.Fatalf("Found unexpected error running test '%s' - %s\n", tst.Input, err.Error())
+		}
+
+		if ret.Inspect() != tst.Result {
+			t.Fatalf("Found unexpected result running script '%s': got %s, expected %s", tst.Input, ret.Inspect(), tst.Result)
+		}
+	}
+}
+
+// TestTernary tests the ternary operator.
+func TestTernary(t *testing.T) {
+
+	type Test struct {
+		Input  string
+		Result string
+	}
+
+	tests := []Test{
+		{Input: `x = 3; return x > 0 ? "positive" : "non-positive";`, Result: "positive"},
+		{Input: `x = -3; return x > 0 ? "positive" : "non-positive";`, Result: "non-positive"},
+		{Input: `return true ? 1 : 2;`, Result: "1"},
+		{Input: `return false ? 1 : 2;`, Result: "2"},
+		{Input: `x = 1; return x == 1 ? "one" : x == 2 ? "two" : "many";`, Result: "one"},
+		{Input: `x = 2; return x == 1 ? "one" : x == 2 ? "two" : "many";`, Result: "two"},
+		{Input: `x = 7; return x == 1 ? "one" : x == 2 ? "two" : "many";`, Result: "many"},
+		{Input: `x = true; y = x ? 10 : 20; return y;`, Result: "10"},
+
+		// Values flowing across the jumps mustn't be folded.
+		{Input: `x = true; return (x ? 1 : 2) + 3;`, Result: "4"},
+		{Input: `x = false; return (x ? 1 : 2) + 3;`, Result: "5"},
+		{Input: `x = true; if ( x ? true : false ) { return "yes"; } return "no";`, Result: "yes"},
+		{Input: `x = false; if ( x ? true : false ) { return "yes"; } return "no";`, Result: "no"},
+
+		// Only the selected branch is evaluated.
+		{Input: `a = 0; b = 0; x = true; x ? (a = 1) : (b = 1); return a + b * 10;`, Result: "1"},
+		{Input: `a = 0; b = 0; x = false; x ? (a = 1) : (b = 1); return a + b * 10;`, Result: "10"},
+	}
+
+	for _, tst := range tests {
+
+		for _, flags := range [][]byte{{}, {NoOptimize}} {
+
+			obj := New(tst.Input)
+
+			p := obj.Prepare(flags)
+			if p != nil {
+				t.Fatalf("Failed to compile '%s': %s", tst.Input, p.Error())
+			}
+
+			ret, err := obj.Execute(nil)
+			if err != nil {
+				t.Fatalf("Found unexpected error running test '%s' - %s\n", tst.Input, err.Error())
+			}
+
+			if ret.Inspect() != tst.Result {
+				t.Fatalf("Found unexpected result running script '%s': got %s, expected %s", tst.Input, ret.Inspect(), tst.Result)
+			}
+		}
+	}
+}
+
+// TestSwitch tests the switch statement.
+func TestSwitch(t *testing.T) {
+
+	type Test struct {
+		Input  string
+		Result string
+	}
+
+	tests := []Test{
+		{Input: `x = 1; switch (x) { case 1 { return "one"; } case 2 { return "two"; } default { return "other"; } }`, Result: "one"},
+		{Input: `x = 2; switch (x) { case 1 { return "one"; } case 2 { return "two"; } default { return "other"; } }`, Result: "two"},
+		{Input: `x = 3; switch (x) { case 1 { return "one"; } case 2 { return "two"; } default { return "other"; } }`, Result: "other"},
+		{Input: `x = 3; r = "none"; switch (x) { case 1 { r = "one"; } } return r;`, Result: "none"},
+		{Input: `x = "foo"; switch (x) { case "bar" { return 1; } case "foo" { return 2; } } return 3;`, Result: "2"},
+		{Input: `switch (1 + 1) { case 1 + 1 { return "yes"; } } return "no";`, Result: "yes"},
+
+		// No fall-through.
+		{Input: `n = 0; switch (1) { case 1 { n = n + 1; } case 1 { n = n + 10; } default { n = n + 100; } } return n;`, Result: "1"},
+
+		// The subject is only evaluated once.
+		{Input: `n = 0; function next() { n = n + 1; return n; } switch (next()) { case 5 { } case 6 { } default { } } return n;`, Result: "1"},
+
+		// break/continue within a loop.
+		{Input: `i = 0; n = 0; while ( i < 5 ) { i = i + 1; switch (i) { case 2 { continue; } case 4 { break; } } n = n + i; } return n;`, Result: "4"},
+
+		// default is not a keyword outside of switch.
+		{Input: `default = 3; return default;`, Result: "3"},
+	}
+
+	for _, tst := range tests {
+
+		for _, flags := range [][]byte{{}, {NoOptimize}} {
+
+			obj := New(tst.Input)
+
+			p := obj.Prepare(flags)
+			if p != nil {
+				t.Fatalf("Failed to compile '%s': %s", tst.Input, p.Error())
+			}
+
+			ret, err := obj.Execute(nil)
+			if err != nil {
+				t.Fatalf("Found unexpected error running test '%s' - %s\n", tst.Input, err.Error())
+			}
+
+			if ret.Inspect() != tst.Result {
+				t.Fatalf("Found unexpected result running script '%s': got %s, expected %s", tst.Input, ret.Inspect(), tst.Result)
+			}
+		}
+	}
+
+	// Parse errors.
+	for _, src := range []string{
+		`switch (1) { foo { } } return 1;`,
+		`switch (1) { default { } default { } } return 1;`,
+		`switch 1 { } return 1;`,
+	} {
+		obj := New(src)
+		if obj.Prepare() == nil {
+			t.Fatalf("Expected a parse-error for '%s'", src)
+		}
+	}
+}
+
+// TestCoalesce tests the null-coalescing operator.
+func TestCoalesce(t *testing.T) {
+
+	type Input struct {
+		Name  string
+		Count int
+		Alive bool
+	}
+
+	type Test struct {
+		Input  string
+		Result string
+	}
+
+	tests := []Test{
+		{Input: `return Name ?? "anonymous";`, Result: "Steve"},
+		{Input: `return Missing ?? "anonymous";`, Result: "anonymous"},
+		{Input: `return Count ?? 10;`, Result: "0"},
+		{Input: `return Alive ?? true;`, Result: "false"},
+		{Input: `return Missing ?? Other ?? "last";`, Result: "last"},
+		{Input: `x = Missing ?? 1 + 2; return x;`, Result: "3"},
+		{Input: `h = {"a": 1}; return h["b"] ?? "none";`, Result: "none"},
+		{Input: `return (Missing ?? 3) + 4;`, Result: "7"},
+		{Input: `return Missing ?? false ? "yes" : "no";`, Result: "no"},
+
+		// The right-hand side is not evaluated unless needed.
+		{Input: `n = 0; function f() { n = n + 1; return 1; } Name ?? f(); return n;`, Result: "0"},
+		{Input: `n = 0; function f() { n = n + 1; return 1; } Missing ?? f(); return n;`, Result: "1"},
+	}
+
+	in := Input{Name: "Steve"}
+
+	for _, tst := range tests {
+
+		for _, flags := range [][]byte{{}, {NoOptimize}} {
+
+			obj := New(tst.Input)
+
+			p := obj.Prepare(flags)
+			if p != nil {
+				t.Fatalf("Failed to compile '%s': %s", tst.Input, p.Error())
+			}
+
+			ret, err := obj.Execute(in)
+			if err != nil {
+				t.Fatalf("Found unexpected error running test '%s' - %s\n", tst.Input, err.Error())
+			}
+
+			if ret.Inspect() != tst.Result {
+				t.Fatalf("Found unexpected result running script '%s': got %s, expected %s", tst.Input, ret.Inspect(), tst.Result)
+			}
+		}
+	}
+}
+
+// TestClone tests that a prepared script may be cloned and run from
+// multiple goroutines.  Run with `go test -race` to detect problems.
+func TestClone(t *testing.T) {
+
+	type Input struct {
+		Name  string
+		Count int
+	}
+
+	obj := New(`
+function double(x) { return x * 2; }
+total = 0;
+i = 0;
+while ( i < Count ) {
+   total = total + double(i);
+   i = i + 1;
+}
+if ( Name ~= /^worker/ && match(Name, "^w") ) {
+   return total;
+}
+return -1;
+`)
+	obj.SetVariable("shared", &object.String{Value: "host"})
+
+	p := obj.Prepare()
+	if p != nil {
+		t.Fatalf("Failed to compile: %s", p.Error())
+	}
+
+	type Result struct {
+		Count int
+		Value string
+		Err   error
+	}
+
+	results := make(chan Result)
+
+	for w := 0; w < 8; w++ {
+		go func(w int, e *Eval) {
+			for n := 0; n < 20; n++ {
+				count := w*20 + n
+				ret, err := e.Execute(Input{Name: "worker", Count: count})
+				val := ""
+				if ret != nil {
+					val = ret.Inspect()
+				}
+				results <- Result{Count: count, Value: val, Err: err}
+			}
+		}(w, obj.Clone())
+	}
+
+	for i := 0; i < 8*20; i++ {
+		res := <-results
+		if res.Err != nil {
+			t.Fatalf("Unexpected error: %s", res.Err.Error())
+		}
+
+		// sum of 2*i for i in [0, count)
+		expected := fmt.Sprintf("%d", res.Count*(res.Count-1))
+		if res.Value != expected {
+			t.Fatalf("Unexpected result for count %d: got %s, expected %s", res.Count, res.Value, expected)
+		}
+	}
+
+	// Variables set by the clones don't affect the original, but
+	// those set by the host before cloning are visible to them.
+	if obj.GetVariable("total").Type() != object.NULL {
+		t.Fatalf("A clone modified the original environment")
+	}
+	clone := obj.Clone()
+	if clone.GetVariable("shared").Inspect() != "host" {
+		t.Fatalf("A clone didn't inherit the host-variables")
+	}
+}
+
+// TestReset tests that script-variables may be removed between runs.
+func TestReset(t *testing.T) {
+
+	obj := New(`if ( count == 0 ) { host = "changed"; } count = count + 1; seen = true; return count;`)
+	obj.SetVariable("host", &object.String{Value: "host"})
+	obj.SetVariable("count", &object.Integer{Value: 0})
+
+	p := obj.Prepare()
+	if p != nil {
+		t.Fatalf("Failed to compile: %s", p.Error())
+	}
+
+	// Variables persist between runs.
+	for i := 1; i <= 3; i++ {
+		ret, err := obj.Execute(nil)
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err.Error())
+		}
+		if ret.Inspect() != fmt.Sprintf("%d", i) {
+			t.Fatalf("Unexpected result: %s", ret.Inspect())
+		}
+	}
+	if obj.GetVariable("host").Inspect() != "changed" {
+		t.Fatalf("Script failed to change the variable")
+	}
+
+	// Until we reset.
+	obj.Reset()
+
+	if obj.GetVariable("seen").Type() != object.NULL {
+		t.Fatalf("Script-variable survived reset")
+	}
+	if obj.GetVariable("host").Inspect() != "host" {
+		t.Fatalf("Host-variable wasn't restored by reset")
+	}
+	if obj.GetVariable("count").Inspect() != "0" {
+		t.Fatalf("Host-variable wasn't restored by reset")
+	}
+
+	ret, err := obj.Execute(nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if ret.Inspect() != "1" {
+		t.Fatalf("Unexpected result after reset: %s", ret.Inspect())
+	}
+
+	// Functions survive a reset.
+	obj = New(`return answer();`)
+	obj.AddFunction("answer", func(args []object.Object) object.Object {
+		return &object.Integer{Value: 42}
+	})
+	p = obj.Prepare()
+	if p != nil {
+		t.Fatalf("Failed to compile: %s", p.Error())
+	}
+	obj.Reset()
+	ret, err = obj.Execute(nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if ret.Inspect() != "42" {
+		t.Fatalf("Unexpected result after reset: %s", ret.Inspect())
+	}
+}
+
+// TestFieldResolver checks that a custom field-resolver is consulted
+// before reflection.
+func TestFieldResolver(t *testing.T) {
+
+	type Input struct {
+		Name string
+		Age  int
+	}
+
+	src := `
+if ( Name != "Steve" ) { return false; }
+if ( Age != 42 ) { return false; }
+if ( Virtual != "virtual:Steve" ) { return false; }
+if ( type(Missing) != "null" ) { return false; }
+return true;
+`
+
+	obj := New(src)
+	obj.SetFieldResolver(func(o interface{}, field string) (object.Object, bool) {
+		switch field {
+		case "Virtual":
+			return &object.String{Value: "virtual:" + o.(*Input).Name}, true
+		case "Age":
+			return &object.Integer{Value: 42}, true
+		}
+		return nil, false
+	})
+
+	p := obj.Prepare()
+	if p != nil {
+		t.Fatalf("Failed to compile: %s", p.Error())
+	}
+
+	ret, err := obj.Run(&Input{Name: "Steve", Age: 17})
+	if err != nil {
+		t.Fatalf("Found unexpected error running script: %s", err)
+	}
+	if !ret {
+		t.Fatalf("Found unexpected result running script")
+	}
+
+	//
+	// Variables take precedence over the resolver.
+	//
+	obj = New(`return Virtual;`)
+	obj.SetVariable("Virtual", &object.String{Value: "variable"})
+	obj.SetFieldResolver(func(o interface{}, field string) (object.Object, bool) {
+		return &object.String{Value: "resolver"}, true
+	})
+
+	p = obj.Prepare()
+	if p != nil {
+		t.Fatalf("Failed to compile: %s", p.Error())
+	}
+
+	out, err := obj.Execute(nil)
+	if err != nil {
+		t.Fatalf("Found unexpected error running script: %s", err)
+	}
+	if out.Inspect() != "variable" {
+		t.Fatalf("Found unexpected result running script: got %s, expected variable", out.Inspect())
+	}
+}
+
+// TestOutput checks that the output of print can be redirected.
+func TestOutput(t *testing.T) {
+
+	obj := New(`print( "Hello, ", Name ); println( "!" ); println( 3, " ", true ); return true;`)
+
+	p := obj.Prepare()
+	if p != nil {
+		t.Fatalf("Failed to compile: %s", p.Error())
+	}
+
+	var out bytes.Buffer
+	obj.SetOutput(&out)
+
+	ret, err := obj.Run(struct{ Name string }{Name: "Steve"})
+	if err != nil {
+		t.Fatalf("Found unexpected error running script: %s", err)
+	}
+	if !ret {
+		t.Fatalf("Found unexpected result running script")
+	}
+
+	expected := "Hello, Steve!\n3 true\n"
+	if out.String() != expected {
+		t.Fatalf("Found unexpected output: got '%s', expected '%s'", out.String(), expected)
+	}
+
+	//
+	// A clone has its own output.
+	//
+	var cloned bytes.Buffer
+	c := obj.Clone()
+	c.SetOutput(&cloned)
+
+	_, err = c.Run(struct{ Name string }{Name: "Clone"})
+	if err != nil {
+		t.Fatalf("Found unexpected error running script: %s", err)
+	}
+	if !strings.HasPrefix(cloned.String(), "Hello, Clone!") {
+		t.Fatalf("Found unexpected output: got '%s'", cloned.String())
+	}
+	if out.String() != expected {
+		t.Fatalf("The original output changed: got '%s'", out.String())
+	}
+}
+
+// TestErrorPositions checks that errors report their position within
+// the source.
+func TestErrorPositions(t *testing.T) {
+
+	//
+	// Parser errors.
+	//
+	obj := New(`a = 3;
+return ( a + ;`)
+
+	err := obj.Prepare()
+	if err == nil {
+		t.Fatalf("Expected an error compiling, got none")
+	}
+	if !strings.Contains(err.Error(), "2:14: no prefix parse function for ;") {
+		t.Fatalf("Error didn't contain the position: %s", err)
+	}
+
+	//
+	// Runtime errors.
+	//
+	type Test struct {
+		Input  string
+		Result string
+	}
+
+	tests := []Test{
+		{Input: `a = 3;
+b = "steve";
+if ( a > 1 ) {
+   return a + b * 2;
+}`, Result: "4:17: type mismatch: STRING * INTEGER"},
+		{Input: `x = 1;
+
+return missing( x );`, Result: "3:15: the function missing does not exist"},
+		{Input: `function f(x) {
+   return x - "s";
+}
+return f( 1 );`, Result: "2:13: type mismatch: INTEGER - STRING"},
+	}
+
+	for _, tst := range tests {
+		for _, flags := range [][]byte{{}, {NoOptimize}} {
+
+			obj := New(tst.Input)
+
+			p := obj.Prepare(flags)
+			if p != nil {
+				t.Fatalf("Failed to compile %s: %s", tst.Input, p.Error())
+			}
+
+			_, err := obj.Execute(nil)
+			if err == nil {
+				t.Fatalf("Expected an error running '%s', got none", tst.Input)
+			}
+			if err.Error() != tst.Result {
+				t.Fatalf("Found unexpected error running '%s': got '%s', expected '%s'", tst.Input, err, tst.Result)
+			}
+		}
+	}
+}
+
+// TestArrayIndex checks indexing arrays, including negative and
+// out-of-range indexes.
+func TestArrayIndex(t *testing.T) {
+
+	type Test struct {
+		Input  string
+		Result string
+	}
+
+	tests := []Test{
+		{Input: `a = [1, 2, 3]; return a[0];`, Result: "1"},
+		{Input: `a = [1, 2, 3]; return a[2];`, Result: "3"},
+		{Input: `a = [1, 2, 3]; return a[3];`, Result: "null"},
+		{Input: `a = [1, 2, 3]; return a[1000];`, Result: "null"},
+		{Input: `a = [1, 2, 3]; return a[-1];`, Result: "3"},
+		{Input: `a = [1, 2, 3]; return a[-2];`, Result: "2"},
+		{Input: `a = [1, 2, 3]; return a[-3];`, Result: "1"},
+		{Input: `a = [1, 2, 3]; return a[-4];`, Result: "null"},
+		{Input: `a = [1, 2, 3]; return a[-1000];`, Result: "null"},
+		{Input: `a = [1, 2, 3]; i = 1; return a[-i];`, Result: "3"},
+		{Input: `a = []; return a[0];`, Result: "null"},
+		{Input: `a = []; return a[-1];`, Result: "null"},
+
+		// Strings follow the same rules, by character.
+		{Input: `return "hello"[0];`, Result: "h"},
+		{Input: `return "hello"[4];`, Result: "o"},
+		{Input: `return "hello"[5];`, Result: "null"},
+		{Input: `return "hello"[-1];`, Result: "o"},
+		{Input: `return "hello"[-5];`, Result: "h"},
+		{Input: `return "hello"[-6];`, Result: "null"},
+		{Input: `return ""[0];`, Result: "null"},
+		{Input: `return "café"[3];`, Result: "é"},
+		{Input: `s = "café"; return s[-1] == s[3:];`, Result: "true"},
+	}
+
+	for _, tst := range tests {
+		for _, flags := range [][]byte{{}, {NoOptimize}} {
+
+			obj := New(tst.Input)
+
+			p := obj.Prepare(flags)
+			if p != nil {
+				t.Fatalf("Failed to compile %s: %s", tst.Input, p.Error())
+			}
+
+			ret, err := obj.Execute(nil)
+			if err != nil {
+				t.Fatalf("Found unexpected error running script '%s': %s", tst.Input, err)
+			}
+			if ret.Inspect() != tst.Result {
+				t.Fatalf("Found unexpected result running script '%s': got %s, expected %s", tst.Input, ret.Inspect(), tst.Result)
+			}
+		}
+	}
+}
+
+// TestSlice checks slicing arrays and strings.
+func TestSlice(t *testing.T) {
+
+	type Test struct {
+		Input  string
+		Result string
+	}
+
+	tests := []Test{
+		{Input: `a = [1, 2, 3, 4, 5]; return a[0:3];`, Result: "[1, 2, 3]"},
+		{Input: `a = [1, 2, 3, 4, 5]; return a[:2];`, Result: "[1, 2]"},
+		{Input: `a = [1, 2, 3, 4, 5]; return a[2:];`, Result: "[3, 4, 5]"},
+		{Input: `a = [1, 2, 3, 4, 5]; return a[:];`, Result: "[1, 2, 3, 4, 5]"},
+		{Input: `a = [1, 2, 3, 4, 5]; return a[-2:];`, Result: "[4, 5]"},
+		{Input: `a = [1, 2, 3, 4, 5]; return a[:-1];`, Result: "[1, 2, 3, 4]"},
+		{Input: `a = [1, 2, 3, 4, 5]; return a[1:100];`, Result: "[2, 3, 4, 5]"},
+		{Input: `a = [1, 2, 3, 4, 5]; return a[-100:2];`, Result: "[1, 2]"},
+		{Input: `a = [1, 2, 3, 4, 5]; return a[3:1];`, Result: "[]"},
+		{Input: `a = []; return a[0:3];`, Result: "[]"},
+		{Input: `a = [1, 2, 3]; b = a[0:2]; b = push( b, 9 ); return a;`, Result: "[1, 2, 3]"},
+		{Input: `i = 1; a = [1, 2, 3]; return a[i:i+1];`, Result: "[2]"},
+		{Input: `a = [1, 2, 3]; return a[true ? 1 : 0:];`, Result: "[2, 3]"},
+		{Input: `return "steve"[1:3];`, Result: "te"},
+		{Input: `return "ünïcödé"[1:4];`, Result: "nïc"},
+		{Input: `return "ünïcödé"[-2:];`, Result: "dé"},
+		{Input: `return "steve"[10:];`, Result: ""},
+	}
+
+	for _, tst := range tests {
+		for _, flags := range [][]byte{{}, {NoOptimize}} {
+
+			obj := New(tst.Input)
+
+			p := obj.Prepare(flags)
+			if p != nil {
+				t.Fatalf("Failed to compile %s: %s", tst.Input, p.Error())
+			}
+
+			ret, err := obj.Execute(nil)
+			if err != nil {
+				t.Fatalf("Found unexpected error running script '%s': %s", tst.Input, err)
+			}
+			if ret.Inspect() != tst.Result {
+				t.Fatalf("Found unexpected result running script '%s': got %s, expected %s", tst.Input, ret.Inspect(), tst.Result)
+			}
+		}
+	}
+
+	//
+	// Errors
+	//
+	for _, src := range []string{`return 3[1:2];`, `a = [1, 2]; return a["a":];`, `a = [1]; return a[1:2;`} {
+		obj := New(src)
+
+		err := obj.Prepare()
+		if err == nil {
+			_, err = obj.Execute(nil)
+		}
+		if err == nil {
+			t.Fatalf("Expected an error with '%s', got none", src)
+		}
+	}
+}
+
+// TestInterpolation checks expressions embedded within strings.
+func TestInterpolation(t *testing.T) {
+
+	type Test struct {
+		Input  string
+		Result string
+	}
+
+	tests := []Test{
+		{Input: `name = "Steve"; return "Hello ${name}!";`, Result: "Hello Steve!"},
+		{Input: `score = 42; return "scored ${score}";`, Result: "scored 42"},
+		{Input: `return "${1 + 2}";`, Result: "3"},
+		{Input: `return "${1 + 2}${3 * 4}";`, Result: "312"},
+		{Input: `a = [1, 2]; return "a=${a}, len=${len(a)}";`, Result: "a=[1, 2], len=2"},
+		{Input: `x = true; return "${x ? "yes" : "no"}";`, Result: "yes"},
+		{Input: `h = { "a": 1 }; return "${h["a"]}";`, Result: "1"},
+		{Input: `return "${ { "a": 1 }["a"] }";`, Result: "1"},
+		{Input: `return "cost: \${price}";`, Result: "cost: ${price}"},
+		{Input: `return "tab\t${1}";`, Result: "tab\t1"},
+		{Input: `return 'single ${quoted}';`, Result: "single ${quoted}"},
+		{Input: `return "dollar $ sign ${"ok"}";`, Result: "dollar $ sign ok"},
+		{Input: `return "count: " + 3;`, Result: "count: 3"},
+		{Input: `return "" + 1.5 + true;`, Result: "1.5true"},
+	}
+
+	for _, tst := range tests {
+		for _, flags := range [][]byte{{}, {NoOptimize}} {
+
+			obj := New(tst.Input)
+
+			p := obj.Prepare(flags)
+			if p != nil {
+				t.Fatalf("Failed to compile %s: %s", tst.Input, p.Error())
+			}
+
+			ret, err := obj.Execute(nil)
+			if err != nil {
+				t.Fatalf("Found unexpected error running script '%s': %s", tst.Input, err)
+			}
+			if ret.Inspect() != tst.Result {
+				t.Fatalf("Found unexpected result running script '%s': got %s, expected %s", tst.Input, ret.Inspect(), tst.Result)
+			}
+		}
+	}
+
+	//
+	// Parse errors.
+	//
+	errs := []Test{
+		{Input: `return "Hello ${name";`, Result: "unterminated ${ in string"},
+		{Input: `return "Hello ${}";`, Result: "empty expression in interpolated string"},
+		{Input: `return "Hello ${1 +}";`, Result: "in interpolated string"},
+		{Input: `return "Hello ${1 2}";`, Result: "unexpected 2 in interpolated expression"},
+	}
+
+	for _, tst := range errs {
+		obj := New(tst.Input)
+
+		err := obj.Prepare()
+		if err == nil {
+			t.Fatalf("Expected an error compiling '%s', got none", tst.Input)
+		}
+		if !strings.Contains(err.Error(), tst.Result) {
+			t.Fatalf("Expected error '%s' compiling '%s', got '%s'", tst.Result, tst.Input, err)
+		}
+	}
+}
+
+// TestStringPromotion tests that adding a value to a string converts
+// that value to a string, and that only the left-hand side is promoted.
+func TestStringPromotion(t *testing.T) {
+
+	type Test struct {
+		Input  string
+		Result string
+	}
+
+	tests := []Test{
+		{Input: `return "v: " + null;`, Result: "v: null"},
+		{Input: `return "v: " + Missing;`, Result: "v: null"},
+		{Input: `return "v: " + [];`, Result: "v: []"},
+		{Input: `return "v: " + [1, "two", [3.5, null]];`, Result: "v: [1, two, [3.5, null]]"},
+		{Input: `return "v: " + {};`, Result: "v: {}"},
+		{Input: `return "v: " + {"b": "x", "a": [1]};`, Result: "v: {a: [1], b: x}"},
+		{Input: `a = [1, 2]; return "v: " + a == "v: ${a}";`, Result: "true"},
+	}
+
+	for _, tst := range tests {
+		for _, flags := range [][]byte{{}, {NoOptimize}} {
+
+			obj := New(tst.Input)
+
+			p := obj.Prepare(flags)
+			if p != nil {
+				t.Fatalf("Failed to compile %s: %s", tst.Input, p.Error())
+			}
+
+			ret, err := obj.Execute(nil)
+			if err != nil {
+				t.Fatalf("Found unexpected error running script '%s': %s", tst.Input, err)
+			}
+			if ret.Inspect() != tst.Result {
+				t.Fatalf("Found unexpected result running script '%s': got %s, expected %s", tst.Input, ret.Inspect(), tst.Result)
+			}
+		}
+	}
+
+	//
+	// A string on the right-hand side isn't promoted.
+	//
+	errs := []Test{
+		{Input: `return 3 + "x";`, Result: "type mismatch: INTEGER + STRING"},
+		{Input: `return null + "x";`, Result: "type mismatch: NULL + STRING"},
+		{Input: `return [1] + "x";`, Result: "type mismatch: ARRAY + STRING"},
+		{Input: `return {} + "x";`, Result: "type mismatch: HASH + STRING"},
+	}
+
+	for _, tst := range errs {
+		for _, flags := range [][]byte{{}, {NoOptimize}} {
+
+			obj := New(tst.Input)
+
+			p := obj.Prepare(flags)
+			if p != nil {
+				t.Fatalf("Failed to compile %s: %s", tst.Input, p.Error())
+			}
+
+			_, err := obj.Execute(nil)
+
+			var re *RuntimeError
+			if !errors.As(err, &re) || re.Code != ErrTypeMismatch || !strings.HasSuffix(err.Error(), tst.Result) {
+				t.Fatalf("Expected error '%s' running '%s', got '%v'", tst.Result, tst.Input, err)
+			}
+		}
+	}
+}
+
+// TestIntegerLiterals checks integers written in different bases.
+func TestIntegerLiterals(t *testing.T) {
+
+	type Test struct {
+		Input  string
+		Result string
+	}
+
+	tests := []Test{
+		{Input: `return 0xFF;`, Result: "255"},
+		{Input: `return 0XfF;`, Result: "255"},
+		{Input: `return 0o755;`, Result: "493"},
+		{Input: `return 0b1010;`, Result: "10"},
+		{Input: `return 1_000_000;`, Result: "1000000"},
+		{Input: `return 0x_FFFF_FFFF;`, Result: "4294967295"},
+		{Input: `return 010;`, Result: "10"},
+		{Input: `return -0x10;`, Result: "-16"},
+		{Input: `return 0xF0 + 0b1111;`, Result: "255"},
+		{Input: `return 1_000.5;`, Result: "1000.5"},
+	}
+
+	for _, tst := range tests {
+		for _, flags := range [][]byte{{}, {NoOptimize}} {
+
+			obj := New(tst.Input)
+
+			p := obj.Prepare(flags)
+			if p != nil {
+				t.Fatalf("Failed to compile %s: %s", tst.Input, p.Error())
+			}
+
+			ret, err := obj.Execute(nil)
+			if err != nil {
+				t.Fatalf("Found unexpected error running script '%s': %s", tst.Input, err)
+			}
+			if ret.Inspect() != tst.Result {
+				t.Fatalf("Found unexpected result running script '%s': got %s, expected %s", tst.Input, ret.Inspect(), tst.Result)
+			}
+		}
+	}
+
+	for _, src := range []string{`return 0b1012;`, `return 0o8;`, `return 0xG;`, `return 0x;`, `return 1__000;`, `return 1_;`} {
+		obj := New(src)
+
+		err := obj.Prepare()
+		if err == nil {
+			t.Fatalf("Expected an error compiling '%s', got none", src)
+		}
+		if !strings.Contains(err.Error(), "could not parse") {
+			t.Fatalf("Unexpected error compiling '%s': %s", src, err)
+		}
+	}
+}
+
+// TestTime tests our time-objects.
+func TestTime(t *testing.T) {
+
+	type Test struct {
+		Input  string
+		Result string
+	}
+
+	tests := []Test{
+		{Input: `return parse_time("2020-03-10T14:15:16Z");`, Result: "2020-03-10T14:15:16Z"},
+		{Input: `return parse_time("10/03/2020", "02/01/2006");`, Result: "2020-03-10T00:00:00Z"},
+		{Input: `return type(now());`, Result: "time"},
+		{Input: `return parse_time("2020-03-10T14:15:16Z") < now();`, Result: "true"},
+		{Input: `return parse_time("2020-03-10T14:15:16Z") > now();`, Result: "false"},
+		{Input: `return parse_time("2020-03-10T14:15:16Z") == parse_time("2020-03-10T16:15:16+02:00");`, Result: "true"},
+		{Input: `return parse_time("2020-03-10T14:15:16Z") != parse_time("2020-03-10T14:15:17Z");`, Result: "true"},
+		{Input: `return parse_time("2020-03-17T00:00:00Z") - parse_time("2020-03-10T00:00:00Z");`, Result: "604800"},
+		{Input: `return parse_time("2020-03-10T00:00:00Z") + 3600;`, Result: "2020-03-10T01:00:00Z"},
+		{Input: `return parse_time("2020-03-10T00:00:00Z") - 86400;`, Result: "2020-03-09T00:00:00Z"},
+		{Input: `return now() - parse_time("2020-03-10T00:00:00Z") > 7 * 86400;`, Result: "true"},
+		{Input: `return hour(parse_time("2020-03-10T14:15:16+02:00"));`, Result: "14"},
+		{Input: `return int(parse_time("1976-03-10T14:15:16Z"));`, Result: "195315316"},
+		{Input: `return parse_time("bogus");`, Result: `error: parse_time failed: parsing time "bogus" as "2006-01-02T15:04:05Z07:00": cannot parse "bogus" as "2006"`},
+	}
+
+	for _, tst := range tests {
+		for _, flags := range [][]byte{{}, {NoOptimize}} {
+
+			obj := New(tst.Input)
+
+			p := obj.Prepare(flags)
+			if p != nil {
+				t.Fatalf("Failed to compile %s: %s", tst.Input, p.Error())
+			}
+
+			ret, err := obj.Execute(nil)
+			if err != nil {
+				t.Fatalf("Found unexpected error running script '%s': %s", tst.Input, err)
+			}
+			if ret.Inspect() != tst.Result {
+				t.Fatalf("Found unexpected result running script '%s': got %s, expected %s", tst.Input, ret.Inspect(), tst.Result)
+			}
+		}
+	}
+
+	// Times cannot be multiplied.
+	obj := New(`return now() * now();`)
+	if err := obj.Prepare(); err != nil {
+		t.Fatalf("Failed to compile: %s", err)
+	}
+	_, err := obj.Execute(nil)
+	if err == nil || !strings.Contains(err.Error(), "unknown operator: TIME * TIME") {
+		t.Fatalf("Expected an error multiplying times, got %v", err)
+	}
+}
+
+// TestNestedFields tests navigating nested maps, structures, and
+// slices, including JSON input.
+func TestNestedFields(t *testing.T) {
+
+	doc := []byte(`{
+  "user": { "name": "Steve", "address": { "city": "Helsinki" } },
+  "items": [ { "name": "apple", "count": 3 }, { "name": "pear", "price": 1.5 } ],
+  "matrix": [ [ 1, 2 ], [ 3, 4 ] ],
+  "flags": { "if": true }
+}`)
+
+	var decoded map[string]interface{}
+	if err := json.Unmarshal(doc, &decoded); err != nil {
+		t.Fatalf("failed to decode JSON: %s", err)
+	}
+
+	type Address struct {
+		City string
+	}
+	type User struct {
+		Name    string
+		Address *Address
+		Tags    []string
+	}
+	type Node struct {
+		Name string
+		Next *Node
+	}
+
+	loop := &Node{Name: "loop"}
+	loop.Next = loop
+
+	type Test struct {
+		Object interface{}
+		Input  string
+		Result string
+	}
+
+	tests := []Test{
+		{Object: doc, Input: `return user.address.city;`, Result: "Helsinki"},
+		{Object: doc, Input: `return user["address"].city;`, Result: "Helsinki"},
+		{Object: doc, Input: `return items.0.name;`, Result: "apple"},
+		{Object: doc, Input: `return items[1].name;`, Result: "pear"},
+		{Object: doc, Input: `return items.0.count + 1;`, Result: "4"},
+		{Object: doc, Input: `return type(items.0.count);`, Result: "integer"},
+		{Object: doc, Input: `return items.1.price;`, Result: "1.5"},
+		{Object: doc, Input: `return matrix.1.0;`, Result: "3"},
+		{Object: doc, Input: `return len(items);`, Result: "2"},
+		{Object: doc, Input: `return flags.if;`, Result: "true"},
+		{Object: doc, Input: `return user.missing.city;`, Result: "null"},
+		{Object: doc, Input: `return items.7.name;`, Result: "null"},
+		{Object: doc, Input: `return missing.0.name ?? "none";`, Result: "none"},
+		{Object: json.RawMessage(doc), Input: `return user.name;`, Result: "Steve"},
+		{Object: decoded, Input: `return user.address.city;`, Result: "Helsinki"},
+		{Object: decoded, Input: `return items.0.count;`, Result: "3"},
+		{Object: map[string]int{"Count": 3}, Input: `return Count;`, Result: "3"},
+		{Object: User{Name: "Steve", Address: &Address{City: "Helsinki"}}, Input: `return Address.City;`, Result: "Helsinki"},
+		{Object: &User{Name: "Steve", Tags: []string{"a", "b"}}, Input: `return Tags.1;`, Result: "b"},
+		{Object: &User{Name: "Steve"}, Input: `return Address.City;`, Result: "null"},
+		{Object: loop, Input: `return Next.Name;`, Result: "loop"},
+		{Object: loop, Input: `return Next.Next;`, Result: "null"},
+	}
+
+	for _, tst := range tests {
+		for _, flags := range [][]byte{{}, {NoOptimize}} {
+
+			obj := New(tst.Input)
+
+			p := obj.Prepare(flags)
+			if p != nil {
+				t.Fatalf("Failed to compile %s: %s", tst.Input, p.Error())
+			}
+
+			ret, err := obj.Execute(tst.Object)
+			if err != nil {
+				t.Fatalf("Found unexpected error running script '%s': %s", tst.Input, err)
+			}
+			if ret.Inspect() != tst.Result {
+				t.Fatalf("Found unexpected result running script '%s': got %s, expected %s", tst.Input, ret.Inspect(), tst.Result)
+			}
+		}
+	}
+
+	// Invalid JSON is an error.
+	obj := New(`return true;`)
+	if err := obj.Prepare(); err != nil {
+		t.Fatalf("Failed to compile: %s", err)
+	}
+	_, err := obj.Execute([]byte(`{ "bogus": `))
+	if err == nil || !strings.Contains(err.Error(), "failed to decode JSON input") {
+		t.Fatalf("Expected an error decoding JSON, got %v", err)
+	}
+
+	// As is a missing field name.
+	obj = New(`return user.;`)
+	if err := obj.Prepare(); err == nil || !strings.Contains(err.Error(), "expected a field name, or index, after '.'") {
+		t.Fatalf("Expected an error parsing a member-access, got %v", err)
+	}
+}
+
+// TestVariables tests that we can retrieve all variables.
+func TestVariables(t *testing.T) {
+
+	obj := New(`name = "Steve"; count = count + 1; function local() { local x = 3; return x; } local(); return true;`)
+	obj.SetVariable("count", &object.Integer{Value: 1})
+
+	p := obj.Prepare()
+	if p != nil {
+		t.Fatalf("Failed to compile: %s", p.Error())
+	}
+
+	if len(obj.Variables()) != 1 {
+		t.Fatalf("Unexpected variables before running: %v", obj.Variables())
+	}
+
+	_, err := obj.Execute(nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+
+	vars := obj.Variables()
+	if len(vars) != 2 {
+		t.Fatalf("Unexpected variables: %v", vars)
+	}
+	if vars["name"].Inspect() != "Steve" {
+		t.Fatalf("Unexpected value for name: %s", vars["name"].Inspect())
+	}
+	if vars["count"].Inspect() != "2" {
+		t.Fatalf("Unexpected value for count: %s", vars["count"].Inspect())
+	}
+
+	// The map is a copy.
+	vars["name"] = &object.String{Value: "Bob"}
+	if obj.GetVariable("name").Inspect() != "Steve" {
+		t.Fatalf("Changing the copy changed the variable")
+	}
+}
+
+// TestTracer tests that a tracer observes every instruction.
+func TestTracer(t *testing.T) {
+
+	obj := New(`a = 1 + 2; return a;`)
+
+	p := obj.Prepare([]byte{NoOptimize})
+	if p != nil {
+		t.Fatalf("Failed to compile: %s", p.Error())
+	}
+
+	var ops []string
+	var depth []int
+	obj.SetTracer(func(ip int, op code.Opcode, stack []object.Object) {
+		ops = append(ops, fmt.Sprintf("%04d %s", ip, code.String(op)))
+		depth = append(depth, len(stack))
+	})
+
+	ret, err := obj.Execute(nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if ret.Inspect() != "3" {
+		t.Fatalf("Unexpected result: %s", ret.Inspect())
+	}
+
+	expected := []string{"0000 OpPush", "0003 OpPush", "0006 OpAdd", "0007 OpConstant", "0010 OpSet", "0011 OpLookup", "0014 OpReturn"}
+	if strings.Join(ops, ",") != strings.Join(expected, ",") {
+		t.Fatalf("Unexpected trace: %v", ops)
+	}
+	if fmt.Sprint(depth) != "[0 1 2 1 2 0 1]" {
+		t.Fatalf("Unexpected stack depths: %v", depth)
+	}
+
+	// Clones are traced too.
+	ops = nil
+	_, err = obj.Clone().Execute(nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if len(ops) != len(expected) {
+		t.Fatalf("Clone wasn't traced: %v", ops)
+	}
+
+	// Until the tracer is removed.
+	ops = nil
+	obj.SetTracer(nil)
+	_, err = obj.Execute(nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if len(ops) != 0 {
+		t.Fatalf("Tracer was called after being removed: %v", ops)
+	}
+}
+
+// TestIntegerOverflow tests that overflowing integer arithmetic is an
+// error, unless wrapping has been enabled.
+func TestIntegerOverflow(t *testing.T) {
+
+	type Test struct {
+		Input   string
+		Error   string
+		Wrapped string
+	}
+
+	tests := []Test{
+		{Input: `return 9223372036854775807 + 1;`, Error: "integer overflow in addition: 9223372036854775807 + 1", Wrapped: "-9223372036854775808"},
+		{Input: `return -9223372036854775807 - 2;`, Error: "integer overflow in subtraction: -9223372036854775807 - 2", Wrapped: "9223372036854775807"},
+		{Input: `return 4611686018427387904 * 2;`, Error: "integer overflow in multiplication: 4611686018427387904 * 2", Wrapped: "-9223372036854775808"},
+		{Input: `return 2 ** 64;`, Error: "integer overflow in exponentiation: 2 ** 64", Wrapped: "0"},
+		{Input: `return 3 ** 41;`, Error: "integer overflow in exponentiation", Wrapped: "-420491770248316829"},
+		{Input: `a = -9223372036854775807 - 1; return a / -1;`, Error: "integer overflow in division: -9223372036854775808 / -1", Wrapped: "-9223372036854775808"},
+		{Input: `a = -9223372036854775807 - 1; return -a;`, Error: "integer overflow negating", Wrapped: "-9223372036854775808"},
+		{Input: `a = 9223372036854775807; return a + 1 > a;`, Error: "integer overflow in addition", Wrapped: "false"},
+	}
+
+	for _, tst := range tests {
+		for _, flags := range [][]byte{{}, {NoOptimize}} {
+			for _, wrap := range []bool{false, true} {
+
+				obj := New(tst.Input)
+				obj.SetWrapArithmetic(wrap)
+
+				p := obj.Prepare(flags)
+				if p != nil {
+					t.Fatalf("Failed to compile %s: %s", tst.Input, p.Error())
+				}
+
+				ret, err := obj.Execute(nil)
+
+				if !wrap {
+					if err == nil || !strings.Contains(err.Error(), tst.Error) {
+						t.Fatalf("Expected an error running script '%s', got %v", tst.Input, err)
+					}
+					continue
+				}
+
+				if err != nil {
+					t.Fatalf("Found unexpected error running script '%s': %s", tst.Input, err)
+				}
+				if ret.Inspect() != tst.Wrapped {
+					t.Fatalf("Found unexpected result running script '%s': got %s, expected %s", tst.Input, ret.Inspect(), tst.Wrapped)
+				}
+			}
+		}
+	}
+
+	// A negative power of zero is a division by zero, rather than an
+	// overflow, whether wrapping or not.
+	for _, wrap := range []bool{false, true} {
+		for _, flags := range [][]byte{{}, {NoOptimize}} {
+			obj := New(`return 0 ** -1;`)
+			obj.SetWrapArithmetic(wrap)
+			if err := obj.Prepare(flags); err != nil {
+				t.Fatalf("Failed to compile: %s", err)
+			}
+
+			_, err := obj.Execute(nil)
+
+			var re *RuntimeError
+			if !errors.As(err, &re) || re.Code != ErrDivByZero || !strings.HasSuffix(err.Error(), "attempted division by zero: 0 ** -1") {
+				t.Fatalf("Expected a division by zero, got %v", err)
+			}
+		}
+	}
+
+	// The absolute value of the smallest integer fails in the same
+	// way as negating it.
+	for _, input := range []string{`a = -9223372036854775807 - 1; return -a;`, `a = -9223372036854775807 - 1; return abs(a);`} {
+		obj := New(input)
+		if err := obj.Prepare(); err != nil {
+			t.Fatalf("Failed to compile %s: %s", input, err)
+		}
+
+		_, err := obj.Execute(nil)
+
+		var re *RuntimeError
+		if !errors.As(err, &re) || re.Code != ErrOverflow || re.Message != "integer overflow negating -9223372036854775808" {
+			t.Fatalf("Expected an overflow running %s, got %v", input, err)
+		}
+	}
+
+	// Large results which fit are fine, and are exact.
+	obj := New(`return 3 ** 39;`)
+	if err := obj.Prepare(); err != nil {
+		t.Fatalf("Failed to compile: %s", err)
+	}
+	ret, err := obj.Execute(nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if ret.Inspect() != "4052555153018976267" {
+		t.Fatalf("Unexpected result: %s", ret.Inspect())
+	}
+}
+
+// TestDeepEquality tests comparing arrays and hashes.
+func TestDeepEquality(t *testing.T) {
+
+	type Test struct {
+		Input  string
+		Result string
+	}
+
+	tests := []Test{
+		{Input: `return [1, 2, 3] == [1, 2, 3];`, Result: "true"},
+		{Input: `return [1, 2, 3] != [1, 2, 3];`, Result: "false"},
+		{Input: `return [1, 2, 3] == [3, 2, 1];`, Result: "false"},
+		{Input: `return [1, 2, 3] == [1, 2];`, Result: "false"},
+		{Input: `return [1, 2] != [1, 2, 3];`, Result: "true"},
+		{Input: `return [] == [];`, Result: "true"},
+		{Input: `return [1, "2"] == [1, 2];`, Result: "false"},
+		{Input: `return [[1, 2], ["a", [true]]] == [[1, 2], ["a", [true]]];`, Result: "true"},
+		{Input: `return [[1, 2], ["a", [true]]] == [[1, 2], ["a", [false]]];`, Result: "false"},
+		{Input: `a = [1, 2]; b = a; return a == b;`, Result: "true"},
+		{Input: `return { "a": 1, "b": [2] } == { "b": [2], "a": 1 };`, Result: "true"},
+		{Input: `return { "a": 1 } == { "a": 2 };`, Result: "false"},
+		{Input: `return { "a": 1 } == { "a": 1, "b": 2 };`, Result: "false"},
+		{Input: `return { "a": 1 } == { "b": 1 };`, Result: "false"},
+		{Input: `return [{ "a": [1] }] == [{ "a": [1] }];`, Result: "true"},
+		{Input: `return [parse_time("2020-03-10T14:15:16Z")] == [parse_time("2020-03-10T16:15:16+02:00")];`, Result: "true"},
+	}
+
+	for _, tst := range tests {
+		for _, flags := range [][]byte{{}, {NoOptimize}} {
+
+			obj := New(tst.Input)
+
+			p := obj.Prepare(flags)
+			if p != nil {
+				t.Fatalf("Failed to compile %s: %s", tst.Input, p.Error())
+			}
+
+			ret, err := obj.Execute(nil)
+			if err != nil {
+				t.Fatalf("Found unexpected error running script '%s': %s", tst.Input, err)
+			}
+			if ret.Inspect() != tst.Result {
+				t.Fatalf("Found unexpected result running script '%s': got %s, expected %s", tst.Input, ret.Inspect(), tst.Result)
+			}
+		}
+	}
+
+	// Other operators are still unsupported.
+	obj := New(`return [1] < [2];`)
+	if err := obj.Prepare(); err != nil {
+		t.Fatalf("Failed to compile: %s", err)
+	}
+	_, err := obj.Execute(nil)
+	if err == nil || !strings.Contains(err.Error(), "unknown operator: ARRAY < ARRAY") {
+		t.Fatalf("Expected an error comparing arrays, got %v", err)
+	}
+
+	// Only arrays and hashes are compared structurally, comparing
+	// other values of different types is still an error.
+	for input, msg := range map[string]string{
+		`return 1 == "1";`:          "type mismatch: INTEGER == STRING",
+		`return "a" != 1;`:          "type mismatch: STRING != INTEGER",
+		`return [1] == { "a": 1 };`: "type mismatch: ARRAY == HASH",
+	} {
+		obj = New(input)
+		if err = obj.Prepare(); err != nil {
+			t.Fatalf("Failed to compile %s: %s", input, err)
+		}
+		_, err = obj.Execute(nil)
+		if err == nil || !strings.Contains(err.Error(), msg) {
+			t.Fatalf("Expected an error running %s, got %v", input, err)
+		}
+	}
+}
+
+// TestHigherOrder tests map, filter, and reduce.
+func TestHigherOrder(t *testing.T) {
+
+	type Test struct {
+		Input  string
+		Result string
+	}
+
+	functions := `
+function double(x) { return x * 2; }
+function even(x) { return x % 2 == 0; }
+function sum(a, b) { return a + b; }
+`
+
+	tests := []Test{
+		{Input: `return map([1, 2, 3], double);`, Result: "[2, 4, 6]"},
+		{Input: `return map([], double);`, Result: "[]"},
+		{Input: `return map(["a", "b"], "upper");`, Result: "[A, B]"},
+		{Input: `return map(map([1, 2], double), double);`, Result: "[4, 8]"},
+		{Input: `return filter([1, 2, 3, 4], even);`, Result: "[2, 4]"},
+		{Input: `return filter([], even);`, Result: "[]"},
+		{Input: `return filter([1, 3], even);`, Result: "[]"},
+		{Input: `return reduce([1, 2, 3, 4], sum, 0);`, Result: "10"},
+		{Input: `return reduce([], sum, 42);`, Result: "42"},
+		{Input: `return reduce(["a", "b"], sum, "");`, Result: "ab"},
+		{Input: `return reduce(map(filter([1, 2, 3, 4], even), double), sum, 0);`, Result: "12"},
+		{Input: `a = [1, 2]; b = map(a, double); return a;`, Result: "[1, 2]"},
+		{Input: `return 1 + len(map([1, 2], double)) + 1;`, Result: "4"},
+		{Input: `return type(double);`, Result: "function"},
+		{Input: `return map([1], 3);`, Result: "error: map expects a function, got INTEGER"},
+		{Input: `return map([1], missing);`, Result: "error: map expects a function, got NULL"},
+		{Input: `return filter([1], "missing");`, Result: "error: filter expects a function, but the function missing does not exist"},
+		{Input: `return reduce(3, sum, 0);`, Result: "error: reduce expects an array or a string, got INTEGER"},
+	}
+
+	for _, tst := range tests {
+		for _, flags := range [][]byte{{}, {NoOptimize}} {
+
+			obj := New(functions + tst.Input)
+
+			p := obj.Prepare(flags)
+			if p != nil {
+				t.Fatalf("Failed to compile %s: %s", tst.Input, p.Error())
+			}
+
+			ret, err := obj.Execute(nil)
+			if err != nil {
+				t.Fatalf("Found unexpected error running script '%s': %s", tst.Input, err)
+			}
+			if ret.Inspect() != tst.Result {
+				t.Fatalf("Found unexpected result running script '%s': got %s, expected %s", tst.Input, ret.Inspect(), tst.Result)
+			}
+		}
+	}
+
+	// Errors within the function abort the script, and are reported
+	// with the position of the function.
+	obj := New(`function bad(x) {
+  return x * "steve";
+}
+return map([1], bad);`)
+	if err := obj.Prepare(); err != nil {
+		t.Fatalf("Failed to compile: %s", err)
+	}
+	_, err := obj.Execute(nil)
+	if err == nil || err.Error() != "2:12: type mismatch: INTEGER * STRING" {
+		t.Fatalf("Unexpected error calling a failing function: %v", err)
+	}
+
+	// As does calling a function with the wrong number of arguments.
+	obj = New(functions + `return map([1], sum);`)
+	if err := obj.Prepare(); err != nil {
+		t.Fatalf("Failed to compile: %s", err)
+	}
+	_, err = obj.Execute(nil)
+	if err == nil || !strings.Contains(err.Error(), "the function sum expects 2 argument(s), got 1") {
+		t.Fatalf("Unexpected error calling a function with the wrong arguments: %v", err)
+	}
+}
+
+// TestInputObject tests that the whole input is available to scripts.
+func TestInputObject(t *testing.T) {
+
+	type Event struct {
+		Name  string
+		Count int
+	}
+
+	event := &Event{Name: "login", Count: 3}
+
+	type Test struct {
+		Object interface{}
+		Input  string
+		Result string
+	}
+
+	tests := []Test{
+		{Object: event, Input: `return type(self);`, Result: "native"},
+		{Object: event, Input: `return self.Name;`, Result: "login"},
+		{Object: event, Input: `return self["Count"] + 1;`, Result: "4"},
+		{Object: event, Input: `return self.Missing;`, Result: "null"},
+		{Object: event, Input: `return $self.Name;`, Result: "login"},
+		{Object: event, Input: `self = 3; return self;`, Result: "3"},
+		{Object: map[string]interface{}{"name": "steve"}, Input: `return self;`, Result: "{name: steve}"},
+		{Object: []byte(`{ "a": [1, 2] }`), Input: `return self.a;`, Result: "[1, 2]"},
+		{Object: nil, Input: `return self;`, Result: "null"},
+	}
+
+	for _, tst := range tests {
+		for _, flags := range [][]byte{{}, {NoOptimize}} {
+
+			obj := New(tst.Input)
+
+			p := obj.Prepare(flags)
+			if p != nil {
+				t.Fatalf("Failed to compile %s: %s", tst.Input, p.Error())
+			}
+
+			ret, err := obj.Execute(tst.Object)
+			if err != nil {
+				t.Fatalf("Found unexpected error running script '%s': %s", tst.Input, err)
+			}
+			if ret.Inspect() != tst.Result {
+				t.Fatalf("Found unexpected result running script '%s': got %s, expected %s", tst.Input, ret.Inspect(), tst.Result)
+			}
+		}
+	}
+
+	// The original value is passed to host functions.
+	var seen interface{}
+
+	obj := New(`log(self); return true;`)
+	obj.AddFunction("log", func(args []object.Object) object.Object {
+		seen = args[0].(*object.Native).Value
+		return &object.Null{}
+	})
+	if err := obj.Prepare(); err != nil {
+		t.Fatalf("Failed to compile: %s", err)
+	}
+	if _, err := obj.Run(event); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if seen != event {
+		t.Fatalf("Host function received %v rather than the input", seen)
+	}
+
+	// The name may be changed, which leaves `self` as a field.
+	obj = New(`return record.Name + " " + self;`)
+	obj.SetInputName("record")
+	if err := obj.Prepare(); err != nil {
+		t.Fatalf("Failed to compile: %s", err)
+	}
+	ret, err := obj.Execute(map[string]interface{}{"Name": "steve", "self": "kemp"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if ret.Inspect() != "steve kemp" {
+		t.Fatalf("Unexpected result: %s", ret.Inspect())
+	}
+}
+
+// TestMultipleAssignment tests assigning an array to several variables.
+func TestMultipleAssignment(t *testing.T) {
+
+	type Test struct {
+		Input  string
+		Result string
+	}
+
+	tests := []Test{
+		{Input: `a, b = [1, 2]; return a + b;`, Result: "3"},
+		{Input: `a, b = split("key=value", "="); return b + a;`, Result: "valuekey"},
+		{Input: `a, b, c = [1, 2]; return c;`, Result: "null"},
+		{Input: `a, b = [1, 2, 3]; return b;`, Result: "2"},
+		{Input: `a = 1; b = 2; a, b = [b, a]; return [a, b];`, Result: "[2, 1]"},
+		{Input: `function pair() { return [true, "ok"]; } ok, msg = pair(); return msg;`, Result: "ok"},
+		{Input: `x, y = [1, 2]
+return x * y;`, Result: "2"},
+	}
+
+	for _, tst := range tests {
+		for _, flags := range [][]byte{{}, {NoOptimize}} {
+
+			obj := New(tst.Input)
+
+			p := obj.Prepare(flags)
+			if p != nil {
+				t.Fatalf("Failed to compile %s: %s", tst.Input, p.Error())
+			}
+
+			ret, err := obj.Execute(nil)
+			if err != nil {
+				t.Fatalf("Found unexpected error running script '%s': %s", tst.Input, err)
+			}
+			if ret.Inspect() != tst.Result {
+				t.Fatalf("Found unexpected result running script '%s': got %s, expected %s", tst.Input, ret.Inspect(), tst.Result)
+			}
+		}
+	}
+
+	// Only arrays may be unpacked.
+	obj := New(`a, b = "steve"; return a;`)
+	if err := obj.Prepare(); err != nil {
+		t.Fatalf("Failed to compile: %s", err)
+	}
+	_, err := obj.Execute(nil)
+	if err == nil || !strings.Contains(err.Error(), "cannot assign STRING to 2 variables") {
+		t.Fatalf("Expected an error unpacking a string, got %v", err)
+	}
+
+	// The targets must be plain variables.
+	for _, input := range []string{`a, 3 = [1, 2];`, `a, b;`} {
+		obj = New(input)
+		if err := obj.Prepare(); err == nil {
+			t.Fatalf("Expected an error compiling '%s'", input)
+		}
+	}
+}
+
+// TestFloatModuloPower tests the modulo and power operators with
+// floating-point numbers.
+func TestFloatModuloPower(t *testing.T) {
+
+	type Test struct {
+		Input  string
+		Result string
+	}
+
+	tests := []Test{
+		{Input: `return 5.5 % 2.0;`, Result: "1.5"},
+		{Input: `return 5.5 % 2;`, Result: "1.5"},
+		{Input: `return 7 % 2.5;`, Result: "2"},
+		{Input: `return -5.5 % 2.0;`, Result: "-1.5"},
+		{Input: `return 5.5 % 0.5;`, Result: "0"},
+		{Input: `return 2.0 ** 0.5;`, Result: "1.4142135623730951"},
+		{Input: `return 2 ** 0.5;`, Result: "1.4142135623730951"},
+		{Input: `return 1.5 ** 2;`, Result: "2.25"},
+		{Input: `return type(7 % 2.5);`, Result: "float"},
+	}
+
+	for _, tst := range tests {
+		for _, flags := range [][]byte{{}, {NoOptimize}} {
+
+			obj := New(tst.Input)
+
+			p := obj.Prepare(flags)
+			if p != nil {
+				t.Fatalf("Failed to compile %s: %s", tst.Input, p.Error())
+			}
+
+			ret, err := obj.Execute(nil)
+			if err != nil {
+				t.Fatalf("Found unexpected error running script '%s': %s", tst.Input, err)
+			}
+			if ret.Inspect() != tst.Result {
+				t.Fatalf("Found unexpected result running script '%s': got %s, expected %s", tst.Input, ret.Inspect(), tst.Result)
+			}
+		}
+	}
+
+	// Modulo by zero is an error, for integers too.
+	for _, input := range []string{`return 5.5 % 0.0;`, `return 5.5 % 0;`, `return 5 % 0.0;`, `return 10 % 0;`, `x = 0; return 10 % x;`} {
+		for _, flags := range [][]byte{{}, {NoOptimize}} {
+			obj := New(input)
+			if err := obj.Prepare(flags); err != nil {
+				t.Fatalf("Failed to compile %s: %s", input, err)
+			}
+			_, err := obj.Execute(nil)
+			if err == nil || !strings.Contains(err.Error(), "attempted modulo by zero") {
+				t.Fatalf("Expected a modulo by zero error running '%s', got %v", input, err)
+			}
+
+			var re *RuntimeError
+			if !errors.As(err, &re) || re.Code != ErrDivByZero {
+				t.Fatalf("Unexpected error running '%s': %v", input, err)
+			}
+		}
+	}
+}
+
+// TestFloatFormat tests how floating-point numbers are converted to
+// strings.
+func TestFloatFormat(t *testing.T) {
+
+	type Test struct {
+		Input  string
+		Result string
+	}
+
+	tests := []Test{
+		{Input: `return 3.0;`, Result: "3"},
+		{Input: `return 0.5;`, Result: "0.5"},
+		{Input: `return "x=" + 0.5;`, Result: "x=0.5"},
+		{Input: `return "${1.0 + 2}";`, Result: "3"},
+		{Input: `return 0.1 + 0.2;`, Result: "0.30000000000000004"},
+		{Input: `return round(0.1 + 0.2, 2);`, Result: "0.3"},
+		{Input: `return "total: " + round(10 / 3.0, 2);`, Result: "total: 3.33"},
+		{Input: `a = 3; b = 3.0; return type(b);`, Result: "float"},
+	}
+
+	for _, tst := range tests {
+		for _, flags := range [][]byte{{}, {NoOptimize}} {
+
+			obj := New(tst.Input)
+
+			p := obj.Prepare(flags)
+			if p != nil {
+				t.Fatalf("Failed to compile %s: %s", tst.Input, p.Error())
+			}
+
+			ret, err := obj.Execute(nil)
+			if err != nil {
+				t.Fatalf("Found unexpected error running script '%s': %s", tst.Input, err)
+			}
+			if ret.Inspect() != tst.Result {
+				t.Fatalf("Found unexpected result running script '%s': got %s, expected %s", tst.Input, ret.Inspect(), tst.Result)
+			}
+		}
+	}
+}
+
+// TestMaxStackDepth tests that runaway recursion is aborted.
+func TestMaxStackDepth(t *testing.T) {
+
+	// Infinite recursion results in an error, directly or via
+	// a built-in function which calls back into the script.
+	for _, input := range []string{
+		`function f(n) { return f(n + 1); } return f(0);`,
+		`function f(n) { return map([n], f); } return f(1);`,
+		`function f(n) { return 1 + f(n); } return f(1);`,
+	} {
+		obj := New(input)
+		if err := obj.Prepare(); err != nil {
+			t.Fatalf("Failed to compile %s: %s", input, err)
+		}
+		_, err := obj.Execute(nil)
+		if err == nil || !strings.Contains(err.Error(), "stack overflow") {
+			t.Fatalf("Expected a stack overflow running '%s', got %v", input, err)
+		}
+	}
+
+	// Recursion within the limit is fine, and the limit may be
+	// changed after Prepare.
+	obj := New(`function f(n) { if ( n == 0 ) { return 0; } return 1 + f(n - 1); } return f(Depth);`)
+	if err := obj.Prepare(); err != nil {
+		t.Fatalf("Failed to compile: %s", err)
+	}
+
+	ret, err := obj.Execute(map[string]int{"Depth": 500})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if ret.Inspect() != "500" {
+		t.Fatalf("Unexpected result: %s", ret.Inspect())
+	}
+
+	obj.SetMaxStackDepth(10)
+	_, err = obj.Execute(map[string]int{"Depth": 20})
+	if err == nil || !strings.Contains(err.Error(), "stack overflow") {
+		t.Fatalf("Expected a stack overflow, got %v", err)
+	}
+
+	// The limit applies to each run.
+	ret, err = obj.Execute(map[string]int{"Depth": 5})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if ret.Inspect() != "5" {
+		t.Fatalf("Unexpected result: %s", ret.Inspect())
+	}
+
+	obj.SetMaxStackDepth(0)
+	ret, err = obj.Execute(map[string]int{"Depth": 20000})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if ret.Inspect() != "20000" {
+		t.Fatalf("Unexpected result: %s", ret.Inspect())
+	}
+
+	// Values of statements are discarded, so loops don't grow
+	// the stack.
+	obj = New(`i = 0; while ( i < 20000 ) { len("steve"); i = i + 1; } return i;`)
+	if err := obj.Prepare(); err != nil {
+		t.Fatalf("Failed to compile: %s", err)
+	}
+	ret, err = obj.Execute(nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if ret.Inspect() != "20000" {
+		t.Fatalf("Unexpected result: %s", ret.Inspect())
+	}
+}
+
+// TestConstants tests that constants are deduplicated, without merging
+// distinct values.
+func TestConstants(t *testing.T) {
+
+	e := New("")
+
+	a := e.addConstant(&object.String{Value: "steve"})
+	b := e.addConstant(&object.String{Value: "steve"})
+	if a != b {
+		t.Fatalf("identical strings were not merged")
+	}
+	if e.addConstant(&object.Integer{Value: 3}) == e.addConstant(&object.Float{Value: 3}) {
+		t.Fatalf("an integer and a float were merged")
+	}
+	if e.addConstant(&object.Float{Value: 0}) == e.addConstant(&object.Float{Value: math.Copysign(0, -1)}) {
+		t.Fatalf("zero and negative zero were merged")
+	}
+	nan := math.Float64frombits(0x7ff8000000000002)
+	if e.addConstant(&object.Float{Value: math.NaN()}) == e.addConstant(&object.Float{Value: nan}) {
+		t.Fatalf("distinct NaN values were merged")
+	}
+	if e.addConstant(&object.Float{Value: 0.5}) != e.addConstant(&object.Float{Value: 0.5}) {
+		t.Fatalf("identical floats were not merged")
+	}
+	if len(e.constants) != 8 {
+		t.Fatalf("unexpected number of constants: %d", len(e.constants))
+	}
+}
+
+// TestArity tests that calls with the wrong number of arguments are
+// reported by Prepare.
+func TestArity(t *testing.T) {
+
+	type Test struct {
+		Input string
+		Error string
+	}
+
+	tests := []Test{
+		{Input: `return trim();`, Error: "1:8: the function trim expects 1 argument(s), got 0"},
+		{Input: `return len(1, 2, 3);`, Error: "the function len expects 1 argument(s), got 3"},
+		{Input: `return now(1);`, Error: "the function now expects 0 argument(s), got 1"},
+		{Input: `return round(1, 2, 3);`, Error: "the function round expects 1 to 2 arguments, got 3"},
+		{Input: `return sprintf();`, Error: "the function sprintf expects at least 1 argument(s), got 0"},
+		{Input: `return host();`, Error: "the function host expects 1 to 3 arguments, got 0"},
+		{Input: `return host(1, 2, 3, 4);`, Error: "the function host expects 1 to 3 arguments, got 4"},
+		{Input: `if ( true ) { return f(1); } function f(a, b) { return a; }`, Error: "the function f expects 2 argument(s), got 1"},
+
+		// Valid calls.
+		{Input: `print(); print(1, 2, 3); return round(1.5, 1);`},
+		{Input: `return host(1) + host(1, 2, 3);`},
+		{Input: `return missing(1, 2, 3);`},
+		{Input: `function len(a, b) { return a + b; } return len(1, 2);`},
+	}
+
+	for _, tst := range tests {
+
+		obj := New(tst.Input)
+		obj.AddFunctionArity("host", func(args []object.Object) object.Object {
+			return &object.Integer{Value: int64(len(args))}
+		}, 1, 3)
+
+		err := obj.Prepare()
+		if tst.Error == "" {
+			if err != nil {
+				t.Fatalf("Failed to compile %s: %s", tst.Input, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tst.Error) {
+			t.Fatalf("Expected error '%s' compiling '%s', got %v", tst.Error, tst.Input, err)
+		}
+	}
+
+	// Functions added without an arity are checked at run-time.
+	obj := New(`return host();`)
+	obj.AddFunctionArity("host", func(args []object.Object) object.Object { return &object.Null{} }, 1, 1)
+	obj.AddFunction("host", func(args []object.Object) object.Object { return &object.Boolean{Value: true} })
+	if err := obj.Prepare(); err != nil {
+		t.Fatalf("Failed to compile: %s", err)
+	}
+	ret, err := obj.Execute(nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if ret.Inspect() != "true" {
+		t.Fatalf("Unexpected result: %s", ret.Inspect())
+	}
+}
+
+// TestRuntimeErrors tests that run-time errors can be identified by
+// their code.
+func TestRuntimeErrors(t *testing.T) {
+
+	failure := fmt.Errorf("the database is down")
+
+	type Test struct {
+		Input string
+		Code  ErrorCode
+	}
+
+	tests := []Test{
+		{Input: `return 1 / 0;`, Code: ErrDivByZero},
+		{Input: `return 1.5 % 0;`, Code: ErrDivByZero},
+		{Input: `return "steve" * 3;`, Code: ErrTypeMismatch},
+		{Input: `return -"steve";`, Code: ErrTypeMismatch},
+		{Input: `return 9223372036854775807 + 1;`, Code: ErrOverflow},
+		{Input: `return 3[0];`, Code: ErrIndex},
+		{Input: `return {}[[1]];`, Code: ErrIndex},
+		{Input: `return missing();`, Code: ErrUnknownFunction},
+		{Input: `function f(a, b) { return a; } return map([1], f);`, Code: ErrArgumentCount},
+		{Input: `return fail();`, Code: ErrFunctionFailed},
+		{Input: `return explode();`, Code: ErrFunctionFailed},
+		{Input: `function f() { return f(); } return f();`, Code: ErrStackOverflow},
+		{Input: `x = 1;`, Code: ErrMissingReturn},
+	}
+
+	for _, tst := range tests {
+		for _, flags := range [][]byte{{}, {NoOptimize}} {
+
+			obj := New(tst.Input)
+			obj.AddFunction("fail", func(args []object.Object) (object.Object, error) {
+				return nil, failure
+			})
+			obj.AddFunction("explode", func(args []object.Object) object.Object {
+				panic("boom")
+			})
+
+			p := obj.Prepare(flags)
+			if p != nil {
+				t.Fatalf("Failed to compile %s: %s", tst.Input, p.Error())
+			}
+
+			_, err := obj.Execute(nil)
+
+			var re *RuntimeError
+			if !errors.As(err, &re) {
+				t.Fatalf("Expected a RuntimeError running '%s', got %v", tst.Input, err)
+			}
+			if re.Code != tst.Code {
+				t.Fatalf("Unexpected code running '%s': got %s, expected %s", tst.Input, re.Code, tst.Code)
+			}
+			if re.Position.Line != 1 && tst.Code != ErrMissingReturn {
+				t.Fatalf("Unexpected position running '%s': %v", tst.Input, re.Position)
+			}
+		}
+	}
+
+	// The error returned by a function is available.
+	obj := New(`return fail();`)
+	obj.AddFunction("fail", func(args []object.Object) (object.Object, error) {
+		return nil, failure
+	})
+	if err := obj.Prepare(); err != nil {
+		t.Fatalf("Failed to compile: %s", err)
+	}
+	_, err := obj.Execute(nil)
+	if !errors.Is(err, failure) {
+		t.Fatalf("The cause of the error was lost: %v", err)
+	}
+	if err.Error() != "1:12: the database is down" {
+		t.Fatalf("Unexpected error message: %s", err)
+	}
+
+	// The message and position are unchanged by a failure within a
+	// function called via a built-in.
+	obj = New(`function bad(x) {
+  return x / 0;
+}
+return map([1], bad);`)
+	if err = obj.Prepare(); err != nil {
+		t.Fatalf("Failed to compile: %s", err)
+	}
+	_, err = obj.Execute(nil)
+
+	var re *RuntimeError
+	if !errors.As(err, &re) || re.Code != ErrDivByZero {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if re.Position.Line != 2 || !strings.HasPrefix(err.Error(), "2:") {
+		t.Fatalf("Unexpected position: %s", err)
+	}
+
+	// Cancellation, and the instruction-limit, are reported as before.
+	obj = New(`while ( true ) { } return true;`)
+	obj.SetMaxInstructions(100)
+	if err = obj.Prepare(); err != nil {
+		t.Fatalf("Failed to compile: %s", err)
+	}
+	if _, err = obj.Execute(nil); err != ErrInstructionLimit {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
+
+// TestExistsDefault tests the `exists` and `default` functions, which
+// distinguish missing fields from those which are present but null.
+func TestExistsDefault(t *testing.T) {
+
+	type Test struct {
+		Object interface{}
+		Input  string
+		Result string
+	}
+
+	record := map[string]interface{}{"name": "steve", "email": nil}
+
+	tests := []Test{
+		{Object: record, Input: `return exists("name");`, Result: "true"},
+		{Object: record, Input: `return exists("email");`, Result: "true"},
+		{Object: record, Input: `return exists("phone");`, Result: "false"},
+		{Object: record, Input: `return type(email) == type(phone);`, Result: "true"},
+		{Object: record, Input: `return default(email, "unknown");`, Result: "unknown"},
+		{Object: record, Input: `return default(name, "unknown");`, Result: "steve"},
+		{Object: record, Input: `return default(false, true);`, Result: "false"},
+		{Object: []byte(`{ "a": null }`), Input: `return exists("a") && ! exists("b");`, Result: "true"},
+		{Object: nil, Input: `return exists("name");`, Result: "false"},
+
+		// Variables aren't fields of the input.
+		{Object: record, Input: `phone = 3; return exists("phone");`, Result: "false"},
+	}
+
+	for _, tst := range tests {
+		for _, flags := range [][]byte{{}, {NoOptimize}} {
+
+			obj := New(tst.Input)
+
+			p := obj.Prepare(flags)
+			if p != nil {
+				t.Fatalf("Failed to compile %s: %s", tst.Input, p.Error())
+			}
+
+			ret, err := obj.Execute(tst.Object)
+			if err != nil {
+				t.Fatalf("Found unexpected error running script '%s': %s", tst.Input, err)
+			}
+			if ret.Inspect() != tst.Result {
+				t.Fatalf("Found unexpected result running script '%s': got %s, expected %s", tst.Input, ret.Inspect(), tst.Result)
+			}
+		}
+	}
+
+	// Fields found by a resolver exist.
+	obj := New(`return exists("Virtual") && ! exists("Missing");`)
+	obj.SetFieldResolver(func(o interface{}, field string) (object.Object, bool) {
+		return nil, field == "Virtual"
+	})
+	if err := obj.Prepare(); err != nil {
+		t.Fatalf("Failed to compile: %s", err)
+	}
+	ret, err := obj.Run(nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if !ret {
+		t.Fatalf("Found unexpected result running script")
+	}
+}
+
+// TestAST tests that the syntax tree of a script may be walked, to find
+// the fields and functions it uses.
+func TestAST(t *testing.T) {
+
+	obj := New(`
+function check(x) {
+  return x > Limit;
+}
+if ( Name == "steve" ) {
+  while ( Count < 3 ) {
+    if ( check(Count) ) { return true; } else { Count = upper(Title); }
+  }
+}
+switch ( Kind ) {
+  case "a" { return [ Age ][0]; }
+  default { return { "k": len(Group) }; }
+}
+return Admin ? "${Role}" : false;
+`)
+
+	tree, err := obj.AST()
+	if err != nil {
+		t.Fatalf("Failed to parse: %s", err)
+	}
+
+	var names, calls []string
+	ast.Walk(tree, func(node ast.Node) bool {
+		switch n := node.(type) {
+		case *ast.Identifier:
+			names = append(names, n.Value)
+		case *ast.CallExpression:
+			calls = append(calls, n.Function.String())
+		}
+		return true
+	})
+
+	found := strings.Join(names, ",")
+	expected := "check,x,x,Limit,Name,Count,check,Count,Count,upper,Title,Kind,Age,len,Group,Admin,Role"
+	if found != expected {
+		t.Fatalf("Unexpected identifiers: got %s, expected %s", found, expected)
+	}
+	found = strings.Join(calls, ",")
+	if found != "check,upper,len" {
+		t.Fatalf("Unexpected calls: %s", found)
+	}
+
+	// Returning false skips the children of a node.
+	count := 0
+	ast.Walk(tree, func(node ast.Node) bool {
+		count++
+		_, ok := node.(*ast.Program)
+		return ok
+	})
+	if count != 5 {
+		t.Fatalf("Unexpected number of nodes visited: %d", count)
+	}
+
+	// Parse errors are reported.
+	if _, err = New(`return (;`).AST(); err == nil {
+		t.Fatalf("Expected an error parsing a bogus script")
+	}
+}
+
+// TestReferencedFields tests that the fields a script reads may be found.
+func TestReferencedFields(t *testing.T) {
+
+	type Test struct {
+		Input  string
+		Result string
+	}
+
+	tests := []Test{
+		{Input: `return Name == "steve" && $Age > 3;`, Result: "Age,Name"},
+		{Input: `count = 3; return count > Limit;`, Result: "Limit"},
+		{Input: `a, b = Pair; return a + b;`, Result: "Pair"},
+		{Input: `function f(x) { y = x * 2; return y + Scale; } return f(Value);`, Result: "Scale,Value"},
+		{Input: `function f(x) { return x; } return map(Items, f);`, Result: "Items"},
+		{Input: `return self.Name + Host;`, Result: "Name"},
+		{Input: `return self["Name"] + self.Age;`, Result: "Age,Name"},
+		{Input: `return len(keys(self)) > Count;`, Result: "Count,self"},
+		{Input: `return exists("Foo") && exists(Bar);`, Result: "Bar,Foo"},
+		{Input: `Foo = 1; return exists("Foo");`, Result: "Foo"},
+		{Input: `return upper(Title);`, Result: "Title"},
+		{Input: `unused = Source; return true;`, Result: "Source"},
+		{Input: `y = q; q = 1; return y;`, Result: "q"},
+		{Input: `total += Amount; return total;`, Result: "Amount,total"},
+
+		// Variables assigned within a block are discarded
+		// when it ends.
+		{Input: `if (true) { q = 1; } return q;`, Result: "q"},
+		{Input: `if (true) { q = 1; return q; } return false;`, Result: ""},
+		{Input: `q = 0; if (true) { q = 1; } return q;`, Result: ""},
+		{Input: `i = 0; while (i < 3) { if (i > 0) { s = Seen; } i++; } return s;`, Result: "Seen,s"},
+		{Input: `function f() { return q; } if (true) { q = 1; return f(); } return 0;`, Result: "q"},
+		{Input: `function f() { return q; } q = 1; return f();`, Result: ""},
+
+		// The error is only visible within the catch-block.
+		{Input: `try { throw Value; } catch (err) { return err; }`, Result: "Value"},
+		{Input: `try { throw 1; } catch (err) { print(err); } return err;`, Result: "err"},
+	}
+
+	for _, tst := range tests {
+		for _, flags := range [][]byte{{BlockScope}, {BlockScope, NoOptimize}} {
+
+			obj := New(tst.Input)
+			obj.SetVariable("Host", &object.String{Value: "example"})
+
+			p := obj.Prepare(flags)
+			if p != nil {
+				t.Fatalf("Failed to compile %s: %s", tst.Input, p.Error())
+			}
+
+			found := strings.Join(obj.ReferencedFields(), ",")
+			if found != tst.Result {
+				t.Fatalf("Found unexpected fields for script '%s': got %s, expected %s", tst.Input, found, tst.Result)
+			}
+		}
+	}
+
+	// Without block-scoping variables assigned within blocks are
+	// visible after them, as is the error of a catch-block.
+	defaults := []Test{
+		{Input: `if (true) { q = 1; } return q;`, Result: ""},
+		{Input: `try { throw 1; } catch (err) { print(err); } return err;`, Result: ""},
+		{Input: `try { throw Value; } catch (err) { return err; }`, Result: "Value"},
+	}
+	for _, tst := range defaults {
+		obj := New(tst.Input)
+		if err := obj.Prepare(); err != nil {
+			t.Fatalf("Failed to compile %s: %s", tst.Input, err)
+		}
+
+		found := strings.Join(obj.ReferencedFields(), ",")
+		if found != tst.Result {
+			t.Fatalf("Found unexpected fields for script '%s': got %s, expected %s", tst.Input, found, tst.Result)
+		}
+	}
+}
+
+// TestElseIf tests chains of `else if` clauses.
+func TestElseIf(t *testing.T) {
+
+	src := `
+if ( x == 1 ) {
+  return "one";
+} else if ( x == 2 ) {
+  return "two";
+} else if ( x == 3 ) {
+  return "three";
+} else {
+  return "many";
+}
+`
+	type Test struct {
+		Value  int64
+		Result string
+	}
+
+	tests := []Test{
+		{Value: 1, Result: "one"},
+		{Value: 2, Result: "two"},
+		{Value: 3, Result: "three"},
+		{Value: 4, Result: "many"},
+	}
+
+	for _, tst := range tests {
+		for _, flags := range [][]byte{{}, {NoOptimize}} {
+
+			obj := New(src)
+			obj.SetVariable("x", &object.Integer{Value: tst.Value})
+
+			p := obj.Prepare(flags)
+			if p != nil {
+				t.Fatalf("Failed to compile: %s", p.Error())
+			}
+
+			ret, err := obj.Execute(nil)
+			if err != nil {
+				t.Fatalf("Found unexpected error running script with x=%d: %s", tst.Value, err)
+			}
+			if ret.Inspect() != tst.Result {
+				t.Fatalf("Found unexpected result running script with x=%d: got %s, expected %s", tst.Value, ret.Inspect(), tst.Result)
+			}
+		}
+	}
+
+	// Without a final else-block execution continues after the chain.
+	obj := New(`y = 0; if ( x == 1 ) { y = 1; } else if ( x == 2 ) { y = 2; } return y;`)
+	obj.SetVariable("x", &object.Integer{Value: 3})
+	if err := obj.Prepare(); err != nil {
+		t.Fatalf("Failed to compile: %s", err)
+	}
+	ret, err := obj.Execute(nil)
+	if err != nil || ret.Inspect() != "0" {
+		t.Fatalf("Unexpected result: %v %v", ret, err)
+	}
+
+	// A broken condition is still an error.
+	if err := New(`if ( x ) { } else if ( { }`).Prepare(); err == nil {
+		t.Fatalf("Expected an error compiling a broken else-if")
+	}
+}
+
+// TestBlockScope tests that variables first assigned within a block are
+// only visible within that block, if that has been requested.
+func TestBlockScope(t *testing.T) {
+
+	type Test struct {
+		Input  string
+		Result string
+	}
+
+	tests := []Test{
+		{Input: `if ( true ) { x = 1; } return x;`, Result: "null"},
+		{Input: `if ( true ) { x = 1; return x; } return false;`, Result: "1"},
+		{Input: `x = 1; if ( true ) { x = 2; } return x;`, Result: "2"},
+		{Input: `if ( true ) { x = 1; if ( true ) { x = x + 1; y = 3; } return [ x, y ]; } return false;`, Result: "[2, null]"},
+		{Input: `if ( false ) { } else { x = 1; } return x;`, Result: "null"},
+		{Input: `i = 0; s = 0; while ( i < 3 ) { t = i * 2; s = s + t; i = i + 1; } return [ s, t ];`, Result: "[6, null]"},
+		{Input: `i = 0; while ( i < 3 ) { i = i + 1; if ( seen ) { return "seen"; } seen = true; } return seen;`, Result: "null"},
+		{Input: `switch ( 1 ) { case 1 { z = 1; } } return z;`, Result: "null"},
+		{Input: `function f() { if ( true ) { y = 3; } return y; } return f();`, Result: "null"},
+		{Input: `function f() { y = 1; if ( true ) { y = 2; } return y; } return f();`, Result: "2"},
+		{Input: `if ( true ) { a, b = [ 1, 2 ]; } return [ a, b ];`, Result: "[null, null]"},
+		{Input: `try { throw 1; } catch (e) { q = 5; } return [ e, q ];`, Result: "[null, null]"},
+		{Input: `e = "outer"; try { throw "inner"; } catch (e) { } return e;`, Result: "outer"},
+	}
+
+	for _, tst := range tests {
+		for _, flags := range [][]byte{{BlockScope}, {BlockScope, NoOptimize}} {
+
+			obj := New(tst.Input)
+
+			p := obj.Prepare(flags)
+			if p != nil {
+				t.Fatalf("Failed to compile %s: %s", tst.Input, p.Error())
+			}
+
+			ret, err := obj.Execute(nil)
+			if err != nil {
+				t.Fatalf("Found unexpected error running script '%s': %s", tst.Input, err)
+			}
+			if ret.Inspect() != tst.Result {
+				t.Fatalf("Found unexpected result running script '%s': got %s, expected %s", tst.Input, ret.Inspect(), tst.Result)
+			}
+		}
+	}
+
+	// Leaving a loop, via `break` or `continue`, ends the scopes of
+	// the blocks within it - so later variables are global.
+	obj := New(`
+i = 0;
+n = 0;
+while ( i < 5 ) {
+  i = i + 1;
+  if ( i % 2 == 0 ) { even = true; continue; }
+  if ( i == 5 ) { last = true; break; }
+  n = n + 1;
+}
+after = n;
+return after;
+`)
+	if err := obj.Prepare([]byte{BlockScope}); err != nil {
+		t.Fatalf("Failed to compile: %s", err)
+	}
+	ret, err := obj.Execute(nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if ret.Inspect() != "2" {
+		t.Fatalf("Unexpected result: %s", ret.Inspect())
+	}
+	if obj.GetVariable("after").Inspect() != "2" {
+		t.Fatalf("The variable after the loop wasn't global")
+	}
+	if obj.GetVariable("even").Type() != object.NULL {
+		t.Fatalf("A block-variable was global")
+	}
+
+	// By default there is no block-scoping, so variables assigned
+	// within blocks are visible after them.
+	defaults := []Test{
+		{Input: `if ( true ) { x = 1; } return x;`, Result: "1"},
+		{Input: `c = false; if ( c ) { r = 1; } else { r = 2; } return r;`, Result: "2"},
+		{Input: `i = 0; while ( i < 3 ) { t = i * 2; i = i + 1; } return t;`, Result: "4"},
+		{Input: `function f() { if ( true ) { y = 3; } return y; } return f();`, Result: "3"},
+		{Input: `try { throw 1; } catch (e) { q = 5; } return [ e, q ];`, Result: "[1, 5]"},
+	}
+	for _, tst := range defaults {
+		for _, flags := range [][]byte{{}, {NoOptimize}} {
+
+			obj := New(tst.Input)
+			if err := obj.Prepare(flags); err != nil {
+				t.Fatalf("Failed to compile %s: %s", tst.Input, err)
+			}
+
+			ret, err := obj.Execute(nil)
+			if err != nil {
+				t.Fatalf("Found unexpected error running script '%s': %s", tst.Input, err)
+			}
+			if ret.Inspect() != tst.Result {
+				t.Fatalf("Found unexpected result running script '%s': got %s, expected %s", tst.Input, ret.Inspect(), tst.Result)
+			}
+		}
+	}
+
+	// A block which fails to compile mustn't leave its scope open.
+	obj = New(`if ( true ) { x = 1; break; } while ( true ) { y = 2; continue; }`)
+	if err := obj.Prepare([]byte{BlockScope}); err == nil || !strings.Contains(err.Error(), "break") {
+		t.Fatalf("Expected an error compiling, got %v", err)
+	}
+	if obj.scopes != 0 {
+		t.Fatalf("The scope depth wasn't restored: %d", obj.scopes)
+	}
+}
+
+// TestCompoundAssignment tests `+=`, and friends, as well as `++` and `--`.
+func TestCompoundAssignment(t *testing.T) {
+
+	type Test struct {
+		Input  string
+		Result string
+	}
+
+	tests := []Test{
+		{Input: `a = 3; a += 2; return a;`, Result: "5"},
+		{Input: `a = 3; a -= 2; return a;`, Result: "1"},
+		{Input: `a = 3; a *= 2 + 1; return a;`, Result: "9"},
+		{Input: `a = 9; a /= 2; return a;`, Result: "4"},
+		{Input: `a = 9; a %= 4; return a;`, Result: "1"},
+		{Input: `a = 1.5; a += 1; return a;`, Result: "2.5"},
+		{Input: `s = "steve"; s += " kemp"; return s;`, Result: "steve kemp"},
+		{Input: `a = 3; a++; a++; a--; return a;`, Result: "4"},
+		{Input: `i = 0; t = 0; while ( i < 4 ) { t += i; i++; } return t;`, Result: "6"},
+		{Input: `function f(x) { x *= 2; return x; } return f(21);`, Result: "42"},
+		{Input: `return 3 - -1;`, Result: "4"},
+		{Input: `a = 3; return a--3;`, Result: "6"},
+		{Input: `a = 3; b = 1; return a-- b;`, Result: "4"},
+		{Input: `a = 3; a-- // comment
+return a;`, Result: "2"},
+	}
+
+	for _, tst := range tests {
+		for _, flags := range [][]byte{{}, {NoOptimize}} {
+
+			obj := New(tst.Input)
+
+			p := obj.Prepare(flags)
+			if p != nil {
+				t.Fatalf("Failed to compile %s: %s", tst.Input, p.Error())
+			}
+
+			ret, err := obj.Execute(nil)
+			if err != nil {
+				t.Fatalf("Found unexpected error running script '%s': %s", tst.Input, err)
+			}
+			if ret.Inspect() != tst.Result {
+				t.Fatalf("Found unexpected result running script '%s': got %s, expected %s", tst.Input, ret.Inspect(), tst.Result)
+			}
+		}
+	}
+
+	// Only variables may be assigned to.
+	for _, src := range []string{`3 += 1;`, `a[0] += 1;`, `a += ;`} {
+		if err := New(src).Prepare(); err == nil {
+			t.Fatalf("Expected an error compiling '%s'", src)
+		}
+	}
+
+	// Updates leave no value behind, so may only be statements.
+	//
+	// Each is reported once, and the operator isn't reported again
+	// by the expressions which enclose it.
+	statements := map[string][]string{
+		`x = 1; return x++;`:      {"1:16: ++ may only be used as a statement"},
+		`x = 1; y = x++;`:         {"1:13: ++ may only be used as a statement"},
+		`b = a++;`:                {"1:6: ++ may only be used as a statement"},
+		`x = 1; print(x++);`:      {"1:15: ++ may only be used as a statement"},
+		`x = 1; x += x--;`:        {"1:14: -- may only be used as a statement"},
+		`x = 1; return (x += 1);`: {"1:18: += may only be used as a statement"},
+		`x = 1; x++ + 1;`:         {"1:12: no prefix parse function for + found"},
+		`b = a++; c = d--;`:       {"1:6: ++ may only be used as a statement", "1:15: -- may only be used as a statement"},
+	}
+	for src, expected := range statements {
+		err := New(src).Prepare()
+		if err == nil {
+			t.Fatalf("Expected an error compiling '%s'", src)
+		}
+		if err.Error() != "\nErrors parsing script:\n"+strings.Join(expected, "\n") {
+			t.Fatalf("Unexpected error compiling '%s': got %q, expected %q", src, err, expected)
+		}
+	}
+
+	// Within a condition the update is reported first.
+	err := New(`x = 1; if (x++) { return 1; } return 2;`).Prepare()
+	if err == nil || !strings.HasPrefix(err.Error(), "\nErrors parsing script:\n1:13: ++ may only be used as a statement") {
+		t.Fatalf("Unexpected error compiling: %v", err)
+	}
+
+	// Updating an unset variable is an error, as it would be with
+	// `total = total + 1`.
+	obj := New(`total += 1; return true;`)
+	if err := obj.Prepare(); err != nil {
+		t.Fatalf("Failed to compile: %s", err)
+	}
+	_, err = obj.Execute(nil)
+	var re *RuntimeError
+	if !errors.As(err, &re) || re.Code != ErrTypeMismatch {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
+
+// TestLargeProgram tests that programs too large for the 16-bit
+// arguments of our opcodes work correctly.
+func TestLargeProgram(t *testing.T) {
+
+	// Each assignment uses a distinct constant, so that there
+	// are more than 65535 of them, and the bytecode is large
+	// enough that jumps past it need wide arguments.
+	var body strings.Builder
+	for i := 0; i < 70000; i++ {
+		fmt.Fprintf(&body, "s = \"str%d\";\n", i)
+	}
+
+	src := `
+s = "";
+i = 0;
+count = 0;
+while ( i < 2 ) {
+  if ( flag ) {
+` + body.String() + `
+    count = count + 1;
+  } else {
+    count = count + 10;
+  }
+  i = i + 1;
+}
+return [ count, s ];
+`
+
+	for _, flag := range []bool{true, false} {
+		for _, flags := range [][]byte{{}, {NoOptimize}} {
+
+			obj := New(src)
+			obj.SetVariable("flag", &object.Boolean{Value: flag})
+
+			if err := obj.Prepare(flags); err != nil {
+				t.Fatalf("Failed to compile: %s", err)
+			}
+
+			ret, err := obj.Execute(nil)
+			if err != nil {
+				t.Fatalf("Found unexpected error running script: %s", err)
+			}
+
+			expected := "[2, str69999]"
+			if !flag {
+				expected = "[20, ]"
+			}
+			if ret.Inspect() != expected {
+				t.Fatalf("Found unexpected result running script: got %s, expected %s", ret.Inspect(), expected)
+			}
+
+			// The wide opcodes are shown by the disassembler.
+			out, err := obj.Disassemble()
+			if err != nil {
+				t.Fatalf("Failed to disassemble: %s", err)
+			}
+			if !strings.Contains(out, "OpJumpIfFalseWide") || !strings.Contains(out, "OpConstantWide\t69999") {
+				t.Fatalf("Wide opcodes weren't disassembled")
+			}
+		}
+	}
+}
+
+// TestExecuteReuse tests running a script repeatedly, via Execute and
+// ExecuteInto, ensuring that no state leaks from one run to the next.
+func TestExecuteReuse(t *testing.T) {
+
+	src := `if ( exists("Name") ) { return Name + " " + 10 / Count; } return "none";`
+
+	type Test struct {
+		Input  map[string]interface{}
+		Result string
+		Error  bool
+	}
+
+	tests := []Test{
+		{Input: map[string]interface{}{"Name": "Steve", "Count": 2}, Result: "Steve 5"},
+		{Input: map[string]interface{}{"Count": 2}, Result: "none"},
+		{Input: map[string]interface{}{"Name": "Steve", "Count": 0}, Error: true},
+		{Input: map[string]interface{}{"Name": "Kemp", "Count": 5}, Result: "Kemp 2"},
+		{Input: map[string]interface{}{}, Result: "none"},
+	}
+
+	for _, flags := range [][]byte{{}, {NoOptimize}} {
+
+		obj := New(src)
+		if err := obj.Prepare(flags); err != nil {
+			t.Fatalf("Failed to compile: %s", err)
+		}
+
+		var into object.Object = &object.String{Value: "unset"}
+
+		for _, tst := range tests {
+
+			out, err := obj.Execute(tst.Input)
+
+			prev := into
+			intoErr := obj.ExecuteInto(tst.Input, &into)
+
+			if tst.Error {
+				if err == nil || intoErr == nil {
+					t.Fatalf("Expected an error running with %v", tst.Input)
+				}
+				if into != prev {
+					t.Fatalf("The result was changed by a failing run")
+				}
+				continue
+			}
+
+			if intoErr != nil {
+				t.Fatalf("Found unexpected error running with %v: %s", tst.Input, intoErr)
+			}
+			if !object.Equals(out, into) {
+				t.Fatalf("Found different results running with %v: %s and %s", tst.Input, out.Inspect(), into.Inspect())
+			}
+
+			if err != nil {
+				t.Fatalf("Found unexpected error running with %v: %s", tst.Input, err)
+			}
+			if out.Inspect() != tst.Result {
+				t.Fatalf("Found unexpected result running with %v: got %s, expected %s", tst.Input, out.Inspect(), tst.Result)
+			}
+		}
+	}
+}
+
+// TestExecuteIntoAllocs tests that ExecuteInto makes no allocations of
+// its own, and that repeated runs only allocate the values they need.
+func TestExecuteIntoAllocs(t *testing.T) {
+
+	type Input struct {
+		Count int
+		Name  string
+	}
+	in := &Input{Count: 4, Name: "Steve"}
+
+	obj := New(`if ( Count > 3 && Name == "Steve" ) { return Count * 2; } return 0;`)
+	if err := obj.Prepare(); err != nil {
+		t.Fatalf("Failed to compile: %s", err)
+	}
+
+	var out object.Object
+	execute := testing.AllocsPerRun(100, func() {
+		out, _ = obj.Execute(in)
+	})
+	into := testing.AllocsPerRun(100, func() {
+		_ = obj.ExecuteInto(in, &out)
+	})
+
+	if into > execute {
+		t.Fatalf("ExecuteInto made %v allocations, but Execute only made %v", into, execute)
+	}
+
+	// The two fields, the literal 3, the literal 2, and the result.
+	if execute > 5 {
+		t.Fatalf("Execute made %v allocations, expected no more than 5", execute)
+	}
+	if out.Inspect() != "8" {
+		t.Fatalf("Unexpected result: %s", out.Inspect())
+	}
+}
+
+// TestSelfConvertedOnce tests that the object a script is executed
+// against is only converted once per run, however often it is indexed,
+// and that it is converted afresh by the next run.
+func TestSelfConvertedOnce(t *testing.T) {
+
+	type Input struct {
+		Count int
+		Name  string
+		Tags  []string
+	}
+	in := &Input{Count: 4, Name: "Steve", Tags: []string{"a", "b"}}
+
+	once := New(`return self.Name == "Steve";`)
+	if err := once.Prepare(); err != nil {
+		t.Fatalf("Failed to compile: %s", err)
+	}
+	many := New(`return self.Name == "Steve" && self.Count == self["Count"] && self.Tags == self.Tags && self["Name"] == self.Name;`)
+	if err := many.Prepare(); err != nil {
+		t.Fatalf("Failed to compile: %s", err)
+	}
+
+	var out object.Object
+	a := testing.AllocsPerRun(100, func() {
+		out, _ = once.Execute(in)
+	})
+	b := testing.AllocsPerRun(100, func() {
+		out, _ = many.Execute(in)
+	})
+
+	// Only the literal "Count" should differ.
+	if b > a+1 {
+		t.Fatalf("indexing self eight times made %v allocations, but once made %v", b, a)
+	}
+	if out.Inspect() != "true" {
+		t.Fatalf("Unexpected result: %s", out.Inspect())
+	}
+
+	// Changes made between runs are seen.
+	in.Name = "Bob"
+	out, err := many.Execute(in)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if out.Inspect() != "false" {
+		t.Fatalf("Unexpected result after changing the input: %s", out.Inspect())
+	}
+}
+
+// TestComments tests that comments are ignored, and that an unterminated
+// block comment is reported.
+func TestComments(t *testing.T) {
+
+	type Test struct {
+		Input  string
+		Result string
+	}
+
+	tests := []Test{
+		{Input: `return 1; // the end`, Result: "1"},
+		{Input: `a = 1 /* one */ + /* two */ 2; return a;`, Result: "3"},
+		{Input: `/*
+  A header, in the style of a configuration file.
+*/
+return "/* */" + "//";`, Result: "/* *///"},
+		{Input: `return /**/ 10 / /* divide */ 5;`, Result: "2"},
+	}
+
+	for _, tst := range tests {
+		for _, flags := range [][]byte{{}, {NoOptimize}} {
+
+			obj := New(tst.Input)
+
+			err := obj.Prepare(flags)
+			if err != nil {
+				t.Fatalf("Failed to compile %s: %s", tst.Input, err)
+			}
+
+			ret, err := obj.Execute(nil)
+			if err != nil {
+				t.Fatalf("Found unexpected error running script '%s': %s", tst.Input, err)
+			}
+			if ret.Inspect() != tst.Result {
+				t.Fatalf("Found unexpected result running script '%s': got %s, expected %s", tst.Input, ret.Inspect(), tst.Result)
+			}
+		}
+	}
+
+	obj := New("return 1;\n/* this never ends\nreturn 2;")
+	err := obj.Prepare()
+	if err == nil {
+		t.Fatalf("Expected an error compiling an unterminated comment")
+	}
+	if !strings.Contains(err.Error(), "unterminated comment") {
+		t.Fatalf("Unexpected error for an unterminated comment: %s", err)
+	}
+}
+
+// TestEscapes tests escape-sequences within strings.
+func TestEscapes(t *testing.T) {
+
+	type Test struct {
+		Input  string
+		Result string
+	}
+
+	tests := []Test{
+		{Input: `return len("a\nb");`, Result: "3"},
+		{Input: `return "say \"hi\"";`, Result: `say "hi"`},
+		{Input: `return "back\\slash";`, Result: `back\slash`},
+		{Input: `return "caf\u00e9";`, Result: "café"},
+		{Input: `return "caf\u00E9" == "café";`, Result: "true"},
+		{Input: `return "tab\there";`, Result: "tab\there"},
+		{Input: `name = "x"; return "A ${name}\n";`, Result: "A x\n"},
+	}
+
+	for _, tst := range tests {
+		for _, flags := range [][]byte{{}, {NoOptimize}} {
+
+			obj := New(tst.Input)
+
+			err := obj.Prepare(flags)
+			if err != nil {
+				t.Fatalf("Failed to compile %s: %s", tst.Input, err)
+			}
+
+			ret, err := obj.Execute(nil)
+			if err != nil {
+				t.Fatalf("Found unexpected error running script '%s': %s", tst.Input, err)
+			}
+			if ret.Inspect() != tst.Result {
+				t.Fatalf("Found unexpected result running script '%s': got %s, expected %s", tst.Input, ret.Inspect(), tst.Result)
+			}
+		}
+	}
+
+	//
+	// Parse errors.
+	//
+	errs := []Test{
+		{Input: `return "\q";`, Result: `invalid escape sequence "\q"`},
+		{Input: `return "\u12";`, Result: `invalid unicode escape sequence "\u12"`},
+		{Input: `return "\u12G4";`, Result: `invalid unicode escape sequence "\u12"`},
+	}
+
+	for _, tst := range errs {
+		obj := New(tst.Input)
+
+		err := obj.Prepare()
+		if err == nil {
+			t.Fatalf("Expected an error compiling '%s', got none", tst.Input)
+		}
+		if !strings.Contains(err.Error(), tst.Result) {
+			t.Fatalf("Expected error '%s' compiling '%s', got '%s'", tst.Result, tst.Input, err)
+		}
+	}
+}
+
+// TestCallbackLimits tests that the instructions of functions invoked
+// by built-in functions, such as `map`, count towards the limit, and that
+// the context is tested while they run.
+func TestCallbackLimits(t *testing.T) {
+
+	src := `
+function count(n) { i = 0; while ( i < n ) { i++; } return i; }
+a = [ 10, 10, 10, 10, 10, 10, 10, 10, 10, 10 ];
+map(a, count);
+map(a, count);
+return map(a, count);
+`
+	obj := New(src)
+	obj.SetMaxInstructions(100)
+	if err := obj.Prepare(); err != nil {
+		t.Fatalf("Failed to compile: %s", err)
+	}
+	if _, err := obj.Execute(nil); err != ErrInstructionLimit {
+		t.Fatalf("Expected the instruction-limit error, got %v", err)
+	}
+
+	// Without a limit the script completes.
+	obj.SetMaxInstructions(0)
+	ret, err := obj.Execute(nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if ret.Inspect() != "[10, 10, 10, 10, 10, 10, 10, 10, 10, 10]" {
+		t.Fatalf("Unexpected result: %s", ret.Inspect())
+	}
+
+	// Each callback is short, but there are a great many of them.
+	obj = New(`function f(d) { if (d < 40) { map([d + 1, d + 1], f); } return d; } return map([0], f);`)
+	if err = obj.Prepare(); err != nil {
+		t.Fatalf("Failed to compile: %s", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err = obj.ExecuteContext(ctx, nil)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("Expected the deadline to be exceeded, got %v", err)
+	}
+	if time.Since(start) > 2*time.Second {
+		t.Fatalf("The script took too long to be aborted: %s", time.Since(start))
+	}
+}
+
+// TestPrepareAgain tests that a script may be changed, and prepared again,
+// keeping the functions and variables of the host application.
+func TestPrepareAgain(t *testing.T) {
+
+	obj := New(`
+function double(x) { return x * 2; }
+function greet(n) { return "bye " + n; }
+function len(x) { return 0; }
+return greet(Name) + " " + double(len("abc")) + " " + Extra;
+`)
+	obj.AddFunctionArity("greet", func(args []object.Object) object.Object {
+		return &object.String{Value: "hello " + args[0].Inspect()}
+	}, 1, 1)
+	obj.SetVariable("Extra", &object.Integer{Value: 7})
+
+	run := func(expected string) {
+		t.Helper()
+		if err := obj.Prepare(); err != nil {
+			t.Fatalf("Failed to compile: %s", err)
+		}
+		ret, err := obj.Execute(map[string]interface{}{"Name": "steve"})
+		if err != nil {
+			t.Fatalf("Found unexpected error running script: %s", err)
+		}
+		if ret.Inspect() != expected {
+			t.Fatalf("Found unexpected result running script: got %s, expected %s", ret.Inspect(), expected)
+		}
+	}
+
+	run("bye steve 0 7")
+
+	// The host's function, and the built-in, are restored, and the
+	// variable is still present.
+	obj.Script = `return greet(Name) + " " + len("abc") + " " + Extra;`
+	run("hello steve 3 7")
+
+	// The functions of the previous script are gone.
+	obj.Script = `return double(3);`
+	if err := obj.Prepare(); err != nil {
+		t.Fatalf("Failed to compile: %s", err)
+	}
+	_, err := obj.Execute(nil)
+	var re *RuntimeError
+	if !errors.As(err, &re) || re.Code != ErrUnknownFunction {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// The host's arity is restored too.
+	obj.Script = `return greet(1, 2);`
+	if err := obj.Prepare(); err == nil {
+		t.Fatalf("Expected an error calling greet with the wrong number of arguments")
+	}
+
+	// A script which fails to compile can't be executed, rather
+	// than running the previous one.
+	if _, err := obj.Execute(nil); err == nil {
+		t.Fatalf("Expected an error executing a script which failed to compile")
+	}
+
+	obj.Script = `return "again";`
+	run("again")
+}
+
+// TestTruthiness pins the truthiness of each type, which must be the same
+// for conditions, `!`, `bool()`, and the result of Run.
+func TestTruthiness(t *testing.T) {
+
+	type Test struct {
+		Value  string
+		Result bool
+	}
+
+	tests := []Test{
+		{Value: `true`, Result: true},
+		{Value: `false`, Result: false},
+		{Value: `Missing`, Result: false},
+		{Value: `0`, Result: false},
+		{Value: `1`, Result: true},
+		{Value: `-1`, Result: true},
+		{Value: `0.0`, Result: false},
+		{Value: `0.5`, Result: true},
+		{Value: `""`, Result: false},
+		{Value: `"0"`, Result: true},
+		{Value: `" "`, Result: true},
+		{Value: `[]`, Result: false},
+		{Value: `[0]`, Result: true},
+		{Value: `{}`, Result: false},
+		{Value: `{"a": 0}`, Result: true},
+		{Value: `now()`, Result: true},
+		{Value: `f`, Result: true},
+	}
+
+	for _, tst := range tests {
+
+		expected := fmt.Sprintf("%t", tst.Result)
+		inverse := fmt.Sprintf("%t", !tst.Result)
+
+		scripts := map[string]string{
+			`function f() { return 1; } return bool(%s);`:                                       expected,
+			`function f() { return 1; } return !%s;`:                                            inverse,
+			`function f() { return 1; } if ( %s ) { return true; } return false;`:               expected,
+			`function f() { return 1; } return ( %s ) ? true : false;`:                          expected,
+			`function f() { return 1; } r = false; while ( %s ) { r = true; break; } return r;`: expected,
+			`function f() { return 1; } return ( %s ) && true;`:                                 expected,
+		}
+
+		for src, result := range scripts {
+			for _, flags := range [][]byte{{}, {NoOptimize}} {
+				input := fmt.Sprintf(src, tst.Value)
+
+				obj := New(input)
+				if err := obj.Prepare(flags); err != nil {
+					t.Fatalf("Failed to compile %s: %s", input, err)
+				}
+
+				ret, err := obj.Execute(nil)
+				if err != nil {
+					t.Fatalf("Found unexpected error running script '%s': %s", input, err)
+				}
+				if ret.Inspect() != result {
+					t.Fatalf("Found unexpected result running script '%s': got %s, expected %s", input, ret.Inspect(), result)
+				}
+			}
+		}
+
+		// Run returns the truthiness of the result.
+		obj := New(`function f() { return 1; } return ` + tst.Value + `;`)
+		if err := obj.Prepare(); err != nil {
+			t.Fatalf("Failed to compile %s: %s", tst.Value, err)
+		}
+		ret, err := obj.Run(nil)
+		if err != nil {
+			t.Fatalf("Found unexpected error running %s: %s", tst.Value, err)
+		}
+		if ret != tst.Result {
+			t.Fatalf("Found unexpected truthiness for %s: got %t, expected %t", tst.Value, ret, tst.Result)
+		}
+	}
+}
+
+// TestLookupOrder tests the order in which names are resolved, where
+// variables and the fields of the input object share a name.
+func TestLookupOrder(t *testing.T) {
+
+	type Input struct {
+		Threshold int
+		Name      string
+	}
+
+	type Test struct {
+		Input  string
+		Result string
+	}
+
+	tests := []Test{
+		// Host variables shadow fields.
+		{Input: `return Threshold;`, Result: "10"},
+		{Input: `return self.Threshold;`, Result: "3"},
+		{Input: `return Name;`, Result: "field"},
+
+		// As do variables set by the script.
+		{Input: `Name = "script"; return Name + " " + self.Name;`, Result: "script field"},
+		{Input: `Threshold = 20; return Threshold;`, Result: "20"},
+
+		// Parameters shadow both, and variables set within
+		// blocks are visible after them.
+		{Input: `function f(Threshold) { return Threshold; } return f(1);`, Result: "1"},
+		{Input: `function f() { return Threshold; } return f();`, Result: "10"},
+		{Input: `if ( true ) { Name = "block"; return Name; }`, Result: "block"},
+		{Input: `if ( true ) { Name = "block"; } return Name;`, Result: "block"},
+	}
+
+	for _, tst := range tests {
+		for _, flags := range [][]byte{{}, {NoOptimize}} {
+
+			obj := New(tst.Input)
+			obj.SetVariable("Threshold", &object.Integer{Value: 10})
+
+			if err := obj.Prepare(flags); err != nil {
+				t.Fatalf("Failed to compile %s: %s", tst.Input, err)
+			}
+
+			for _, input := range []interface{}{Input{Threshold: 3, Name: "field"}, map[string]interface{}{"Threshold": 3, "Name": "field"}} {
+
+				obj.Reset()
+
+				ret, err := obj.Execute(input)
+				if err != nil {
+					t.Fatalf("Found unexpected error running script '%s': %s", tst.Input, err)
+				}
+				if ret.Inspect() != tst.Result {
+					t.Fatalf("Found unexpected result running script '%s': got %s, expected %s", tst.Input, ret.Inspect(), tst.Result)
+				}
+			}
+		}
+	}
+
+	// A field resolver doesn't change the order.
+	obj := New(`return Threshold;`)
+	obj.SetVariable("Threshold", &object.Integer{Value: 10})
+	obj.SetFieldResolver(func(obj interface{}, field string) (object.Object, bool) {
+		return &object.Integer{Value: 99}, true
+	})
+	if err := obj.Prepare(); err != nil {
+		t.Fatalf("Failed to compile: %s", err)
+	}
+	ret, err := obj.Execute(nil)
+	if err != nil || ret.Inspect() != "10" {
+		t.Fatalf("Unexpected result with a field resolver: %v %v", ret, err)
+	}
+}
+
+// TestValidate ensures that all the errors in a script are reported.
+func TestValidate(t *testing.T) {
+
+	type Test struct {
+		Input  string
+		Errors []string
+	}
+
+	tests := []Test{
+		{Input: `return true;`},
+		{Input: `function foo(a) { return a; } return foo(1);`},
+		{Input: `break;
+if ( true ) { continue; }
+len(1, 2);
+return true;`,
+			Errors: []string{
+				"1:1: break statement outside of a loop",
+				"2:15: continue statement outside of a loop",
+				"3:1: the function len expects 1 argument(s), got 2",
+			}},
+		{Input: `function bar() { break; } function foo(a) { return a; }
+return foo(1, 2) + len();`,
+			Errors: []string{
+				"1:18: break statement outside of a loop",
+				"2:8: the function foo expects 1 argument(s), got 2",
+				"2:20: the function len expects 1 argument(s), got 0",
+			}},
+		{Input: `return 1 +;`,
+			Errors: []string{
+				"1:11: no prefix parse function for ; found",
+				"1:12: expected semicolon after return-value; found token ''",
+			}},
+	}
+
+	for _, tst := range tests {
+
+		obj := New(tst.Input)
+		errs := obj.Validate()
+
+		if len(errs) != len(tst.Errors) {
+			t.Fatalf("Expected %d errors validating '%s', got %d: %v", len(tst.Errors), tst.Input, len(errs), errs)
+		}
+		for i, err := range errs {
+			if err.Error() != tst.Errors[i] {
+				t.Fatalf("Unexpected error validating '%s': got %s, expected %s", tst.Input, err, tst.Errors[i])
+			}
+
+			var ce *CompileError
+			if !errors.As(err, &ce) || ce.Position.Line == 0 {
+				t.Fatalf("Expected a CompileError with a position for '%s', got %v", tst.Input, err)
+			}
+		}
+
+		// Prepare reports the first error.
+		err := obj.Prepare()
+		if len(tst.Errors) == 0 && err != nil {
+			t.Fatalf("Unexpected error preparing '%s': %s", tst.Input, err)
+		}
+		if len(tst.Errors) > 0 && (err == nil || !strings.Contains(err.Error(), tst.Errors[0])) {
+			t.Fatalf("Expected error '%s' preparing '%s', got %v", tst.Errors[0], tst.Input, err)
+		}
+	}
+
+	// Validating doesn't change a script which was prepared.
+	obj := New(`function double(a) { return a * 2; } return double(3) == 6;`)
+	if err := obj.Prepare(); err != nil {
+		t.Fatalf("Failed to compile: %s", err)
+	}
+	obj.Script = `return len(1, 2);`
+	if errs := obj.Validate(); len(errs) != 1 {
+		t.Fatalf("Expected one error, got %v", errs)
+	}
+	ret, err := obj.Run(nil)
+	if err != nil || !ret {
+		t.Fatalf("Unexpected result after validating: %v %v", ret, err)
+	}
+}
+
+// TestStats tests the statistics about a script's bytecode.
+func TestStats(t *testing.T) {
+
+	obj := New(`function f(a) { return a; } if ( Name == "x" || Name == "y" ) { return f(Name); } return false;`)
+	if err := obj.Prepare(); err != nil {
+		t.Fatalf("Failed to compile: %s", err)
+	}
+
+	stats := obj.Stats()
+	if stats.Bytes != 34 || stats.Instructions != 16 || stats.Constants != 6 || stats.Functions != 1 || stats.Jumps != 1 {
+		t.Fatalf("Unexpected statistics: %+v", stats)
+	}
+
+	expected := map[string]int{
+		"OpCall":        1,
+		"OpConstant":    3,
+		"OpEqual":       2,
+		"OpFalse":       1,
+		"OpJumpIfFalse": 1,
+		"OpLookup":      4,
+		"OpOr":          1,
+		"OpReturn":      3,
+	}
+	if len(stats.Opcodes) != len(expected) {
+		t.Fatalf("Unexpected opcodes: %v", stats.Opcodes)
+	}
+	for op, n := range expected {
+		if stats.Opcodes[op] != n {
+			t.Fatalf("Expected %d uses of %s, got %d", n, op, stats.Opcodes[op])
+		}
+	}
+
+	// A script which hasn't been prepared has no bytecode.
+	stats = New(`return true;`).Stats()
+	if stats.Bytes != 0 || stats.Instructions != 0 || len(stats.Opcodes) != 0 {
+		t.Fatalf("Unexpected statistics: %+v", stats)
+	}
+}
+
+// TestDivisionByZero ensures that dividing by zero is an error, rather
+// than a panic, or a result.
+func TestDivisionByZero(t *testing.T) {
+
+	tests := []string{
+		`return 1 / 0;`,
+		`return 1 % 0;`,
+		`return 1.0 / 0.0;`,
+		`return 1.0 % 0.0;`,
+		`return 1 / 0.0;`,
+		`return 1.0 / 0;`,
+		`x = 0; return 1 / x == 0;`,
+	}
+
+	for _, input := range tests {
+		for _, flags := range [][]byte{{}, {NoOptimize}} {
+
+			obj := New(input)
+			if err := obj.Prepare(flags); err != nil {
+				t.Fatalf("Failed to compile %s: %s", input, err)
+			}
+
+			ret, err := obj.Run(nil)
+			if err == nil || ret {
+				t.Fatalf("Expected an error running '%s', got %v %v", input, ret, err)
+			}
+			if !strings.Contains(err.Error(), "by zero") {
+				t.Fatalf("Unexpected error running '%s': %s", input, err)
+			}
+
+			var re *RuntimeError
+			if !errors.As(err, &re) || re.Code != ErrDivByZero || re.Position.Line != 1 {
+				t.Fatalf("Expected a division by zero error, with a position, running '%s', got %v", input, err)
+			}
+		}
+	}
+}
+
+// TestChainedComparison tests chains of comparisons, such as `1 < x < 10`.
+func TestChainedComparison(t *testing.T) {
+
+	type Test struct {
+		Input  string
+		Result string
+	}
+
+	tests := []Test{
+		{Input: `x = 5; return 1 < x < 10;`, Result: "true"},
+		{Input: `x = 50; return 1 < x < 10;`, Result: "false"},
+		{Input: `x = 1; return 1 < x < 10;`, Result: "false"},
+		{Input: `x = 1; return 1 <= x < 10;`, Result: "true"},
+		{Input: `return 1 < 2 <= 2 < 3;`, Result: "true"},
+		{Input: `return 1 < 2 <= 2 < 2;`, Result: "false"},
+		{Input: `return 3 > 2 > 1;`, Result: "true"},
+		{Input: `return 1 < 3 > 2;`, Result: "true"},
+		{Input: `return 1 < 2 > 3;`, Result: "false"},
+		{Input: `return "a" < "b" < "c";`, Result: "true"},
+		{Input: `return 1 < 5 < 10 == true;`, Result: "true"},
+		{Input: `return 1 < 5 < 10 && false;`, Result: "false"},
+		{Input: `x = 5; return ( 1 < x < 10 ) ? "in" : "out";`, Result: "in"},
+		{Input: `return ( 1 < 2 ) == true;`, Result: "true"},
+	}
+
+	for _, tst := range tests {
+		for _, flags := range [][]byte{{}, {NoOptimize}} {
+
+			obj := New(tst.Input)
+			if err := obj.Prepare(flags); err != nil {
+				t.Fatalf("Failed to compile %s: %s", tst.Input, err)
+			}
+
+			ret, err := obj.Execute(nil)
+			if err != nil {
+				t.Fatalf("Found unexpected error running script '%s': %s", tst.Input, err)
+			}
+			if ret.Inspect() != tst.Result {
+				t.Fatalf("Found unexpected result running script '%s': got %s, expected %s", tst.Input, ret.Inspect(), tst.Result)
+			}
+		}
+	}
+
+	// Parentheses stop a chain, so this compares a boolean.
+	obj := New(`return ( 1 < 2 ) < 3;`)
+	if err := obj.Prepare(); err != nil {
+		t.Fatalf("Failed to compile: %s", err)
+	}
+	if _, err := obj.Execute(nil); err == nil {
+		t.Fatalf("Expected an error comparing a boolean with an integer")
+	}
+
+	// Each operand is evaluated once, and later operands aren't
+	// evaluated if an earlier comparison is false.
+	for _, tst := range []Test{
+		{Input: `return 1 < count() < 10;`, Result: "1"},
+		{Input: `return 5 < 1 < count();`, Result: "0"},
+		{Input: `return count() <= 5 <= count() < 10;`, Result: "2"},
+	} {
+		calls := 0
+		obj = New(tst.Input)
+		obj.AddFunction("count", func(args []object.Object) object.Object {
+			calls++
+			return &object.Integer{Value: 5}
+		})
+		if err := obj.Prepare(); err != nil {
+			t.Fatalf("Failed to compile %s: %s", tst.Input, err)
+		}
+		if _, err := obj.Execute(nil); err != nil {
+			t.Fatalf("Found unexpected error running script '%s': %s", tst.Input, err)
+		}
+		if fmt.Sprintf("%d", calls) != tst.Result {
+			t.Fatalf("Unexpected number of calls running script '%s': got %d, expected %s", tst.Input, calls, tst.Result)
+		}
+	}
+
+	// The chain is shown as such.
+	tree, err := New(`1 < x <= 10;`).AST()
+	if err != nil {
+		t.Fatalf("Failed to parse: %s", err)
+	}
+	if !strings.Contains(tree.String(), "(1 < x <= 10)") {
+		t.Fatalf("Unexpected parse tree: %s", tree.String())
+	}
+}
+
+// TestPrefixOperators tests the types which `-` and `√` accept.
+func TestPrefixOperators(t *testing.T) {
+
+	type Test struct {
+		Input  string
+		Result string
+	}
+
+	tests := []Test{
+		{Input: `return √9;`, Result: "3"},
+		{Input: `return √2.25;`, Result: "1.5"},
+		{Input: `return √0;`, Result: "0"},
+		{Input: `x = 16; return √x > 2;`, Result: "true"},
+		{Input: `return type(√4);`, Result: "float"},
+		{Input: `return -3;`, Result: "-3"},
+		{Input: `x = 2.5; return -x;`, Result: "-2.5"},
+	}
+
+	for _, tst := range tests {
+		for _, flags := range [][]byte{{}, {NoOptimize}} {
+
+			obj := New(tst.Input)
+			if err := obj.Prepare(flags); err != nil {
+				t.Fatalf("Failed to compile %s: %s", tst.Input, err)
+			}
+
+			ret, err := obj.Execute(nil)
+			if err != nil {
+				t.Fatalf("Found unexpected error running script '%s': %s", tst.Input, err)
+			}
+			if ret.Inspect() != tst.Result {
+				t.Fatalf("Found unexpected result running script '%s': got %s, expected %s", tst.Input, ret.Inspect(), tst.Result)
+			}
+		}
+	}
+
+	type Failure struct {
+		Input string
+		Code  ErrorCode
+	}
+
+	failures := []Failure{
+		{Input: `return √-4;`, Code: ErrInvalidValue},
+		{Input: `x = -0.5; return √x > 2;`, Code: ErrInvalidValue},
+		{Input: `return √"steve";`, Code: ErrTypeMismatch},
+		{Input: `return √[4];`, Code: ErrTypeMismatch},
+		{Input: `return -"steve";`, Code: ErrTypeMismatch},
+		{Input: `return -[1, 2];`, Code: ErrTypeMismatch},
+		{Input: `return -{"a": 1};`, Code: ErrTypeMismatch},
+	}
+
+	for _, tst := range failures {
+		for _, flags := range [][]byte{{}, {NoOptimize}} {
+
+			obj := New(tst.Input)
+			if err := obj.Prepare(flags); err != nil {
+				t.Fatalf("Failed to compile %s: %s", tst.Input, err)
+			}
+
+			_, err := obj.Execute(nil)
+
+			var re *RuntimeError
+			if !errors.As(err, &re) || re.Code != tst.Code {
+				t.Fatalf("Expected %s running '%s', got %v", tst.Code, tst.Input, err)
+			}
+		}
+	}
+
+	// The square root of a negative number fails in the same way
+	// whether it is taken via the operator, or the function.
+	for _, input := range []string{`a = -1; return √a;`, `a = -1; return sqrt(a);`} {
+		obj := New(input)
+		if err := obj.Prepare(); err != nil {
+			t.Fatalf("Failed to compile %s: %s", input, err)
+		}
+
+		_, err := obj.Execute(nil)
+
+		var re *RuntimeError
+		if !errors.As(err, &re) || re.Code != ErrInvalidValue || re.Message != "attempted square-root of -1" {
+			t.Fatalf("Expected an invalid value running %s, got %v", input, err)
+		}
+	}
+}
+
+// TestFunctionCache ensures that functions which are changed after a
+// script has been prepared are called.
+func TestFunctionCache(t *testing.T) {
+
+	answer := func(n int64) func(args []object.Object) object.Object {
+		return func(args []object.Object) object.Object {
+			return &object.Integer{Value: n}
+		}
+	}
+
+	obj := New(`return answer() + answer();`)
+	obj.AddFunction("answer", answer(1))
+	if err := obj.Prepare(); err != nil {
+		t.Fatalf("Failed to compile: %s", err)
+	}
+
+	expect := func(e *Eval, result string) {
+		t.Helper()
+		ret, err := e.Execute(nil)
+		if err != nil {
+			t.Fatalf("Found unexpected error: %s", err)
+		}
+		if ret.Inspect() != result {
+			t.Fatalf("Found unexpected result: got %s, expected %s", ret.Inspect(), result)
+		}
+	}
+	expect(obj, "2")
+
+	// Replacing the function after Prepare is seen.
+	obj.AddFunction("answer", answer(2))
+	expect(obj, "4")
+
+	// A copy has functions of its own.
+	c := obj.Clone()
+	c.AddFunction("answer", answer(3))
+	expect(c, "6")
+	expect(obj, "4")
+
+	// A function which didn't exist when the script was prepared
+	// may be added later.
+	obj = New(`return later();`)
+	if err := obj.Prepare(); err != nil {
+		t.Fatalf("Failed to compile: %s", err)
+	}
+	if _, err := obj.Execute(nil); err == nil {
+		t.Fatalf("Expected an error calling a missing function")
+	}
+	obj.AddFunction("later", answer(7))
+	expect(obj, "7")
+}
+
+// TestSubstrings tests startswith, endswith, and contains.
+func TestSubstrings(t *testing.T) {
+
+	type Test struct {
+		Input  string
+		Result bool
+	}
+
+	tests := []Test{
+		{Input: `return startswith(Name, "Ste");`, Result: true},
+		{Input: `return startswith(Name, "eve");`, Result: false},
+		{Input: `return startswith(Name, "");`, Result: true},
+		{Input: `return endswith(Name, "eve");`, Result: true},
+		{Input: `return endswith(Name, "");`, Result: true},
+		{Input: `return endswith(City, "ö");`, Result: false},
+		{Input: `return endswith(City, "ön");`, Result: true},
+		{Input: `return startswith(City, "Mal");`, Result: true},
+		{Input: `return contains(Name, "tev");`, Result: true},
+		{Input: `return contains(Name, "kemp");`, Result: false},
+		{Input: `return contains(City, "lm");`, Result: true},
+		{Input: `return contains(Count, 2);`, Result: true},
+		{Input: `return contains([1, 2, 3], 2);`, Result: true},
+		{Input: `return contains(["Steve"], "tev");`, Result: false},
+	}
+
+	type Input struct {
+		Name  string
+		City  string
+		Count int
+	}
+
+	for _, tst := range tests {
+		for _, flags := range [][]byte{{}, {NoOptimize}} {
+
+			obj := New(tst.Input)
+			if err := obj.Prepare(flags); err != nil {
+				t.Fatalf("Failed to compile %s: %s", tst.Input, err)
+			}
+
+			ret, err := obj.Run(Input{Name: "Steve", City: "Malmön", Count: 123})
+			if err != nil {
+				t.Fatalf("Found unexpected error running script '%s': %s", tst.Input, err)
+			}
+			if ret != tst.Result {
+				t.Fatalf("Found unexpected result running script '%s': got %v, expected %v", tst.Input, ret, tst.Result)
+			}
+		}
+	}
+
+	// They expect two arguments.
+	for _, input := range []string{`return startswith("steve");`, `return endswith("a", "b", "c");`, `return contains("steve");`} {
+		obj := New(input)
+		if err := obj.Prepare(); err == nil || !strings.Contains(err.Error(), "expects 2 argument(s)") {
+			t.Fatalf("Expected an argument-count error compiling '%s', got %v", input, err)
+		}
+	}
+}
+
+// TestSetConstant tests constants set by the host application.
+func TestSetConstant(t *testing.T) {
+
+	type Test struct {
+		Input  string
+		Result string
+	}
+
+	tests := []Test{
+		{Input: `return STATUS_OK;`, Result: "200"},
+		{Input: `return Status == STATUS_OK;`, Result: "true"},
+		{Input: `function check(s) { return s == STATUS_OK; } return check(Status);`, Result: "true"},
+		{Input: `function shadow(STATUS_OK) { STATUS_OK = 3; return STATUS_OK; } return shadow(1);`, Result: "3"},
+		{Input: `x = STATUS_OK; x += 1; return x;`, Result: "201"},
+	}
+
+	for _, tst := range tests {
+		for _, flags := range [][]byte{{}, {NoOptimize}} {
+
+			obj := New(tst.Input)
+			obj.SetConstant("STATUS_OK", &object.Integer{Value: 200})
+			if err := obj.Prepare(flags); err != nil {
+				t.Fatalf("Failed to compile %s: %s", tst.Input, err)
+			}
+
+			ret, err := obj.Execute(map[string]interface{}{"Status": 200})
+			if err != nil {
+				t.Fatalf("Found unexpected error running script '%s': %s", tst.Input, err)
+			}
+			if ret.Inspect() != tst.Result {
+				t.Fatalf("Found unexpected result running script '%s': got %s, expected %s", tst.Input, ret.Inspect(), tst.Result)
+			}
+		}
+	}
+
+	// Scripts cannot assign to constants.
+	failures := []string{
+		`STATUS_OK = 1; return true;`,
+		`STATUS_OK += 1; return true;`,
+		`STATUS_OK++; return true;`,
+		`a, STATUS_OK = [1, 2]; return true;`,
+		`if ( true ) { STATUS_OK = 1; } return true;`,
+		`function f() { STATUS_OK = 1; } f(); return true;`,
+	}
+	for _, input := range failures {
+		for _, flags := range [][]byte{{}, {NoOptimize}} {
+
+			obj := New(input)
+			obj.SetConstant("STATUS_OK", &object.Integer{Value: 200})
+			if err := obj.Prepare(flags); err != nil {
+				t.Fatalf("Failed to compile %s: %s", input, err)
+			}
+
+			_, err := obj.Execute(nil)
+
+			var re *RuntimeError
+			if !errors.As(err, &re) || re.Code != ErrConstant || !strings.Contains(err.Error(), "cannot assign to constant STATUS_OK") {
+				t.Fatalf("Expected a constant error running '%s', got %v", input, err)
+			}
+			if obj.GetVariable("STATUS_OK").Inspect() != "200" {
+				t.Fatalf("The constant was changed by '%s'", input)
+			}
+		}
+	}
+
+	// Constants survive Reset, and Clone.
+	obj := New(`return STATUS_OK;`)
+	obj.SetConstant("STATUS_OK", &object.Integer{Value: 200})
+	if err := obj.Prepare(); err != nil {
+		t.Fatalf("Failed to compile: %s", err)
+	}
+	obj.Reset()
+	c := obj.Clone()
+	for _, e := range []*Eval{obj, c} {
+		ret, err := e.Execute(nil)
+		if err != nil || ret.Inspect() != "200" {
+			t.Fatalf("Unexpected result: %v %v", ret, err)
+		}
+	}
+
+	// A variable of the same name replaces the constant.
+	obj = New(`STATUS_OK = 1; return STATUS_OK;`)
+	obj.SetConstant("STATUS_OK", &object.Integer{Value: 200})
+	obj.SetVariable("STATUS_OK", &object.Integer{Value: 200})
+	if err := obj.Prepare(); err != nil {
+		t.Fatalf("Failed to compile: %s", err)
+	}
+	obj.Reset()
+	ret, err := obj.Execute(nil)
+	if err != nil || ret.Inspect() != "1" {
+		t.Fatalf("Unexpected result: %v %v", ret, err)
+	}
+}
+
+// TestExecuteValue tests converting results to golang values.
+func TestExecuteValue(t *testing.T) {
+
+	type Input struct {
+		Name string
+	}
+	in := &Input{Name: "Steve"}
+	when := time.Date(2020, 3, 10, 0, 0, 0, 0, time.UTC)
+
+	type Test struct {
+		Input  string
+		Result interface{}
+	}
+
+	tests := []Test{
+		{Input: `return 3;`, Result: int64(3)},
+		{Input: `return 1.5;`, Result: 1.5},
+		{Input: `return Name;`, Result: "Steve"},
+		{Input: `return true;`, Result: true},
+		{Input: `return Missing;`, Result: nil},
+		{Input: `return [1, "two", [3.5, false], null];`, Result: []interface{}{int64(1), "two", []interface{}{3.5, false}, nil}},
+		{Input: `return {"a": 1, 2: ["b"]};`, Result: map[string]interface{}{"a": int64(1), "2": []interface{}{"b"}}},
+		{Input: `return parse_time("2020-03-10T00:00:00Z");`, Result: when},
+		{Input: `return self;`, Result: in},
+	}
+
+	for _, tst := range tests {
+		for _, flags := range [][]byte{{}, {NoOptimize}} {
+
+			obj := New(tst.Input)
+			if err := obj.Prepare(flags); err != nil {
+				t.Fatalf("Failed to compile %s: %s", tst.Input, err)
+			}
+
+			ret, err := obj.ExecuteValue(in)
+			if err != nil {
+				t.Fatalf("Found unexpected error running script '%s': %s", tst.Input, err)
+			}
+			if !reflect.DeepEqual(ret, tst.Result) {
+				t.Fatalf("Found unexpected result running script '%s': got %#v, expected %#v", tst.Input, ret, tst.Result)
+			}
+		}
+	}
+
+	// Errors are returned, with a nil value.
+	obj := New(`return 1 / 0;`)
+	if err := obj.Prepare(); err != nil {
+		t.Fatalf("Failed to compile: %s", err)
+	}
+	ret, err := obj.ExecuteValue(nil)
+	if err == nil || ret != nil {
+		t.Fatalf("Expected an error, got %v %v", ret, err)
+	}
+}
+
+// TestAssert tests that `assert` aborts the script when its condition
+// is false, and does nothing otherwise.
+func TestAssert(t *testing.T) {
+
+	type Test struct {
+		Input string
+		Error string
+	}
+
+	tests := []Test{
+		{Input: `assert(true); return true;`},
+		{Input: `assert(1 < 2, "maths is broken"); return true;`},
+		{Input: `x = assert("steve"); return x;`},
+		{Input: `assert(false, "nope"); return true;`, Error: "assertion failed: nope"},
+		{Input: `assert(len("") > 0, sprintf("%d is too short", len(""))); return true;`, Error: "assertion failed: 0 is too short"},
+		{Input: `assert(Missing); print("unreachable"); return true;`, Error: "assertion failed"},
+		{Input: `function check(x) { assert(x > 0, "x must be positive"); return x; } return check(1) == 1 && check(-1) == -1;`, Error: "x must be positive"},
+	}
+
+	for _, test := range tests {
+		for _, flags := range [][]byte{{}, {NoOptimize}} {
+
+			obj := New(test.Input)
+			if err := obj.Prepare(flags); err != nil {
+				t.Fatalf("Failed to compile %s: %s", test.Input, err)
+			}
+
+			ret, err := obj.Run(nil)
+			if test.Error == "" {
+				if err != nil || !ret {
+					t.Fatalf("Unexpected result running '%s': %v %v", test.Input, ret, err)
+				}
+				continue
+			}
+
+			if err == nil || ret {
+				t.Fatalf("Expected an error running '%s', got %v %v", test.Input, ret, err)
+			}
+			if !strings.Contains(err.Error(), test.Error) {
+				t.Fatalf("Unexpected error running '%s': %s", test.Input, err)
+			}
+
+			var re *RuntimeError
+			if !errors.As(err, &re) || re.Code != ErrFunctionFailed {
+				t.Fatalf("Expected a function failure running '%s', got %v", test.Input, err)
+			}
+		}
+	}
+}
+
+// TestKeysValues tests retrieving the keys, and values, of a hash.
+func TestKeysValues(t *testing.T) {
+
+	type Test struct {
+		Input  string
+		Result string
+	}
+
+	tests := []Test{
+		{Input: `return keys({});`, Result: "[]"},
+		{Input: `return values({});`, Result: "[]"},
+		{Input: `return keys({"b": 2, "a": 1, "c": 3});`, Result: "[a, b, c]"},
+		{Input: `return values({"b": 2, "a": 1, "c": 3});`, Result: "[1, 2, 3]"},
+		{Input: `h = {"x": 10, "y": 20}; k = keys(h); v = values(h); i = 0; t = 0; while (i < len(k)) { t += h[k[i]] + v[i]; i++; } return t;`, Result: "60"},
+		{Input: `return type(keys([1, 2]));`, Result: "error"},
+		{Input: `return type(values("steve"));`, Result: "error"},
+	}
+
+	for _, test := range tests {
+		for _, flags := range [][]byte{{}, {NoOptimize}} {
+
+			obj := New(test.Input)
+			if err := obj.Prepare(flags); err != nil {
+				t.Fatalf("Failed to compile %s: %s", test.Input, err)
+			}
+
+			out, err := obj.Execute(nil)
+			if err != nil {
+				t.Fatalf("Failed to run %s: %s", test.Input, err)
+			}
+			if out.Inspect() != test.Result {
+				t.Fatalf("Found unexpected result running script '%s': got %s, expected %s", test.Input, out.Inspect(), test.Result)
+			}
+		}
+	}
+}
+
+// TestImplicitReturn tests that a script which ends with an expression
+// returns its value, just as if it had used `return`.
+func TestImplicitReturn(t *testing.T) {
+
+	type Test struct {
+		Input  string
+		Result string
+	}
+
+	tests := []Test{
+		{Input: `1 + 2;`, Result: "3"},
+		{Input: `"steve";`, Result: "steve"},
+		{Input: `x = 3; x * 2`, Result: "6"},
+		{Input: `Count > 10;`, Result: "true"},
+		{Input: `Name ?? "anonymous";`, Result: "anonymous"},
+		{Input: `x = [1, 2]; len(x) == 2 ? "two" : "other";`, Result: "two"},
+		{Input: `double(4); function double(x) { return x * 2; }`, Result: "8"},
+		{Input: `if (true) { return 1; } 2;`, Result: "1"},
+		{Input: `if (false) { return 1; } 2;`, Result: "2"},
+		{Input: `function f(x) { x + 1; } f(3);`, Result: "null"},
+	}
+
+	for _, test := range tests {
+		for _, flags := range [][]byte{{}, {NoOptimize}} {
+
+			implicit := New(test.Input)
+			if err := implicit.Prepare(flags); err != nil {
+				t.Fatalf("Failed to compile %s: %s", test.Input, err)
+			}
+			out, err := implicit.Execute(map[string]interface{}{"Count": 12})
+			if err != nil {
+				t.Fatalf("Failed to run %s: %s", test.Input, err)
+			}
+			if out.Inspect() != test.Result {
+				t.Fatalf("Found unexpected result running script '%s': got %s, expected %s", test.Input, out.Inspect(), test.Result)
+			}
+
+			// Run applies the same truthiness as an
+			// explicit return would.
+			ret, err := implicit.Run(map[string]interface{}{"Count": 12})
+			if err != nil || ret != out.True() {
+				t.Fatalf("Unexpected result from Run with '%s': %v %v", test.Input, ret, err)
+			}
+		}
+	}
+
+	// Scripts which end with a statement that has no value fail.
+	for _, input := range []string{`x = 1;`, `x = 1; x++;`, `i = 0; while (i < 3) { i++; }`, `if (false) { return 1; }`} {
+		obj := New(input)
+		if err := obj.Prepare(); err != nil {
+			t.Fatalf("Failed to compile %s: %s", input, err)
+		}
+		_, err := obj.Execute(nil)
+
+		var re *RuntimeError
+		if !errors.As(err, &re) || re.Code != ErrMissingReturn {
+			t.Fatalf("Expected a missing return running '%s', got %v", input, err)
+		}
+	}
+}
+
+// TestMaxDepth tests that deeply nested scripts fail to compile, rather
+// than exhausting the stack.
+func TestMaxDepth(t *testing.T) {
+
+	deep := 100000
+	tests := []string{
+		"return " + strings.Repeat("(", deep) + "1" + strings.Repeat(")", deep) + ";",
+		"return " + strings.Repeat("-", deep) + "1;",
+		"return " + strings.Repeat("!", deep) + "true;",
+		"return " + strings.Repeat("[", deep) + strings.Repeat("]", deep) + ";",
+		"return " + strings.Repeat("{\"a\": ", deep) + "1" + strings.Repeat("}", deep) + ";",
+		"return " + strings.Repeat("f(", deep) + strings.Repeat(")", deep) + ";",
+		strings.Repeat("if (true) { ", deep) + strings.Repeat("}", deep) + " return true;",
+		strings.Repeat("function f() { ", deep) + strings.Repeat("}", deep) + " return true;",
+		"return \"${" + strings.Repeat("(", deep) + "1" + strings.Repeat(")", deep) + "}\";",
+		"return " + strings.Repeat("(", deep),
+	}
+
+	for i, input := range tests {
+		obj := New(input)
+		err := obj.Prepare()
+		if err == nil || !strings.Contains(err.Error(), "expression nesting too deep") {
+			t.Fatalf("Expected a nesting error for test %d, got %v", i, err)
+		}
+
+		// The error is only reported once.
+		errs := obj.Validate()
+		if len(errs) != 1 {
+			t.Fatalf("Expected one error validating test %d, got %v", i, errs)
+		}
+	}
+
+	// Reasonable nesting is fine, and the limit may be changed.
+	input := "return " + strings.Repeat("(", 500) + "1" + strings.Repeat(")", 500) + ";"
+
+	obj := New(input)
+	if err := obj.Prepare(); err != nil {
+		t.Fatalf("Failed to compile a script with reasonable nesting: %s", err)
+	}
+
+	obj.SetMaxDepth(100)
+	if err := obj.Prepare(); err == nil {
+		t.Fatalf("Expected a nesting error, with a lower limit")
+	}
+	if err := obj.Clone().Prepare(); err == nil {
+		t.Fatalf("Expected a clone to keep the lower limit")
+	}
+
+	obj.SetMaxDepth(0)
+	obj.Script = "return " + strings.Repeat("(", 5000) + "1" + strings.Repeat(")", 5000) + ";"
+	if err := obj.Prepare(); err != nil {
+		t.Fatalf("Failed to compile with no limit: %s", err)
+	}
+	ret, err := obj.Run(nil)
+	if err != nil || !ret {
+		t.Fatalf("Unexpected result with no limit: %v %v", ret, err)
+	}
+}
+
+// TestCoalesceFunction tests that `coalesce` returns its first argument
+// which isn't null.
+func TestCoalesceFunction(t *testing.T) {
+
+	type Test struct {
+		Input  string
+		Result string
+	}
+
+	tests := []Test{
+		{Input: `return coalesce(Missing, Name, "anonymous");`, Result: "Steve"},
+		{Input: `return coalesce(Missing, Absent, "anonymous");`, Result: "anonymous"},
+		{Input: `return coalesce(Missing, false, true);`, Result: "false"},
+		{Input: `return coalesce(Missing);`, Result: "null"},
+		{Input: `return coalesce(Missing, Absent) ?? "default";`, Result: "default"},
+		{Input: `x = []; return coalesce(x[3], x[-1], len(x));`, Result: "0"},
+
+		// Unlike `??` every argument is evaluated.
+		{Input: `n = 0; function f() { n = n + 1; return 1; } coalesce(Name, f()); return n;`, Result: "1"},
+	}
+
+	for _, test := range tests {
+		for _, flags := range [][]byte{{}, {NoOptimize}} {
+
+			obj := New(test.Input)
+			if err := obj.Prepare(flags); err != nil {
+				t.Fatalf("Failed to compile %s: %s", test.Input, err)
+			}
+
+			out, err := obj.Execute(map[string]interface{}{"Name": "Steve"})
+			if err != nil {
+				t.Fatalf("Failed to run %s: %s", test.Input, err)
+			}
+			if out.Inspect() != test.Result {
+				t.Fatalf("Found unexpected result running script '%s': got %s, expected %s", test.Input, out.Inspect(), test.Result)
+			}
+		}
+	}
+
+	// At least one argument is required.
+	obj := New(`return coalesce();`)
+	if err := obj.Prepare(); err == nil {
+		t.Fatalf("Expected an error calling coalesce without arguments")
+	}
+}
+
+// TestSafeNavigation tests the safe-navigation operator, `?.`.
+func TestSafeNavigation(t *testing.T) {
+
+	type Test struct {
+		Input  string
+		Result string
+	}
+
+	tests := []Test{
+		{Input: `return user?.address?.city;`, Result: "Helsinki"},
+		{Input: `return user?.address.city;`, Result: "Helsinki"},
+		{Input: `return user?.missing?.city;`, Result: "null"},
+		{Input: `return missing?.address?.city;`, Result: "null"},
+		{Input: `return user?.address?.missing?.deeper;`, Result: "null"},
+		{Input: `return items[0]?.name;`, Result: "apple"},
+		{Input: `return items[5]?.name;`, Result: "null"},
+		{Input: `return items?.0?.name;`, Result: "apple"},
+		{Input: `return missing?.0?.name;`, Result: "null"},
+		{Input: `return user?.if;`, Result: "null"},
+		{Input: `return len(missing?.name ?? "none");`, Result: "4"},
+		{Input: `x = null; return type(x?.name);`, Result: "null"},
+		{Input: `return {"a": {"b": 1}}?.a?.b + 1;`, Result: "2"},
+		{Input: `return (user?.address)?.city;`, Result: "Helsinki"},
+
+		// The ternary operator is not confused with `?.`
+		{Input: `return true ? 0.5 : 1;`, Result: "0.5"},
+		{Input: `x = {"a": 1}; return x ?x.a : 2;`, Result: "1"},
+	}
+
+	input := map[string]interface{}{
+		"user": map[string]interface{}{
+			"address": map[string]interface{}{"city": "Helsinki"},
+		},
+		"items": []interface{}{map[string]interface{}{"name": "apple"}},
+	}
+
+	for _, test := range tests {
+		for _, flags := range [][]byte{{}, {NoOptimize}} {
+
+			obj := New(test.Input)
+			if err := obj.Prepare(flags); err != nil {
+				t.Fatalf("Failed to compile %s: %s", test.Input, err)
+			}
+
+			out, err := obj.Execute(input)
+			if err != nil {
+				t.Fatalf("Failed to run %s: %s", test.Input, err)
+			}
+			if out.Inspect() != test.Result {
+				t.Fatalf("Found unexpected result running script '%s': got %s, expected %s", test.Input, out.Inspect(), test.Result)
+			}
+		}
+	}
+
+	// A field name, or index, must follow.
+	for _, input := range []string{`return a?.;`, `return a?.(1);`, `return a?."b";`} {
+		obj := New(input)
+		if err := obj.Prepare(); err == nil {
+			t.Fatalf("Expected an error compiling '%s'", input)
+		}
+	}
+
+	// Values other than null are still indexed as usual.
+	obj := New(`return Count?.name;`)
+	if err := obj.Prepare(); err != nil {
+		t.Fatalf("Failed to compile: %s", err)
+	}
+	if _, err := obj.Execute(map[string]interface{}{"Count": 3}); err == nil {
+		t.Fatalf("Expected an error indexing an integer")
+	}
+}
+
+// TestPeephole tests that pointless jumps, and unreachable code, are
+// removed by the optimizer without changing the result of a script.
+func TestPeephole(t *testing.T) {
+
+	type Test struct {
+		Input  string
+		Result string
+	}
+
+	tests := []Test{
+		{Input: `if (Count > 1) { return "big"; } else { return "small"; }`, Result: "big"},
+		{Input: `x = 0; if (Count > 1) { x = 1; } else { x = 2; } return x;`, Result: "1"},
+		{Input: `x = 0; if (Count > 1) { if (Count > 2) { x = 1; } else { x = 2; } } else { x = 3; } return x;`, Result: "1"},
+		{Input: `i = 0; while (i < 10) { if (i == 5) { break; } i++; } return i;`, Result: "5"},
+		{Input: `i = 0; t = 0; while (i < 10) { i++; if (i % 2 == 0) { continue; } t += i; } return t;`, Result: "25"},
+		{Input: `i = 0; while (true) { i++; if (i > 3) { return i; } }`, Result: "4"},
+		{Input: `x = ""; switch (Count) { case 1 { x = "one"; } case 3 { x = "three"; } default { x = "many"; } } return x;`, Result: "three"},
+		{Input: `return Count > 1 ? (Count > 2 ? "a" : "b") : "c";`, Result: "a"},
+		{Input: `function f(x) { if (x) { return 1; } else { return 2; } return 3; } return f(false);`, Result: "2"},
+		{Input: `return 1; x = 2; return x;`, Result: "1"},
+		{Input: `return missing?.a?.b ?? "none";`, Result: "none"},
+		{Input: `return 1 < Count <= 3;`, Result: "true"},
+		{Input: `if (false) { return 1; } return 2;`, Result: "2"},
+	}
+
+	for _, tst := range tests {
+
+		var unoptimized int
+
+		for _, flags := range [][]byte{{NoOptimize}, {}} {
+
+			obj := New(tst.Input)
+			if err := obj.Prepare(flags); err != nil {
+				t.Fatalf("Failed to compile %s: %s", tst.Input, err)
+			}
+
+			ret, err := obj.Execute(map[string]interface{}{"Count": 3})
+			if err != nil {
+				t.Fatalf("Found unexpected error running script '%s': %s", tst.Input, err)
+			}
+			if ret.Inspect() != tst.Result {
+				t.Fatalf("Found unexpected result running script '%s': got %s, expected %s", tst.Input, ret.Inspect(), tst.Result)
+			}
+
+			if len(flags) != 0 {
+				unoptimized = len(obj.instructions)
+				continue
+			}
+
+			if len(obj.instructions) > unoptimized {
+				t.Fatalf("Optimizing '%s' made it larger", tst.Input)
+			}
+
+			//
+			// No jump should land upon another jump, or
+			// upon the instruction which follows it.
+			//
+			programs := []code.Instructions{obj.instructions}
+			for _, fn := range obj.functions {
+				programs = append(programs, fn.Instructions)
+			}
+			for _, ins := range programs {
+				for ip := 0; ip < len(ins); ip += code.Length(code.Opcode(ins[ip])) {
+					op := code.Opcode(ins[ip])
+					if !code.IsJump(op) {
+						continue
+					}
+					target := code.Operand(ins, ip)
+					if op == code.OpJump && target == ip+code.Length(op) {
+						t.Fatalf("Found a jump to the next instruction in '%s'", tst.Input)
+					}
+					if target < len(ins) && code.Opcode(ins[target]) == code.OpJump && target != ip {
+						t.Fatalf("Found a jump to a jump in '%s'", tst.Input)
+					}
+				}
+			}
+		}
+	}
+
+	// Unreachable code is removed.
+	obj := New(`if (Count > 1) { return 1; } else { return 2; } print("unreachable"); return 3;`)
+	if err := obj.Prepare(); err != nil {
+		t.Fatalf("Failed to compile: %s", err)
+	}
+	out, err := obj.Disassemble()
+	if err != nil {
+		t.Fatalf("Failed to disassemble: %s", err)
+	}
+	if strings.Contains(out, "OpCall") {
+		t.Fatalf("Found unreachable code:\n%s", out)
+	}
+
+	// A script with nothing to return is still reported as such.
+	for _, input := range []string{``, `if (false) { return 1; }`} {
+		obj := New(input)
+		if err := obj.Prepare(); err != nil {
+			t.Fatalf("Failed to compile %s: %s", input, err)
+		}
+		_, err := obj.Execute(nil)
+
+		var re *RuntimeError
+		if !errors.As(err, &re) || re.Code != ErrMissingReturn {
+			t.Fatalf("Expected a missing return running '%s', got %v", input, err)
+		}
+	}
+}
+
+// TestRemoveFunction tests that host functions may be tested for, and
+// removed, and that doing so restores any built-in they replaced.
+func TestRemoveFunction(t *testing.T) {
+
+	var buf bytes.Buffer
+
+	obj := New(`print("hello"); return answer();`)
+	obj.SetOutput(&buf)
+
+	if obj.HasFunction("answer") {
+		t.Fatalf("Found a function which wasn't added")
+	}
+	if !obj.HasFunction("print") {
+		t.Fatalf("Expected the built-in print to be present")
+	}
+
+	obj.AddFunction("answer", func(args []object.Object) object.Object {
+		return &object.Integer{Value: 42}
+	})
+	obj.AddFunction("print", func(args []object.Object) object.Object {
+		buf.WriteString("custom\n")
+		return &object.Integer{Value: 0}
+	})
+	if !obj.HasFunction("answer") {
+		t.Fatalf("Expected the added function to be present")
+	}
+
+	if err := obj.Prepare(); err != nil {
+		t.Fatalf("Failed to compile: %s", err)
+	}
+	ret, err := obj.Execute(nil)
+	if err != nil {
+		t.Fatalf("Found unexpected error: %s", err)
+	}
+	if ret.Inspect() != "42" || buf.String() != "custom\n" {
+		t.Fatalf("Found unexpected result: %s %q", ret.Inspect(), buf.String())
+	}
+
+	// Removing our print restores the built-in.
+	buf.Reset()
+	obj.RemoveFunction("print")
+	obj.RemoveFunction("answer")
+	if obj.HasFunction("answer") {
+		t.Fatalf("Found a function which was removed")
+	}
+	_, err = obj.Execute(nil)
+	var re *RuntimeError
+	if !errors.As(err, &re) || re.Code != ErrUnknownFunction {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if buf.String() != "hello" {
+		t.Fatalf("Expected the built-in print to be used, got %q", buf.String())
+	}
+
+	// Built-in functions can't be removed.
+	obj.RemoveFunction("len")
+	if !obj.HasFunction("len") {
+		t.Fatalf("Expected the built-in len to remain")
+	}
+
+	// A function defined by the script survives the removal of the
+	// host's function it replaced, but the host's function isn't
+	// restored when the script is prepared again.
+	obj.AddFunction("greet", func(args []object.Object) object.Object {
+		return &object.String{Value: "host"}
+	})
+	obj.Script = `function greet() { return "script"; } return greet();`
+	if err := obj.Prepare(); err != nil {
+		t.Fatalf("Failed to compile: %s", err)
+	}
+	obj.RemoveFunction("greet")
+	ret, err = obj.Execute(nil)
+	if err != nil || ret.Inspect() != "script" {
+		t.Fatalf("Unexpected result: %v %v", ret, err)
+	}
+	obj.Script = `return greet();`
+	if err := obj.Prepare(); err != nil {
+		t.Fatalf("Failed to compile: %s", err)
+	}
+	if _, err = obj.Execute(nil); !errors.As(err, &re) || re.Code != ErrUnknownFunction {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
+
+// TestInvalidRegexp tests that an invalid regular expression, used with
+// `~=`, is reported when it is first used.
+func TestInvalidRegexp(t *testing.T) {
+
+	for _, input := range []string{
+		`return Name ~= "+";`,
+		`return Name !~ /a(b/i;`,
+	} {
+		obj := New(input)
+		if err := obj.Prepare(); err != nil {
+			t.Fatalf("Failed to compile %s: %s", input, err)
+		}
+
+		// Twice, so that the cache is consulted.
+		for i := 0; i < 2; i++ {
+			_, err := obj.Execute(map[string]interface{}{"Name": "Steve"})
+
+			var re *RuntimeError
+			if !errors.As(err, &re) || re.Code != ErrInvalidValue {
+				t.Fatalf("Expected an invalid value running '%s', got %v", input, err)
+			}
+			if !strings.Contains(err.Error(), "invalid regular expression") {
+				t.Fatalf("Unexpected error running '%s': %s", input, err)
+			}
+		}
+	}
+
+	// Patterns which aren't constants work too.
+	obj := New(`return Name ~= Pattern;`)
+	if err := obj.Prepare(); err != nil {
+		t.Fatalf("Failed to compile: %s", err)
+	}
+	for _, pattern := range []string{"^St", "^st", "(?i)^st"} {
+		ret, err := obj.Run(map[string]interface{}{"Name": "Steve", "Pattern": pattern})
+		if err != nil {
+			t.Fatalf("Found unexpected error: %s", err)
+		}
+		if ret != (pattern != "^st") {
+			t.Fatalf("Found unexpected result matching %s", pattern)
+		}
+	}
+
+	// A pattern computed at run-time isn't confused with a constant
+	// holding the same source, and an invalid one is reported each
+	// time it is used.
+	obj = New(`if (Name ~= /^St/) { return Name ~= Pattern; } return false;`)
+	if err := obj.Prepare(); err != nil {
+		t.Fatalf("Failed to compile: %s", err)
+	}
+	for _, pattern := range []string{"^St", "+", "^Sx", "+"} {
+		ret, err := obj.Run(map[string]interface{}{"Name": "Steve", "Pattern": pattern})
+		if pattern == "+" {
+			if err == nil {
+				t.Fatalf("Expected an error matching %s", pattern)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Found unexpected error: %s", err)
+		}
+		if ret != (pattern == "^St") {
+			t.Fatalf("Found unexpected result matching %s", pattern)
+		}
+	}
+}
+
+// TestTryCatch tests throwing values, and catching them along with
+// run-time errors.
+func TestTryCatch(t *testing.T) {
+
+	tests := []struct {
+		Input  string
+		Result string
+	}{
+		{Input: `try { throw "bad"; } catch (e) { return "caught " + e; }`, Result: "caught bad"},
+		{Input: `x = 0; try { x = 1; } catch (e) { return e; } return x;`, Result: "1"},
+		{Input: `try { throw 3; } catch (e) { return e * 2; }`, Result: "6"},
+		{Input: `try { throw [1, 2]; } catch (e) { return len(e); }`, Result: "2"},
+		{Input: `try { return 1 / 0; } catch (e) { return e; }`, Result: "attempted division by zero: 1 / 0"},
+		{Input: `try { throw 1; } catch { return "anonymous"; }`, Result: "anonymous"},
+
+		// The error is an ordinary variable.
+		{Input: `e = "outer"; try { throw "inner"; } catch (e) { print(e); } return e;`, Result: "inner"},
+
+		// Thrown from a function.
+		{Input: `function check(n) { if (n < 0) { throw "negative"; } return n; }
+try { return check(-1); } catch (e) { return e; }`, Result: "negative"},
+		{Input: `function deep(n) { if (n == 0) { throw "bottom"; } return deep(n - 1); }
+try { deep(10); } catch (e) { return e; }`, Result: "bottom"},
+
+		// Caught within a function.
+		{Input: `function safe(n) { try { return 10 / n; } catch { return 0; } }
+return safe(0) + safe(5);`, Result: "2"},
+
+		// Thrown from a function called by a built-in.
+		{Input: `function f(n) { throw n; }
+try { map([7], f); } catch (e) { return e; }`, Result: "7"},
+
+		// Rethrown, and nested.
+		{Input: `try { try { throw "a"; } catch (e) { throw e + "b"; } } catch (e) { return e; }`, Result: "ab"},
+		{Input: `x = ""; try { try { throw "a"; } catch (e) { x = e; } throw x + "c"; } catch (e) { return e; }`, Result: "ac"},
+
+		// Leaving a try-block via break, and continue.
+		{Input: `i = 0; while (i < 3) { i++; try { if (i == 1) { continue; } break; } catch { return "bad"; } }
+try { throw i; } catch (e) { return e; }`, Result: "2"},
+	}
+
+	for _, tst := range tests {
+		for _, flags := range [][]byte{{}, {NoOptimize}} {
+
+			obj := New(tst.Input)
+			obj.SetOutput(&bytes.Buffer{})
+			if err := obj.Prepare(flags); err != nil {
+				t.Fatalf("Failed to compile %s: %s", tst.Input, err)
+			}
+
+			ret, err := obj.Execute(nil)
+			if err != nil {
+				t.Fatalf("Found unexpected error running %s: %s", tst.Input, err)
+			}
+			if ret.Inspect() != tst.Result {
+				t.Fatalf("Found unexpected result running %s: got %s, expected %s", tst.Input, ret.Inspect(), tst.Result)
+			}
+		}
+	}
+
+	// Uncaught values are reported as errors.
+	for _, input := range []string{
+		`throw "invalid record";`,
+		`function f() { throw "invalid record"; } return f();`,
+		`try { throw "ignored"; } catch (e) { throw "invalid record"; }`,
+		`try { print("no error"); } catch (e) { return e; } throw "invalid record";`,
+	} {
+		obj := New(input)
+		obj.SetOutput(&bytes.Buffer{})
+		if err := obj.Prepare(); err != nil {
+			t.Fatalf("Failed to compile %s: %s", input, err)
+		}
+
+		_, err := obj.Execute(nil)
+
+		var re *RuntimeError
+		if !errors.As(err, &re) || re.Code != ErrThrown {
+			t.Fatalf("Expected an uncaught error running '%s', got %v", input, err)
+		}
+		if re.Value.Inspect() != "invalid record" || !strings.Contains(err.Error(), "uncaught error: invalid record") {
+			t.Fatalf("Unexpected error running '%s': %s", input, err)
+		}
+	}
+
+	// Exceeding the instruction-limit can't be caught.
+	obj := New(`try { while (true) { } } catch { return 1; }`)
+	obj.SetMaxInstructions(1000)
+	if err := obj.Prepare(); err != nil {
+		t.Fatalf("Failed to compile: %s", err)
+	}
+	if _, err := obj.Execute(nil); err != ErrInstructionLimit {
+		t.Fatalf("Expected the instruction-limit to be exceeded, got %v", err)
+	}
+
+	// Errors returned by functions can be caught, but panics and
+	// internal errors can't.
+	catches := []struct {
+		Input  string
+		Caught bool
+		Code   ErrorCode
+	}{
+		{Input: `try { fails(); } catch (e) { return e; }`, Caught: true},
+		{Input: `try { panics(); } catch (e) { return e; }`, Code: ErrFunctionFailed},
+		{Input: `function f(x) { return panics(); } try { map([1], f); } catch { }`, Code: ErrFunctionFailed},
+		{Input: `try { broken(); } catch (e) { return e; }`, Code: ErrInternal},
+	}
+	for _, tst := range catches {
+		obj := New(tst.Input)
+		obj.AddFunction("fails", func(args []object.Object) (object.Object, error) {
+			return nil, fmt.Errorf("failed")
+		})
+		obj.AddFunction("panics", func(args []object.Object) object.Object {
+			panic("oops")
+		})
+		obj.AddFunction("broken", 3)
+		if err := obj.Prepare(); err != nil {
+			t.Fatalf("Failed to compile %s: %s", tst.Input, err)
+		}
+
+		ret, err := obj.Execute(nil)
+		if tst.Caught {
+			if err != nil || ret.Inspect() != "failed" {
+				t.Fatalf("Expected the error to be caught running '%s', got %v %v", tst.Input, ret, err)
+			}
+			continue
+		}
+
+		var re *RuntimeError
+		if !errors.As(err, &re) || re.Code != tst.Code {
+			t.Fatalf("Expected an uncaught %s running '%s', got %v", tst.Code, tst.Input, err)
+		}
+	}
+
+	// Invalid statements.
+	for _, input := range []string{
+		`throw "missing semicolon"`,
+		`try { } return 1;`,
+		`try { } catch (1) { }`,
+		`try { } catch (e { }`,
+	} {
+		obj := New(input)
+		if err := obj.Prepare(); err == nil {
+			t.Fatalf("Expected an error compiling %s", input)
+		}
+	}
+}
+
+// TestConversions tests the int, float, and string functions, and that a
+// failed conversion can be told apart from zero.
+func TestConversions(t *testing.T) {
+
+	tests := []struct {
+		Input  string
+		Result string
+	}{
+		{Input: `return int("42") + 1;`, Result: "43"},
+		{Input: `return int(Price);`, Result: "9"},
+		{Input: `return int(true) + int(false);`, Result: "1"},
+		{Input: `return type(int("abc"));`, Result: "error"},
+		{Input: `return type(int(Missing));`, Result: "error"},
+		{Input: `return int("0") == 0 && type(int("0")) == "integer";`, Result: "true"},
+		{Input: `return float(Count) / 2;`, Result: "1.5"},
+		{Input: `return float("2.5") * 2;`, Result: "5"},
+		{Input: `return type(float("abc"));`, Result: "error"},
+		{Input: `return string(Count) + string(Price);`, Result: "39.99"},
+		{Input: `return string(Missing);`, Result: "null"},
+	}
+
+	for _, tst := range tests {
+
+		obj := New(tst.Input)
+		if err := obj.Prepare(); err != nil {
+			t.Fatalf("Failed to compile %s: %s", tst.Input, err)
+		}
+
+		ret, err := obj.Execute(map[string]interface{}{"Count": 3, "Price": 9.99})
+		if err != nil {
+			t.Fatalf("Found unexpected error running %s: %s", tst.Input, err)
+		}
+		if ret.Inspect() != tst.Result {
+			t.Fatalf("Found unexpected result running %s: got %s, expected %s", tst.Input, ret.Inspect(), tst.Result)
+		}
+	}
+}
+
+// TestYield tests collecting the values a script yields.
+func TestYield(t *testing.T) {
+
+	tests := []struct {
+		Input  string
+		Result string
+	}{
+		{Input: `yield 1; yield "two"; yield [3];`, Result: "[1, two, [3]]"},
+		{Input: `i = 0; while (i < 5) { if (i % 2 == 0) { yield i * 10; } i++; }`, Result: "[0, 20, 40]"},
+		{Input: `yield 1; return 7; yield 2;`, Result: "[1]"},
+		{Input: `yield 1; if (Stop) { return false; } yield 2;`, Result: "[1]"},
+		{Input: `function emit(x) { yield x; yield x + 1; } emit(1); emit(10);`, Result: "[1, 2, 10, 11]"},
+		{Input: `function f(x) { yield x; return x; } map([1, 2], f);`, Result: "[1, 2]"},
+		{Input: `return 3;`, Result: "[]"},
+		{Input: `x = 1;`, Result: "[]"},
+	}
+
+	for _, tst := range tests {
+		for _, flags := range [][]byte{{}, {NoOptimize}} {
+
+			obj := New(tst.Input)
+			if err := obj.Prepare(flags); err != nil {
+				t.Fatalf("Failed to compile %s: %s", tst.Input, err)
+			}
+
+			// Twice, to ensure the values of one run aren't
+			// kept by the next.
+			for i := 0; i < 2; i++ {
+				ret, err := obj.ExecuteCollect(map[string]interface{}{"Stop": true})
+				if err != nil {
+					t.Fatalf("Found unexpected error running %s: %s", tst.Input, err)
+				}
+				if ret.Inspect() != tst.Result {
+					t.Fatalf("Found unexpected result running %s: got %s, expected %s", tst.Input, ret.Inspect(), tst.Result)
+				}
+			}
+		}
+	}
+
+	// The values are available after other kinds of run too.
+	obj := New(`yield "a"; yield "b"; return true;`)
+	if err := obj.Prepare(); err != nil {
+		t.Fatalf("Failed to compile: %s", err)
+	}
+	if obj.Yielded() != nil {
+		t.Fatalf("Found values before the script was run")
+	}
+	ok, err := obj.Run(nil)
+	if err != nil || !ok {
+		t.Fatalf("Unexpected result running script: %v %v", ok, err)
+	}
+	if len(obj.Yielded()) != 2 || obj.Yielded()[1].Inspect() != "b" {
+		t.Fatalf("Unexpected values yielded: %v", obj.Yielded())
+	}
+
+	// Other errors are reported.
+	obj = New(`yield 1; return 1 / 0;`)
+	if err := obj.Prepare(); err != nil {
+		t.Fatalf("Failed to compile: %s", err)
+	}
+	if _, err := obj.ExecuteCollect(nil); err == nil {
+		t.Fatalf("Expected an error dividing by zero")
+	}
+
+	// Yield is a statement, which needs a value.
+	for _, input := range []string{`yield;`, `yield 1`, `x = yield 1;`} {
+		obj := New(input)
+		if err := obj.Prepare(); err == nil {
+			t.Fatalf("Expected an error compiling %s", input)
+		}
+	}
+}
+
+// TestStrictFields tests that unknown fields may be reported as errors.
+func TestStrictFields(t *testing.T) {
+
+	type Record struct {
+		ID   int
+		Name string
+		Tags []string
+	}
+
+	valid := []string{
+		`return record.ID == 3;`,
+		`return ID == 3 && Name == "steve";`,
+		`return len(Tags) == 0 && type(null) == "null";`,
+		`count = 1; return count + ID == 4;`,
+		`return Host == "example" && Limit == 10;`,
+		`function f(x) { return x; } return len(map([1], f)) == 1;`,
+		`return exists("Missing") == false;`,
+		`return Computed == 7;`,
+	}
+	invalid := map[string]string{
+		`return recrod.ID == 3;`:             "recrod",
+		`return ID == 3 && Nmae == "steve";`: "Nmae",
+		`y = x; x = 1; return y;`:            "x",
+		`return $Missing;`:                   "Missing",
+	}
+
+	setup := func(input string) *Eval {
+		obj := New(input)
+		obj.SetInputName("record")
+		obj.SetVariable("Host", &object.String{Value: "example"})
+		obj.SetConstant("Limit", &object.Integer{Value: 10})
+		obj.SetFieldResolver(func(o interface{}, field string) (object.Object, bool) {
+			if field == "Computed" {
+				return &object.Integer{Value: 7}, true
+			}
+			return nil, false
+		})
+		obj.SetStrictFields(true)
+		if err := obj.Prepare(); err != nil {
+			t.Fatalf("Failed to compile %s: %s", input, err)
+		}
+		return obj
+	}
+
+	rec := &Record{ID: 3, Name: "steve"}
+
+	for _, input := range valid {
+		ret, err := setup(input).Run(rec)
+		if err != nil {
+			t.Fatalf("Found unexpected error running %s: %s", input, err)
+		}
+		if !ret {
+			t.Fatalf("Found unexpected result running %s", input)
+		}
+	}
+
+	for input, name := range invalid {
+		_, err := setup(input).Run(rec)
+
+		var re *RuntimeError
+		if !errors.As(err, &re) || re.Code != ErrUnknownField {
+			t.Fatalf("Expected an unknown field running '%s', got %v", input, err)
+		}
+		if !strings.HasSuffix(err.Error(), "unknown field: "+name) {
+			t.Fatalf("Unexpected error running '%s': %s", input, err)
+		}
+	}
+
+	// The error reports the position of the unknown field itself,
+	// rather than that of the expression which contains it.
+	positions := map[string]code.Position{
+		`x = 1; return recrod;`:                    {Line: 1, Column: 15},
+		`return ID == 3 && Nmae == "steve";`:       {Line: 1, Column: 19},
+		"x = 1;\nif ( x > 0 ) {\n  return Nmae; }": {Line: 3, Column: 10},
+	}
+	for input, pos := range positions {
+		_, err := setup(input).Run(rec)
+
+		var re *RuntimeError
+		if !errors.As(err, &re) || re.Code != ErrUnknownField {
+			t.Fatalf("Expected an unknown field running '%s', got %v", input, err)
+		}
+		if re.Position != pos {
+			t.Fatalf("Unexpected position running '%s': got %v, expected %v", input, re.Position, pos)
+		}
+	}
+
+	// The default is lenient, and strictness may be changed after
+	// the script is prepared - or disabled again.
+	obj := New(`return type(Nmae) == "null";`)
+	if err := obj.Prepare(); err != nil {
+		t.Fatalf("Failed to compile: %s", err)
+	}
+	if ret, err := obj.Run(rec); err != nil || !ret {
+		t.Fatalf("Unexpected result running leniently: %v %v", ret, err)
+	}
+	obj.SetStrictFields(true)
+	if _, err := obj.Clone().Run(rec); err == nil {
+		t.Fatalf("Expected an error running strictly")
+	}
+	obj.SetStrictFields(false)
+	if ret, err := obj.Run(rec); err != nil || !ret {
+		t.Fatalf("Unexpected result running leniently: %v %v", ret, err)
+	}
+}
+
+// TestRunes tests that strings are handled by character, rather than by
+// byte, so that multi-byte characters are never split.
+func TestRunes(t *testing.T) {
+
+	tests := []struct {
+		Input  string
+		Result string
+	}{
+		{Input: `return len("héllo");`, Result: "5"},
+		{Input: `return len(Greeting);`, Result: "7"},
+		{Input: `return "héllo"[1];`, Result: "é"},
+		{Input: `return Greeting[-1];`, Result: "👋"},
+		{Input: `return Greeting[5];`, Result: " "},
+		{Input: `return type(Greeting[7]);`, Result: "null"},
+		{Input: `return Greeting[1:3];`, Result: "él"},
+		{Input: `return Greeting[-2:];`, Result: " 👋"},
+		{Input: `return reverse(Greeting);`, Result: "👋 olléh"},
+		{Input: `return map("né👋", "upper");`, Result: "[N, É, 👋]"},
+		{Input: `function ascii(c) { return c ~= /^[a-z ]$/; } return len(filter(Greeting, ascii));`, Result: "4"},
+		{Input: `function count(n, c) { return n + 1; } return reduce(Greeting, count, 0);`, Result: "7"},
+		{Input: `return split("a👋b", "");`, Result: "[a, 👋, b]"},
+	}
+
+	for _, tst := range tests {
+		for _, flags := range [][]byte{{}, {NoOptimize}} {
+
+			obj := New(tst.Input)
+			if err := obj.Prepare(flags); err != nil {
+				t.Fatalf("Failed to compile %s: %s", tst.Input, err)
+			}
+
+			ret, err := obj.Execute(map[string]interface{}{"Greeting": "héllo 👋"})
+			if err != nil {
+				t.Fatalf("Found unexpected error running %s: %s", tst.Input, err)
+			}
+			if ret.Inspect() != tst.Result {
+				t.Fatalf("Found unexpected result running %s: got %s, expected %s", tst.Input, ret.Inspect(), tst.Result)
+			}
+		}
+	}
+}
+
+// TestFunctionNames tests listing the available functions.
+func TestFunctionNames(t *testing.T) {
+
+	obj := New(`function zzz() { return 1; } return zzz();`)
+	obj.AddFunction("aaa", func(args []object.Object) object.Object {
+		return &object.Null{}
+	})
+	obj.AddFunction("len", func(args []object.Object) object.Object {
+		return &object.Null{}
+	})
+
+	count := func(list []string, name string) int {
+		n := 0
+		for _, fn := range list {
+			if fn == name {
+				n++
+			}
+		}
+		return n
+	}
+
+	list := obj.Functions()
+	if !sort.StringsAreSorted(list) {
+		t.Fatalf("The functions are not sorted: %v", list)
+	}
+	if list[0] != "aaa" || count(list, "len") != 1 || count(list, "print") != 1 || count(list, "zzz") != 0 {
+		t.Fatalf("Unexpected functions: %v", list)
+	}
+
+	// Functions defined by the script are present once it is prepared.
+	if err := obj.Prepare(); err != nil {
+		t.Fatalf("Failed to compile: %s", err)
+	}
+	list = obj.Functions()
+	if list[len(list)-1] != "zzz" {
+		t.Fatalf("Expected the script function to be listed: %v", list)
+	}
+	for _, fn := range list {
+		if !obj.HasFunction(fn) {
+			t.Fatalf("Listed function %s is not available", fn)
+		}
+	}
+
+	obj.RemoveFunction("aaa")
+	if count(obj.Functions(), "aaa") != 0 {
+		t.Fatalf("Found a function which was removed")
+	}
+}
+
+// TestNumericPromotion tests every arithmetic, and comparison, operator
+// with each combination of integer and float operands.
+//
+// If either operand is a float then the result of arithmetic is a float,
+// and comparisons are made by value, so `1 == 1.0` is true.
+func TestNumericPromotion(t *testing.T) {
+
+	operands := [][2]string{{"7", "2"}, {"7", "2.0"}, {"7.0", "2"}, {"7.0", "2.0"}}
+
+	tests := []struct {
+		Op     string
+		Result [4]string
+	}{
+		{Op: "+", Result: [4]string{"INTEGER 9", "FLOAT 9", "FLOAT 9", "FLOAT 9"}},
+		{Op: "-", Result: [4]string{"INTEGER 5", "FLOAT 5", "FLOAT 5", "FLOAT 5"}},
+		{Op: "*", Result: [4]string{"INTEGER 14", "FLOAT 14", "FLOAT 14", "FLOAT 14"}},
+		{Op: "/", Result: [4]string{"INTEGER 3", "FLOAT 3.5", "FLOAT 3.5", "FLOAT 3.5"}},
+		{Op: "%", Result: [4]string{"INTEGER 1", "FLOAT 1", "FLOAT 1", "FLOAT 1"}},
+		{Op: "**", Result: [4]string{"INTEGER 49", "FLOAT 49", "FLOAT 49", "FLOAT 49"}},
+		{Op: "==", Result: [4]string{"BOOLEAN false", "BOOLEAN false", "BOOLEAN false", "BOOLEAN false"}},
+		{Op: "!=", Result: [4]string{"BOOLEAN true", "BOOLEAN true", "BOOLEAN true", "BOOLEAN true"}},
+		{Op: "<", Result: [4]string{"BOOLEAN false", "BOOLEAN false", "BOOLEAN false", "BOOLEAN false"}},
+		{Op: "<=", Result: [4]string{"BOOLEAN false", "BOOLEAN false", "BOOLEAN false", "BOOLEAN false"}},
+		{Op: ">", Result: [4]string{"BOOLEAN true", "BOOLEAN true", "BOOLEAN true", "BOOLEAN true"}},
+		{Op: ">=", Result: [4]string{"BOOLEAN true", "BOOLEAN true", "BOOLEAN true", "BOOLEAN true"}},
+	}
+
+	run := func(src string) object.Object {
+		obj := New(src)
+		if err := obj.Prepare(); err != nil {
+			t.Fatalf("Failed to compile %s: %s", src, err)
+		}
+		ret, err := obj.Execute(nil)
+		if err != nil {
+			t.Fatalf("Found unexpected error running %s: %s", src, err)
+		}
+		return ret
+	}
+
+	for _, tst := range tests {
+		for i, pair := range operands {
+
+			// The operands are held in variables, so that
+			// the optimizer can't fold them.
+			src := fmt.Sprintf("a = %s; b = %s; return a %s b;", pair[0], pair[1], tst.Op)
+			ret := run(src)
+
+			out := fmt.Sprintf("%s %s", ret.Type(), ret.Inspect())
+			if out != tst.Result[i] {
+				t.Fatalf("Found unexpected result running %s: got %s, expected %s", src, out, tst.Result[i])
+			}
+		}
+	}
+
+	// Numbers which are equal compare as equal, whatever their type,
+	// but integers aren't rounded to the nearest float.
+	equal := []string{
+		`return 1 == 1.0 && 1.0 == 1 && 0 == -0.0;`,
+		`return 2 <= 2.0 && 2.0 >= 2 && !(2 < 2.0) && !(2.0 > 2);`,
+		`return 1 < 1.5 && 1.5 < 2 && -1 > -1.5;`,
+		`return 9007199254740993 != 9007199254740992.0;`,
+		`return 9007199254740993 > 9007199254740992.0;`,
+		`return 9223372036854775807 < 9223372036854775808.0;`,
+		`return -9223372036854775807 - 1 == -9223372036854775808.0;`,
+		`return [1, 2] == [1.0, 2.0] && {"a": 1} == {"a": 1.0};`,
+		`return 1 in [1.0] && 2.0 in [1, 2] && !(3 in [1.5]);`,
+		`return contains([1.0], 1) && !contains([1], 1.5);`,
+		`x = 2; switch (x) { case 2.0 { return true; } } return false;`,
+	}
+	for _, src := range equal {
+		for _, flags := range [][]byte{{}, {NoOptimize}} {
+			obj := New(src)
+			if err := obj.Prepare(flags); err != nil {
+				t.Fatalf("Failed to compile %s: %s", src, err)
+			}
+			ret, err := obj.Run(nil)
+			if err != nil {
+				t.Fatalf("Found unexpected error running %s: %s", src, err)
+			}
+			if !ret {
+				t.Fatalf("Found unexpected result running %s", src)
+			}
+		}
+	}
+
+	// Operators which don't apply to numbers are still errors.
+	for _, src := range []string{`return 1 ~= 2.0;`, `return 1.0 in 2;`} {
+		obj := New(src)
+		if err := obj.Prepare(); err != nil {
+			t.Fatalf("Failed to compile %s: %s", src, err)
+		}
+		if _, err := obj.Execute(nil); err == nil {
+			t.Fatalf("Expected an error running %s", src)
+		}
+	}
+}
+
+// row is a record which looks up its own fields, for TestLookupable.
+type row struct {
+	values  map[string]string
+	lookups int
+}
+
+func (r *row) Lookup(field string) (object.Object, bool) {
+	r.lookups++
+	if field == "child" {
+		return &object.Native{Value: &row{values: map[string]string{"name": "child"}}}, true
+	}
+	val, ok := r.values[field]
+	if !ok {
+		return nil, false
+	}
+	return &object.String{Value: val}, true
+}
+
+// tags is a collection which indexes itself, for TestLookupable.
+type tags []string
+
+func (t tags) Index(index object.Object) (object.Object, bool) {
+	switch index := index.(type) {
+	case *object.Integer:
+		if index.Value >= 0 && index.Value < int64(len(t)) {
+			return &object.String{Value: strings.ToUpper(t[index.Value])}, true
+		}
+	case *object.String:
+		for i, tag := range t {
+			if tag == index.Value {
+				return &object.Integer{Value: int64(i)}, true
+			}
+		}
+	}
+	return nil, false
+}
+
+// TestLookupable tests objects which look up, and index, themselves.
+func TestLookupable(t *testing.T) {
+
+	type Document struct {
+		Owner *row
+		Tags  tags
+		Title string
+	}
+
+	input := &row{values: map[string]string{"name": "steve", "secret": "hidden"}}
+
+	tests := []struct {
+		Input  string
+		Result string
+		Object interface{}
+	}{
+		{Input: `return name;`, Result: "steve", Object: input},
+		{Input: `return self.name;`, Result: "steve", Object: input},
+		{Input: `return child.name;`, Result: "child", Object: input},
+		{Input: `return self["child"]["name"];`, Result: "child", Object: input},
+		{Input: `return type(missing);`, Result: "null", Object: input},
+		{Input: `return type(child.missing);`, Result: "null", Object: input},
+		{Input: `return exists("name") && !exists("values");`, Result: "true", Object: input},
+		{Input: `return Owner.name + ": " + Title;`, Result: "steve: Report", Object: &Document{Owner: input, Title: "Report"}},
+		{Input: `return Tags[1] + " " + Tags["b"];`, Result: "B 1", Object: &Document{Tags: tags{"a", "b"}}},
+		{Input: `return type(Tags[5]);`, Result: "null", Object: &Document{Tags: tags{"a", "b"}}},
+		{Input: `return type(Owner);`, Result: "null", Object: &Document{}},
+	}
+
+	for _, tst := range tests {
+		for _, flags := range [][]byte{{}, {NoOptimize}} {
+
+			obj := New(tst.Input)
+			if err := obj.Prepare(flags); err != nil {
+				t.Fatalf("Failed to compile %s: %s", tst.Input, err)
+			}
+
+			ret, err := obj.Execute(tst.Object)
+			if err != nil {
+				t.Fatalf("Found unexpected error running %s: %s", tst.Input, err)
+			}
+			if ret.Inspect() != tst.Result {
+				t.Fatalf("Found unexpected result running %s: got %s, expected %s", tst.Input, ret.Inspect(), tst.Result)
+			}
+		}
+	}
+
+	// Fields are looked up each time they're referred to, rather
+	// than being discovered, and cached, up-front.
+	input.lookups = 0
+	obj := New(`return name + name;`)
+	if err := obj.Prepare(); err != nil {
+		t.Fatalf("Failed to compile: %s", err)
+	}
+	if _, err := obj.Execute(input); err != nil {
+		t.Fatalf("Found unexpected error: %s", err)
+	}
+	if input.lookups != 2 {
+		t.Fatalf("Expected two lookups, got %d", input.lookups)
+	}
+
+	// Unknown fields are still reported in strict mode.
+	obj = New(`return nmae;`)
+	obj.SetStrictFields(true)
+	if err := obj.Prepare(); err != nil {
+		t.Fatalf("Failed to compile: %s", err)
+	}
+	var re *RuntimeError
+	if _, err := obj.Execute(input); !errors.As(err, &re) || re.Code != ErrUnknownField {
+		t.Fatalf("Expected an unknown field, got %v", err)
+	}
+
+	// Fields must be looked up by name.
+	obj = New(`return self[1];`)
+	if err := obj.Prepare(); err != nil {
+		t.Fatalf("Failed to compile: %s", err)
+	}
+	if _, err := obj.Execute(input); !errors.As(err, &re) || re.Code != ErrIndex {
+		t.Fatalf("Expected an index error, got %v", err)
+	}
+}
+
+// TestWarnings tests reporting variables which are read before they're
+// assigned.
+func TestWarnings(t *testing.T) {
+
+	tests := []struct {
+		Input    string
+		Warnings []string
+	}{
+		{Input: `x = 1; return x;`},
+		{Input: `return Name == "steve";`},
+		{Input: `return count; count = 1;`, Warnings: []string{"1:8: count is read before it is assigned"}},
+		{Input: `if (Name) { total = 1; } return total;`, Warnings: []string{"1:33: total is read before it is assigned"}},
+		{Input: `total = 0; if (Name) { total = 1; } return total;`},
+		{Input: `while (i < 3) { i = i + 1; } return true;`, Warnings: []string{
+			"1:8: i is read before it is assigned",
+			"1:21: i is read before it is assigned",
+		}},
+		{Input: `function f(a) { b = a; return b; } return f(1);`},
+		{Input: `function f() { return local; }
+function g() { local = 1; return local; }
+return f() + g() + local;`, Warnings: []string{
+			"1:23: local is read before it is assigned",
+			"3:20: local is read before it is assigned",
+		}},
+		{Input: `try { throw 1; } catch (e) { return e; }`},
+		{Input: `a, b = [1, 2]; return a + b;`},
+		{Input: `x = $x; return x;`, Warnings: []string{"1:5: x is read before it is assigned"}},
+		{Input: `Host = Host + "!"; return Host;`},
+		{Input: `self = 1; return true;`},
+		{Input: `print = 3; return print;`},
+	}
+
+	for _, tst := range tests {
+
+		obj := New(tst.Input)
+		obj.SetVariable("Host", &object.String{Value: "example"})
+		if err := obj.Prepare([]byte{WarnUnassigned, BlockScope}); err != nil {
+			t.Fatalf("Failed to compile %s: %s", tst.Input, err)
+		}
+
+		if !reflect.DeepEqual(obj.Warnings(), tst.Warnings) {
+			t.Fatalf("Unexpected warnings for %s: got %q, expected %q", tst.Input, obj.Warnings(), tst.Warnings)
+		}
+
+		// Warnings are only reported if they're requested.
+		if err := obj.Prepare(); err != nil {
+			t.Fatalf("Failed to compile %s: %s", tst.Input, err)
+		}
+		if len(obj.Warnings()) != 0 {
+			t.Fatalf("Unexpected warnings for %s: %q", tst.Input, obj.Warnings())
+		}
+	}
+
+	// Warnings may be combined with other flags, and are kept by Clone.
+	obj := New(`return x; x = 1;`)
+	if err := obj.Prepare([]byte{NoOptimize, WarnUnassigned}); err != nil {
+		t.Fatalf("Failed to compile: %s", err)
+	}
+	if len(obj.Clone().Warnings()) != 1 {
+		t.Fatalf("Expected a warning, got %q", obj.Clone().Warnings())
+	}
+
+	// Once the fields are declared names which are neither fields, nor
+	// assigned, are reported too.
+	known := []struct {
+		Input    string
+		Fields   []string
+		Warnings []string
+	}{
+		{Input: `count = 1; return cuont;`},
+		{Input: `count = 1; return cuont;`, Fields: []string{"Name"}, Warnings: []string{"1:19: cuont is never assigned, and is not a known field"}},
+		{Input: `return Name == "steve";`, Fields: []string{"Name"}},
+		{Input: `return Nmae == "steve";`, Fields: []string{"Name"}, Warnings: []string{"1:8: Nmae is never assigned, and is not a known field"}},
+		{Input: `return Name == "steve" && len(Host) > 0;`, Fields: []string{}, Warnings: []string{"1:8: Name is never assigned, and is not a known field"}},
+		{Input: `return count + Name; count = 1;`, Fields: []string{"Name"}, Warnings: []string{"1:8: count is read before it is assigned"}},
+		{Input: `return x == null;`, Fields: []string{"x"}},
+	}
+
+	for _, tst := range known {
+
+		obj := New(tst.Input)
+		obj.SetVariable("Host", &object.String{Value: "example"})
+		obj.SetKnownFields(tst.Fields)
+		if err := obj.Prepare([]byte{WarnUnassigned}); err != nil {
+			t.Fatalf("Failed to compile %s: %s", tst.Input, err)
+		}
+
+		if !reflect.DeepEqual(obj.Warnings(), tst.Warnings) {
+			t.Fatalf("Unexpected warnings for %s: got %q, expected %q", tst.Input, obj.Warnings(), tst.Warnings)
+		}
+	}
 }
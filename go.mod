@@ -1,6 +1,6 @@
 module github.com/skx/evalfilter/v2
 
-go 1.12
+go 1.13
 
 require (
 	github.com/dvyukov/go-fuzz v0.0.0-20191206100749-a378175e205c // indirect
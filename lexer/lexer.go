@@ -8,6 +8,7 @@ package lexer
 import (
 	"errors"
 	"fmt"
+	"strconv"
 	"strings"
 	"unicode"
 
@@ -28,17 +29,41 @@ type Lexer struct {
 	// A rune slice of our input string
 	characters []rune
 
+	// The line and column of the current character.
+	line   int
+	column int
+
 	// Previous token.
 	prevToken token.Token
 }
 
 // New creates a Lexer instance from the given string
 func New(input string) *Lexer {
-	l := &Lexer{characters: []rune(input)}
+	l := &Lexer{characters: []rune(input), line: 1}
 	l.readChar()
 	return l
 }
 
+// Tokens returns all of the tokens in the given script, ending with an
+// EOF token.
+//
+// This allows tools, such as syntax-highlighters, to see the script just
+// as the parser does.  Problems, such as an unterminated string, are
+// returned as ILLEGAL tokens, and the remainder of the script is still
+// tokenized.  Comments and white space are skipped.
+func Tokens(script string) []token.Token {
+	l := New(script)
+
+	var out []token.Token
+	for {
+		tok := l.NextToken()
+		out = append(out, tok)
+		if tok.Type == token.EOF {
+			return out
+		}
+	}
+}
+
 // GetLine returns the rough line-number of our current position.
 //
 // This is used to report errors in a more humane manner.
@@ -60,6 +85,15 @@ func (l *Lexer) GetLine() int {
 
 // read forward one character.
 func (l *Lexer) readChar() {
+
+	// Keep track of our line and column.
+	if l.ch == rune('\n') {
+		l.line++
+		l.column = 1
+	} else {
+		l.column++
+	}
+
 	if l.readPosition >= len(l.characters) {
 		l.ch = rune(0)
 	} else {
@@ -71,8 +105,9 @@ func (l *Lexer) readChar() {
 
 // NextToken reads and returns the next token, skipping any intervening
 // white space, and swallowing any comments, in the process.
-func (l *Lexer) NextToken() token.Token {
-	var tok token.Token
+//
+// The token records the line and column at which it started.
+func (l *Lexer) NextToken() (tok token.Token) {
 	l.skipWhitespace()
 
 	// skip single-line comments
@@ -81,6 +116,21 @@ func (l *Lexer) NextToken() token.Token {
 		return (l.NextToken())
 	}
 
+	// skip block comments, which may span multiple lines.
+	if l.ch == rune('/') && l.peekChar() == rune('*') {
+		line, column := l.line, l.column
+		if !l.skipBlockComment() {
+			return token.Token{Type: token.ILLEGAL, Literal: "unterminated comment", Line: line, Column: column}
+		}
+		return (l.NextToken())
+	}
+
+	line, column := l.line, l.column
+	defer func() {
+		tok.Line = line
+		tok.Column = column
+	}()
+
 	switch l.ch {
 
 	case rune('&'):
@@ -117,14 +167,46 @@ func (l *Lexer) NextToken() token.Token {
 	case rune(','):
 		tok = newToken(token.COMMA, l.ch)
 
+	case rune(':'):
+		tok = newToken(token.COLON, l.ch)
+
+	case rune('?'):
+		if l.peekChar() == rune('?') {
+			ch := l.ch
+			l.readChar()
+			tok = token.Token{Type: token.COALESCE, Literal: string(ch) + string(l.ch)}
+		} else if l.peekChar() == rune('.') {
+			ch := l.ch
+			l.readChar()
+			tok = token.Token{Type: token.SAFE_PERIOD, Literal: string(ch) + string(l.ch)}
+		} else {
+			tok = newToken(token.QUESTION, l.ch)
+		}
+
 	case rune('.'):
 		tok = newToken(token.PERIOD, l.ch)
 
 	case rune('+'):
-		tok = newToken(token.PLUS, l.ch)
+		if l.peekChar() == rune('=') {
+			ch := l.ch
+			l.readChar()
+			tok = token.Token{Type: token.PLUS_EQ, Literal: string(ch) + string(l.ch)}
+		} else if l.peekChar() == rune('+') && l.postfix() {
+			ch := l.ch
+			l.readChar()
+			tok = token.Token{Type: token.INCREMENT, Literal: string(ch) + string(l.ch)}
+		} else {
+			tok = newToken(token.PLUS, l.ch)
+		}
 
 	case rune('%'):
-		tok = newToken(token.MOD, l.ch)
+		if l.peekChar() == rune('=') {
+			ch := l.ch
+			l.readChar()
+			tok = token.Token{Type: token.MOD_EQ, Literal: string(ch) + string(l.ch)}
+		} else {
+			tok = newToken(token.MOD, l.ch)
+		}
 
 	case rune('√'):
 		tok = newToken(token.SQRT, l.ch)
@@ -142,7 +224,17 @@ func (l *Lexer) NextToken() token.Token {
 		tok = newToken(token.RSQUARE, l.ch)
 
 	case rune('-'):
-		tok = newToken(token.MINUS, l.ch)
+		if l.peekChar() == rune('=') {
+			ch := l.ch
+			l.readChar()
+			tok = token.Token{Type: token.MINUS_EQ, Literal: string(ch) + string(l.ch)}
+		} else if l.peekChar() == rune('-') && l.postfix() {
+			ch := l.ch
+			l.readChar()
+			tok = token.Token{Type: token.DECREMENT, Literal: string(ch) + string(l.ch)}
+		} else {
+			tok = newToken(token.MINUS, l.ch)
+		}
 
 	case rune('/'):
 
@@ -161,7 +253,13 @@ func (l *Lexer) NextToken() token.Token {
 			l.prevToken.Type == token.RSQUARE ||
 			l.prevToken.Type == token.FLOAT ||
 			l.prevToken.Type == token.INT {
-			tok = newToken(token.SLASH, l.ch)
+			if l.peekChar() == rune('=') {
+				ch := l.ch
+				l.readChar()
+				tok = token.Token{Type: token.SLASH_EQ, Literal: string(ch) + string(l.ch)}
+			} else {
+				tok = newToken(token.SLASH, l.ch)
+			}
 		} else {
 			str, err := l.readRegexp()
 			if err == nil {
@@ -178,6 +276,10 @@ func (l *Lexer) NextToken() token.Token {
 			ch := l.ch
 			l.readChar()
 			tok = token.Token{Type: token.POW, Literal: string(ch) + string(l.ch)}
+		} else if l.peekChar() == rune('=') {
+			ch := l.ch
+			l.readChar()
+			tok = token.Token{Type: token.ASTERISK_EQ, Literal: string(ch) + string(l.ch)}
 		} else {
 			tok = newToken(token.ASTERISK, l.ch)
 		}
@@ -223,17 +325,20 @@ func (l *Lexer) NextToken() token.Token {
 		}
 
 	case rune('"'):
-		str, err := l.readString('"')
+		str, interpolated, err := l.readString('"')
 		if err == nil {
 			tok.Type = token.STRING
 			tok.Literal = str
+			if interpolated {
+				tok.Type = token.INTERPOLATED
+			}
 		} else {
 			tok.Type = token.ILLEGAL
 			tok.Literal = err.Error()
 		}
 
 	case rune('\''):
-		str, err := l.readString('\'')
+		str, _, err := l.readString('\'')
 
 		if err == nil {
 			tok.Type = token.STRING
@@ -263,7 +368,6 @@ func (l *Lexer) NextToken() token.Token {
 		}
 		tok.Type = token.ILLEGAL
 		tok.Literal = fmt.Sprintf("invalid character for indentifier '%c'", l.ch)
-		return tok
 
 	}
 
@@ -292,6 +396,36 @@ func (l *Lexer) readIdentifier() string {
 	return id
 }
 
+// postfix reports whether the `++`, or `--`, at the current position is
+// an increment, or decrement, rather than an operator followed by a prefix
+// operator.
+//
+// They are only an increment, or decrement, after a name, and when they
+// are not followed by something which could be an operand - so that
+// `3 - -1`, and `a--3`, are both subtractions.
+func (l *Lexer) postfix() bool {
+	if l.prevToken.Type != token.IDENT {
+		return false
+	}
+
+	// Find the first character after the operator, ignoring any
+	// spaces.
+	i := l.readPosition + 1
+	for i < len(l.characters) && (l.characters[i] == rune(' ') || l.characters[i] == rune('\t')) {
+		i++
+	}
+	if i >= len(l.characters) {
+		return true
+	}
+
+	ch := l.characters[i]
+	if ch == rune('/') {
+		// A comment, rather than a regular expression.
+		return i+1 < len(l.characters) && (l.characters[i+1] == rune('/') || l.characters[i+1] == rune('*'))
+	}
+	return !isIdentifier(ch) && !strings.ContainsRune("\"'([{-!√", ch)
+}
+
 // skip over any white space.
 func (l *Lexer) skipWhitespace() {
 	for isWhitespace(l.ch) {
@@ -307,13 +441,38 @@ func (l *Lexer) skipComment() {
 	l.skipWhitespace()
 }
 
+// skip a block comment, which runs until the closing "*/".
+//
+// Returns false if the end of the input was reached before the comment
+// was closed.
+func (l *Lexer) skipBlockComment() bool {
+
+	// skip the opening "/*"
+	l.readChar()
+	l.readChar()
+
+	for !(l.ch == rune('*') && l.peekChar() == rune('/')) {
+		if l.ch == rune(0) {
+			return false
+		}
+		l.readChar()
+	}
+
+	// skip the closing "*/"
+	l.readChar()
+	l.readChar()
+	return true
+}
+
 // read a number.  We only care about numerical digits here, floats will
 // be handled elsewhere.
+//
+// Underscores are allowed as digit-separators, e.g. `1_000_000`.
 func (l *Lexer) readNumber() string {
 
 	id := ""
 
-	for isDigit(l.ch) {
+	for isDigit(l.ch) || l.ch == rune('_') {
 		id += string(l.ch)
 		l.readChar()
 	}
@@ -321,8 +480,29 @@ func (l *Lexer) readNumber() string {
 }
 
 // read a decimal number, either int or floating-point.
+//
+// Integers may also be written in hexadecimal, octal, or binary, with
+// the prefixes `0x`, `0o`, and `0b` respectively.
 func (l *Lexer) readDecimal() token.Token {
 
+	//
+	// Hex, octal, or binary?
+	//
+	// We read all the letters and digits which follow the prefix,
+	// so that invalid digits are reported by the parser, rather
+	// than being treated as the start of another token.
+	//
+	if l.ch == rune('0') && strings.ContainsRune("xXoObB", l.peekChar()) {
+		integer := string(l.ch)
+		l.readChar()
+
+		for isDigit(l.ch) || unicode.IsLetter(l.ch) || l.ch == rune('_') {
+			integer += string(l.ch)
+			l.readChar()
+		}
+		return token.Token{Type: token.INT, Literal: integer}
+	}
+
 	//
 	// Read an integer-number.
 	//
@@ -331,7 +511,10 @@ func (l *Lexer) readDecimal() token.Token {
 	//
 	// If the next token is a `.` we've got a floating-point number.
 	//
-	if l.ch == rune('.') && isDigit(l.peekChar()) {
+	// Unless this number follows a `.` itself, as in `matrix.0.1`,
+	// in which case it is an index.
+	//
+	if l.ch == rune('.') && isDigit(l.peekChar()) && l.prevToken.Type != token.PERIOD {
 
 		// Skip the period
 		l.readChar()
@@ -347,57 +530,246 @@ func (l *Lexer) readDecimal() token.Token {
 	return token.Token{Type: token.INT, Literal: integer}
 }
 
-// read a string, deliminated by the given character.
-func (l *Lexer) readString(delim rune) (string, error) {
+// readString reads a string, which is terminated by the given delimiter.
+//
+// Double-quoted strings may contain interpolated expressions, such as
+// "${name}".  If any are found then the raw content of the string is
+// returned, without escape-sequences being processed, along with a flag
+// to indicate that it must be split by SplitInterpolated.
+func (l *Lexer) readString(delim rune) (string, bool, error) {
 	out := ""
 
+	// raw holds the content exactly as written.
+	raw := ""
+	interpolated := false
+
 	for {
 		l.readChar()
 
 		if l.ch == rune(0) {
-			return "", fmt.Errorf("unterminated string")
+			return "", false, fmt.Errorf("unterminated string")
 		}
 		if l.ch == delim {
 			break
 		}
+
+		//
+		// Handle "${ ... }"
+		//
+		if delim == rune('"') && l.ch == rune('$') && l.peekChar() == rune('{') {
+			expr, err := l.readInterpolation()
+			if err != nil {
+				return "", false, err
+			}
+			raw += "${" + expr + "}"
+			interpolated = true
+			continue
+		}
+
 		//
 		// Handle \n, \r, \t, \", etc.
 		//
 		if l.ch == '\\' {
-
-			// Line ending with "\" + newline
-			if l.peekChar() == '\n' {
-				// consume the newline.
-				l.readChar()
-				continue
+			start := l.position
+			ch, ok, err := l.readEscape()
+			if err != nil {
+				l.skipString(delim)
+				return "", false, err
+			}
+			raw += string(l.characters[start : l.position+1])
+			if ok {
+				out = out + string(ch)
 			}
+			continue
+		}
 
-			l.readChar()
+		raw += string(l.ch)
+		out = out + string(l.ch)
+	}
 
+	if interpolated {
+		return raw, true, nil
+	}
+	return out, false, nil
+}
+
+// skipString skips over the remainder of a string which contains an
+// error, so that lexing continues after its closing delimiter.
+func (l *Lexer) skipString(delim rune) {
+	for {
+		l.readChar()
+
+		switch l.ch {
+		case rune(0), delim:
+			return
+		case rune('\\'):
+			l.readChar()
 			if l.ch == rune(0) {
-				return "", errors.New("unterminated string")
+				return
 			}
-			if l.ch == rune('n') {
-				l.ch = '\n'
+		}
+	}
+}
+
+// readEscape handles an escape-sequence within a string, the current
+// character being the backslash.
+//
+// It returns the character the sequence represents, along with false if
+// the sequence was a line-continuation, which represents nothing.
+func (l *Lexer) readEscape() (rune, bool, error) {
+
+	// Line ending with "\" + newline
+	if l.peekChar() == '\n' {
+		// consume the newline.
+		l.readChar()
+		return 0, false, nil
+	}
+
+	l.readChar()
+
+	switch l.ch {
+	case rune(0):
+		return 0, false, errors.New("unterminated string")
+	case rune('n'):
+		return '\n', true, nil
+	case rune('r'):
+		return '\r', true, nil
+	case rune('t'):
+		return '\t', true, nil
+	case rune('u'):
+		return l.readUnicodeEscape()
+	case rune('\\'), rune('"'), rune('\''), rune('$'):
+		// These are themselves, so "\\" is a backslash, and
+		// "\$" is a dollar.
+		return l.ch, true, nil
+	}
+
+	return 0, false, fmt.Errorf("invalid escape sequence \"\\%c\"", l.ch)
+}
+
+// readUnicodeEscape reads the four hexadecimal digits of a "\uXXXX"
+// escape-sequence, the current character being the "u".
+func (l *Lexer) readUnicodeEscape() (rune, bool, error) {
+
+	digits := ""
+	for len(digits) < 4 && isHexDigit(l.peekChar()) {
+		l.readChar()
+		digits += string(l.ch)
+	}
+
+	if len(digits) != 4 {
+		return 0, false, fmt.Errorf("invalid unicode escape sequence \"\\u%s\"", digits)
+	}
+
+	val, err := strconv.ParseUint(digits, 16, 32)
+	if err != nil {
+		return 0, false, err
+	}
+	return rune(val), true, nil
+}
+
+// readInterpolation reads the source of an expression embedded in a
+// string, the current character being the "$" of "${".
+//
+// The source is returned without the surrounding "${" and "}", and we
+// cope with braces and strings which are nested inside it.
+func (l *Lexer) readInterpolation() (string, error) {
+
+	// Skip the "${"
+	l.readChar()
+	start := l.readPosition
+
+	depth := 1
+	for depth > 0 {
+		l.readChar()
+
+		switch l.ch {
+		case rune(0):
+			return "", errors.New("unterminated ${ in string")
+		case rune('{'):
+			depth++
+		case rune('}'):
+			depth--
+		case rune('"'), rune('\''):
+			delim := l.ch
+			for {
+				l.readChar()
+				if l.ch == rune(0) {
+					return "", errors.New("unterminated ${ in string")
+				}
+				if l.ch == rune('\\') {
+					l.readChar()
+					continue
+				}
+				if l.ch == delim {
+					break
+				}
 			}
-			if l.ch == rune('r') {
-				l.ch = '\r'
+		}
+	}
+
+	return string(l.characters[start:l.position]), nil
+}
+
+// Segment is one part of an interpolated string, which is either some
+// literal text, or the source of an embedded expression.
+type Segment struct {
+	// Text holds the literal text, or the source of the expression.
+	Text string
+
+	// Expression is true if this segment is an expression.
+	Expression bool
+}
+
+// SplitInterpolated splits the content of an interpolated string into
+// literal text, and expressions.
+//
+// The input is the literal of an INTERPOLATED token.
+func SplitInterpolated(raw string) ([]Segment, error) {
+
+	var segments []Segment
+
+	l := &Lexer{characters: []rune(raw), line: 1}
+	text := ""
+
+	for {
+		l.readChar()
+
+		if l.ch == rune(0) {
+			break
+		}
+
+		if l.ch == rune('$') && l.peekChar() == rune('{') {
+			expr, err := l.readInterpolation()
+			if err != nil {
+				return nil, err
 			}
-			if l.ch == rune('t') {
-				l.ch = '\t'
+			if text != "" {
+				segments = append(segments, Segment{Text: text})
+				text = ""
 			}
-			if l.ch == rune('"') {
-				l.ch = '"'
+			segments = append(segments, Segment{Text: expr, Expression: true})
+			continue
+		}
+
+		if l.ch == rune('\\') {
+			ch, ok, err := l.readEscape()
+			if err != nil {
+				return nil, err
 			}
-			if l.ch == rune('\\') {
-				l.ch = '\\'
+			if ok {
+				text += string(ch)
 			}
+			continue
 		}
-		out = out + string(l.ch)
 
+		text += string(l.ch)
 	}
 
-	return out, nil
+	if text != "" {
+		segments = append(segments, Segment{Text: text})
+	}
+	return segments, nil
 }
 
 // read a regexp, including flags.
@@ -459,10 +831,10 @@ func (l *Lexer) peekChar() rune {
 }
 
 // determinate ch is identifier or not.  Identifiers may be alphanumeric,
-// but they must start with a letter.  Here that works because we are only
+// and contain `$` and `_`, but they must start with a letter.  Here that works because we are only
 // called if the first character is alphabetical.
 func isIdentifier(ch rune) bool {
-	if unicode.IsLetter(ch) || unicode.IsDigit(ch) || ch == '$' {
+	if unicode.IsLetter(ch) || unicode.IsDigit(ch) || ch == '$' || ch == '_' {
 		return true
 	}
 	return false
@@ -477,3 +849,8 @@ func isWhitespace(ch rune) bool {
 func isDigit(ch rune) bool {
 	return rune('0') <= ch && ch <= rune('9')
 }
+
+// is hexadecimal Digit
+func isHexDigit(ch rune) bool {
+	return isDigit(ch) || (rune('a') <= ch && ch <= rune('f')) || (rune('A') <= ch && ch <= rune('F'))
+}
@@ -189,6 +189,18 @@ func TestUnicodeLexer(t *testing.T) {
 	}
 }
 
+func TestUnderscoreIdentifier(t *testing.T) {
+	input := `parse_time`
+	l := New(input)
+	tok := l.NextToken()
+	if tok.Type != token.IDENT {
+		t.Fatalf("token type wrong, expected=%q, got=%q", token.IDENT, tok.Type)
+	}
+	if tok.Literal != "parse_time" {
+		t.Fatalf("token literal wrong, expected=%q, got=%q", "parse_time", tok.Literal)
+	}
+}
+
 func TestSimpleComment(t *testing.T) {
 	input := `=+// This is a comment
 // This is still a comment
@@ -220,6 +232,108 @@ a = 1;
 	}
 }
 
+func TestBlockComment(t *testing.T) {
+	input := `a = /* between tokens */ 1; /* at the end of a line */
+/* a comment
+   spanning * several / lines **/ b = "/* not a comment */";
+c = "*/" /***/ + // line
+/* nested /* isn't supported */ "x";`
+
+	tests := []struct {
+		expectedType    token.Type
+		expectedLiteral string
+	}{
+		{token.IDENT, "a"},
+		{token.ASSIGN, "="},
+		{token.INT, "1"},
+		{token.SEMICOLON, ";"},
+		{token.IDENT, "b"},
+		{token.ASSIGN, "="},
+		{token.STRING, "/* not a comment */"},
+		{token.SEMICOLON, ";"},
+		{token.IDENT, "c"},
+		{token.ASSIGN, "="},
+		{token.STRING, "*/"},
+		{token.PLUS, "+"},
+		{token.STRING, "x"},
+		{token.SEMICOLON, ";"},
+		{token.EOF, ""},
+	}
+	l := New(input)
+	for i, tt := range tests {
+		tok := l.NextToken()
+		if tok.Type != tt.expectedType {
+			t.Fatalf("tests[%d] - tokentype wrong, expected=%q, got=%q", i, tt.expectedType, tok.Type)
+		}
+		if tok.Literal != tt.expectedLiteral {
+			t.Fatalf("tests[%d] - Literal wrong, expected=%q, got=%q", i, tt.expectedLiteral, tok.Literal)
+		}
+	}
+}
+
+// TestUnterminatedComment ensures an unclosed block comment is reported,
+// at the position it started.
+func TestUnterminatedComment(t *testing.T) {
+	input := `a = 1;
+  /* this comment
+never ends`
+
+	l := New(input)
+	for i := 0; i < 4; i++ {
+		l.NextToken()
+	}
+
+	tok := l.NextToken()
+	if tok.Type != token.ILLEGAL || tok.Literal != "unterminated comment" {
+		t.Fatalf("expected an unterminated comment, got %v", tok)
+	}
+	if tok.Line != 2 || tok.Column != 3 {
+		t.Fatalf("unexpected position %d:%d", tok.Line, tok.Column)
+	}
+
+	tok = l.NextToken()
+	if tok.Type != token.EOF {
+		t.Fatalf("expected EOF after the comment, got %v", tok)
+	}
+}
+
+// TestEscapes tests the escape-sequences permitted within strings, and
+// that an invalid one is reported without disrupting what follows.
+func TestEscapes(t *testing.T) {
+	input := `"a\nb\tc" "\"\\\$" 'it\'s' "caf\u00e9" "\u263A!"
+"bad \q escape" 1 "short \u12" 2 "\u" 3 '\z \'x\' ' 4`
+
+	tests := []struct {
+		expectedType    token.Type
+		expectedLiteral string
+	}{
+		{token.STRING, "a\nb\tc"},
+		{token.STRING, "\"\\$"},
+		{token.STRING, "it's"},
+		{token.STRING, "café"},
+		{token.STRING, "☺!"},
+		{token.ILLEGAL, "invalid escape sequence \"\\q\""},
+		{token.INT, "1"},
+		{token.ILLEGAL, "invalid unicode escape sequence \"\\u12\""},
+		{token.INT, "2"},
+		{token.ILLEGAL, "invalid unicode escape sequence \"\\u\""},
+		{token.INT, "3"},
+		{token.ILLEGAL, "invalid escape sequence \"\\z\""},
+		{token.INT, "4"},
+		{token.EOF, ""},
+	}
+	l := New(input)
+	for i, tt := range tests {
+		tok := l.NextToken()
+		if tok.Type != tt.expectedType {
+			t.Fatalf("tests[%d] - tokentype wrong, expected=%q, got=%q", i, tt.expectedType, tok.Type)
+		}
+		if tok.Literal != tt.expectedLiteral {
+			t.Fatalf("tests[%d] - Literal wrong, expected=%q, got=%q", i, tt.expectedLiteral, tok.Literal)
+		}
+	}
+}
+
 func TestIntegers(t *testing.T) {
 	input := `10 20 33.3 "steve\
 `
@@ -337,6 +451,43 @@ func TestLine(t *testing.T) {
 
 }
 
+// TestPosition tests that tokens record their line and column.
+func TestPosition(t *testing.T) {
+	input := `a = 3;
+  // comment
+  if ( "ünïcödé" == b ) {`
+
+	tests := []struct {
+		expectedLiteral string
+		expectedLine    int
+		expectedColumn  int
+	}{
+		{"a", 1, 1},
+		{"=", 1, 3},
+		{"3", 1, 5},
+		{";", 1, 6},
+		{"if", 3, 3},
+		{"(", 3, 6},
+		{"ünïcödé", 3, 8},
+		{"==", 3, 18},
+		{"b", 3, 21},
+		{")", 3, 23},
+		{"{", 3, 25},
+		{"", 3, 26},
+	}
+
+	l := New(input)
+	for i, tt := range tests {
+		tok := l.NextToken()
+		if tok.Literal != tt.expectedLiteral {
+			t.Fatalf("tests[%d] - Literal wrong, expected=%q, got=%q", i, tt.expectedLiteral, tok.Literal)
+		}
+		if tok.Line != tt.expectedLine || tok.Column != tt.expectedColumn {
+			t.Fatalf("tests[%d] - position of %q wrong, expected=%d:%d, got=%d:%d", i, tok.Literal, tt.expectedLine, tt.expectedColumn, tok.Line, tok.Column)
+		}
+	}
+}
+
 // TestRegexp ensures a simple regexp can be parsed.
 func TestRegexp(t *testing.T) {
 	input := `if ( f ~= /steve/i )
@@ -449,3 +600,347 @@ a = 3/4;
 		}
 	}
 }
+
+func TestMember(t *testing.T) {
+	input := `user.name; matrix.0.1; 0.5`
+
+	tests := []struct {
+		expectedType    token.Type
+		expectedLiteral string
+	}{
+		{token.IDENT, "user"},
+		{token.PERIOD, "."},
+		{token.IDENT, "name"},
+		{token.SEMICOLON, ";"},
+		{token.IDENT, "matrix"},
+		{token.PERIOD, "."},
+		{token.INT, "0"},
+		{token.PERIOD, "."},
+		{token.INT, "1"},
+		{token.SEMICOLON, ";"},
+		{token.FLOAT, "0.5"},
+		{token.EOF, ""},
+	}
+	l := New(input)
+	for i, tt := range tests {
+		tok := l.NextToken()
+		if tok.Type != tt.expectedType {
+			t.Fatalf("tests[%d] - tokentype wrong, expected=%q, got=%q", i, tt.expectedType, tok.Type)
+		}
+		if tok.Literal != tt.expectedLiteral {
+			t.Fatalf("tests[%d] - Literal wrong, expected=%q, got=%q", i, tt.expectedLiteral, tok.Literal)
+		}
+	}
+}
+
+func TestTernary(t *testing.T) {
+	input := `a ? "yes" : "no";`
+
+	tests := []struct {
+		expectedType    token.Type
+		expectedLiteral string
+	}{
+		{token.IDENT, "a"},
+		{token.QUESTION, "?"},
+		{token.STRING, "yes"},
+		{token.COLON, ":"},
+		{token.STRING, "no"},
+		{token.SEMICOLON, ";"},
+		{token.EOF, ""},
+	}
+	l := New(input)
+	for i, tt := range tests {
+		tok := l.NextToken()
+		if tok.Type != tt.expectedType {
+			t.Fatalf("tests[%d] - tokentype wrong, expected=%q, got=%q", i, tt.expectedType, tok.Type)
+		}
+		if tok.Literal != tt.expectedLiteral {
+			t.Fatalf("tests[%d] - Literal wrong, expected=%q, got=%q", i, tt.expectedLiteral, tok.Literal)
+		}
+	}
+}
+
+func TestCoalesce(t *testing.T) {
+	input := `a ?? b ? c : d`
+
+	tests := []struct {
+		expectedType    token.Type
+		expectedLiteral string
+	}{
+		{token.IDENT, "a"},
+		{token.COALESCE, "??"},
+		{token.IDENT, "b"},
+		{token.QUESTION, "?"},
+		{token.IDENT, "c"},
+		{token.COLON, ":"},
+		{token.IDENT, "d"},
+		{token.EOF, ""},
+	}
+	l := New(input)
+	for i, tt := range tests {
+		tok := l.NextToken()
+		if tok.Type != tt.expectedType {
+			t.Fatalf("tests[%d] - tokentype wrong, expected=%q, got=%q", i, tt.expectedType, tok.Type)
+		}
+		if tok.Literal != tt.expectedLiteral {
+			t.Fatalf("tests[%d] - Literal wrong, expected=%q, got=%q", i, tt.expectedLiteral, tok.Literal)
+		}
+	}
+}
+
+// TestInterpolation tests strings with embedded expressions.
+func TestInterpolation(t *testing.T) {
+	input := `"plain \${x}" "a ${b} c" "${ "}" }" 'd ${e}'`
+
+	tests := []struct {
+		expectedType    token.Type
+		expectedLiteral string
+	}{
+		{token.STRING, "plain ${x}"},
+		{token.INTERPOLATED, "a ${b} c"},
+		{token.INTERPOLATED, `${ "}" }`},
+		{token.STRING, "d ${e}"},
+		{token.EOF, ""},
+	}
+	l := New(input)
+	for i, tt := range tests {
+		tok := l.NextToken()
+		if tok.Type != tt.expectedType {
+			t.Fatalf("tests[%d] - tokentype wrong, expected=%q, got=%q", i, tt.expectedType, tok.Type)
+		}
+		if tok.Literal != tt.expectedLiteral {
+			t.Fatalf("tests[%d] - Literal wrong, expected=%q, got=%q", i, tt.expectedLiteral, tok.Literal)
+		}
+	}
+
+	segments, err := SplitInterpolated(`a\tb ${c + "}"}\${d}${e}`)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	expected := []Segment{
+		{Text: "a\tb "},
+		{Text: `c + "}"`, Expression: true},
+		{Text: "${d}"},
+		{Text: "e", Expression: true},
+	}
+	if len(segments) != len(expected) {
+		t.Fatalf("unexpected segments: %v", segments)
+	}
+	for i, seg := range segments {
+		if seg != expected[i] {
+			t.Fatalf("segment %d wrong, expected=%v, got=%v", i, expected[i], seg)
+		}
+	}
+
+	// Unterminated
+	l = New(`"a ${b"`)
+	tok := l.NextToken()
+	if tok.Type != token.ILLEGAL {
+		t.Fatalf("expected an illegal token, got %v", tok)
+	}
+}
+
+// TestIntegerBases tests hex, octal, and binary integers, along with
+// digit-separators.
+func TestIntegerBases(t *testing.T) {
+	input := `0xFF 0o755 0b1010 0XfF 1_000_000 0b1012 3.1_4 10`
+
+	tests := []struct {
+		expectedType    token.Type
+		expectedLiteral string
+	}{
+		{token.INT, "0xFF"},
+		{token.INT, "0o755"},
+		{token.INT, "0b1010"},
+		{token.INT, "0XfF"},
+		{token.INT, "1_000_000"},
+		{token.INT, "0b1012"},
+		{token.FLOAT, "3.1_4"},
+		{token.INT, "10"},
+		{token.EOF, ""},
+	}
+	l := New(input)
+	for i, tt := range tests {
+		tok := l.NextToken()
+		if tok.Type != tt.expectedType {
+			t.Fatalf("tests[%d] - tokentype wrong, expected=%q, got=%q", i, tt.expectedType, tok.Type)
+		}
+		if tok.Literal != tt.expectedLiteral {
+			t.Fatalf("tests[%d] - Literal wrong, expected=%q, got=%q", i, tt.expectedLiteral, tok.Literal)
+		}
+	}
+}
+
+// TestCompoundAssignment tests the compound assignment operators, and
+// that `++` and `--` are only recognized after a name.
+func TestCompoundAssignment(t *testing.T) {
+	input := `a += 1; a -= 2; a *= 3; a /= 4; a %= 5; a++; a--; 3 - -1; 1 + +2; a--3; a ++ b; f(a--)`
+
+	tests := []struct {
+		expectedType    token.Type
+		expectedLiteral string
+	}{
+		{token.IDENT, "a"},
+		{token.PLUS_EQ, "+="},
+		{token.INT, "1"},
+		{token.SEMICOLON, ";"},
+		{token.IDENT, "a"},
+		{token.MINUS_EQ, "-="},
+		{token.INT, "2"},
+		{token.SEMICOLON, ";"},
+		{token.IDENT, "a"},
+		{token.ASTERISK_EQ, "*="},
+		{token.INT, "3"},
+		{token.SEMICOLON, ";"},
+		{token.IDENT, "a"},
+		{token.SLASH_EQ, "/="},
+		{token.INT, "4"},
+		{token.SEMICOLON, ";"},
+		{token.IDENT, "a"},
+		{token.MOD_EQ, "%="},
+		{token.INT, "5"},
+		{token.SEMICOLON, ";"},
+		{token.IDENT, "a"},
+		{token.INCREMENT, "++"},
+		{token.SEMICOLON, ";"},
+		{token.IDENT, "a"},
+		{token.DECREMENT, "--"},
+		{token.SEMICOLON, ";"},
+		{token.INT, "3"},
+		{token.MINUS, "-"},
+		{token.MINUS, "-"},
+		{token.INT, "1"},
+		{token.SEMICOLON, ";"},
+		{token.INT, "1"},
+		{token.PLUS, "+"},
+		{token.PLUS, "+"},
+		{token.INT, "2"},
+		{token.SEMICOLON, ";"},
+		{token.IDENT, "a"},
+		{token.MINUS, "-"},
+		{token.MINUS, "-"},
+		{token.INT, "3"},
+		{token.SEMICOLON, ";"},
+		{token.IDENT, "a"},
+		{token.PLUS, "+"},
+		{token.PLUS, "+"},
+		{token.IDENT, "b"},
+		{token.SEMICOLON, ";"},
+		{token.IDENT, "f"},
+		{token.LPAREN, "("},
+		{token.IDENT, "a"},
+		{token.DECREMENT, "--"},
+		{token.RPAREN, ")"},
+		{token.EOF, ""},
+	}
+	l := New(input)
+	for i, tt := range tests {
+		tok := l.NextToken()
+		if tok.Type != tt.expectedType {
+			t.Fatalf("tests[%d] - tokentype wrong, expected=%q, got=%q", i, tt.expectedType, tok.Type)
+		}
+		if tok.Literal != tt.expectedLiteral {
+			t.Fatalf("tests[%d] - Literal wrong, expected=%q, got=%q", i, tt.expectedLiteral, tok.Literal)
+		}
+	}
+}
+
+// TestTokens tests retrieving all the tokens of a script at once.
+func TestTokens(t *testing.T) {
+	input := `if ( Name ~= /steve/i && x !~ "a" ) {
+  return √x ** 2 in [ 1.5, 0x10 ];
+} # @`
+
+	tests := []struct {
+		expectedType    token.Type
+		expectedLiteral string
+		expectedLine    int
+		expectedColumn  int
+	}{
+		{token.IF, "if", 1, 1},
+		{token.LPAREN, "(", 1, 4},
+		{token.IDENT, "Name", 1, 6},
+		{token.CONTAINS, "~=", 1, 11},
+		{token.REGEXP, "(?i)steve", 1, 14},
+		{token.AND, "&&", 1, 23},
+		{token.IDENT, "x", 1, 26},
+		{token.MISSING, "!~", 1, 28},
+		{token.STRING, "a", 1, 31},
+		{token.RPAREN, ")", 1, 35},
+		{token.LBRACE, "{", 1, 37},
+		{token.RETURN, "return", 2, 3},
+		{token.SQRT, "√", 2, 10},
+		{token.IDENT, "x", 2, 11},
+		{token.POW, "**", 2, 13},
+		{token.INT, "2", 2, 16},
+		{token.IN, "in", 2, 18},
+		{token.LSQUARE, "[", 2, 21},
+		{token.FLOAT, "1.5", 2, 23},
+		{token.COMMA, ",", 2, 26},
+		{token.INT, "0x10", 2, 28},
+		{token.RSQUARE, "]", 2, 33},
+		{token.SEMICOLON, ";", 2, 34},
+		{token.RBRACE, "}", 3, 1},
+		{token.ILLEGAL, "invalid character for indentifier '#'", 3, 3},
+		{token.ILLEGAL, "invalid character for indentifier '@'", 3, 5},
+		{token.EOF, "", 3, 6},
+	}
+
+	tokens := Tokens(input)
+	if len(tokens) != len(tests) {
+		t.Fatalf("expected %d tokens, got %d: %v", len(tests), len(tokens), tokens)
+	}
+	for i, tt := range tests {
+		tok := tokens[i]
+		if tok.Type != tt.expectedType {
+			t.Fatalf("tests[%d] - tokentype wrong, expected=%q, got=%q", i, tt.expectedType, tok.Type)
+		}
+		if tok.Literal != tt.expectedLiteral {
+			t.Fatalf("tests[%d] - Literal wrong, expected=%q, got=%q", i, tt.expectedLiteral, tok.Literal)
+		}
+		if tok.Line != tt.expectedLine || tok.Column != tt.expectedColumn {
+			t.Fatalf("tests[%d] - position of %q wrong, expected=%d:%d, got=%d:%d", i, tok.Literal, tt.expectedLine, tt.expectedColumn, tok.Line, tok.Column)
+		}
+	}
+
+	// Malformed scripts still end with EOF.
+	for _, input := range []string{``, `"unterminated`, `/* open`, `/[/`, "`", "a ` b", `"${"`, `0x`, `1e`} {
+		tokens := Tokens(input)
+		if len(tokens) == 0 || tokens[len(tokens)-1].Type != token.EOF {
+			t.Fatalf("expected %q to end with EOF, got %v", input, tokens)
+		}
+	}
+}
+
+// TestSafeNavigation tests the safe-navigation operator, `?.`.
+func TestSafeNavigation(t *testing.T) {
+	input := `a?.b?.0 ? . ?? c.d`
+
+	tests := []struct {
+		expectedType    token.Type
+		expectedLiteral string
+	}{
+		{token.IDENT, "a"},
+		{token.SAFE_PERIOD, "?."},
+		{token.IDENT, "b"},
+		{token.SAFE_PERIOD, "?."},
+		{token.INT, "0"},
+		{token.QUESTION, "?"},
+		{token.PERIOD, "."},
+		{token.COALESCE, "??"},
+		{token.IDENT, "c"},
+		{token.PERIOD, "."},
+		{token.IDENT, "d"},
+		{token.EOF, ""},
+	}
+	l := New(input)
+	for i, tt := range tests {
+		tok := l.NextToken()
+		if tok.Type != tt.expectedType {
+			t.Fatalf("tests[%d] - tokentype wrong, expected=%q, got=%q", i, tt.expectedType, tok.Type)
+		}
+		if tok.Literal != tt.expectedLiteral {
+			t.Fatalf("tests[%d] - Literal wrong, expected=%q, got=%q", i, tt.expectedLiteral, tok.Literal)
+		}
+	}
+}
@@ -5,27 +5,39 @@
 //
 // * Array.
 // * Boolean value.
+// * Error, returned by functions which were called incorrectly.
 // * Floating-point number.
+// * Function, defined within a script.
+// * Hash.
 // * Integer number.
+// * Native, an arbitrary golang value.
 // * Null
 // * String value.
+// * Time, a date and time.
 //
 // To allow these objects to be used interchanagably there is a simple
 // interface which all object-types must implement, which is simple to
 // satisfy.
 package object
 
+import "math"
+
 // Type describes the type of an object.
 type Type string
 
 // pre-defined object types.
 const (
-	ARRAY   = "ARRAY"
-	BOOLEAN = "BOOLEAN"
-	FLOAT   = "FLOAT"
-	INTEGER = "INTEGER"
-	NULL    = "NULL"
-	STRING  = "STRING"
+	ARRAY    = "ARRAY"
+	BOOLEAN  = "BOOLEAN"
+	ERROR    = "ERROR"
+	FLOAT    = "FLOAT"
+	FUNCTION = "FUNCTION"
+	HASH     = "HASH"
+	INTEGER  = "INTEGER"
+	NATIVE   = "NATIVE"
+	NULL     = "NULL"
+	STRING   = "STRING"
+	TIME     = "TIME"
 )
 
 // Object is the interface that all of our various object-types must implement.
@@ -46,3 +58,135 @@ type Object interface {
 	// for example, or with the logical `&&` and `||` operations.
 	True() bool
 }
+
+// Equals returns true if the two objects are equal.
+//
+// Arrays are equal if they have the same length, and each pair of
+// elements is equal.  Hashes are equal if they have the same keys, and
+// the values of each are equal.  Both are compared recursively.
+//
+// Numbers are equal if they have the same value, so the integer 1 is
+// equal to the float 1.0.  Times are equal if they refer to the same
+// instant, and all other objects are equal if they have the same type
+// and value.
+func Equals(a Object, b Object) bool {
+
+	if c, ok := CompareNumbers(a, b); ok {
+		return c == 0
+	}
+
+	if a.Type() != b.Type() {
+		return false
+	}
+
+	switch a := a.(type) {
+
+	case *Array:
+		b := b.(*Array)
+		if len(a.Elements) != len(b.Elements) {
+			return false
+		}
+		for i := range a.Elements {
+			if !Equals(a.Elements[i], b.Elements[i]) {
+				return false
+			}
+		}
+		return true
+
+	case *Hash:
+		b := b.(*Hash)
+		if len(a.Pairs) != len(b.Pairs) {
+			return false
+		}
+		for key, pair := range a.Pairs {
+			other, ok := b.Pairs[key]
+			if !ok || !Equals(pair.Value, other.Value) {
+				return false
+			}
+		}
+		return true
+
+	case *Time:
+		return a.Value.Equal(b.(*Time).Value)
+	}
+
+	return a.Inspect() == b.Inspect()
+}
+
+// CompareNumbers compares two numbers, which may be integers or floats,
+// returning -1 if the first is smaller, 0 if they're equal, and 1 if the
+// first is larger.
+//
+// The comparison is exact, an integer is never converted to a float
+// which cannot represent it.  If either object isn't a number, or is a
+// float which is NaN, then false is returned.
+func CompareNumbers(a Object, b Object) (int, bool) {
+
+	switch a := a.(type) {
+	case *Integer:
+		switch b := b.(type) {
+		case *Integer:
+			return compareIntegers(a.Value, b.Value), true
+		case *Float:
+			return compareIntegerFloat(a.Value, b.Value)
+		}
+	case *Float:
+		switch b := b.(type) {
+		case *Integer:
+			c, ok := compareIntegerFloat(b.Value, a.Value)
+			return -c, ok
+		case *Float:
+			if math.IsNaN(a.Value) || math.IsNaN(b.Value) {
+				return 0, false
+			}
+			switch {
+			case a.Value < b.Value:
+				return -1, true
+			case a.Value > b.Value:
+				return 1, true
+			}
+			return 0, true
+		}
+	}
+	return 0, false
+}
+
+// compareIntegers compares two integers.
+func compareIntegers(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// compareIntegerFloat compares an integer with a float.
+//
+// Floats only represent integers exactly up to 2^53, so rather than
+// converting the integer the float is split into its integer and
+// fractional parts, which are compared in turn.
+func compareIntegerFloat(i int64, f float64) (int, bool) {
+	switch {
+	case math.IsNaN(f):
+		return 0, false
+	case f < math.MinInt64:
+		return 1, true
+	case f >= math.MaxInt64:
+		return -1, true
+	}
+
+	whole := math.Trunc(f)
+	if c := compareIntegers(i, int64(whole)); c != 0 {
+		return c, true
+	}
+
+	switch {
+	case f > whole:
+		return -1, true
+	case f < whole:
+		return 1, true
+	}
+	return 0, true
+}
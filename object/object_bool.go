@@ -26,3 +26,8 @@ func (b *Boolean) Inspect() string {
 func (b *Boolean) True() bool {
 	return b.Value
 }
+
+// HashKey returns a hash key for the given object.
+func (b *Boolean) HashKey() HashKey {
+	return HashKey{Type: b.Type(), Value: b.Inspect()}
+}
@@ -0,0 +1,28 @@
+package object
+
+// Error wraps an error-message and implements the Object interface.
+//
+// Errors are returned by the built-in functions when they're called
+// incorrectly, for example with the wrong number of arguments.  They
+// don't abort the execution of the script.
+type Error struct {
+	// Message contains the error-message.
+	Message string
+}
+
+// Type returns the type of this object.
+func (e *Error) Type() Type {
+	return ERROR
+}
+
+// Inspect returns a string-representation of the given object.
+func (e *Error) Inspect() string {
+	return "error: " + e.Message
+}
+
+// True returns whether this object wraps a true-like value.
+//
+// Used when this object is the conditional in a comparison, etc.
+func (e *Error) True() bool {
+	return false
+}
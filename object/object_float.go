@@ -26,3 +26,8 @@ func (f *Float) Type() Type {
 func (f *Float) True() bool {
 	return (f.Value != 0)
 }
+
+// HashKey returns a hash key for the given object.
+func (f *Float) HashKey() HashKey {
+	return HashKey{Type: f.Type(), Value: f.Inspect()}
+}
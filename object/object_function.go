@@ -0,0 +1,40 @@
+package object
+
+import (
+	"strings"
+
+	"github.com/skx/evalfilter/v2/code"
+)
+
+// Function holds a function which was defined within a user-script.
+type Function struct {
+	// Name is the name of the function.
+	Name string
+
+	// Parameters holds the names of the parameters the function
+	// expects to be called with.
+	Parameters []string
+
+	// Instructions holds the compiled bytecode of the function-body.
+	Instructions code.Instructions
+
+	// Positions holds the source-positions of the instructions.
+	Positions code.Positions
+}
+
+// Type returns the type of this object.
+func (f *Function) Type() Type {
+	return FUNCTION
+}
+
+// Inspect returns a string-representation of the given object.
+func (f *Function) Inspect() string {
+	return "function " + f.Name + "(" + strings.Join(f.Parameters, ", ") + ")"
+}
+
+// True returns whether this object wraps a true-like value.
+//
+// Used when this object is the conditional in a comparison, etc.
+func (f *Function) True() bool {
+	return true
+}
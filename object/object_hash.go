@@ -0,0 +1,91 @@
+package object
+
+import (
+	"bytes"
+	"sort"
+	"strings"
+)
+
+// HashKey is the key used to store values within a hash.
+//
+// We use the type of the key, as well as its string-value, so that
+// the integer `1` and the string "1" are stored separately.
+type HashKey struct {
+	// Type holds the type of the object which was used as a key.
+	Type Type
+
+	// Value holds the string-representation of the key.
+	Value string
+}
+
+// Hashable is implemented by all object-types which may be used
+// as the key for a hash-entry.
+type Hashable interface {
+
+	// HashKey returns the key to use for storing this object
+	// within a hash.
+	HashKey() HashKey
+}
+
+// HashPair holds a single key/value pair stored in a hash.
+type HashPair struct {
+	// Key holds the original key object.
+	Key Object
+
+	// Value holds the value associated with the key.
+	Value Object
+}
+
+// Hash wraps a map of key/value pairs and implements the Object interface.
+type Hash struct {
+	// Pairs holds the contents of the hash.
+	Pairs map[HashKey]HashPair
+}
+
+// Type returns the type of this object.
+func (h *Hash) Type() Type {
+	return HASH
+}
+
+// Inspect returns a string-representation of the given object.
+//
+// The keys are sorted, so that the output is stable.
+func (h *Hash) Inspect() string {
+	var out bytes.Buffer
+
+	pairs := make([]string, 0)
+	for _, key := range h.SortedKeys() {
+		pair := h.Pairs[key]
+		pairs = append(pairs, pair.Key.Inspect()+": "+pair.Value.Inspect())
+	}
+
+	out.WriteString("{")
+	out.WriteString(strings.Join(pairs, ", "))
+	out.WriteString("}")
+	return out.String()
+}
+
+// True returns whether this object wraps a true-like value.
+//
+// Used when this object is the conditional in a comparison, etc.
+func (h *Hash) True() bool {
+	return (len(h.Pairs) != 0)
+}
+
+// SortedKeys returns the keys of the hash, in a stable order.
+//
+// Keys are sorted by their string-value, and then by their type.
+func (h *Hash) SortedKeys() []HashKey {
+	keys := make([]HashKey, 0, len(h.Pairs))
+	for key := range h.Pairs {
+		keys = append(keys, key)
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Value == keys[j].Value {
+			return keys[i].Type < keys[j].Type
+		}
+		return keys[i].Value < keys[j].Value
+	})
+	return keys
+}
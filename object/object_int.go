@@ -26,3 +26,8 @@ func (i *Integer) Type() Type {
 func (i *Integer) True() bool {
 	return (i.Value != 0)
 }
+
+// HashKey returns a hash key for the given object.
+func (i *Integer) HashKey() HashKey {
+	return HashKey{Type: i.Type(), Value: i.Inspect()}
+}
@@ -0,0 +1,30 @@
+package object
+
+import "fmt"
+
+// Native wraps an arbitrary golang value and implements the Object
+// interface.
+//
+// This is used to pass values from the host application through a
+// script, and back to the host application, unchanged.
+type Native struct {
+	// Value holds the golang value this object wraps.
+	Value interface{}
+}
+
+// Type returns the type of this object.
+func (n *Native) Type() Type {
+	return NATIVE
+}
+
+// Inspect returns a string-representation of the given object.
+func (n *Native) Inspect() string {
+	return fmt.Sprintf("%v", n.Value)
+}
+
+// True returns whether this object wraps a true-like value.
+//
+// Used when this object is the conditional in a comparison, etc.
+func (n *Native) True() bool {
+	return n.Value != nil
+}
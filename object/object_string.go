@@ -22,3 +22,8 @@ func (s *String) Inspect() string {
 func (s *String) True() bool {
 	return (s.Value != "")
 }
+
+// HashKey returns a hash key for the given object.
+func (s *String) HashKey() HashKey {
+	return HashKey{Type: s.Type(), Value: s.Value}
+}
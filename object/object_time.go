@@ -0,0 +1,35 @@
+package object
+
+import "time"
+
+// Time wraps time.Time and implements the Object interface.
+type Time struct {
+	// Value holds the time this object wraps.
+	Value time.Time
+}
+
+// Type returns the type of this object.
+func (t *Time) Type() Type {
+	return TIME
+}
+
+// Inspect returns a string-representation of the given object.
+//
+// Times are formatted in RFC3339 format, including any fractional
+// seconds, so that two times have the same representation only if
+// they refer to the same instant in the same zone.
+func (t *Time) Inspect() string {
+	return t.Value.Format(time.RFC3339Nano)
+}
+
+// True returns whether this object wraps a true-like value.
+//
+// Used when this object is the conditional in a comparison, etc.
+func (t *Time) True() bool {
+	return !t.Value.IsZero()
+}
+
+// HashKey returns a hash key for the given object.
+func (t *Time) HashKey() HashKey {
+	return HashKey{Type: t.Type(), Value: t.Inspect()}
+}
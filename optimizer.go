@@ -10,6 +10,9 @@
 // Once we've done that we can convert some jumping operations which might
 // use those results into unconditional jumps, or NOPs as appropriate.
 //
+// Finally we remove jumps which land upon other jumps, or upon the next
+// instruction, along with code which can never be reached.
+//
 // Brief discussion in this blog post:
 //
 // https://blog.steve.fi/adventures_optimizing_a_bytecode_based_scripting_language.html
@@ -17,10 +20,9 @@
 package evalfilter
 
 import (
-	"encoding/binary"
-	"fmt"
-
 	"github.com/skx/evalfilter/v2/code"
+	"github.com/skx/evalfilter/v2/object"
+	"github.com/skx/evalfilter/v2/vm"
 )
 
 // optimize optimizes our bytecode by working over the program
@@ -56,6 +58,11 @@ func (e *Eval) optimize() int {
 		changes++
 	}
 
+	// Remove pointless jumps, and unreachable code
+	for e.optimizePeephole() {
+		changes++
+	}
+
 	// Remove NOPs
 	e.removeNOPs()
 
@@ -76,6 +83,11 @@ func (e *Eval) optimize() int {
 //
 // That can be replaced by "OpPush 6", "NOP", "NOP", "NOP", & "NOP".
 //
+// Integer constants which are too large to be pushed directly are
+// loaded via `OpConstant`, and these are folded too.  Because we're run
+// repeatedly nested expressions such as `60 * 60 * 24` are folded to a
+// single value.
+//
 func (e *Eval) optimizeMaths() (bool, error) {
 
 	//
@@ -87,7 +99,7 @@ func (e *Eval) optimizeMaths() (bool, error) {
 		offset int
 
 		// value is the (integer) constant value referred to.
-		value int
+		value int64
 	}
 
 	//
@@ -102,6 +114,11 @@ func (e *Eval) optimizeMaths() (bool, error) {
 	//
 	var args []Constants
 
+	//
+	// Find the targets of any jumps.
+	//
+	targets := e.jumpTargets()
+
 	//
 	// Walk the bytecode.
 	//
@@ -126,10 +143,18 @@ func (e *Eval) optimizeMaths() (bool, error) {
 
 			//
 			// Note in the future we might have to cope
-			// with opcodes with more than a single argument,
-			// and they might be different sizes.
+			// with opcodes with more than a single argument.
 			//
-			opArg = int(binary.BigEndian.Uint16(e.instructions[ip+1 : ip+3]))
+			opArg = code.Operand(e.instructions, ip)
+		}
+
+		//
+		// If this instruction is the target of a jump then
+		// the values on the stack might have come from
+		// elsewhere, so we can't use those we've seen.
+		//
+		if targets[ip] {
+			args = nil
 		}
 
 		//
@@ -143,7 +168,19 @@ func (e *Eval) optimizeMaths() (bool, error) {
 			// If we see a constant being pushed we
 			// add that to our list tracking such things.
 			//
-			args = append(args, Constants{offset: ip, value: opArg})
+			args = append(args, Constants{offset: ip, value: int64(opArg)})
+
+		case code.OpConstant:
+
+			//
+			// Integer constants are tracked too, but
+			// nothing else.
+			//
+			if i, ok := e.constants[opArg].(*object.Integer); ok {
+				args = append(args, Constants{offset: ip, value: i.Value})
+			} else {
+				args = nil
+			}
 
 		case code.OpNop:
 
@@ -211,7 +248,7 @@ func (e *Eval) optimizeMaths() (bool, error) {
 			// reset our argument counters.
 			args = nil
 
-		case code.OpMul, code.OpAdd, code.OpSub, code.OpDiv:
+		case code.OpMul, code.OpAdd, code.OpSub, code.OpDiv, code.OpMod, code.OpPower:
 
 			//
 			// Primitive maths operation.
@@ -232,34 +269,34 @@ func (e *Eval) optimizeMaths() (bool, error) {
 				a := args[len(args)-1]
 				b := args[len(args)-2]
 
-				// Calculate the result.
 				//
-				// We only allow integers in the range
-				// 0x0000-0xFFFF to be stored inline
-				// so not all maths can be collapsed.
+				// Calculate the result, in the same
+				// way that the virtual machine would.
 				//
-				result := 0
-
-				if op == code.OpMul {
-					result = a.value * b.value
-				}
-				if op == code.OpAdd {
-					result = a.value + b.value
-				}
-				if op == code.OpSub {
-					result = b.value - a.value
-				}
-				if op == code.OpDiv {
-
-					// found division by zero
-					if a.value == 0 {
-						return false, fmt.Errorf("attempted division by zero")
+				// Division by zero, and overflow, are
+				// left alone so that the error is
+				// reported at run-time - or not, if
+				// the machine is set to wrap around.
+				//
+				var result int64
+				var err error
+
+				if (op == code.OpDiv || op == code.OpMod) && a.value == 0 {
+					args = nil
+				} else {
+					result, err = vm.IntegerArithmetic(op, b.value, a.value, false)
+					if err != nil {
+						args = nil
 					}
-					result = b.value / a.value
 				}
 
-				if result%1 == 0 && result >= 0 && result <= 65534 {
-					e.changeOperand(a.offset, result)
+				if args != nil {
+
+					// Replace the first argument-load with the result
+					if !e.setInteger(a.offset, result) {
+						args = nil
+						break
+					}
 
 					// Replace the second argument-load with nop
 					e.instructions[b.offset] = byte(code.OpNop)
@@ -273,9 +310,6 @@ func (e *Eval) optimizeMaths() (bool, error) {
 					// We changed something, so we stop now.
 					return true, nil
 				}
-
-				// The result was not something we can
-				// replace.  Keep going.
 			}
 
 			// reset our argument counters.
@@ -310,6 +344,33 @@ func (e *Eval) optimizeMaths() (bool, error) {
 	return false, nil
 }
 
+// setInteger replaces the three-byte instruction at the given offset with
+// one which loads the given integer.
+//
+// Small integers are pushed directly, larger ones are loaded from our
+// constant pool.
+//
+// If the offset of the constant is too large for the instruction then
+// nothing is changed, and false is returned.
+func (e *Eval) setInteger(offset int, value int64) bool {
+
+	op := code.OpPush
+	arg := int(value)
+
+	if value < 0 || value > 65534 {
+		op = code.OpConstant
+		arg = e.addConstant(&object.Integer{Value: value})
+	}
+
+	if arg > code.MaxOperand {
+		return false
+	}
+
+	e.instructions[offset] = byte(op)
+	e.changeOperand(offset, arg)
+	return true
+}
+
 // optimizeJumps updates simple jump operations in-place.
 //
 // This is only possible if a script used some simple integer-maths
@@ -344,6 +405,11 @@ func (e *Eval) optimizeJumps() bool {
 	//
 	prevOp := code.OpNop
 
+	//
+	// Find the targets of any jumps.
+	//
+	targets := e.jumpTargets()
+
 	//
 	// Walk the bytecode.
 	//
@@ -359,6 +425,15 @@ func (e *Eval) optimizeJumps() bool {
 		//
 		opLen := code.Length(op)
 
+		//
+		// If this instruction is the target of a jump then
+		// we might have arrived here from elsewhere, so the
+		// previous opcode is irrelevant.
+		//
+		if targets[ip] {
+			prevOp = code.OpNop
+		}
+
 		//
 		// Now we do the magic.
 		//
@@ -421,6 +496,149 @@ func (e *Eval) optimizeJumps() bool {
 	return false
 }
 
+// optimizePeephole removes jumps which are pointless, once the code has
+// been compiled, and the code which can never be reached.
+//
+// A jump to another jump is changed to go straight to the destination
+// of the second:
+//
+//   OpJumpIfFalse 0x0010
+//   ..
+//   0x0010 OpJump 0x0020
+//
+// Becomes "OpJumpIfFalse 0x0020".  A jump to the instruction which
+// follows it is replaced by NOPs, as are the instructions following an
+// unconditional jump, or a return, which are not themselves the target
+// of a jump - because there is no way to reach them.
+//
+// The NOPs are removed later, by removeNOPs, which updates the targets
+// of the remaining jumps.
+//
+func (e *Eval) optimizePeephole() bool {
+
+	ip := 0
+	ln := len(e.instructions)
+
+	targets := e.jumpTargets()
+
+	for ip < ln {
+
+		op := code.Opcode(e.instructions[ip])
+		opLen := code.Length(op)
+
+		if code.IsJump(op) {
+
+			//
+			// Jump straight to the destination of
+			// any jump we'd land upon.
+			//
+			target := code.Operand(e.instructions, ip)
+			dest := e.jumpDestination(target)
+			if dest != target && (op&code.Wide != 0 || dest <= 0xFFFF) {
+				code.SetOperand(e.instructions, ip, dest)
+				return true
+			}
+
+			//
+			// A jump to the next instruction does nothing.
+			//
+			if op&^code.Wide == code.OpJump && e.skipNOPs(target) == e.skipNOPs(ip+opLen) {
+				for i := ip; i < ip+opLen; i++ {
+					e.instructions[i] = byte(code.OpNop)
+				}
+				return true
+			}
+		}
+
+		//
+		// Nothing following an unconditional jump, a return, or a
+		// throw, can be reached - unless something jumps to it.
+		//
+		if op&^code.Wide == code.OpJump || op == code.OpReturn || op == code.OpThrow {
+			changed := false
+
+			next := ip + opLen
+			for next < ln && !targets[next] {
+				nextLen := code.Length(code.Opcode(e.instructions[next]))
+				for i := next; i < next+nextLen; i++ {
+					if e.instructions[i] != byte(code.OpNop) {
+						e.instructions[i] = byte(code.OpNop)
+						changed = true
+					}
+				}
+				next += nextLen
+			}
+
+			if changed {
+				return true
+			}
+			ip = next
+			continue
+		}
+
+		ip += opLen
+	}
+
+	return false
+}
+
+// skipNOPs returns the offset of the first instruction, at or after the
+// given offset, which isn't a NOP.
+func (e *Eval) skipNOPs(ip int) int {
+	for ip < len(e.instructions) && code.Opcode(e.instructions[ip]) == code.OpNop {
+		ip++
+	}
+	return ip
+}
+
+// jumpDestination returns the offset at which execution continues after
+// jumping to the given target.
+//
+// If the target is an unconditional jump then execution continues at
+// its destination, and so on.  A loop of jumps, from a script such as
+// `while ( true ) { }`, leaves the target unchanged.
+func (e *Eval) jumpDestination(target int) int {
+
+	seen := make(map[int]bool)
+
+	for {
+		ip := e.skipNOPs(target)
+		if ip >= len(e.instructions) || seen[ip] {
+			return target
+		}
+		if code.Opcode(e.instructions[ip])&^code.Wide != code.OpJump {
+			return target
+		}
+
+		seen[ip] = true
+		target = code.Operand(e.instructions, ip)
+	}
+}
+
+// jumpTargets returns the offsets of all instructions which are the
+// target of a jump.
+func (e *Eval) jumpTargets() map[int]bool {
+
+	targets := make(map[int]bool)
+
+	ip := 0
+	ln := len(e.instructions)
+
+	for ip < ln {
+
+		op := code.Opcode(e.instructions[ip])
+		opLen := code.Length(op)
+
+		if code.IsJump(op) {
+			targets[code.Operand(e.instructions, ip)] = true
+		}
+
+		ip += opLen
+	}
+
+	return targets
+}
+
 // removeNOPs removes any inline NOP instructions.
 //
 // It also rewrites the destinations for jumps as appropriate, to
@@ -443,6 +661,11 @@ func (e *Eval) removeNOPs() {
 	//
 	rewrite := make(map[int]int)
 
+	//
+	// Positions of the instructions, at their new offsets.
+	//
+	positions := make(code.Positions)
+
 	//
 	// Walk the bytecode.
 	//
@@ -452,12 +675,6 @@ func (e *Eval) removeNOPs() {
 		op := code.Opcode(e.instructions[ip])
 		opLen := code.Length(op)
 
-		// Get the opcode's argument, if any.
-		opArg := 0
-		if opLen > 1 {
-			opArg = int(binary.BigEndian.Uint16(e.instructions[ip+1 : ip+3]))
-		}
-
 		//
 		// Now we do the magic.
 		//
@@ -489,24 +706,23 @@ func (e *Eval) removeNOPs() {
 			//
 			rewrite[ip] = len(tmp)
 
-			//
-			// Copy the instruction.
-			//
-			tmp = append(tmp, byte(op))
+			if pos, ok := e.positions[ip]; ok {
+				positions[len(tmp)] = pos
+			}
 
 			//
-			// Copy any argument.
+			// Copy the instruction, and any argument.
 			//
-			if opLen > 1 {
-				b := make([]byte, 2)
-				binary.BigEndian.PutUint16(b, uint16(opArg))
-
-				tmp = append(tmp, b...)
-			}
+			tmp = append(tmp, e.instructions[ip:ip+opLen]...)
 		}
 		ip += opLen
 	}
 
+	//
+	// A jump might point to the end of the program.
+	//
+	rewrite[ln] = len(tmp)
+
 	//
 	// If we've done this correctly we've now got a temporary
 	// program with no NOPs.   We now need to patch up
@@ -522,39 +738,24 @@ func (e *Eval) removeNOPs() {
 		// And its length
 		opLen := code.Length(op)
 
-		// Get the optional argument
-		opArg := 0
-		if opLen > 1 {
-			opArg = int(binary.BigEndian.Uint16(tmp[ip+1 : ip+3]))
-		}
-
-		//
-		// Now we do the magic.
 		//
-		switch op {
-
 		// If this was a jump we'll have to change
 		// the target.
 		//
 		// We use the rewrite map we already made,
 		// which contains "old -> new".
 		//
-		case code.OpJump, code.OpJumpIfFalse:
+		if code.IsJump(op) {
 
-			// The old destination is in "opArg".
+			// The old destination is the argument.
 			//
 			// So the new one `rewrite[old]`
 			//
-			newDst := rewrite[opArg]
-
-			// Make into a two-byte pair.
-			b := make([]byte, 2)
-			binary.BigEndian.PutUint16(b, uint16(newDst))
-
-			// Update in-place
-			tmp[ip+1] = b[0]
-			tmp[ip+2] = b[1]
+			newDst := rewrite[code.Operand(tmp, ip)]
 
+			// Update in-place, the new destination is
+			// never further away than the old one.
+			code.SetOperand(tmp, ip, newDst)
 		}
 
 		//
@@ -567,6 +768,7 @@ func (e *Eval) removeNOPs() {
 	// Replace the instructions.
 	//
 	e.instructions = tmp
+	e.positions = positions
 }
 
 // removeDeadCode does the bare minimum of dead-code removal:
@@ -602,30 +804,15 @@ func (e *Eval) removeDeadCode() {
 		//
 		opLen := code.Length(op)
 
-		//
-		// If the opcode is more than a single byte long
-		// we read the argument here.
-		//
-		opArg := 0
-		if opLen > 1 {
-
-			//
-			// Note in the future we might have to cope
-			// with opcodes with more than a single argument,
-			// and they might be different sizes.
-			//
-			opArg = int(binary.BigEndian.Uint16(e.instructions[ip+1 : ip+3]))
-		}
-
 		//
 		// Now we do the magic.
 		//
-		switch op {
+		switch {
 
-		case code.OpJumpIfFalse, code.OpJump:
+		case code.IsJump(op):
 			return
 
-		case code.OpReturn:
+		case op == code.OpReturn:
 
 			// Stop once we've seen the first return
 			run = false
@@ -634,16 +821,8 @@ func (e *Eval) removeDeadCode() {
 
 		default:
 
-			tmp = append(tmp, byte(op))
-			if opLen > 1 {
-
-				// Make a buffer for the arg
-				b := make([]byte, 2)
-				binary.BigEndian.PutUint16(b, uint16(opArg))
-
-				// append
-				tmp = append(tmp, b...)
-			}
+			// Copy the instruction, and any argument.
+			tmp = append(tmp, e.instructions[ip:ip+opLen]...)
 		}
 		ip += opLen
 	}
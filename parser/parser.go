@@ -26,9 +26,11 @@ type (
 const (
 	_ int = iota
 	LOWEST
-	ASSIGN // =
-	COND   // OR or AND
-	EQUALS // == or !=
+	ASSIGN   // =
+	TERNARY  // a ? b : c
+	COALESCE // a ?? b
+	COND     // OR or AND
+	EQUALS   // == or !=
 	CMP
 	LESSGREATER // > or <
 	SUM         // + or -
@@ -40,29 +42,44 @@ const (
 	INDEX       // array[index], map[key]
 )
 
+// DefaultMaxDepth is the default limit upon how deeply expressions,
+// and blocks, may be nested within each other.
+const DefaultMaxDepth = 1000
+
 // precedence contains the prededence for each token-type, which
 // is part of the magic of a Pratt-Parser.
 var precedences = map[token.Type]int{
-	token.ASSIGN:   ASSIGN,
-	token.EQ:       EQUALS,
-	token.NOTEQ:    EQUALS,
-	token.LT:       LESSGREATER,
-	token.LTEQUALS: LESSGREATER,
-	token.GT:       LESSGREATER,
-	token.GTEQUALS: LESSGREATER,
-	token.CONTAINS: LESSGREATER,
-	token.MISSING:  LESSGREATER,
-	token.IN:       LESSGREATER,
-	token.PLUS:     SUM,
-	token.MINUS:    SUM,
-	token.SLASH:    PRODUCT,
-	token.ASTERISK: PRODUCT,
-	token.POW:      POWER,
-	token.MOD:      MOD,
-	token.AND:      COND,
-	token.OR:       COND,
-	token.LPAREN:   CALL,
-	token.LSQUARE:  INDEX,
+	token.ASSIGN:      ASSIGN,
+	token.PLUS_EQ:     ASSIGN,
+	token.MINUS_EQ:    ASSIGN,
+	token.ASTERISK_EQ: ASSIGN,
+	token.SLASH_EQ:    ASSIGN,
+	token.MOD_EQ:      ASSIGN,
+	token.INCREMENT:   ASSIGN,
+	token.DECREMENT:   ASSIGN,
+	token.EQ:          EQUALS,
+	token.NOTEQ:       EQUALS,
+	token.LT:          LESSGREATER,
+	token.LTEQUALS:    LESSGREATER,
+	token.GT:          LESSGREATER,
+	token.GTEQUALS:    LESSGREATER,
+	token.CONTAINS:    LESSGREATER,
+	token.MISSING:     LESSGREATER,
+	token.IN:          LESSGREATER,
+	token.PLUS:        SUM,
+	token.MINUS:       SUM,
+	token.SLASH:       PRODUCT,
+	token.ASTERISK:    PRODUCT,
+	token.POW:         POWER,
+	token.QUESTION:    TERNARY,
+	token.COALESCE:    COALESCE,
+	token.MOD:         MOD,
+	token.AND:         COND,
+	token.OR:          COND,
+	token.LPAREN:      CALL,
+	token.LSQUARE:     INDEX,
+	token.PERIOD:      INDEX,
+	token.SAFE_PERIOD: INDEX,
 }
 
 // Parser is the object which maintains our parser state.
@@ -81,7 +98,7 @@ type Parser struct {
 	peekToken token.Token
 
 	// errors holds parsing-errors.
-	errors []string
+	errors []*Error
 
 	// prefixParseFns holds a map of parsing methods for
 	// prefix-based syntax.
@@ -90,6 +107,21 @@ type Parser struct {
 	// infixParseFns holds a map of parsing methods for
 	// infix-based syntax.
 	infixParseFns map[token.Type]infixParseFn
+
+	// statement is true if the next expression to be parsed is a
+	// statement of its own, which means it may be an update such as
+	// `count++`.
+	statement bool
+
+	// depth is how deeply nested the expression, or block, we're
+	// parsing is.
+	depth int
+
+	// maxDepth is the limit upon depth, zero means unlimited.
+	maxDepth int
+
+	// tooDeep is set once the nesting limit has been exceeded.
+	tooDeep bool
 }
 
 // New returns a new parser.
@@ -97,7 +129,7 @@ type Parser struct {
 // Once constructed it can be used to parse an input-program
 // into an AST.
 func New(l *lexer.Lexer) *Parser {
-	p := &Parser{l: l, errors: []string{}}
+	p := &Parser{l: l, errors: []*Error{}, maxDepth: DefaultMaxDepth}
 	p.nextToken()
 	p.nextToken()
 
@@ -110,11 +142,13 @@ func New(l *lexer.Lexer) *Parser {
 	p.registerPrefix(token.IF, p.parseIfExpression)
 	p.registerPrefix(token.ILLEGAL, p.parseIllegal)
 	p.registerPrefix(token.INT, p.parseIntegerLiteral)
+	p.registerPrefix(token.LBRACE, p.parseHashLiteral)
 	p.registerPrefix(token.LPAREN, p.parseGroupedExpression)
 	p.registerPrefix(token.LSQUARE, p.parseArrayLiteral)
 	p.registerPrefix(token.MINUS, p.parsePrefixExpression)
 	p.registerPrefix(token.REGEXP, p.parseRegexpLiteral)
 	p.registerPrefix(token.SQRT, p.parsePrefixExpression)
+	p.registerPrefix(token.INTERPOLATED, p.parseInterpolatedString)
 	p.registerPrefix(token.STRING, p.parseStringLiteral)
 	p.registerPrefix(token.TRUE, p.parseBooleanLiteral)
 	p.registerPrefix(token.WHILE, p.parseWhileStatement)
@@ -122,7 +156,15 @@ func New(l *lexer.Lexer) *Parser {
 	p.infixParseFns = make(map[token.Type]infixParseFn)
 	p.registerInfix(token.AND, p.parseInfixExpression)
 	p.registerInfix(token.ASSIGN, p.parseAssignExpression)
+	p.registerInfix(token.ASTERISK_EQ, p.parseCompoundAssignment)
+	p.registerInfix(token.DECREMENT, p.parseIncrement)
+	p.registerInfix(token.INCREMENT, p.parseIncrement)
+	p.registerInfix(token.MINUS_EQ, p.parseCompoundAssignment)
+	p.registerInfix(token.MOD_EQ, p.parseCompoundAssignment)
+	p.registerInfix(token.PLUS_EQ, p.parseCompoundAssignment)
+	p.registerInfix(token.SLASH_EQ, p.parseCompoundAssignment)
 	p.registerInfix(token.ASTERISK, p.parseInfixExpression)
+	p.registerInfix(token.COALESCE, p.parseInfixExpression)
 	p.registerInfix(token.CONTAINS, p.parseInfixExpression)
 	p.registerInfix(token.EQ, p.parseInfixExpression)
 	p.registerInfix(token.GT, p.parseInfixExpression)
@@ -130,6 +172,8 @@ func New(l *lexer.Lexer) *Parser {
 	p.registerInfix(token.IN, p.parseInfixExpression)
 	p.registerInfix(token.LPAREN, p.parseCallExpression)
 	p.registerInfix(token.LSQUARE, p.parseIndexExpression)
+	p.registerInfix(token.PERIOD, p.parseMemberExpression)
+	p.registerInfix(token.SAFE_PERIOD, p.parseMemberExpression)
 	p.registerInfix(token.LT, p.parseInfixExpression)
 	p.registerInfix(token.LTEQUALS, p.parseInfixExpression)
 	p.registerInfix(token.MINUS, p.parseInfixExpression)
@@ -139,6 +183,7 @@ func New(l *lexer.Lexer) *Parser {
 	p.registerInfix(token.OR, p.parseInfixExpression)
 	p.registerInfix(token.PLUS, p.parseInfixExpression)
 	p.registerInfix(token.POW, p.parseInfixExpression)
+	p.registerInfix(token.QUESTION, p.parseTernaryExpression)
 	p.registerInfix(token.SLASH, p.parseInfixExpression)
 
 	return p
@@ -154,15 +199,83 @@ func (p *Parser) registerInfix(tokenType token.Type, fn infixParseFn) {
 	p.infixParseFns[tokenType] = fn
 }
 
+// Error is an error found while parsing, along with the position in the
+// script at which it was found.
+type Error struct {
+	// Line is the line-number, counting from one.
+	Line int
+
+	// Column is the column within the line, counting from one.
+	Column int
+
+	// Message describes the problem.
+	Message string
+}
+
+// Error returns the message, prefixed with the line and column.
+func (e *Error) Error() string {
+	return fmt.Sprintf("%d:%d: %s", e.Line, e.Column, e.Message)
+}
+
 // Errors return stored errors
 func (p *Parser) Errors() []string {
+	out := []string{}
+	for _, e := range p.errors {
+		out = append(out, e.Error())
+	}
+	return out
+}
+
+// ErrorList returns the stored errors, with their positions.
+func (p *Parser) ErrorList() []*Error {
 	return p.errors
 }
 
+// SetMaxDepth sets the limit upon how deeply expressions, and blocks,
+// may be nested within each other.
+//
+// Scripts which exceed it fail to parse, rather than exhausting the
+// stack.  The default is DefaultMaxDepth, and a limit of zero means
+// there is no limit.
+func (p *Parser) SetMaxDepth(n int) {
+	p.maxDepth = n
+}
+
+// enter records that we're parsing a nested expression, or block, and
+// returns false if that exceeds our nesting limit.
+//
+// The caller must call leave once it has finished.
+func (p *Parser) enter() bool {
+	p.depth++
+	if p.maxDepth > 0 && p.depth > p.maxDepth {
+		if !p.tooDeep {
+			p.errorf(p.curToken, "expression nesting too deep")
+			p.tooDeep = true
+		}
+		return false
+	}
+	return true
+}
+
+// leave records that we've finished parsing a nested expression, or block.
+func (p *Parser) leave() {
+	p.depth--
+}
+
+// errorf records an error, at the line and column of the given token.
+//
+// Once the nesting limit has been exceeded no further errors are
+// recorded, because they would only be a consequence of it.
+func (p *Parser) errorf(tok token.Token, format string, args ...interface{}) {
+	if p.tooDeep {
+		return
+	}
+	p.errors = append(p.errors, &Error{Line: tok.Line, Column: tok.Column, Message: fmt.Sprintf(format, args...)})
+}
+
 // peekError raises an error if the next token is not the expected type.
 func (p *Parser) peekError(t token.Type) {
-	msg := fmt.Sprintf("expected next token to be %s, got %s instead around line %d", t, p.curToken.Type, p.l.GetLine())
-	p.errors = append(p.errors, msg)
+	p.errorf(p.peekToken, "expected next token to be %s, got %s instead", t, p.peekToken.Type)
 }
 
 // nextToken moves to our next token from the lexer.
@@ -185,7 +298,7 @@ func (p *Parser) ParseProgram() *ast.Program {
 	}
 
 	if p.curToken.Type == token.ILLEGAL {
-		p.errors = append(p.errors, p.curToken.Literal)
+		p.errorf(p.curToken, "%s", p.curToken.Literal)
 	}
 	return program
 }
@@ -200,11 +313,261 @@ func (p *Parser) parseStatement() ast.Statement {
 		}
 		return r
 
+	case token.BREAK:
+		return p.parseBreakStatement()
+
+	case token.CONTINUE:
+		return p.parseContinueStatement()
+
+	case token.FUNCTION:
+		f := p.parseFunctionStatement()
+		if f == nil {
+			return nil
+		}
+		return f
+
+	case token.SWITCH:
+		s := p.parseSwitchStatement()
+		if s == nil {
+			return nil
+		}
+		return s
+
+	case token.TRY:
+		t := p.parseTryStatement()
+		if t == nil {
+			return nil
+		}
+		return t
+
+	case token.THROW:
+		t := p.parseThrowStatement()
+		if t == nil {
+			return nil
+		}
+		return t
+
+	case token.YIELD:
+		y := p.parseYieldStatement()
+		if y == nil {
+			return nil
+		}
+		return y
+
+	case token.IDENT:
+		if p.peekTokenIs(token.COMMA) {
+			return p.parseMultipleAssignment()
+		}
+		return p.parseExpressionStatement()
+
 	default:
 		return p.parseExpressionStatement()
 	}
 }
 
+// parseBreakStatement parses a break-statement.
+func (p *Parser) parseBreakStatement() *ast.BreakStatement {
+	stmt := &ast.BreakStatement{Token: p.curToken}
+	for p.peekTokenIs(token.SEMICOLON) {
+		p.nextToken()
+	}
+	return stmt
+}
+
+// parseContinueStatement parses a continue-statement.
+func (p *Parser) parseContinueStatement() *ast.ContinueStatement {
+	stmt := &ast.ContinueStatement{Token: p.curToken}
+	for p.peekTokenIs(token.SEMICOLON) {
+		p.nextToken()
+	}
+	return stmt
+}
+
+// parseFunctionStatement parses the definition of a function.
+func (p *Parser) parseFunctionStatement() *ast.FunctionStatement {
+	stmt := &ast.FunctionStatement{Token: p.curToken}
+	if !p.expectPeek(token.IDENT) {
+		return nil
+	}
+	stmt.Name = &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal}
+	if !p.expectPeek(token.LPAREN) {
+		return nil
+	}
+	stmt.Parameters = p.parseFunctionParameters()
+	if stmt.Parameters == nil {
+		return nil
+	}
+	if !p.expectPeek(token.LBRACE) {
+		return nil
+	}
+	stmt.Body = p.parseBlockStatement()
+	if stmt.Body == nil {
+		return nil
+	}
+	for p.peekTokenIs(token.SEMICOLON) {
+		p.nextToken()
+	}
+	return stmt
+}
+
+// parseSwitchStatement parses a switch-statement.
+//
+// Note that `default` is not a keyword, it is only special within
+// the body of a switch-statement.
+func (p *Parser) parseSwitchStatement() *ast.SwitchStatement {
+	stmt := &ast.SwitchStatement{Token: p.curToken}
+	if !p.expectPeek(token.LPAREN) {
+		return nil
+	}
+	p.nextToken()
+	stmt.Subject = p.parseExpression(LOWEST)
+	if stmt.Subject == nil {
+		return nil
+	}
+	if !p.expectPeek(token.RPAREN) {
+		return nil
+	}
+	if !p.expectPeek(token.LBRACE) {
+		return nil
+	}
+	p.nextToken()
+
+	for !p.curTokenIs(token.RBRACE) {
+
+		switch {
+		case p.curTokenIs(token.CASE):
+			p.nextToken()
+			clause := ast.CaseClause{Value: p.parseExpression(LOWEST)}
+			if clause.Value == nil {
+				return nil
+			}
+			if !p.expectPeek(token.LBRACE) {
+				return nil
+			}
+			clause.Body = p.parseBlockStatement()
+			if clause.Body == nil {
+				return nil
+			}
+			stmt.Cases = append(stmt.Cases, clause)
+
+		case p.curTokenIs(token.IDENT) && p.curToken.Literal == "default":
+			if stmt.Default != nil {
+				p.errorf(p.curToken, "switch statement has more than one default block")
+				return nil
+			}
+			if !p.expectPeek(token.LBRACE) {
+				return nil
+			}
+			stmt.Default = p.parseBlockStatement()
+			if stmt.Default == nil {
+				return nil
+			}
+
+		default:
+			p.errorf(p.curToken, "expected case or default within switch statement, got %s instead", p.curToken.Literal)
+			return nil
+		}
+
+		p.nextToken()
+	}
+
+	for p.peekTokenIs(token.SEMICOLON) {
+		p.nextToken()
+	}
+	return stmt
+}
+
+// parseTryStatement parses a try-statement.
+//
+// The name of the variable which holds the error, within the
+// catch-block, is optional.
+func (p *Parser) parseTryStatement() *ast.TryStatement {
+	stmt := &ast.TryStatement{Token: p.curToken}
+	if !p.expectPeek(token.LBRACE) {
+		return nil
+	}
+	stmt.Body = p.parseBlockStatement()
+	if stmt.Body == nil {
+		return nil
+	}
+	if !p.expectPeek(token.CATCH) {
+		return nil
+	}
+	if p.peekTokenIs(token.LPAREN) {
+		p.nextToken()
+		if !p.expectPeek(token.IDENT) {
+			return nil
+		}
+		stmt.Name = &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal}
+		if !p.expectPeek(token.RPAREN) {
+			return nil
+		}
+	}
+	if !p.expectPeek(token.LBRACE) {
+		return nil
+	}
+	stmt.Catch = p.parseBlockStatement()
+	if stmt.Catch == nil {
+		return nil
+	}
+	for p.peekTokenIs(token.SEMICOLON) {
+		p.nextToken()
+	}
+	return stmt
+}
+
+// parseThrowStatement parses a throw-statement.
+func (p *Parser) parseThrowStatement() *ast.ThrowStatement {
+	stmt := &ast.ThrowStatement{Token: p.curToken}
+	p.nextToken()
+	stmt.Value = p.parseExpression(LOWEST)
+	if stmt.Value == nil {
+		return nil
+	}
+	if !p.expectPeek(token.SEMICOLON) {
+		return nil
+	}
+	return stmt
+}
+
+// parseYieldStatement parses a yield-statement.
+func (p *Parser) parseYieldStatement() *ast.YieldStatement {
+	stmt := &ast.YieldStatement{Token: p.curToken}
+	p.nextToken()
+	stmt.Value = p.parseExpression(LOWEST)
+	if stmt.Value == nil {
+		return nil
+	}
+	if !p.expectPeek(token.SEMICOLON) {
+		return nil
+	}
+	return stmt
+}
+
+// parseFunctionParameters parses the names of function-parameters.
+func (p *Parser) parseFunctionParameters() []*ast.Identifier {
+	identifiers := make([]*ast.Identifier, 0)
+	if p.peekTokenIs(token.RPAREN) {
+		p.nextToken()
+		return identifiers
+	}
+	if !p.expectPeek(token.IDENT) {
+		return nil
+	}
+	identifiers = append(identifiers, &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal})
+	for p.peekTokenIs(token.COMMA) {
+		p.nextToken()
+		if !p.expectPeek(token.IDENT) {
+			return nil
+		}
+		identifiers = append(identifiers, &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal})
+	}
+	if !p.expectPeek(token.RPAREN) {
+		return nil
+	}
+	return identifiers
+}
+
 // parseReturnStatement parses a return-statement.
 func (p *Parser) parseReturnStatement() *ast.ReturnStatement {
 	stmt := &ast.ReturnStatement{Token: p.curToken}
@@ -212,7 +575,7 @@ func (p *Parser) parseReturnStatement() *ast.ReturnStatement {
 	stmt.ReturnValue = p.parseExpression(LOWEST)
 	p.nextToken()
 	if p.curToken.Type != token.SEMICOLON {
-		p.errors = append(p.errors, fmt.Sprintf("expected semicolon after return-value; found token '%v'", p.curToken))
+		p.errorf(p.curToken, "expected semicolon after return-value; found token '%s'", p.curToken.Literal)
 		stmt.ReturnValue = nil
 		return nil
 	}
@@ -223,13 +586,13 @@ func (p *Parser) parseReturnStatement() *ast.ReturnStatement {
 // Function called on error if there is no prefix-based parsing method
 // for the given token.
 func (p *Parser) noPrefixParseFnError(t token.Type) {
-	msg := fmt.Sprintf("no prefix parse function for %s found around line %d", t, p.l.GetLine())
-	p.errors = append(p.errors, msg)
+	p.errorf(p.curToken, "no prefix parse function for %s found", t)
 }
 
 // parse Expression Statement
 func (p *Parser) parseExpressionStatement() *ast.ExpressionStatement {
 	stmt := &ast.ExpressionStatement{Token: p.curToken}
+	p.statement = true
 	stmt.Expression = p.parseExpression(LOWEST)
 	for p.peekTokenIs(token.SEMICOLON) {
 		p.nextToken()
@@ -239,6 +602,18 @@ func (p *Parser) parseExpressionStatement() *ast.ExpressionStatement {
 
 // parse an expression.
 func (p *Parser) parseExpression(precedence int) ast.Expression {
+
+	defer p.leave()
+	if !p.enter() {
+		return nil
+	}
+
+	// Updates, such as `count++` and `total += 3`, leave no value
+	// behind so they may only be used as statements - not within
+	// any expression, including those nested within this one.
+	statement := p.statement
+	p.statement = false
+
 	prefix := p.prefixParseFns[p.curToken.Type]
 	if prefix == nil {
 		p.noPrefixParseFnError(p.curToken.Type)
@@ -256,6 +631,21 @@ func (p *Parser) parseExpression(precedence int) ast.Expression {
 		if infix == nil {
 			return leftExp
 		}
+
+		_, update := compoundOperators[p.peekToken.Type]
+		if update && !statement {
+			p.errorf(p.peekToken, "%s may only be used as a statement", p.peekToken.Literal)
+
+			// Skip the update, so that neither its operator nor
+			// its value are reported again by the expressions
+			// which enclose this one.
+			reported := len(p.errors)
+			p.nextToken()
+			infix(leftExp)
+			p.errors = p.errors[:reported]
+			return nil
+		}
+
 		p.nextToken()
 		leftExp = infix(leftExp)
 
@@ -263,6 +653,12 @@ func (p *Parser) parseExpression(precedence int) ast.Expression {
 		if leftExp == nil {
 			return nil
 		}
+
+		// Nothing may follow an update.
+		if update {
+			return leftExp
+		}
+		statement = false
 	}
 	return leftExp
 }
@@ -271,14 +667,13 @@ func (p *Parser) parseExpression(precedence int) ast.Expression {
 //
 // This is generally seen with an unterminated string.
 func (p *Parser) parseIllegal() ast.Expression {
-	msg := fmt.Sprintf("illegal token hit parsing program %s", p.curToken.Literal)
-	p.errors = append(p.errors, msg)
+	p.errorf(p.curToken, "illegal token hit parsing program %s", p.curToken.Literal)
 	return nil
 }
 
 // report an error if we hit an unexpected end of file.
 func (p *Parser) parseEOF() ast.Expression {
-	p.errors = append(p.errors, "unexpected end of file reached")
+	p.errorf(p.curToken, "unexpected end of file reached")
 	return nil
 }
 
@@ -291,23 +686,39 @@ func (p *Parser) parseIdentifier() ast.Expression {
 func (p *Parser) parseIntegerLiteral() ast.Expression {
 	lit := &ast.IntegerLiteral{Token: p.curToken}
 
-	value, err := strconv.ParseInt(p.curToken.Literal, 10, 64)
+	value, err := parseInteger(p.curToken.Literal)
 	if err != nil {
-		msg := fmt.Sprintf("could not parse %q as integer around line %d", p.curToken.Literal, p.l.GetLine())
-		p.errors = append(p.errors, msg)
+		p.errorf(p.curToken, "could not parse %q as integer", p.curToken.Literal)
 		return nil
 	}
 	lit.Value = value
 	return lit
 }
 
+// parseInteger converts the literal of an integer to its value.
+//
+// Literals prefixed with `0x`, `0o`, or `0b` are hexadecimal, octal, and
+// binary respectively, and all others are decimal - even those with a
+// leading zero.  Underscores may be used to separate digits.
+func parseInteger(lit string) (int64, error) {
+
+	lower := strings.ToLower(lit)
+	if strings.HasPrefix(lower, "0x") || strings.HasPrefix(lower, "0o") || strings.HasPrefix(lower, "0b") {
+		return strconv.ParseInt(lit, 0, 64)
+	}
+
+	if strings.Contains(lit, "__") || strings.HasSuffix(lit, "_") {
+		return 0, fmt.Errorf("invalid use of digit-separator in %s", lit)
+	}
+	return strconv.ParseInt(strings.ReplaceAll(lit, "_", ""), 10, 64)
+}
+
 // parseFloatLiteral parses a float-literal
 func (p *Parser) parseFloatLiteral() ast.Expression {
 	flo := &ast.FloatLiteral{Token: p.curToken}
 	value, err := strconv.ParseFloat(p.curToken.Literal, 64)
 	if err != nil {
-		msg := fmt.Sprintf("could not parse %q as float around line %d", p.curToken.Literal, p.l.GetLine())
-		p.errors = append(p.errors, msg)
+		p.errorf(p.curToken, "could not parse %q as float", p.curToken.Literal)
 		return nil
 	}
 	flo.Value = value
@@ -341,6 +752,61 @@ func (p *Parser) parseInfixExpression(left ast.Expression) ast.Expression {
 	precedence := p.curPrecedence()
 	p.nextToken()
 	expression.Right = p.parseExpression(precedence)
+
+	//
+	// A chain of comparisons, such as `1 < x < 10`, tests each
+	// pair of operands in turn, rather than comparing the result
+	// of the first comparison with the next operand.
+	//
+	if !isComparison(expression.Token.Type) || !isComparison(p.peekToken.Type) || expression.Right == nil {
+		return expression
+	}
+
+	chain := &ast.ComparisonExpression{
+		Token:     expression.Token,
+		Operands:  []ast.Expression{left, expression.Right},
+		Operators: []string{expression.Operator},
+	}
+	for isComparison(p.peekToken.Type) {
+		p.nextToken()
+		chain.Operators = append(chain.Operators, p.curToken.Literal)
+
+		p.nextToken()
+		right := p.parseExpression(precedence)
+		if right == nil {
+			return nil
+		}
+		chain.Operands = append(chain.Operands, right)
+	}
+	return chain
+}
+
+// isComparison returns true if the given token is one of the comparisons
+// which may be chained, such as `<`.
+func isComparison(t token.Type) bool {
+	return t == token.LT || t == token.LTEQUALS || t == token.GT || t == token.GTEQUALS
+}
+
+// parseTernaryExpression parses a ternary-expression, `cond ? a : b`.
+//
+// The else-branch is parsed at a lower precedence so that ternary
+// expressions may be chained: `a ? b : c ? d : e`.
+func (p *Parser) parseTernaryExpression(condition ast.Expression) ast.Expression {
+	expression := &ast.TernaryExpression{Token: p.curToken, Condition: condition}
+
+	p.nextToken()
+	expression.Then = p.parseExpression(LOWEST)
+	if expression.Then == nil {
+		return nil
+	}
+	if !p.expectPeek(token.COLON) {
+		return nil
+	}
+	p.nextToken()
+	expression.Else = p.parseExpression(ASSIGN)
+	if expression.Else == nil {
+		return nil
+	}
 	return expression
 }
 
@@ -381,6 +847,25 @@ func (p *Parser) parseIfExpression() ast.Expression {
 	}
 	if p.peekTokenIs(token.ELSE) {
 		p.nextToken()
+
+		//
+		// `else if` is handled by treating the second if as
+		// the only statement of the else-block.
+		//
+		if p.peekTokenIs(token.IF) {
+			p.nextToken()
+			tok := p.curToken
+			nested := p.parseIfExpression()
+			if nested == nil {
+				return nil
+			}
+			expression.Alternative = &ast.BlockStatement{
+				Token:      tok,
+				Statements: []ast.Statement{&ast.ExpressionStatement{Token: tok, Expression: nested}},
+			}
+			return expression
+		}
+
 		if !p.expectPeek(token.LBRACE) {
 			return nil
 		}
@@ -418,6 +903,11 @@ func (p *Parser) parseWhileStatement() ast.Expression {
 
 // parseBlockStatement parses a block.
 func (p *Parser) parseBlockStatement() *ast.BlockStatement {
+	defer p.leave()
+	if !p.enter() {
+		return nil
+	}
+
 	block := &ast.BlockStatement{Token: p.curToken}
 	block.Statements = []ast.Statement{}
 	p.nextToken()
@@ -430,7 +920,7 @@ func (p *Parser) parseBlockStatement() *ast.BlockStatement {
 		p.nextToken()
 
 		if p.curToken.Type == token.EOF || p.curToken.Type == token.ILLEGAL {
-			p.errors = append(p.errors, "incomplete block statement")
+			p.errorf(p.curToken, "incomplete block statement")
 			return nil
 		}
 	}
@@ -442,6 +932,66 @@ func (p *Parser) parseStringLiteral() ast.Expression {
 	return &ast.StringLiteral{Token: p.curToken, Value: p.curToken.Literal}
 }
 
+// parseInterpolatedString parses a string containing expressions, such
+// as "Hello ${name}".
+//
+// Each embedded expression is parsed by a parser of its own.
+func (p *Parser) parseInterpolatedString() ast.Expression {
+	str := &ast.InterpolatedString{Token: p.curToken}
+
+	segments, err := lexer.SplitInterpolated(p.curToken.Literal)
+	if err != nil {
+		p.errorf(p.curToken, "%s", err)
+		return nil
+	}
+
+	for _, seg := range segments {
+
+		if !seg.Expression {
+			str.Parts = append(str.Parts, &ast.StringLiteral{Token: token.Token{Type: token.STRING, Literal: seg.Text, Line: p.curToken.Line, Column: p.curToken.Column}, Value: seg.Text})
+			continue
+		}
+
+		sub := New(lexer.New(seg.Text))
+		sub.depth = p.depth
+		sub.maxDepth = p.maxDepth
+		if sub.curTokenIs(token.EOF) {
+			p.errorf(p.curToken, "empty expression in interpolated string")
+			return nil
+		}
+
+		exp := sub.parseExpression(LOWEST)
+		if exp != nil && !sub.peekTokenIs(token.EOF) {
+			sub.errorf(sub.peekToken, "unexpected %s in interpolated expression", sub.peekToken.Literal)
+		}
+		if len(sub.errors) > 0 {
+			for _, e := range sub.errors {
+				p.errorf(p.curToken, "in interpolated string: %s", e.Error())
+			}
+			return nil
+		}
+
+		str.Parts = append(str.Parts, exp)
+	}
+
+	//
+	// Ensure we start with a string, so that concatenation
+	// converts everything else to strings.
+	//
+	if len(str.Parts) == 0 || !isStringLiteral(str.Parts[0]) {
+		empty := &ast.StringLiteral{Token: token.Token{Type: token.STRING, Line: p.curToken.Line, Column: p.curToken.Column}}
+		str.Parts = append([]ast.Expression{empty}, str.Parts...)
+	}
+
+	return str
+}
+
+// isStringLiteral returns true if the given expression is a string-literal.
+func isStringLiteral(exp ast.Expression) bool {
+	_, ok := exp.(*ast.StringLiteral)
+	return ok
+}
+
 // parseRegexpLiteral parses a regular-expression.
 func (p *Parser) parseRegexpLiteral() ast.Expression {
 
@@ -475,6 +1025,35 @@ func (p *Parser) parseArrayLiteral() ast.Expression {
 	return array
 }
 
+// parseHashLiteral parses a hash literal.
+func (p *Parser) parseHashLiteral() ast.Expression {
+	hash := &ast.HashLiteral{Token: p.curToken}
+	hash.Pairs = []ast.HashPair{}
+	for !p.peekTokenIs(token.RBRACE) {
+		p.nextToken()
+		key := p.parseExpression(LOWEST)
+		if key == nil {
+			return nil
+		}
+		if !p.expectPeek(token.COLON) {
+			return nil
+		}
+		p.nextToken()
+		value := p.parseExpression(LOWEST)
+		if value == nil {
+			return nil
+		}
+		hash.Pairs = append(hash.Pairs, ast.HashPair{Key: key, Value: value})
+		if !p.peekTokenIs(token.RBRACE) && !p.expectPeek(token.COMMA) {
+			return nil
+		}
+	}
+	if !p.expectPeek(token.RBRACE) {
+		return nil
+	}
+	return hash
+}
+
 // parse an array of expressions, as used for function-arguments.
 func (p *Parser) parseExpressionList(end token.Type) []ast.Expression {
 	list := make([]ast.Expression, 0)
@@ -501,8 +1080,7 @@ func (p *Parser) parseAssignExpression(name ast.Expression) ast.Expression {
 	if n, ok := name.(*ast.Identifier); ok {
 		stmt.Name = n
 	} else {
-		msg := fmt.Sprintf("expected assign token to be IDENT, got %s instead around line %d", name.TokenLiteral(), p.l.GetLine())
-		p.errors = append(p.errors, msg)
+		p.errorf(p.curToken, "expected assign token to be IDENT, got %s instead", name.TokenLiteral())
 	}
 
 	// Skip over the `=`
@@ -512,6 +1090,94 @@ func (p *Parser) parseAssignExpression(name ast.Expression) ast.Expression {
 	return stmt
 }
 
+// compoundOperators maps the compound assignment operators to the
+// arithmetic operators they apply.
+var compoundOperators = map[token.Type]token.Type{
+	token.PLUS_EQ:     token.PLUS,
+	token.MINUS_EQ:    token.MINUS,
+	token.ASTERISK_EQ: token.ASTERISK,
+	token.SLASH_EQ:    token.SLASH,
+	token.MOD_EQ:      token.MOD,
+	token.INCREMENT:   token.PLUS,
+	token.DECREMENT:   token.MINUS,
+}
+
+// parseCompoundAssignment parses an assignment such as `total += 3`,
+// which is rewritten as `total = total + 3`.
+func (p *Parser) parseCompoundAssignment(name ast.Expression) ast.Expression {
+	tok := p.curToken
+
+	// Skip over the operator
+	p.nextToken()
+
+	return p.compoundAssignment(name, tok, p.parseExpression(LOWEST))
+}
+
+// parseIncrement parses `count++`, and `count--`, which are rewritten as
+// `count = count + 1`, and `count = count - 1`, respectively.
+func (p *Parser) parseIncrement(name ast.Expression) ast.Expression {
+	tok := p.curToken
+	one := &ast.IntegerLiteral{Token: token.Token{Type: token.INT, Literal: "1", Line: tok.Line, Column: tok.Column}, Value: 1}
+	return p.compoundAssignment(name, tok, one)
+}
+
+// compoundAssignment returns an assignment to the named variable of the
+// result of applying the arithmetic operator, of the given compound
+// operator, to the variable and the value.
+func (p *Parser) compoundAssignment(name ast.Expression, tok token.Token, value ast.Expression) ast.Expression {
+	n, ok := name.(*ast.Identifier)
+	if !ok {
+		p.errorf(tok, "expected %s token to follow IDENT, got %s instead", tok.Literal, name.TokenLiteral())
+		return nil
+	}
+	if value == nil {
+		return nil
+	}
+
+	op := compoundOperators[tok.Type]
+	return &ast.AssignStatement{
+		Token: tok,
+		Name:  n,
+		Value: &ast.InfixExpression{
+			Token:    token.Token{Type: op, Literal: string(op), Line: tok.Line, Column: tok.Column},
+			Left:     n,
+			Operator: string(op),
+			Right:    value,
+		},
+	}
+}
+
+// parseMultipleAssignment parses an assignment to several variables,
+// such as `a, b = split(str, ",")`.
+func (p *Parser) parseMultipleAssignment() ast.Statement {
+	names := []*ast.Identifier{{Token: p.curToken, Value: p.curToken.Literal}}
+
+	for p.peekTokenIs(token.COMMA) {
+		p.nextToken()
+		if !p.expectPeek(token.IDENT) {
+			return nil
+		}
+		names = append(names, &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal})
+	}
+
+	if !p.expectPeek(token.ASSIGN) {
+		return nil
+	}
+	stmt := &ast.AssignStatement{Token: p.curToken, Names: names}
+
+	// Skip over the `=`
+	p.nextToken()
+
+	stmt.Value = p.parseExpression(LOWEST)
+	if stmt.Value == nil {
+		return nil
+	}
+	for p.peekTokenIs(token.SEMICOLON) {
+		p.nextToken()
+	}
+	return &ast.ExpressionStatement{Token: names[0].Token, Expression: stmt}
+}
+
 // parseCallExpression parses a function-call expression.
 func (p *Parser) parseCallExpression(function ast.Expression) ast.Expression {
 	exp := &ast.CallExpression{Token: p.curToken, Function: function}
@@ -520,16 +1186,77 @@ func (p *Parser) parseCallExpression(function ast.Expression) ast.Expression {
 }
 
 // parseIndexExpression parse an array-index expression.
+//
+// This also handles slices, such as `a[1:3]`, `a[:3]`, and `a[1:]`.
 func (p *Parser) parseIndexExpression(left ast.Expression) ast.Expression {
-	exp := &ast.IndexExpression{Token: p.curToken, Left: left}
+	tok := p.curToken
 	p.nextToken()
-	exp.Index = p.parseExpression(LOWEST)
+
+	var index ast.Expression
+	if !p.curTokenIs(token.COLON) {
+		index = p.parseExpression(LOWEST)
+		if index == nil {
+			return nil
+		}
+
+		if !p.peekTokenIs(token.COLON) {
+			if !p.expectPeek(token.RSQUARE) {
+				return nil
+			}
+			return &ast.IndexExpression{Token: tok, Left: left, Index: index}
+		}
+		p.nextToken()
+	}
+
+	//
+	// We're looking at the colon of a slice.
+	//
+	exp := &ast.SliceExpression{Token: tok, Left: left, Start: index}
+	if !p.peekTokenIs(token.RSQUARE) {
+		p.nextToken()
+		exp.End = p.parseExpression(LOWEST)
+		if exp.End == nil {
+			return nil
+		}
+	}
 	if !p.expectPeek(token.RSQUARE) {
 		return nil
 	}
 	return exp
 }
 
+// parseMemberExpression parses a member-access, such as `user.name` or
+// `items.0`.
+//
+// These are just another way of writing the index-expressions
+// `user["name"]` and `items[0]`.
+func (p *Parser) parseMemberExpression(left ast.Expression) ast.Expression {
+	tok := p.curToken
+	optional := tok.Type == token.SAFE_PERIOD
+	p.nextToken()
+
+	// An array-index.
+	if p.curTokenIs(token.INT) {
+		index := p.parseIntegerLiteral()
+		if index == nil {
+			return nil
+		}
+		return &ast.IndexExpression{Token: tok, Left: left, Index: index, Optional: optional}
+	}
+
+	// A field name, which may be a keyword such as `if`.
+	//
+	// Keywords are the only tokens, other than identifiers, which
+	// the lexer reads as identifiers.
+	if p.curToken.Type != token.LookupIdentifier(p.curToken.Literal) {
+		p.errorf(p.curToken, "expected a field name, or index, after '%s', got %s", tok.Literal, p.curToken.Type)
+		return nil
+	}
+
+	name := &ast.StringLiteral{Token: p.curToken, Value: p.curToken.Literal}
+	return &ast.IndexExpression{Token: tok, Left: left, Index: name, Optional: optional}
+}
+
 // curTokenIs tests if the current token has the given type.
 func (p *Parser) curTokenIs(t token.Type) bool {
 	return p.curToken.Type == t
@@ -49,6 +49,23 @@ func (s *Stack) Export() []string {
 	return ret
 }
 
+// Entries returns the entries stored upon the stack, with the top of
+// the stack being the last entry.
+//
+// This is not a copy, so the entries must not be modified.
+func (s *Stack) Entries() []object.Object {
+	return s.entries
+}
+
+// Reset removes all entries from the stack, keeping the memory they used
+// so that it may be reused.
+func (s *Stack) Reset() {
+	for i := range s.entries {
+		s.entries[i] = nil
+	}
+	s.entries = s.entries[:0]
+}
+
 // Size retrieves the number of entries stored upon the stack.
 func (s *Stack) Size() int {
 	return (len(s.entries))
@@ -73,3 +90,14 @@ func (s *Stack) Pop() (object.Object, error) {
 
 	return result, nil
 }
+
+// Truncate removes entries from the stack, until it holds no more than
+// the given number.
+func (s *Stack) Truncate(size int) {
+	for i := size; i < len(s.entries); i++ {
+		s.entries[i] = nil
+	}
+	if size < len(s.entries) {
+		s.entries = s.entries[:size]
+	}
+}
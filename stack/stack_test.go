@@ -94,3 +94,71 @@ func TestEmptyStack(t *testing.T) {
 		t.Errorf("should receive an error popping an empty stack!")
 	}
 }
+
+// Test we can view the entries
+func TestStackEntries(t *testing.T) {
+	s := New()
+
+	if len(s.Entries()) != 0 {
+		t.Errorf("New stack has entries")
+	}
+
+	s.Push(&object.String{Value: "Steve Kemp"})
+	s.Push(&object.Integer{Value: 3})
+
+	entries := s.Entries()
+	if len(entries) != 2 {
+		t.Errorf("stack has a size-mismatch")
+	}
+	if entries[0].Inspect() != "Steve Kemp" || entries[1].Inspect() != "3" {
+		t.Errorf("stack entries are in the wrong order")
+	}
+}
+
+// Test resetting a stack empties it, and leaves it usable
+func TestStackReset(t *testing.T) {
+	s := New()
+
+	s.Push(&object.String{Value: "Steve"})
+	s.Push(&object.String{Value: "Kemp"})
+	s.Reset()
+
+	if !s.Empty() {
+		t.Errorf("Stack should be empty after a reset.")
+	}
+
+	s.Push(&object.String{Value: "Again"})
+	val, err := s.Pop()
+	if err != nil {
+		t.Errorf("Received an unexpected error popping from the stack")
+	}
+	if val.Inspect() != "Again" {
+		t.Errorf("Stack push/pop mismatch")
+	}
+}
+
+// Test we can remove several entries at once.
+func TestStackTruncate(t *testing.T) {
+	s := New()
+
+	s.Push(&object.String{Value: "Steve"})
+	s.Push(&object.String{Value: "Kemp"})
+	s.Push(&object.String{Value: "Again"})
+
+	s.Truncate(5)
+	if s.Size() != 3 {
+		t.Errorf("Truncating to a larger size changed the stack")
+	}
+
+	s.Truncate(1)
+	if s.Size() != 1 {
+		t.Errorf("stack has a size-mismatch")
+	}
+	val, err := s.Pop()
+	if err != nil {
+		t.Errorf("Received an unexpected error popping from the stack")
+	}
+	if val.Inspect() != "Steve" {
+		t.Errorf("Stack truncate mismatch")
+	}
+}
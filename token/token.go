@@ -16,63 +16,104 @@ type Type string
 type Token struct {
 	Type    Type
 	Literal string
+
+	// Line is the line, within the source, where the token started.
+	//
+	// Lines are numbered from one.
+	Line int
+
+	// Column is the column, within the line, where the token started.
+	//
+	// Columns are numbered from one, and count characters rather
+	// than bytes.
+	Column int
 }
 
 // pre-defined Type
 const (
-	AND       = "&&"
-	ASSIGN    = "="
-	ASTERISK  = "*"
-	BANG      = "!"
-	COMMA     = ","
-	CONTAINS  = "~="
-	ELSE      = "ELSE"
-	EOF       = "EOF"
-	EQ        = "=="
-	FALSE     = "FALSE"
-	FLOAT     = "FLOAT"
-	GT        = ">"
-	GTEQUALS  = ">="
-	IDENT     = "IDENT"
-	IF        = "IF"
-	ILLEGAL   = "ILLEGAL"
-	IN        = "IN"
-	INT       = "INT"
-	LBRACE    = "{"
-	LPAREN    = "("
-	LSQUARE   = "["
-	LT        = "<"
-	LTEQUALS  = "<="
-	MINUS     = "-"
-	MISSING   = "!~"
-	MOD       = "%"
-	NOTEQ     = "!="
-	OR        = "||"
-	PERIOD    = "."
-	PLUS      = "+"
-	POW       = "**"
-	RBRACE    = "}"
-	REGEXP    = "REGEXP"
-	RETURN    = "RETURN"
-	RPAREN    = ")"
-	RSQUARE   = "]"
-	SEMICOLON = ";"
-	SLASH     = "/"
-	SQRT      = "√"
-	STRING    = "STRING"
-	TRUE      = "TRUE"
-	WHILE     = "WHILE"
+	AND          = "&&"
+	ASSIGN       = "="
+	ASTERISK     = "*"
+	ASTERISK_EQ  = "*="
+	BANG         = "!"
+	BREAK        = "BREAK"
+	CASE         = "CASE"
+	CATCH        = "CATCH"
+	COALESCE     = "??"
+	COLON        = ":"
+	COMMA        = ","
+	DECREMENT    = "--"
+	CONTAINS     = "~="
+	CONTINUE     = "CONTINUE"
+	ELSE         = "ELSE"
+	EOF          = "EOF"
+	EQ           = "=="
+	FALSE        = "FALSE"
+	FLOAT        = "FLOAT"
+	FUNCTION     = "FUNCTION"
+	GT           = ">"
+	GTEQUALS     = ">="
+	IDENT        = "IDENT"
+	IF           = "IF"
+	ILLEGAL      = "ILLEGAL"
+	INCREMENT    = "++"
+	IN           = "IN"
+	INT          = "INT"
+	INTERPOLATED = "INTERPOLATED"
+	LBRACE       = "{"
+	LPAREN       = "("
+	LSQUARE      = "["
+	LT           = "<"
+	LTEQUALS     = "<="
+	MINUS        = "-"
+	MINUS_EQ     = "-="
+	MISSING      = "!~"
+	MOD          = "%"
+	MOD_EQ       = "%="
+	NOTEQ        = "!="
+	OR           = "||"
+	PERIOD       = "."
+	PLUS         = "+"
+	PLUS_EQ      = "+="
+	POW          = "**"
+	QUESTION     = "?"
+	RBRACE       = "}"
+	REGEXP       = "REGEXP"
+	RETURN       = "RETURN"
+	RPAREN       = ")"
+	RSQUARE      = "]"
+	SAFE_PERIOD  = "?."
+	SEMICOLON    = ";"
+	SLASH        = "/"
+	SLASH_EQ     = "/="
+	SQRT         = "√"
+	STRING       = "STRING"
+	SWITCH       = "SWITCH"
+	THROW        = "THROW"
+	TRUE         = "TRUE"
+	TRY          = "TRY"
+	WHILE        = "WHILE"
+	YIELD        = "YIELD"
 )
 
 // reversed keywords
 var keywords = map[string]Type{
-	"else":   ELSE,
-	"false":  FALSE,
-	"if":     IF,
-	"in":     IN,
-	"return": RETURN,
-	"true":   TRUE,
-	"while":  WHILE,
+	"break":    BREAK,
+	"case":     CASE,
+	"catch":    CATCH,
+	"continue": CONTINUE,
+	"else":     ELSE,
+	"false":    FALSE,
+	"function": FUNCTION,
+	"if":       IF,
+	"in":       IN,
+	"return":   RETURN,
+	"switch":   SWITCH,
+	"throw":    THROW,
+	"true":     TRUE,
+	"try":      TRY,
+	"while":    WHILE,
+	"yield":    YIELD,
 }
 
 // LookupIdentifier used to determinate whether identifier is keyword nor not
@@ -0,0 +1,291 @@
+// This file contains the code which allows golang functions with
+// ordinary signatures, such as `func(string, int) bool`, to be exposed
+// to the scripting environment.
+//
+// Arguments are converted from objects to the types the function
+// expects, and the return value is converted back into an object.
+//
+// It also contains the conversion of the results of scripts to golang
+// values, which is used by ExecuteValue.
+
+package evalfilter
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+
+	"github.com/skx/evalfilter/v2/object"
+)
+
+var (
+	// objectType is the type of the object.Object interface.
+	objectType = reflect.TypeOf((*object.Object)(nil)).Elem()
+
+	// errorType is the type of the error interface.
+	errorType = reflect.TypeOf((*error)(nil)).Elem()
+)
+
+// AddTypedFunction exposes a golang function from your host application
+// to the scripting environment, converting arguments and results
+// automatically.
+//
+// Unlike AddFunction the function may have an ordinary signature, for
+// example `func(string, int) bool`, or `func(float64) float64`.  The
+// supported parameter types are strings, booleans, integers, floats,
+// and object.Object.  The function may return nothing, a single value,
+// or a value and an error.  Slices of the supported types may also be
+// returned, and these become arrays.
+//
+// If the script calls the function with the wrong number of arguments,
+// or with arguments which cannot be converted, execution is aborted
+// with an error.  The same happens if the function returns a non-nil
+// error, or an unsigned integer which is too large to be represented.
+func (e *Eval) AddTypedFunction(name string, fn interface{}) error {
+
+	val := reflect.ValueOf(fn)
+	if val.Kind() != reflect.Func {
+		return fmt.Errorf("%s is not a function, it is %T", name, fn)
+	}
+
+	typ := val.Type()
+	if typ.IsVariadic() {
+		return fmt.Errorf("the function %s is variadic, which is not supported", name)
+	}
+
+	//
+	// Ensure we can convert all the parameters.
+	//
+	for i := 0; i < typ.NumIn(); i++ {
+		if !typedArgumentSupported(typ.In(i)) {
+			return fmt.Errorf("the function %s has an unsupported type for argument %d: %s", name, i+1, typ.In(i))
+		}
+	}
+
+	//
+	// And the results.
+	//
+	switch typ.NumOut() {
+	case 0:
+	case 1:
+		if !typedResultSupported(typ.Out(0)) {
+			return fmt.Errorf("the function %s has an unsupported return type: %s", name, typ.Out(0))
+		}
+	case 2:
+		if !typedResultSupported(typ.Out(0)) {
+			return fmt.Errorf("the function %s has an unsupported return type: %s", name, typ.Out(0))
+		}
+		if typ.Out(1) != errorType {
+			return fmt.Errorf("the second return value of the function %s must be an error, not %s", name, typ.Out(1))
+		}
+	default:
+		return fmt.Errorf("the function %s returns too many values", name)
+	}
+
+	wrapper := func(args []object.Object) (object.Object, error) {
+
+		if len(args) != typ.NumIn() {
+			return nil, fmt.Errorf("the function %s expects %d argument(s), got %d", name, typ.NumIn(), len(args))
+		}
+
+		in := make([]reflect.Value, len(args))
+		for i, arg := range args {
+			v, err := typedArgument(arg, typ.In(i))
+			if err != nil {
+				return nil, fmt.Errorf("argument %d to the function %s: %s", i+1, name, err)
+			}
+			in[i] = v
+		}
+
+		out := val.Call(in)
+
+		if len(out) == 0 {
+			return &object.Null{}, nil
+		}
+		if len(out) == 2 && !out[1].IsNil() {
+			return nil, fmt.Errorf("the function %s failed: %s", name, out[1].Interface().(error))
+		}
+		ret, err := typedResult(out[0])
+		if err != nil {
+			return nil, fmt.Errorf("the result of the function %s: %s", name, err)
+		}
+		return ret, nil
+	}
+
+	e.hostFunctions[name] = hostFunction{fun: wrapper, min: typ.NumIn(), max: typ.NumIn(), arity: true}
+	e.environment.SetFunction(name, wrapper)
+	e.environment.SetArity(name, typ.NumIn(), typ.NumIn())
+	return nil
+}
+
+// typedArgumentSupported returns true if we can convert objects to the
+// given type.
+func typedArgumentSupported(typ reflect.Type) bool {
+
+	if typ == objectType {
+		return true
+	}
+
+	switch typ.Kind() {
+	case reflect.String, reflect.Bool,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return true
+	}
+	return false
+}
+
+// typedResultSupported returns true if we can convert values of the
+// given type to an object.
+func typedResultSupported(typ reflect.Type) bool {
+
+	if typ.Kind() == reflect.Slice {
+		return typedResultSupported(typ.Elem())
+	}
+
+	if typ.Implements(objectType) {
+		return true
+	}
+	return typedArgumentSupported(typ)
+}
+
+// typedArgument converts the given object to a value of the given type.
+func typedArgument(arg object.Object, typ reflect.Type) (reflect.Value, error) {
+
+	if typ == objectType {
+		if arg == nil {
+			return reflect.Zero(typ), nil
+		}
+		return reflect.ValueOf(arg), nil
+	}
+
+	v := reflect.New(typ).Elem()
+
+	switch typ.Kind() {
+
+	case reflect.String:
+		s, ok := arg.(*object.String)
+		if !ok {
+			return v, fmt.Errorf("expected a string, got %s", arg.Type())
+		}
+		v.SetString(s.Value)
+
+	case reflect.Bool:
+		b, ok := arg.(*object.Boolean)
+		if !ok {
+			return v, fmt.Errorf("expected a boolean, got %s", arg.Type())
+		}
+		v.SetBool(b.Value)
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, ok := arg.(*object.Integer)
+		if !ok {
+			return v, fmt.Errorf("expected an integer, got %s", arg.Type())
+		}
+		if v.OverflowInt(i.Value) {
+			return v, fmt.Errorf("the integer %d is out of range for %s", i.Value, typ)
+		}
+		v.SetInt(i.Value)
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		i, ok := arg.(*object.Integer)
+		if !ok {
+			return v, fmt.Errorf("expected an integer, got %s", arg.Type())
+		}
+		if i.Value < 0 || v.OverflowUint(uint64(i.Value)) {
+			return v, fmt.Errorf("the integer %d is out of range for %s", i.Value, typ)
+		}
+		v.SetUint(uint64(i.Value))
+
+	case reflect.Float32, reflect.Float64:
+		switch n := arg.(type) {
+		case *object.Float:
+			v.SetFloat(n.Value)
+		case *object.Integer:
+			v.SetFloat(float64(n.Value))
+		default:
+			return v, fmt.Errorf("expected a number, got %s", arg.Type())
+		}
+	}
+
+	return v, nil
+}
+
+// typedResult converts the given value to an object.
+//
+// An error is returned if the value cannot be represented, such as an
+// unsigned integer which is too large for an integer object.
+func typedResult(v reflect.Value) (object.Object, error) {
+
+	if v.Type().Implements(objectType) {
+		if (v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface) && v.IsNil() {
+			return &object.Null{}, nil
+		}
+		return v.Interface().(object.Object), nil
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		return &object.String{Value: v.String()}, nil
+	case reflect.Bool:
+		return &object.Boolean{Value: v.Bool()}, nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return &object.Integer{Value: v.Int()}, nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if v.Uint() > math.MaxInt64 {
+			return nil, fmt.Errorf("the integer %d is out of range for int64", v.Uint())
+		}
+		return &object.Integer{Value: int64(v.Uint())}, nil
+	case reflect.Float32, reflect.Float64:
+		return &object.Float{Value: v.Float()}, nil
+	case reflect.Slice:
+		elements := make([]object.Object, v.Len())
+		for i := 0; i < v.Len(); i++ {
+			el, err := typedResult(v.Index(i))
+			if err != nil {
+				return nil, fmt.Errorf("element %d: %s", i, err)
+			}
+			elements[i] = el
+		}
+		return &object.Array{Elements: elements}, nil
+	}
+
+	return &object.Null{}, nil
+}
+
+// goValue converts the given object to the natural golang value, as
+// described by ExecuteValue.
+func goValue(obj object.Object) interface{} {
+
+	switch obj := obj.(type) {
+	case *object.Integer:
+		return obj.Value
+	case *object.Float:
+		return obj.Value
+	case *object.String:
+		return obj.Value
+	case *object.Boolean:
+		return obj.Value
+	case *object.Null:
+		return nil
+	case *object.Array:
+		out := make([]interface{}, len(obj.Elements))
+		for i, el := range obj.Elements {
+			out[i] = goValue(el)
+		}
+		return out
+	case *object.Hash:
+		out := make(map[string]interface{}, len(obj.Pairs))
+		for _, pair := range obj.Pairs {
+			out[pair.Key.Inspect()] = goValue(pair.Value)
+		}
+		return out
+	case *object.Time:
+		return obj.Value
+	case *object.Native:
+		return obj.Value
+	}
+
+	return obj
+}
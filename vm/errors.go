@@ -0,0 +1,189 @@
+// errors.go contains the errors which are returned when a script fails
+// at run-time.
+
+package vm
+
+import (
+	"fmt"
+
+	"github.com/skx/evalfilter/v2/code"
+	"github.com/skx/evalfilter/v2/object"
+)
+
+// ErrorCode identifies the kind of problem which caused a RuntimeError.
+type ErrorCode int
+
+// The kinds of run-time error.
+const (
+	// ErrInternal is used for problems which should never happen,
+	// such as malformed bytecode.
+	ErrInternal ErrorCode = iota
+
+	// ErrTypeMismatch is used when an operation is applied to values
+	// of a type it doesn't support, e.g. `"steve" * 3`.
+	ErrTypeMismatch
+
+	// ErrDivByZero is used for division, or modulo, by zero.
+	ErrDivByZero
+
+	// ErrOverflow is used when integer arithmetic overflows.
+	ErrOverflow
+
+	// ErrIndex is used when an index, or key, cannot be used,
+	// e.g. indexing an integer, or using an array as a hash key.
+	ErrIndex
+
+	// ErrUnknownFunction is used when a script calls a function
+	// which doesn't exist.
+	ErrUnknownFunction
+
+	// ErrArgumentCount is used when a function is called with the
+	// wrong number of arguments.
+	ErrArgumentCount
+
+	// ErrFunctionFailed is used when a golang function, which was
+	// called by the script, returned an error or panicked.
+	ErrFunctionFailed
+
+	// ErrStackOverflow is used when the limit configured via
+	// SetMaxStackDepth is exceeded.
+	ErrStackOverflow
+
+	// ErrMissingReturn is used when a script finishes without
+	// returning a value.
+	ErrMissingReturn
+
+	// ErrInvalidValue is used when an operation is applied to a value
+	// of a type it supports, but which it cannot handle, e.g. the
+	// square root of a negative number.
+	ErrInvalidValue
+
+	// ErrConstant is used when a script attempts to assign to a
+	// constant, which was set via SetConstant.
+	ErrConstant
+
+	// ErrThrown is used when a script throws a value, via `throw`,
+	// which is not caught.
+	ErrThrown
+
+	// ErrUnknownField is used when a script refers to a name which
+	// is neither a variable, nor a field, and SetStrictFields is
+	// enabled.
+	ErrUnknownField
+)
+
+// String returns the name of the error code.
+func (c ErrorCode) String() string {
+	switch c {
+	case ErrInternal:
+		return "ErrInternal"
+	case ErrTypeMismatch:
+		return "ErrTypeMismatch"
+	case ErrDivByZero:
+		return "ErrDivByZero"
+	case ErrOverflow:
+		return "ErrOverflow"
+	case ErrIndex:
+		return "ErrIndex"
+	case ErrUnknownFunction:
+		return "ErrUnknownFunction"
+	case ErrArgumentCount:
+		return "ErrArgumentCount"
+	case ErrFunctionFailed:
+		return "ErrFunctionFailed"
+	case ErrStackOverflow:
+		return "ErrStackOverflow"
+	case ErrMissingReturn:
+		return "ErrMissingReturn"
+	case ErrInvalidValue:
+		return "ErrInvalidValue"
+	case ErrConstant:
+		return "ErrConstant"
+	case ErrThrown:
+		return "ErrThrown"
+	case ErrUnknownField:
+		return "ErrUnknownField"
+	}
+	return fmt.Sprintf("ErrorCode(%d)", int(c))
+}
+
+// RuntimeError is the error returned when the execution of a script
+// fails, for example because it divides by zero.
+//
+// Use errors.As to retrieve it, and examine the code.
+//
+// A script may catch these errors with `try` and `catch`, except those
+// with the code ErrInternal, and those with the code ErrFunctionFailed
+// which were caused by a golang function panicking.
+type RuntimeError struct {
+	// Code identifies the kind of error.
+	Code ErrorCode
+
+	// Message describes the error.
+	Message string
+
+	// IP is the offset of the instruction which failed.  Within a
+	// function this is relative to the start of the function's
+	// bytecode.
+	IP int
+
+	// Position is the position, within the source, of the code
+	// which failed.  The line is zero if it is unknown.
+	Position code.Position
+
+	// Err is the error which caused this one, if any, such as an
+	// error returned by a golang function.
+	Err error
+
+	// Value is the value which was thrown, for ErrThrown.
+	Value object.Object
+
+	// located is true once the IP and position have been recorded.
+	located bool
+
+	// panicked is true if this error was caused by a golang function
+	// which panicked.
+	panicked bool
+}
+
+// Error returns the error message, including the position if it is known.
+func (r *RuntimeError) Error() string {
+	if r.Position.Line > 0 {
+		return fmt.Sprintf("%d:%d: %s", r.Position.Line, r.Position.Column, r.Message)
+	}
+	return r.Message
+}
+
+// Unwrap returns the error which caused this one, if any.
+func (r *RuntimeError) Unwrap() error {
+	return r.Err
+}
+
+// caught returns the value which a catch-block receives for the given
+// error, and false if the error cannot be caught.
+//
+// Thrown values are received unchanged, and other run-time errors as
+// their message.  Every code may be caught, except:
+//
+//   - ErrInternal, which means the bytecode, or the VM, is broken.
+//   - ErrFunctionFailed, when the golang function panicked rather than
+//     returning an error, because the host is probably in a bad state.
+//
+// Exceeding the instruction-limit, or the context being cancelled, cannot
+// be caught either.
+func caught(err error) (object.Object, bool) {
+	re, ok := err.(*RuntimeError)
+	if !ok || re.Code == ErrInternal || re.panicked {
+		return nil, false
+	}
+	if re.Code == ErrThrown {
+		return re.Value, true
+	}
+	return &object.String{Value: re.Message}, true
+}
+
+// runtimeError returns a new RuntimeError with the given code, and a
+// message built from the format-string and arguments.
+func runtimeError(c ErrorCode, format string, args ...interface{}) *RuntimeError {
+	return &RuntimeError{Code: c, Message: fmt.Sprintf(format, args...)}
+}
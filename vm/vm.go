@@ -9,10 +9,13 @@
 package vm
 
 import (
-	"encoding/binary"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"math"
 	"reflect"
+	"regexp"
 	"strings"
 	"time"
 
@@ -22,6 +25,21 @@ import (
 	"github.com/skx/evalfilter/v2/stack"
 )
 
+var (
+	// timeType is the type of time.Time, which gets special handling
+	// when we convert values via reflection.
+	timeType = reflect.TypeOf(time.Time{})
+
+	// numberType is the type of json.Number, which is how numbers are
+	// represented when JSON is decoded with UseNumber.
+	numberType = reflect.TypeOf(json.Number(""))
+
+	// lookupableType and indexableType are the types of the Lookupable
+	// and Indexable interfaces.
+	lookupableType = reflect.TypeOf((*Lookupable)(nil)).Elem()
+	indexableType  = reflect.TypeOf((*Indexable)(nil)).Elem()
+)
+
 // True is our global "true" object.
 var True = &object.Boolean{Value: true}
 
@@ -31,6 +49,108 @@ var False = &object.Boolean{Value: false}
 // Null is our global "false" object.
 var Null = &object.Null{}
 
+// contextCheckInterval is the number of instructions we execute between
+// tests of the context we were given - testing it on every instruction
+// would be unnecessarily slow.
+const contextCheckInterval = 1000
+
+// DefaultInputName is the name of the variable which holds the whole of
+// the object a script is executed against, unless SetInputName is used.
+const DefaultInputName = "self"
+
+// DefaultMaxStackDepth is the default limit upon the depth of nested
+// function calls, and upon the number of values held upon the stack.
+const DefaultMaxStackDepth = 10000
+
+// ErrInstructionLimit is returned when a script executes more instructions
+// than the limit which was configured via SetMaxInstructions.
+var ErrInstructionLimit = errors.New("instruction limit exceeded")
+
+// FieldResolver is the signature of a function which may be used to
+// lookup the fields of the object a script is executed against.
+//
+// It returns the value of the named field, and true, if the field was
+// found.  If false is returned the field is discovered via reflection
+// instead.
+type FieldResolver func(obj interface{}, field string) (object.Object, bool)
+
+// Lookupable may be implemented by the object a script is executed
+// against, or by values within it, to look up their fields directly
+// rather than via reflection.
+//
+// Lookup returns the value of the named field, and true, if the field
+// was found.
+type Lookupable interface {
+	Lookup(field string) (object.Object, bool)
+}
+
+// Indexable may be implemented by values to give them custom behaviour
+// when they're indexed by a script, e.g. `Items[0]`, or `Items["name"]`.
+//
+// Index returns the value at the given index, and true, if there is
+// one.  Otherwise the result of the index is null.
+type Indexable interface {
+	Index(index object.Object) (object.Object, bool)
+}
+
+// Tracer is the signature of a function which may be used to observe
+// the execution of a script.
+//
+// It is called before each instruction is executed, with the offset of
+// the instruction, the opcode, and the contents of the stack.  The top
+// of the stack is the last entry.  Within a function the offset is
+// relative to the start of the function's bytecode.
+//
+// The stack is not a copy, so modifying it is unsupported.
+type Tracer func(ip int, op code.Opcode, stack []object.Object)
+
+// frame holds the state of a function-call which is in progress.
+//
+// The main program runs in a frame of its own, and each call to a
+// user-defined function pushes a new one.
+type frame struct {
+	// bytecode holds the instructions being executed.
+	bytecode code.Instructions
+
+	// ip holds the instruction pointer within the bytecode.
+	//
+	// This is only updated when another function is called, so
+	// that we know where to resume once it returns.
+	ip int
+
+	// locals holds the variables which are local to the function,
+	// including its parameters.
+	//
+	// This is nil for the main program, because all variables
+	// set there are global.
+	locals map[string]object.Object
+
+	// scopes holds the variables of the blocks being executed, the
+	// innermost last.
+	scopes []map[string]object.Object
+
+	// positions holds the source-positions of the instructions,
+	// if they are known.
+	positions code.Positions
+
+	// handlers holds the handlers of the try-blocks being executed,
+	// the innermost last.
+	handlers []handler
+}
+
+// handler records the state to restore when a try-block catches an error.
+type handler struct {
+	// ip is the offset of the catch-block.
+	ip int
+
+	// stack is the size of the stack when the try-block began.
+	stack int
+
+	// scopes is the number of block-scopes which were open when
+	// the try-block began.
+	scopes int
+}
+
 // VM is the structure which holds our state.
 type VM struct {
 
@@ -63,8 +183,106 @@ type VM struct {
 	// the need to reparse the same object multiple times.
 	fields map[string]object.Object
 
+	// seen holds the references which are being converted, when the
+	// fields are discovered.  It is kept so that it is allocated once,
+	// rather than once for each field.
+	seen map[reference]bool
+
 	// debug can be enabled to dump our execution-log as we run.
 	debug bool
+
+	// maxInstructions is the maximum number of instructions we'll
+	// execute in a single run, zero means there is no limit.
+	maxInstructions int
+
+	// count holds the number of instructions executed by the current
+	// run, including those of functions invoked by built-in functions
+	// such as `map`.  It is used to decide when to test the context,
+	// and to enforce any instruction-limit.
+	//
+	// Note that a call to a golang function counts as only a single
+	// instruction, regardless of how long that function runs.
+	count int
+
+	// maxStackDepth is the maximum depth of nested function calls,
+	// and the maximum size of the stack, zero means there is no limit.
+	maxStackDepth int
+
+	// depth holds the number of function calls which are in progress,
+	// including the main program.
+	depth int
+
+	// functions caches the functions which the script calls, indexed
+	// by the constant which holds their name.
+	functions []interface{}
+
+	// functionsVersion is the version of the environment's functions
+	// which are cached.
+	functionsVersion int
+
+	// resolver, if set, is consulted before reflection when looking
+	// up the fields of the object we're executing against.
+	resolver FieldResolver
+
+	// tracer, if set, is called before each instruction is executed.
+	tracer Tracer
+
+	// wrap is true if integer arithmetic should silently wrap around
+	// on overflow, rather than aborting with an error.
+	wrap bool
+
+	// strict is true if looking up a name which is neither a variable,
+	// a field, nor a function, should abort with an error rather
+	// than resulting in null.
+	strict bool
+
+	// positions holds the source-positions of our bytecode, which
+	// are used to report the location of errors.
+	positions code.Positions
+
+	// ctx and obj hold the context, and object, of the current run.
+	//
+	// These are used when built-in functions call back into the
+	// script.
+	ctx context.Context
+	obj interface{}
+
+	// main is the frame of the main program, which is reused by
+	// each run to save allocating a new one.
+	main frame
+
+	// inputName is the name of the variable which holds the object
+	// we're executing against.
+	inputName string
+
+	// input caches the value of that variable, once it has been
+	// referred to.
+	input object.Object
+
+	// converted caches the result of converting a wrapped value, such
+	// as `self`, when it is indexed - so that reflection is used once
+	// per run, rather than for every field it is asked for.
+	//
+	// convertedFrom holds the wrapped value it was converted from.
+	converted     object.Object
+	convertedFrom *object.Native
+
+	// regexps caches the regular expressions used by `~=` and `!~`,
+	// indexed by the constant which holds their source, so that each
+	// is compiled only once.
+	//
+	// Patterns which are computed at run-time aren't cached, so the
+	// cache cannot grow beyond the size of the constant pool.
+	regexps []*regexp.Regexp
+
+	// patterns maps the string constants to their offsets within the
+	// constant pool, and is created when a regular expression is
+	// first used.
+	patterns map[*object.String]int
+
+	// yielded holds the values yielded by the current run, in the
+	// order they were yielded.
+	yielded []object.Object
 }
 
 // New constructs a new virtual machine.
@@ -73,12 +291,92 @@ func New(constants []object.Object, bytecode code.Instructions, env *environment
 	// If we have a `DEBUG` environment then we enable debugging
 	_, present := env.Get("DEBUG")
 
-	return &VM{
-		constants:   constants,
-		environment: env,
-		bytecode:    bytecode,
-		debug:       present,
+	vm := &VM{
+		constants:     constants,
+		environment:   env,
+		bytecode:      bytecode,
+		debug:         present,
+		maxStackDepth: DefaultMaxStackDepth,
+		inputName:     DefaultInputName,
 	}
+
+	// Allow built-in functions, such as `map`, to call functions.
+	env.SetCaller(vm.call)
+
+	// Allow the `exists` function to find the fields of our input.
+	env.SetFieldLookup(vm.hasField)
+
+	return vm
+}
+
+// SetMaxInstructions sets the maximum number of instructions which will
+// be executed by a single invocation of Run, or RunContext.
+//
+// Once the limit is reached execution is aborted, and ErrInstructionLimit
+// is returned.  A limit of zero means there is no limit.
+func (vm *VM) SetMaxInstructions(n int) {
+	vm.maxInstructions = n
+}
+
+// SetMaxStackDepth sets the maximum depth of nested function calls, and
+// the maximum number of values which may be held upon the stack.
+//
+// Exceeding either aborts execution with a "stack overflow" error.  A
+// limit of zero means there is no limit.
+func (vm *VM) SetMaxStackDepth(n int) {
+	vm.maxStackDepth = n
+}
+
+// SetFieldResolver sets a function which will be used to lookup the
+// fields of the object we're executing against, before falling back
+// to reflection.
+func (vm *VM) SetFieldResolver(resolver FieldResolver) {
+	vm.resolver = resolver
+}
+
+// SetWrapArithmetic controls what happens if integer arithmetic
+// overflows.
+//
+// By default overflow aborts execution with an error, if wrap is true
+// the result wraps around instead.
+func (vm *VM) SetWrapArithmetic(wrap bool) {
+	vm.wrap = wrap
+}
+
+// SetStrictFields controls what happens if the script refers to a name
+// which is neither a variable, nor a field of the object we're executing
+// against.
+//
+// By default the result is null, if strict is true execution is aborted
+// with an error instead.
+func (vm *VM) SetStrictFields(strict bool) {
+	vm.strict = strict
+}
+
+// SetInputName sets the name of the variable which holds the whole of the
+// object we're executing against.
+func (vm *VM) SetInputName(name string) {
+	vm.inputName = name
+}
+
+// SetTracer sets a function which will be called before each instruction
+// is executed.
+//
+// A nil tracer disables tracing.
+func (vm *VM) SetTracer(tracer Tracer) {
+	vm.tracer = tracer
+}
+
+// Yielded returns the values yielded by the most recent run, via `yield`,
+// in the order they were yielded.
+func (vm *VM) Yielded() []object.Object {
+	return vm.yielded
+}
+
+// SetPositions sets the source-positions of the instructions in our
+// bytecode, which are used to report the location of run-time errors.
+func (vm *VM) SetPositions(positions code.Positions) {
+	vm.positions = positions
 }
 
 // Run launches our virtual machine, intepreting the bytecode-program we were
@@ -88,19 +386,33 @@ func New(constants []object.Object, bytecode code.Instructions, env *environment
 // the supplied bytecode.  As programs can contain flow-control operation
 // it is certainly possible they will never return.
 //
-// (Although our compiler does not implement for/while/do/until loops
-// a hand-created program could build such a things via the instruction-set.)
+// If you wish to bound the runtime of a script use RunContext instead.
 func (vm *VM) Run(obj interface{}) (object.Object, error) {
+	return vm.RunContext(context.Background(), obj)
+}
 
-	// Sanity-check the bytecode program is non-empty
-	if len(vm.bytecode) < 1 {
-		return nil, fmt.Errorf("the bytecode program is empty")
-	}
+// RunContext is identical to Run, except that the supplied context is
+// periodically tested while the bytecode is executed.
+//
+// If the context is cancelled, or its deadline expires, then execution
+// is aborted and the context's error is returned.
+//
+// Other errors are prefixed with the line and column of the code which
+// caused them, if that is known.
+func (vm *VM) RunContext(ctx context.Context, obj interface{}) (object.Object, error) {
 
 	//
-	// Make an empty map to store field/map contents.
+	// Empty the map which stores field/map contents, reusing it
+	// if possible.
 	//
-	vm.fields = make(map[string]object.Object)
+	if vm.fields == nil {
+		vm.fields = make(map[string]object.Object)
+	}
+	for k := range vm.fields {
+		delete(vm.fields, k)
+	}
+	vm.input = nil
+	vm.converted, vm.convertedFrom = nil, nil
 
 	//
 	// When (built-in) functions are invoked they always store their
@@ -116,277 +428,641 @@ func (vm *VM) Run(obj interface{}) (object.Object, error) {
 	// have a stack growing to an essentially infinite size if a
 	// script is constantly reused.
 	//
-	// To avoid that explicitly give ourself a new stack every time
-	// we run a script.
+	// To avoid that explicitly empty our stack every time we run
+	// a script.  The memory it used is kept, so that it doesn't
+	// need to grow again.
 	//
-	vm.stack = stack.New()
+	if vm.stack == nil {
+		vm.stack = stack.New()
+	}
+	vm.stack.Reset()
 
 	//
+	// Record the context, and object, so that they're available
+	// if a built-in function calls back into the script.
 	//
-	// Instruction pointer and length.
+	vm.ctx, vm.obj = ctx, obj
+	vm.depth = 0
+	vm.count = 0
+	vm.yielded = nil
+
+	vm.main = frame{bytecode: vm.bytecode, positions: vm.positions}
+	return vm.execute(ctx, obj, &vm.main)
+}
+
+// execute runs the bytecode of the given frame, until it returns.
+//
+// This is used to run the main program, and also to run functions which
+// are invoked by built-in functions such as `map`.
+func (vm *VM) execute(ctx context.Context, obj interface{}, cur *frame) (result object.Object, err error) {
+
+	//
+	// The frames of the functions being executed, the
+	// current frame is the last one.
+	//
+	frames := []*frame{cur}
+
+	//
+	// Our frames are counted towards the depth of nested calls,
+	// along with those of any function which invoked us.
+	//
+	vm.depth++
+	if vm.maxStackDepth > 0 && vm.depth > vm.maxStackDepth {
+		vm.depth--
+		return nil, runtimeError(ErrStackOverflow, "stack overflow: more than %d nested function calls", vm.maxStackDepth)
+	}
+	defer func() { vm.depth -= len(frames) }()
+
+	//
+	// Instruction pointer, bytecode, and length.
 	//
 	ip := 0
-	ln := len(vm.bytecode)
+	bytecode := cur.bytecode
+	ln := len(bytecode)
 
 	//
-	// Loop over all the bytecode.
+	// If we fail then report where, unless we were aborted.
 	//
-	// Note that the instruction set supports control-flow, so it
-	// is possible we'll run forever..
+	// Errors which already have a location, because they came from
+	// a function invoked by a built-in, are left alone.
 	//
-	for ip < ln {
+	defer func() {
+		if err == nil || err == ErrInstructionLimit || err == ctx.Err() {
+			return
+		}
+		re, ok := err.(*RuntimeError)
+		if !ok {
+			re = &RuntimeError{Code: ErrInternal, Message: err.Error(), Err: err}
+		}
+		if !re.located {
+			re.IP = ip
+			re.Position = cur.positions[ip]
+			re.located = true
+		}
+		err = re
+	}()
 
-		//
-		// Get the next opcode
-		//
-		op := code.Opcode(vm.bytecode[ip])
+	//
+	// run executes the bytecode until it returns, or fails.
+	//
+	run := func() (object.Object, error) {
 
 		//
-		// Find out how long it is.
-		//
-		opLen := code.Length(op)
-
+		// Loop over all the bytecode.
 		//
-		// If the opcode is more than a single byte long
-		// we read the argument here.
+		// Note that the instruction set supports control-flow, so it
+		// is possible we'll run forever..
 		//
-		opArg := 0
-		if opLen > 1 {
+		for ip < ln {
 
 			//
-			// Note in the future we might have to cope
-			// with opcodes with more than a single argument,
-			// and they might be different sizes.
+			// Stop if our context has been cancelled.
 			//
-			opArg = int(binary.BigEndian.Uint16(vm.bytecode[ip+1 : ip+3]))
-		}
+			vm.count++
+			if vm.count%contextCheckInterval == 0 {
+				if err := ctx.Err(); err != nil {
+					return nil, err
+				}
+			}
+
+			//
+			// Stop if we've exceeded our instruction-limit.
+			//
+			if vm.maxInstructions > 0 && vm.count > vm.maxInstructions {
+				return nil, ErrInstructionLimit
+			}
+
+			//
+			// Stop if the stack has grown too large.
+			//
+			if vm.maxStackDepth > 0 && vm.stack.Size() > vm.maxStackDepth {
+				return nil, runtimeError(ErrStackOverflow, "stack overflow: more than %d values upon the stack", vm.maxStackDepth)
+			}
+
+			//
+			// Get the next opcode
+			//
+			op := code.Opcode(bytecode[ip])
 
-		if vm.debug {
-			fmt.Printf("\n\tStack: [%s]\n",
-				strings.Join(vm.stack.Export(), ", "))
+			//
+			// Find out how long it is.
+			//
+			opLen := code.Length(op)
 
+			//
+			// If the opcode is more than a single byte long
+			// we read the argument here.
+			//
+			opArg := 0
 			if opLen > 1 {
-				fmt.Printf("%04d\t%s\t%04d\n", ip, code.String(op), opArg)
-			} else {
-				fmt.Printf("%04d\t%s\n", ip, code.String(op))
+
+				//
+				// Note in the future we might have to cope
+				// with opcodes with more than a single argument.
+				//
+				opArg = code.Operand(bytecode, ip)
 			}
 
-		}
+			//
+			// Wide opcodes behave identically to the normal
+			// versions, once their argument has been read.
+			//
+			op &^= code.Wide
 
-		switch op {
+			if vm.tracer != nil {
+				vm.tracer(ip, op, vm.stack.Entries())
+			}
 
-		// NOP
-		case code.OpNop:
-			// NOP
+			if vm.debug {
+				fmt.Printf("\n\tStack: [%s]\n",
+					strings.Join(vm.stack.Export(), ", "))
 
-			// Store an integer upon the stack
-		case code.OpPush:
-			vm.stack.Push(&object.Integer{Value: int64(opArg)})
+				if opLen > 1 {
+					fmt.Printf("%04d\t%s\t%04d\n", ip, code.String(op), opArg)
+				} else {
+					fmt.Printf("%04d\t%s\n", ip, code.String(op))
+				}
 
-			// Lookup variable/field, by name
-		case code.OpConstant:
+			}
 
-			// move the contents of a constant onto the stack
-			vm.stack.Push(vm.constants[opArg])
+			switch op {
 
-			// Lookup variable/field, by name
-		case code.OpLookup:
+			// NOP
+			case code.OpNop:
+				// NOP
 
-			// Get the name.
-			name := vm.constants[opArg].Inspect()
+				// Store an integer upon the stack
+			case code.OpPush:
+				vm.stack.Push(&object.Integer{Value: int64(opArg)})
 
-			// Lookup the value.
-			val := vm.lookup(obj, name)
-			vm.stack.Push(val)
+				// Lookup variable/field, by name
+			case code.OpConstant:
 
-			// Set a variable by name
-		case code.OpSet:
+				// move the contents of a constant onto the stack
+				vm.stack.Push(vm.constants[opArg])
 
-			var name object.Object
-			var val object.Object
-			var err error
-			name, err = vm.stack.Pop()
-			if err != nil {
-				return nil, err
-			}
-			val, err = vm.stack.Pop()
-			if err != nil {
-				return nil, err
-			}
+				// Lookup variable/field, by name
+			case code.OpLookup:
 
-			vm.environment.Set(name.Inspect(), val)
+				// Get the name.
+				name := vm.constants[opArg].Inspect()
 
-			// maths & comparisons
-		case code.OpAdd, code.OpSub, code.OpMul, code.OpDiv, code.OpMod, code.OpPower, code.OpLess, code.OpLessEqual, code.OpGreater, code.OpGreaterEqual, code.OpEqual, code.OpNotEqual, code.OpMatches, code.OpNotMatches, code.OpAnd, code.OpOr, code.OpArrayIn:
-			err := vm.executeBinaryOperation(op)
-			if err != nil {
-				return nil, err
-			}
+				// Block and local variables take precedence.
+				if val, ok := cur.variable(name); ok {
+					vm.stack.Push(val)
+					break
+				}
 
-			// Store an array
-		case code.OpArray:
+				// Lookup the value.
+				// `null` is itself an unset name, so it is
+				// never an error.
+				val, ok := vm.lookup(obj, name)
+				if !ok && vm.strict && name != "null" {
+					return nil, runtimeError(ErrUnknownField, "unknown field: %s", strings.TrimPrefix(name, "$"))
+				}
+				vm.stack.Push(val)
+
+				// Set a variable by name
+			case code.OpSet:
 
-			elements := make([]object.Object, opArg)
-			for opArg > 0 {
+				var name object.Object
+				var val object.Object
 				var err error
-				elements[opArg-1], err = vm.stack.Pop()
+				name, err = vm.stack.Pop()
+				if err != nil {
+					return nil, err
+				}
+				val, err = vm.stack.Pop()
 				if err != nil {
 					return nil, err
 				}
-				opArg--
-			}
-			arr := &object.Array{Elements: elements}
-			vm.stack.Push(arr)
 
-			// Lookup an array index
-		case code.OpArrayIndex:
-			index, err := vm.stack.Pop()
-			if err != nil {
-				return nil, err
-			}
-			left, err := vm.stack.Pop()
-			if err != nil {
-				return nil, err
-			}
+				err = vm.setVariable(cur, name.Inspect(), val)
+				if err != nil {
+					return nil, err
+				}
 
-			err = vm.executeIndexExpression(left, index)
-			if err != nil {
-				return nil, err
-			}
+				// maths & comparisons
+			case code.OpAdd, code.OpSub, code.OpMul, code.OpDiv, code.OpMod, code.OpPower, code.OpLess, code.OpLessEqual, code.OpGreater, code.OpGreaterEqual, code.OpEqual, code.OpNotEqual, code.OpMatches, code.OpNotMatches, code.OpAnd, code.OpOr, code.OpArrayIn:
+				err := vm.executeBinaryOperation(op)
+				if err != nil {
+					return nil, err
+				}
 
-			// !true -> false
-		case code.OpBang:
+				// Store an array
+			case code.OpArray:
+
+				elements := make([]object.Object, opArg)
+				for opArg > 0 {
+					var err error
+					elements[opArg-1], err = vm.stack.Pop()
+					if err != nil {
+						return nil, err
+					}
+					opArg--
+				}
+				arr := &object.Array{Elements: elements}
+				vm.stack.Push(arr)
 
-			err := vm.executeBangOperator()
-			if err != nil {
-				return nil, err
-			}
+				// Store a hash
+			case code.OpHash:
 
-			// -1
-		case code.OpMinus:
-			err := vm.executeMinusOperator()
-			if err != nil {
-				return nil, err
-			}
+				err := vm.executeHashLiteral(opArg)
+				if err != nil {
+					return nil, err
+				}
 
-			// square root
-		case code.OpRoot:
-			err := vm.executeSquareRoot()
-			if err != nil {
-				return nil, err
-			}
+				// Unpack an array, for a multiple assignment
+			case code.OpUnpack:
 
-			// Boolean literal
-		case code.OpTrue:
-			vm.stack.Push(True)
+				val, err := vm.stack.Pop()
+				if err != nil {
+					return nil, err
+				}
 
-			// Boolean literal
-		case code.OpFalse:
-			vm.stack.Push(False)
+				arr, ok := val.(*object.Array)
+				if !ok {
+					return nil, runtimeError(ErrTypeMismatch, "cannot assign %s to %d variables, expected an array", val.Type(), opArg)
+				}
 
-			// return from script
-		case code.OpReturn:
-			result, err := vm.stack.Pop()
-			return result, err
+				for i := opArg - 1; i >= 0; i-- {
+					if i < len(arr.Elements) {
+						vm.stack.Push(arr.Elements[i])
+					} else {
+						vm.stack.Push(&object.Null{})
+					}
+				}
 
-			// flow-control: unconditional jump
-		case code.OpJump:
+				// Lookup an array index
+			case code.OpArrayIndex:
+				index, err := vm.stack.Pop()
+				if err != nil {
+					return nil, err
+				}
+				left, err := vm.stack.Pop()
+				if err != nil {
+					return nil, err
+				}
 
-			// NOTE: We reduce the offset, becaues
-			// at the end of our loop we increment
-			// it again..
+				err = vm.executeIndexExpression(left, index)
+				if err != nil {
+					return nil, err
+				}
 
-			ip = opArg - opLen
+			case code.OpPushScope:
+				cur.scopes = append(cur.scopes, make(map[string]object.Object))
 
-			// flow-control: jump if stack contains non-true
-		case code.OpJumpIfFalse:
+			case code.OpPopScope:
+				if len(cur.scopes) == 0 {
+					return nil, runtimeError(ErrInternal, "tried to end a block-scope which was never begun")
+				}
+				cur.scopes = cur.scopes[:len(cur.scopes)-1]
 
-			condition, err := vm.stack.Pop()
-			if err != nil {
-				return nil, err
-			}
+				// Begin a try-block
+			case code.OpTry:
+				cur.handlers = append(cur.handlers, handler{ip: opArg, stack: vm.stack.Size(), scopes: len(cur.scopes)})
 
-			// If the condition evaluated to a non-true
-			// then we change the IP.
-			if !condition.True() {
+				// End a try-block
+			case code.OpEndTry:
+				if len(cur.handlers) == 0 {
+					return nil, runtimeError(ErrInternal, "tried to end a try-block which was never begun")
+				}
+				cur.handlers = cur.handlers[:len(cur.handlers)-1]
+
+				// Yield a value
+			case code.OpYield:
+				val, err := vm.stack.Pop()
+				if err != nil {
+					return nil, err
+				}
+				vm.yielded = append(vm.yielded, val)
+
+				// Throw a value
+			case code.OpThrow:
+				val, err := vm.stack.Pop()
+				if err != nil {
+					return nil, err
+				}
+				return nil, &RuntimeError{Code: ErrThrown, Message: "uncaught error: " + val.Inspect(), Value: val}
+
+				// Set a variable within the current block-scope
+			case code.OpSetLocal:
+				name, err := vm.stack.Pop()
+				if err != nil {
+					return nil, err
+				}
+				val, err := vm.stack.Pop()
+				if err != nil {
+					return nil, err
+				}
+				if len(cur.scopes) == 0 {
+					return nil, runtimeError(ErrInternal, "tried to set a variable outside of a block-scope")
+				}
+				cur.scopes[len(cur.scopes)-1][name.Inspect()] = val
+
+			case code.OpSlice:
+				end, err := vm.stack.Pop()
+				if err != nil {
+					return nil, err
+				}
+				start, err := vm.stack.Pop()
+				if err != nil {
+					return nil, err
+				}
+				left, err := vm.stack.Pop()
+				if err != nil {
+					return nil, err
+				}
+
+				err = vm.executeSliceExpression(left, start, end)
+				if err != nil {
+					return nil, err
+				}
+
+				// !true -> false
+			case code.OpBang:
+
+				err := vm.executeBangOperator()
+				if err != nil {
+					return nil, err
+				}
+
+				// -1
+			case code.OpMinus:
+				err := vm.executeMinusOperator()
+				if err != nil {
+					return nil, err
+				}
+
+				// square root
+			case code.OpRoot:
+				err := vm.executeSquareRoot()
+				if err != nil {
+					return nil, err
+				}
+
+				// Duplicate the top of the stack
+			case code.OpDup:
+				val, err := vm.stack.Pop()
+				if err != nil {
+					return nil, err
+				}
+				vm.stack.Push(val)
+				vm.stack.Push(val)
+
+				// Copy the top of the stack beneath the value below it
+			case code.OpTuck:
+				b, err := vm.stack.Pop()
+				if err != nil {
+					return nil, err
+				}
+				a, err := vm.stack.Pop()
+				if err != nil {
+					return nil, err
+				}
+				vm.stack.Push(b)
+				vm.stack.Push(a)
+				vm.stack.Push(b)
+
+				// Discard the top of the stack
+			case code.OpPop:
+				_, err := vm.stack.Pop()
+				if err != nil {
+					return nil, err
+				}
+
+				// Boolean literal
+			case code.OpTrue:
+				vm.stack.Push(True)
+
+				// Boolean literal
+			case code.OpFalse:
+				vm.stack.Push(False)
+
+				// return from script
+			case code.OpReturn:
+				result, err := vm.stack.Pop()
+
+				// Returning from the main program?
+				if len(frames) == 1 || err != nil {
+					return result, err
+				}
+
+				// Otherwise resume the caller, with the
+				// result upon the stack.
+				frames = frames[:len(frames)-1]
+				cur = frames[len(frames)-1]
+				vm.depth--
+
+				bytecode = cur.bytecode
+				ln = len(bytecode)
+				ip = cur.ip
+
+				vm.stack.Push(result)
+				continue
+
+				// flow-control: unconditional jump
+			case code.OpJump:
 
 				// NOTE: We reduce the offset, becaues
 				// at the end of our loop we increment
 				// it again..
 
 				ip = opArg - opLen
-			}
 
-			// function-call: This is messy.
-		case code.OpCall:
+				// flow-control: jump if stack contains non-null
+			case code.OpCoalesce:
 
-			// The OpCall instruction is followed by an
-			// argument describing the number of args the
-			// function we're calling should be invoked with.
+				val, err := vm.stack.Pop()
+				if err != nil {
+					return nil, err
+				}
 
-			// get the name of the function from the stack.
-			fName, err := vm.stack.Pop()
-			if err != nil {
-				return nil, err
-			}
+				// If the value is not null we leave it upon
+				// the stack, and skip the right-hand side.
+				if val.Type() != object.NULL {
+					vm.stack.Push(val)
 
-			//
-			// The argument to the call-instruction is the
-			// number of arguments to pass to the function
-			// we're to invoke.
-			//
-			// Of course these are in reverse.
-			//
-			// Create an array and pop each stack-argument
-			// off into the correct location.
-			//
-			fnArgs := make([]object.Object, opArg)
-			for opArg > 0 {
-				fnArgs[opArg-1], err = vm.stack.Pop()
+					// NOTE: We reduce the offset, becaues
+					// at the end of our loop we increment
+					// it again..
+
+					ip = opArg - opLen
+				}
+
+				// flow-control: jump if stack contains non-true
+			case code.OpJumpIfFalse:
+
+				condition, err := vm.stack.Pop()
 				if err != nil {
 					return nil, err
 				}
-				opArg--
-			}
 
-			// Get the function we're to invoke.
-			fn, ok := vm.environment.GetFunction(fName.Inspect())
-			if !ok {
-				return nil, fmt.Errorf("the function %s does not exist", fName.Inspect())
-			}
+				// If the condition evaluated to a non-true
+				// then we change the IP.
+				if !condition.True() {
 
-			// Cast the function & call it
-			out := fn.(func(args []object.Object) object.Object)
-			ret := out(fnArgs)
+					// NOTE: We reduce the offset, becaues
+					// at the end of our loop we increment
+					// it again..
 
-			// store the result back on the stack.
-			vm.stack.Push(ret)
+					ip = opArg - opLen
+				}
 
-			// These two opcodes are just used for internal
-			// use.  They are never generated, and they should
-			// never be executed either.
-		case code.OpCodeSingleArg, code.OpFinal:
+				// function-call: This is messy.
+			case code.OpCall:
 
-			return nil, fmt.Errorf("tried to execute fake instruction %s - this is definitely a bug", code.String(op))
+				// The OpCall instruction is followed by an
+				// argument describing the number of args the
+				// function we're calling should be invoked with.
 
-			// Can't happen?
-		default:
-			return nil, fmt.Errorf("unhandled opcode: %v %s", op, code.String(op))
+				// get the name of the function from the stack.
+				fName, err := vm.stack.Pop()
+				if err != nil {
+					return nil, err
+				}
+
+				//
+				// The argument to the call-instruction is the
+				// number of arguments to pass to the function
+				// we're to invoke.
+				//
+				// Of course these are in reverse.
+				//
+				// Create an array and pop each stack-argument
+				// off into the correct location.
+				//
+				fnArgs := make([]object.Object, opArg)
+				for opArg > 0 {
+					fnArgs[opArg-1], err = vm.stack.Pop()
+					if err != nil {
+						return nil, err
+					}
+					opArg--
+				}
+
+				// Get the function we're to invoke.
+				fn, ok := vm.function(bytecode, ip, fName)
+				if !ok {
+					return nil, runtimeError(ErrUnknownFunction, "the function %s does not exist", fName.Inspect())
+				}
+
+				switch fn := fn.(type) {
+
+				// A function defined in the script.
+				case *object.Function:
+
+					if len(fnArgs) != len(fn.Parameters) {
+						return nil, runtimeError(ErrArgumentCount, "the function %s expects %d argument(s), got %d", fn.Name, len(fn.Parameters), len(fnArgs))
+					}
+
+					// Bind the arguments to the parameters.
+					locals := make(map[string]object.Object)
+					for i, name := range fn.Parameters {
+						locals[name] = fnArgs[i]
+					}
+
+					if vm.maxStackDepth > 0 && vm.depth >= vm.maxStackDepth {
+						return nil, runtimeError(ErrStackOverflow, "stack overflow: more than %d nested function calls", vm.maxStackDepth)
+					}
+
+					// Record where to resume, once the
+					// function returns.
+					cur.ip = ip + opLen
+
+					// And start executing the function.
+					cur = &frame{bytecode: fn.Instructions, locals: locals, positions: fn.Positions}
+					frames = append(frames, cur)
+					vm.depth++
+
+					bytecode = cur.bytecode
+					ln = len(bytecode)
+					ip = 0
+					continue
+
+				// A golang function, which may return an error
+				// to abort execution.
+				case func(args []object.Object) object.Object, func(args []object.Object) (object.Object, error):
+
+					// Call it, and store the result
+					// back on the stack.
+					res, err := vm.callGolang(fName.Inspect(), fn, fnArgs)
+					if err != nil {
+						return nil, err
+					}
+					vm.stack.Push(res)
+
+				default:
+					return nil, runtimeError(ErrInternal, "the function %s has unsupported type %T", fName.Inspect(), fn)
+				}
+
+				// These two opcodes are just used for internal
+				// use.  They are never generated, and they should
+				// never be executed either.
+			case code.OpCodeSingleArg, code.OpFinal:
+
+				return nil, runtimeError(ErrInternal, "tried to execute fake instruction %s - this is definitely a bug", code.String(op))
+
+				// Can't happen?
+			default:
+				return nil, runtimeError(ErrInternal, "unhandled opcode: %v %s", op, code.String(op))
+			}
+
+			ip += opLen
 		}
 
-		ip += opLen
+		//
+		// If we get here we've hit the end of the bytecode, and we
+		// didn't encounter a return-instruction.
+		//
+		// A script which ends with an expression returns its value,
+		// so that means the script ended with a statement which has
+		// no value, such as an assignment, and is malformed.
+		//
+		// We could decide this means the script returns `false`, but
+		// I'd rather users were explicit.
+		//
+		return nil, runtimeError(ErrMissingReturn, "missing return at the end of the script")
 	}
 
 	//
-	// If we get here we've hit the end of the bytecode, and we
-	// didn't encounter a return-instruction.
-	//
-	// That means the script is malformed..
+	// If a value is thrown, or an error occurs, then we resume at
+	// the catch-block of the innermost try-block - abandoning any
+	// functions which were called within it.
 	//
-	// We could decide this means the script returns `false`, but
-	// I'd rather users were explicit.
-	//
-	return nil, fmt.Errorf("missing return at the end of the script")
+	for {
+		result, err = run()
+		if err == nil {
+			return result, nil
+		}
+
+		value, ok := caught(err)
+		if !ok {
+			return nil, err
+		}
+
+		n := len(frames)
+		for n > 0 && len(frames[n-1].handlers) == 0 {
+			n--
+		}
+		if n == 0 {
+			return nil, err
+		}
+
+		vm.depth -= len(frames) - n
+		frames = frames[:n]
+		cur = frames[n-1]
+
+		h := cur.handlers[len(cur.handlers)-1]
+		cur.handlers = cur.handlers[:len(cur.handlers)-1]
+		cur.scopes = cur.scopes[:h.scopes]
+		vm.stack.Truncate(h.stack)
+		vm.stack.Push(value)
+
+		bytecode = cur.bytecode
+		ln = len(bytecode)
+		ip = h.ip
+	}
 }
 
 // inspectObject discovers the names/values of all structure fields, or
@@ -395,6 +1071,9 @@ func (vm *VM) Run(obj interface{}) (object.Object, error) {
 // This method is called the first time any reference is made to a field
 // value - which means we don't eat the cost unless we need it, and we
 // don't have to call reflection more than once.  (Reflection is s-l-o-w.)
+//
+// Nested maps, structures, and slices are converted too, so that scripts
+// may navigate them via expressions such as `user.address.city`.
 func (vm *VM) inspectObject(obj interface{}) {
 
 	//
@@ -405,9 +1084,12 @@ func (vm *VM) inspectObject(obj interface{}) {
 	}
 
 	//
-	// Time gets special handling
+	// The references being converted, which is empty between
+	// conversions.
 	//
-	timeKind := reflect.TypeOf(time.Time{}).Kind()
+	if vm.seen == nil {
+		vm.seen = make(map[reference]bool)
+	}
 
 	//
 	// Get the value, be it a "thing", or a pointer to a thing.
@@ -424,169 +1106,209 @@ func (vm *VM) inspectObject(obj interface{}) {
 		//
 		for _, key := range val.MapKeys() {
 
-			// The name of the key.
-			name := key.Interface().(string)
-
-			// The actual thing inside it
-			field := val.MapIndex(key).Elem()
-
-			// Default
-			var ret object.Object
-			ret = &object.Null{}
-
-			switch field.Kind() {
-
-			// Hack.
-			//
-			// Probably broken.
-			case reflect.Slice:
-				ret = vm.createArrayFromSlice(field)
-			case reflect.Int, reflect.Int64:
-				ret = &object.Integer{Value: field.Int()}
-			case reflect.Float32, reflect.Float64:
-				ret = &object.Float{Value: field.Float()}
-			case reflect.String:
-				ret = &object.String{Value: field.String()}
-			case reflect.Bool:
-				ret = &object.Boolean{Value: field.Bool()}
-			case timeKind:
-				time, ok := field.Interface().(time.Time)
-				if ok {
-					ret = &object.Integer{Value: time.Unix()}
-				}
+			// We can only look up string-keys by name.
+			if key.Kind() != reflect.String {
+				continue
 			}
 
-			vm.fields[name] = ret
+			vm.fields[key.String()] = objectFromValue(val.MapIndex(key), vm.seen)
 		}
 		return
 	}
 
 	//
-	// OK this is an object
+	// OK this should be an object
 	//
-	for i := 0; i < val.NumField(); i++ {
+	if val.Kind() != reflect.Struct {
+		return
+	}
 
-		// Get the field
-		field := val.Field(i)
+	for i := 0; i < val.NumField(); i++ {
 
 		// Get the name
-		typeField := val.Type().Field(i)
-		name := typeField.Name
-
-		// Default
-		var ret object.Object
-		ret = &object.Null{}
-
-		switch field.Kind() {
-
-		case reflect.Slice:
-			ret = vm.createArrayFromSlice(field)
-		case reflect.Int, reflect.Int64:
-			ret = &object.Integer{Value: field.Int()}
-		case reflect.Float32, reflect.Float64:
-			ret = &object.Float{Value: field.Float()}
-		case reflect.String:
-			ret = &object.String{Value: field.String()}
-		case reflect.Bool:
-			ret = &object.Boolean{Value: field.Bool()}
-		case timeKind:
-			time, ok := field.Interface().(time.Time)
-			if ok {
-				ret = &object.Integer{Value: time.Unix()}
-			}
-		default:
-			fmt.Printf("Failed to reflect on %T\n", field.Interface())
-		}
+		name := val.Type().Field(i).Name
 
-		vm.fields[name] = ret
+		vm.fields[name] = objectFromValue(val.Field(i), vm.seen)
 	}
 }
 
-// createArrayFromSlice creates an object.Array value from the
-// given object/map slice.  This uses reflection and is slow/horrid
-func (vm *VM) createArrayFromSlice(field reflect.Value) object.Object {
-
-	// Elements we've found
-	var el []object.Object
+// inputObject returns the object we're executing against, as an object.
+//
+// Maps are converted to hashes, and all other values are wrapped so
+// that they may be passed through the script unchanged.  The fields of
+// wrapped values may still be retrieved by indexing them.
+func inputObject(obj interface{}) object.Object {
 
-	// Find the length of the slice
-	l := field.Len()
+	if obj == nil {
+		return Null
+	}
 
-	// For each entry
-	for i := 0; i < l; i++ {
+	val := reflect.ValueOf(obj)
+	if reflect.Indirect(val).Kind() == reflect.Map {
+		return objectFromValue(val, make(map[reference]bool))
+	}
+	return &object.Native{Value: obj}
+}
 
-		// Cast the array-member to an interface
-		in := field.Index(i).Interface()
+// reference identifies a pointer, map, or slice, which we're converting
+// via reflection.
+//
+// The type is required because a structure and its first field share
+// the same address.
+type reference struct {
+	ptr uintptr
+	typ reflect.Type
+}
 
-		//
-		// Now we're in horrible-land
-		//
-		// We want to work out the type of the
-		// array-member.  Of course every member
-		// will have the same type, unless we're
-		// in the case of an array of interfaces.
-		//
-		// The following code will try to cast
-		// to all "reasonable" values, which will
-		// cover either case.
-		//
-		// It is still horrible though, and that
-		// should be noted.
-		//
+// objectFromValue converts the given golang value to an object, using
+// reflection.
+//
+// Maps and structures become hashes, and slices become arrays, with
+// their contents converted recursively.  Values of time.Time are
+// converted to seconds past the Unix Epoch.  Values which we cannot
+// convert become null.
+//
+// Values which implement Lookupable, or Indexable, are wrapped rather
+// than converted, so that they may look up their own contents.
+//
+// The `seen` map holds the references we're currently converting, so
+// that self-referential values become null rather than recursing forever.
+func objectFromValue(v reflect.Value, seen map[reference]bool) object.Object {
 
-		// Is it a string?
-		s, ok := in.(string)
-		if ok {
-			el = append(el, &object.String{Value: s})
-			continue
+	//
+	// Follow pointers and interfaces to the value they refer to.
+	//
+	for {
+		if custom(v) {
+			return &object.Native{Value: v.Interface()}
+		}
+		if v.Kind() != reflect.Ptr && v.Kind() != reflect.Interface {
+			break
+		}
+		if v.IsNil() {
+			return Null
+		}
+		if v.Kind() == reflect.Ptr {
+			ref := reference{ptr: v.Pointer(), typ: v.Type()}
+			if seen[ref] {
+				return Null
+			}
+			seen[ref] = true
+			defer delete(seen, ref)
 		}
+		v = v.Elem()
+	}
+
+	if !v.IsValid() {
+		return Null
+	}
 
-		// Is it a bool?
-		b, ok := in.(bool)
-		if ok {
-			el = append(el, &object.Boolean{Value: b})
-			continue
+	//
+	// Time gets special handling.
+	//
+	if v.Type() == timeType {
+		if !v.CanInterface() {
+			return Null
 		}
+		return &object.Integer{Value: v.Interface().(time.Time).Unix()}
+	}
 
-		// is it a float?
-		f, ok := in.(float32)
-		if ok {
-			el = append(el, &object.Float{Value: float64(f)})
-			continue
+	//
+	// As do numbers decoded from JSON.
+	//
+	if v.Type() == numberType {
+		n := json.Number(v.String())
+		if i, err := n.Int64(); err == nil {
+			return &object.Integer{Value: i}
 		}
-		ff, ok := in.(float64)
-		if ok {
-			el = append(el, &object.Float{Value: ff})
-			continue
+		if f, err := n.Float64(); err == nil {
+			return &object.Float{Value: f}
 		}
+		return Null
+	}
+
+	switch v.Kind() {
+	case reflect.Bool:
+		return &object.Boolean{Value: v.Bool()}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return &object.Integer{Value: v.Int()}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return &object.Integer{Value: int64(v.Uint())}
+	case reflect.Float32, reflect.Float64:
+		return &object.Float{Value: v.Float()}
+	case reflect.String:
+		return &object.String{Value: v.String()}
+	}
 
-		// is it an integer?
-		d, ok := in.(int)
-		if ok {
-			el = append(el, &object.Integer{Value: int64(d)})
-			continue
+	//
+	// Maps and slices may contain themselves, so we must take
+	// care not to loop forever.
+	//
+	if v.Kind() == reflect.Map || v.Kind() == reflect.Slice {
+		if v.IsNil() {
+			return Null
 		}
-		dd, ok := in.(int32)
-		if ok {
-			el = append(el, &object.Integer{Value: int64(dd)})
-			continue
+		ref := reference{ptr: v.Pointer(), typ: v.Type()}
+		if seen[ref] {
+			return Null
 		}
-		ddd, ok := in.(int64)
-		if ok {
-			el = append(el, &object.Integer{Value: ddd})
-			continue
+		seen[ref] = true
+		defer delete(seen, ref)
+	}
+
+	switch v.Kind() {
+
+	case reflect.Slice, reflect.Array:
+		elements := make([]object.Object, v.Len())
+		for i := 0; i < v.Len(); i++ {
+			elements[i] = objectFromValue(v.Index(i), seen)
 		}
+		return &object.Array{Elements: elements}
 
-		tm, ok := in.(time.Time)
-		if ok {
-			el = append(el, &object.Integer{Value: tm.Unix()})
-			continue
+	case reflect.Map:
+		hash := &object.Hash{Pairs: make(map[object.HashKey]object.HashPair)}
+		for _, key := range v.MapKeys() {
+			k, ok := objectFromValue(key, seen).(object.Hashable)
+			if !ok {
+				continue
+			}
+			hash.Pairs[k.HashKey()] = object.HashPair{Key: k.(object.Object), Value: objectFromValue(v.MapIndex(key), seen)}
 		}
+		return hash
+
+	case reflect.Struct:
+		hash := &object.Hash{Pairs: make(map[object.HashKey]object.HashPair)}
+		for i := 0; i < v.NumField(); i++ {
+			k := &object.String{Value: v.Type().Field(i).Name}
+			hash.Pairs[k.HashKey()] = object.HashPair{Key: k, Value: objectFromValue(v.Field(i), seen)}
+		}
+		return hash
+	}
 
-		fmt.Printf("Failed to convert array-member to object")
+	return Null
+}
+
+// custom returns true if the given value implements Lookupable, or
+// Indexable.
+//
+// The type is examined, rather than the value, so that the values of
+// ordinary fields aren't boxed into interfaces just to be tested.
+func custom(v reflect.Value) bool {
+	if !v.IsValid() || !v.CanInterface() {
+		return false
 	}
 
-	return &object.Array{Elements: el}
+	switch v.Kind() {
+	case reflect.Interface:
+		// The value it holds is examined instead.
+		return false
+	case reflect.Ptr, reflect.Map, reflect.Slice:
+		if v.IsNil() {
+			return false
+		}
+	}
+
+	return v.Type().Implements(lookupableType) || v.Type().Implements(indexableType)
 }
 
 // Execute an operation against two arguments, i.e "foo == bar", "2 + 3", etc.
@@ -612,12 +1334,27 @@ func (vm *VM) executeBinaryOperation(op code.Opcode) error {
 		return vm.evalIntegerInfixExpression(op, left, right)
 	case left.Type() == object.FLOAT && right.Type() == object.FLOAT:
 		return vm.evalFloatInfixExpression(op, left, right)
-	case left.Type() == object.FLOAT && right.Type() == object.INTEGER:
-		return vm.evalFloatIntegerInfixExpression(op, left, right)
-	case left.Type() == object.INTEGER && right.Type() == object.FLOAT:
-		return vm.evalIntegerFloatInfixExpression(op, left, right)
+	case left.Type() == object.FLOAT && right.Type() == object.INTEGER,
+		left.Type() == object.INTEGER && right.Type() == object.FLOAT:
+		return vm.evalMixedInfixExpression(op, left, right)
 	case left.Type() == object.STRING && right.Type() == object.STRING:
 		return vm.evalStringInfixExpression(op, left, right)
+	case left.Type() == object.TIME && right.Type() == object.TIME:
+		return vm.evalTimeInfixExpression(op, left, right)
+	case left.Type() == object.TIME && right.Type() == object.INTEGER:
+		return vm.evalTimeIntegerInfixExpression(op, left, right)
+	case (op == code.OpEqual || op == code.OpNotEqual) && left.Type() == right.Type() && (left.Type() == object.ARRAY || left.Type() == object.HASH):
+		// Arrays and hashes are compared element by element.
+		equal := object.Equals(left, right)
+		vm.stack.Push(vm.nativeBoolToBooleanObject(equal == (op == code.OpEqual)))
+		return nil
+	case op == code.OpAdd && left.Type() == object.STRING:
+		// "count: " + 3
+		//
+		// Only the left operand is promoted, the right is converted
+		// as print would show it - including null, arrays, and hashes.
+		vm.stack.Push(&object.String{Value: left.(*object.String).Value + right.Inspect()})
+		return nil
 	case op == code.OpAnd:
 		// if left is false skip right
 		if !left.True() {
@@ -644,9 +1381,18 @@ func (vm *VM) executeBinaryOperation(op code.Opcode) error {
 		return nil
 	case op == code.OpArrayIn:
 
-		// Ensure we're invoked with an array
+		// Ensure we're invoked with an array.
+		//
+		// (Strings are handled with the other string
+		// operations, as both operands must be strings.)
+		//
+		// If the right operand is a string the problem is the
+		// left one, which must be a string too.
+		if right.Type() == object.STRING {
+			return runtimeError(ErrTypeMismatch, "left operand for 'in' must be a string when searching a string, not %s", left.Type())
+		}
 		if right.Type() != object.ARRAY {
-			return fmt.Errorf("operand for 'in' must be an array, not %s", right.Type())
+			return runtimeError(ErrTypeMismatch, "operand for 'in' must be an array, or a string, not %s", right.Type())
 		}
 
 		// Get the array.
@@ -655,10 +1401,10 @@ func (vm *VM) executeBinaryOperation(op code.Opcode) error {
 		// For each element ..
 		for _, entry := range values.Elements {
 
-			// If the type and values are equal then
-			// the array DOES contain the value.
-			if (left.Type() == entry.Type()) &&
-				(left.Inspect() == entry.Inspect()) {
+			// If the values are equal, as they would be
+			// with `==`, then the array DOES contain the
+			// value.
+			if object.Equals(left, entry) {
 				vm.stack.Push(True)
 				return nil
 			}
@@ -671,75 +1417,69 @@ func (vm *VM) executeBinaryOperation(op code.Opcode) error {
 	case left.Type() == object.BOOLEAN && right.Type() == object.BOOLEAN:
 		return vm.evalBooleanInfixExpression(op, left, right)
 	case left.Type() != right.Type():
-		return fmt.Errorf("type mismatch: %s %s %s",
-			left.Type(), code.String(op), right.Type())
+		return runtimeError(ErrTypeMismatch, "type mismatch: %s %s %s",
+			left.Type(), operator(op), right.Type())
 	default:
-		return fmt.Errorf("unknown operator: %s %s %s",
-			left.Type(), code.String(op), right.Type())
+		return runtimeError(ErrTypeMismatch, "unknown operator: %s %s %s",
+			left.Type(), operator(op), right.Type())
 	}
 }
 
-// integer OP integer
-func (vm *VM) evalIntegerInfixExpression(op code.Opcode, left, right object.Object) error {
-	leftVal := left.(*object.Integer).Value
-	rightVal := right.(*object.Integer).Value
-
+// operator returns the operator, as written within a script, which the
+// given opcode implements - so that errors refer to the script rather
+// than to our bytecode.
+func operator(op code.Opcode) string {
 	switch op {
 	case code.OpAdd:
-		vm.stack.Push(&object.Integer{Value: leftVal + rightVal})
+		return "+"
 	case code.OpSub:
-		vm.stack.Push(&object.Integer{Value: leftVal - rightVal})
+		return "-"
 	case code.OpMul:
-		vm.stack.Push(&object.Integer{Value: leftVal * rightVal})
+		return "*"
 	case code.OpDiv:
-		if rightVal == 0 {
-			return fmt.Errorf("attempted division by zero: %d / %d", leftVal, rightVal)
-		}
-		vm.stack.Push(&object.Integer{Value: leftVal / rightVal})
+		return "/"
 	case code.OpMod:
-		vm.stack.Push(&object.Integer{Value: leftVal % rightVal})
+		return "%"
 	case code.OpPower:
-		vm.stack.Push(&object.Integer{Value: int64(math.Pow(float64(leftVal), float64(rightVal)))})
+		return "**"
 	case code.OpLess:
-		vm.stack.Push(vm.nativeBoolToBooleanObject(leftVal < rightVal))
+		return "<"
 	case code.OpLessEqual:
-		vm.stack.Push(vm.nativeBoolToBooleanObject(leftVal <= rightVal))
+		return "<="
 	case code.OpGreater:
-		vm.stack.Push(vm.nativeBoolToBooleanObject(leftVal > rightVal))
+		return ">"
 	case code.OpGreaterEqual:
-		vm.stack.Push(vm.nativeBoolToBooleanObject(leftVal >= rightVal))
+		return ">="
 	case code.OpEqual:
-		vm.stack.Push(vm.nativeBoolToBooleanObject(leftVal == rightVal))
+		return "=="
 	case code.OpNotEqual:
-		vm.stack.Push(vm.nativeBoolToBooleanObject(leftVal != rightVal))
-	default:
-		return (fmt.Errorf("unknown operator: %s %s %s", left.Type(), code.String(op), right.Type()))
+		return "!="
+	case code.OpMatches:
+		return "~="
+	case code.OpNotMatches:
+		return "!~"
+	case code.OpAnd:
+		return "&&"
+	case code.OpOr:
+		return "||"
+	case code.OpArrayIn:
+		return "in"
 	}
-
-	return nil
+	return code.String(op)
 }
 
-// float OP float
-func (vm *VM) evalFloatInfixExpression(op code.Opcode, left, right object.Object) error {
-	leftVal := left.(*object.Float).Value
-	rightVal := right.(*object.Float).Value
+// integer OP integer
+func (vm *VM) evalIntegerInfixExpression(op code.Opcode, left, right object.Object) error {
+	leftVal := left.(*object.Integer).Value
+	rightVal := right.(*object.Integer).Value
 
 	switch op {
-	case code.OpAdd:
-		vm.stack.Push(&object.Float{Value: leftVal + rightVal})
-	case code.OpSub:
-		vm.stack.Push(&object.Float{Value: leftVal - rightVal})
-	case code.OpMul:
-		vm.stack.Push(&object.Float{Value: leftVal * rightVal})
-	case code.OpDiv:
-		if rightVal == 0 {
-			return fmt.Errorf("attempted division by zero: %f / %f", leftVal, rightVal)
+	case code.OpAdd, code.OpSub, code.OpMul, code.OpDiv, code.OpMod, code.OpPower:
+		res, err := IntegerArithmetic(op, leftVal, rightVal, vm.wrap)
+		if err != nil {
+			return err
 		}
-		vm.stack.Push(&object.Float{Value: leftVal / rightVal})
-	case code.OpMod:
-		vm.stack.Push(&object.Float{Value: float64(int(leftVal) % int(rightVal))})
-	case code.OpPower:
-		vm.stack.Push(&object.Float{Value: math.Pow(leftVal, rightVal)})
+		vm.stack.Push(&object.Integer{Value: res})
 	case code.OpLess:
 		vm.stack.Push(vm.nativeBoolToBooleanObject(leftVal < rightVal))
 	case code.OpLessEqual:
@@ -753,55 +1493,118 @@ func (vm *VM) evalFloatInfixExpression(op code.Opcode, left, right object.Object
 	case code.OpNotEqual:
 		vm.stack.Push(vm.nativeBoolToBooleanObject(leftVal != rightVal))
 	default:
-		return (fmt.Errorf("unknown operator: %s %s %s", left.Type(), code.String(op), right.Type()))
+		return (runtimeError(ErrTypeMismatch, "unknown operator: %s %s %s", left.Type(), operator(op), right.Type()))
 	}
 
 	return nil
 }
 
-// float OP int
-func (vm *VM) evalFloatIntegerInfixExpression(op code.Opcode, left, right object.Object) error {
-	leftVal := left.(*object.Float).Value
-	rightVal := float64(right.(*object.Integer).Value)
+// IntegerArithmetic performs the given arithmetic operation upon two
+// integers, in the same way as the virtual machine.
+//
+// If the result overflows an error is returned, unless wrap is true,
+// in which case the result silently wraps around.
+func IntegerArithmetic(op code.Opcode, left, right int64, wrap bool) (int64, error) {
+
+	var res int64
+	var name string
+	overflow := false
 
 	switch op {
 	case code.OpAdd:
-		vm.stack.Push(&object.Float{Value: leftVal + rightVal})
+		res = left + right
+		overflow = (left^res)&(right^res) < 0
+		name = "addition"
 	case code.OpSub:
-		vm.stack.Push(&object.Float{Value: leftVal - rightVal})
+		res = left - right
+		overflow = (left^right)&(left^res) < 0
+		name = "subtraction"
 	case code.OpMul:
-		vm.stack.Push(&object.Float{Value: leftVal * rightVal})
+		res, overflow = multiply(left, right)
+		name = "multiplication"
 	case code.OpDiv:
-		if rightVal == 0 {
-			return fmt.Errorf("attempted division by zero: %f / %f", leftVal, rightVal)
+		if right == 0 {
+			return 0, runtimeError(ErrDivByZero, "attempted division by zero: %d / %d", left, right)
 		}
-		vm.stack.Push(&object.Float{Value: leftVal / rightVal})
+		res = left / right
+		overflow = left == math.MinInt64 && right == -1
+		name = "division"
 	case code.OpMod:
-		vm.stack.Push(&object.Float{Value: float64(int(leftVal) % int(rightVal))})
+		if right == 0 {
+			return 0, runtimeError(ErrDivByZero, "attempted modulo by zero: %d %% %d", left, right)
+		}
+		res = left % right
 	case code.OpPower:
-		vm.stack.Push(&object.Float{Value: math.Pow(leftVal, rightVal)})
-	case code.OpLess:
-		vm.stack.Push(vm.nativeBoolToBooleanObject(leftVal < rightVal))
-	case code.OpLessEqual:
-		vm.stack.Push(vm.nativeBoolToBooleanObject(leftVal <= rightVal))
-	case code.OpGreater:
-		vm.stack.Push(vm.nativeBoolToBooleanObject(leftVal > rightVal))
-	case code.OpGreaterEqual:
-		vm.stack.Push(vm.nativeBoolToBooleanObject(leftVal >= rightVal))
-	case code.OpEqual:
-		vm.stack.Push(vm.nativeBoolToBooleanObject(leftVal == rightVal))
-	case code.OpNotEqual:
-		vm.stack.Push(vm.nativeBoolToBooleanObject(leftVal != rightVal))
+		if left == 0 && right < 0 {
+			return 0, runtimeError(ErrDivByZero, "attempted division by zero: %d ** %d", left, right)
+		}
+		res, overflow = power(left, right)
+		name = "exponentiation"
 	default:
-		return (fmt.Errorf("unknown operator: %s %s %s", left.Type(), code.String(op), right.Type()))
+		return 0, runtimeError(ErrInternal, "unknown arithmetic operator: %s", code.String(op))
 	}
 
-	return nil
+	if overflow && !wrap {
+		return 0, runtimeError(ErrOverflow, "integer overflow in %s: %d %s %d", name, left, operator(op), right)
+	}
+	return res, nil
+}
+
+// multiply returns the product of two integers, and whether that
+// overflowed.
+func multiply(left, right int64) (int64, bool) {
+	res := left * right
+	if left == 0 || right == 0 {
+		return 0, false
+	}
+	if res/right != left || (left == -1 && right == math.MinInt64) || (right == -1 && left == math.MinInt64) {
+		return res, true
+	}
+	return res, false
 }
 
-// int OP float
-func (vm *VM) evalIntegerFloatInfixExpression(op code.Opcode, left, right object.Object) error {
-	leftVal := float64(left.(*object.Integer).Value)
+// power raises the given base to the given exponent, and returns
+// the result along with whether it overflowed.
+//
+// Negative exponents result in a fraction, which is truncated towards
+// zero.  The caller must reject a zero base with a negative exponent,
+// which would be a division by zero.
+func power(base, exp int64) (int64, bool) {
+
+	if exp < 0 {
+		switch base {
+		case 1:
+			return 1, false
+		case -1:
+			if exp%2 == 0 {
+				return 1, false
+			}
+			return -1, false
+		}
+		return 0, false
+	}
+
+	// Exponentiation by squaring.
+	res := int64(1)
+	overflow := false
+	for exp > 0 {
+		var o bool
+		if exp&1 == 1 {
+			res, o = multiply(res, base)
+			overflow = overflow || o
+		}
+		exp >>= 1
+		if exp > 0 {
+			base, o = multiply(base, base)
+			overflow = overflow || o
+		}
+	}
+	return res, overflow
+}
+
+// float OP float
+func (vm *VM) evalFloatInfixExpression(op code.Opcode, left, right object.Object) error {
+	leftVal := left.(*object.Float).Value
 	rightVal := right.(*object.Float).Value
 
 	switch op {
@@ -813,11 +1616,14 @@ func (vm *VM) evalIntegerFloatInfixExpression(op code.Opcode, left, right object
 		vm.stack.Push(&object.Float{Value: leftVal * rightVal})
 	case code.OpDiv:
 		if rightVal == 0 {
-			return fmt.Errorf("attempted division by zero: %f / %f", leftVal, rightVal)
+			return runtimeError(ErrDivByZero, "attempted division by zero: %f / %f", leftVal, rightVal)
 		}
 		vm.stack.Push(&object.Float{Value: leftVal / rightVal})
 	case code.OpMod:
-		vm.stack.Push(&object.Float{Value: float64(int(leftVal) % int(rightVal))})
+		if rightVal == 0 {
+			return runtimeError(ErrDivByZero, "attempted modulo by zero: %f %% %f", leftVal, rightVal)
+		}
+		vm.stack.Push(&object.Float{Value: math.Mod(leftVal, rightVal)})
 	case code.OpPower:
 		vm.stack.Push(&object.Float{Value: math.Pow(leftVal, rightVal)})
 	case code.OpLess:
@@ -833,10 +1639,60 @@ func (vm *VM) evalIntegerFloatInfixExpression(op code.Opcode, left, right object
 	case code.OpNotEqual:
 		vm.stack.Push(vm.nativeBoolToBooleanObject(leftVal != rightVal))
 	default:
-		return (fmt.Errorf("unknown operator: %s %s %s", left.Type(), code.String(op), right.Type()))
+		return (runtimeError(ErrTypeMismatch, "unknown operator: %s %s %s", left.Type(), operator(op), right.Type()))
+	}
+
+	return nil
+}
+
+// int OP float, or float OP int
+//
+// Comparisons are made exactly, so that `1 == 1.0` is true, but
+// a large integer isn't equal to the nearest float.  Otherwise the
+// integer is promoted, and the result is a float.
+func (vm *VM) evalMixedInfixExpression(op code.Opcode, left, right object.Object) error {
+
+	switch op {
+	case code.OpLess, code.OpLessEqual, code.OpGreater, code.OpGreaterEqual, code.OpEqual, code.OpNotEqual:
+
+		// NaN isn't ordered, so it is compared as a float.
+		c, ok := object.CompareNumbers(left, right)
+		if !ok {
+			break
+		}
+
+		var res bool
+		switch op {
+		case code.OpLess:
+			res = c < 0
+		case code.OpLessEqual:
+			res = c <= 0
+		case code.OpGreater:
+			res = c > 0
+		case code.OpGreaterEqual:
+			res = c >= 0
+		case code.OpEqual:
+			res = c == 0
+		case code.OpNotEqual:
+			res = c != 0
+		}
+		vm.stack.Push(vm.nativeBoolToBooleanObject(res))
+		return nil
+
+	case code.OpAdd, code.OpSub, code.OpMul, code.OpDiv, code.OpMod, code.OpPower:
+	default:
+		return runtimeError(ErrTypeMismatch, "unknown operator: %s %s %s", left.Type(), operator(op), right.Type())
 	}
 
-	return nil
+	return vm.evalFloatInfixExpression(op, toFloat(left), toFloat(right))
+}
+
+// toFloat promotes an integer to a float, returning floats unchanged.
+func toFloat(obj object.Object) *object.Float {
+	if i, ok := obj.(*object.Integer); ok {
+		return &object.Float{Value: float64(i.Value)}
+	}
+	return obj.(*object.Float)
 }
 
 // string OP string
@@ -857,38 +1713,103 @@ func (vm *VM) evalStringInfixExpression(op code.Opcode, left object.Object, righ
 		vm.stack.Push(vm.nativeBoolToBooleanObject(l.Value <= r.Value))
 	case code.OpLess:
 		vm.stack.Push(vm.nativeBoolToBooleanObject(l.Value < r.Value))
-	case code.OpMatches:
-		args := []object.Object{l, r}
-		fn, ok := vm.environment.GetFunction("match")
-		if !ok {
-			return (fmt.Errorf("failed to lookup match-function"))
+	case code.OpMatches, code.OpNotMatches:
+		reg, err := vm.regexp(r)
+		if err != nil {
+			return err
 		}
-		out := fn.(func(args []object.Object) object.Object)
-		ret := out(args)
+		match := environment.Match(reg, l.Value)
+		vm.stack.Push(vm.nativeBoolToBooleanObject(match == (op == code.OpMatches)))
+	case code.OpAdd:
+		vm.stack.Push(&object.String{Value: l.Value + r.Value})
+	case code.OpArrayIn:
+		// "ell" in "hello"
+		vm.stack.Push(vm.nativeBoolToBooleanObject(strings.Contains(r.Value, l.Value)))
+	default:
+		return (runtimeError(ErrTypeMismatch, "unknown operator: %s %s %s", left.Type(), operator(op), right.Type()))
+	}
 
-		if ret.(*object.Boolean).Value {
-			vm.stack.Push(True)
-		} else {
-			vm.stack.Push(False)
-		}
-	case code.OpNotMatches:
-		args := []object.Object{l, r}
-		fn, ok := vm.environment.GetFunction("match")
-		if !ok {
-			return (fmt.Errorf("failed to lookup match-function"))
-		}
-		out := fn.(func(args []object.Object) object.Object)
-		ret := out(args)
+	return nil
+}
 
-		if ret.(*object.Boolean).Value {
-			vm.stack.Push(False)
-		} else {
-			vm.stack.Push(True)
+// regexp returns the compiled form of the given regular expression.
+//
+// Patterns held in the constant pool, such as `/^steve/i`, are compiled
+// on first use and then reused.  Others, which are only known at run-time,
+// are compiled every time they're used.
+func (vm *VM) regexp(pattern *object.String) (*regexp.Regexp, error) {
+
+	if vm.patterns == nil {
+		vm.patterns = make(map[*object.String]int)
+		for i, c := range vm.constants {
+			if str, ok := c.(*object.String); ok {
+				vm.patterns[str] = i
+			}
 		}
+		vm.regexps = make([]*regexp.Regexp, len(vm.constants))
+	}
+
+	i, constant := vm.patterns[pattern]
+	if constant && vm.regexps[i] != nil {
+		return vm.regexps[i], nil
+	}
+
+	reg, err := regexp.Compile(pattern.Value)
+	if err != nil {
+		return nil, runtimeError(ErrInvalidValue, "invalid regular expression /%s/: %s", pattern.Value, err)
+	}
+
+	if constant {
+		vm.regexps[i] = reg
+	}
+	return reg, nil
+}
+
+// time OP time
+//
+// Subtracting one time from another results in the number of seconds
+// between them.
+func (vm *VM) evalTimeInfixExpression(op code.Opcode, left, right object.Object) error {
+	l := left.(*object.Time).Value
+	r := right.(*object.Time).Value
+
+	switch op {
+	case code.OpSub:
+		vm.stack.Push(&object.Integer{Value: int64(l.Sub(r) / time.Second)})
+	case code.OpLess:
+		vm.stack.Push(vm.nativeBoolToBooleanObject(l.Before(r)))
+	case code.OpLessEqual:
+		vm.stack.Push(vm.nativeBoolToBooleanObject(!l.After(r)))
+	case code.OpGreater:
+		vm.stack.Push(vm.nativeBoolToBooleanObject(l.After(r)))
+	case code.OpGreaterEqual:
+		vm.stack.Push(vm.nativeBoolToBooleanObject(!l.Before(r)))
+	case code.OpEqual:
+		vm.stack.Push(vm.nativeBoolToBooleanObject(l.Equal(r)))
+	case code.OpNotEqual:
+		vm.stack.Push(vm.nativeBoolToBooleanObject(!l.Equal(r)))
+	default:
+		return (runtimeError(ErrTypeMismatch, "unknown operator: %s %s %s", left.Type(), operator(op), right.Type()))
+	}
+
+	return nil
+}
+
+// time OP integer
+//
+// The integer is a number of seconds to add to, or subtract from,
+// the time.
+func (vm *VM) evalTimeIntegerInfixExpression(op code.Opcode, left, right object.Object) error {
+	l := left.(*object.Time).Value
+	r := time.Duration(right.(*object.Integer).Value) * time.Second
+
+	switch op {
 	case code.OpAdd:
-		vm.stack.Push(&object.String{Value: l.Value + r.Value})
+		vm.stack.Push(&object.Time{Value: l.Add(r)})
+	case code.OpSub:
+		vm.stack.Push(&object.Time{Value: l.Add(-r)})
 	default:
-		return (fmt.Errorf("unknown operator: %s %s %s", left.Type(), code.String(op), right.Type()))
+		return (runtimeError(ErrTypeMismatch, "unknown operator: %s %s %s", left.Type(), operator(op), right.Type()))
 	}
 
 	return nil
@@ -915,16 +1836,9 @@ func (vm *VM) executeBangOperator() error {
 		return err
 	}
 
-	switch operand {
-	case True:
-		vm.stack.Push(False)
-	case False:
-		vm.stack.Push(True)
-	case Null:
-		vm.stack.Push(True)
-	default:
-		vm.stack.Push(False)
-	}
+	// The result is the opposite of the operand's truthiness, so
+	// `!x` is true whenever `if ( x )` would not be taken.
+	vm.stack.Push(vm.nativeBoolToBooleanObject(!operand.True()))
 	return nil
 }
 
@@ -938,11 +1852,14 @@ func (vm *VM) executeMinusOperator() error {
 
 	switch obj := operand.(type) {
 	case *object.Integer:
+		if obj.Value == math.MinInt64 && !vm.wrap {
+			return runtimeError(ErrOverflow, "integer overflow negating %d", obj.Value)
+		}
 		res = &object.Integer{Value: -obj.Value}
 	case *object.Float:
 		res = &object.Float{Value: -obj.Value}
 	default:
-		return fmt.Errorf("unsupported type for negation: %s", operand.Type())
+		return runtimeError(ErrTypeMismatch, "unsupported type for negation: %s", operand.Type())
 	}
 
 	vm.stack.Push(res)
@@ -955,21 +1872,64 @@ func (vm *VM) executeSquareRoot() error {
 	if err != nil {
 		return err
 	}
-	var res object.Object
+	var val float64
 
 	switch obj := operand.(type) {
 	case *object.Integer:
-		res = &object.Float{Value: math.Sqrt(float64(obj.Value))}
+		val = float64(obj.Value)
 	case *object.Float:
-		res = &object.Float{Value: math.Sqrt(obj.Value)}
+		val = obj.Value
 	default:
-		return fmt.Errorf("unsupported type for square-root: %s", operand.Type())
+		return runtimeError(ErrTypeMismatch, "unsupported type for square-root: %s", operand.Type())
 	}
 
-	vm.stack.Push(res)
+	// Don't let NaN escape, to confuse later comparisons.
+	res, err := environment.SquareRoot(val)
+	if err != nil {
+		return runtimeError(ErrInvalidValue, "%s", err)
+	}
+
+	vm.stack.Push(&object.Float{Value: res})
 	return nil
 }
 
+// function returns the named function, which is to be called by the
+// OpCall instruction at the given offset.
+//
+// The compiler always loads the name from the constants immediately
+// before the call, so each function is cached by the offset of the
+// constant which names it, saving a lookup by name for every call.  The
+// cache is discarded if functions are added to, or removed from, the
+// environment - for example by the host application, after the script
+// was prepared.
+func (vm *VM) function(bytecode code.Instructions, ip int, name object.Object) (interface{}, bool) {
+
+	if vm.functions == nil || vm.functionsVersion != vm.environment.Version() {
+		vm.functions = make([]interface{}, len(vm.constants))
+		vm.functionsVersion = vm.environment.Version()
+	}
+
+	// Fall back to the name if it wasn't loaded from the constants.
+	const start = 3
+	if ip < start || code.Opcode(bytecode[ip-start]) != code.OpConstant {
+		return vm.environment.GetFunction(name.Inspect())
+	}
+	idx := code.Operand(bytecode, ip-start)
+	if idx >= len(vm.constants) || vm.constants[idx] != name {
+		return vm.environment.GetFunction(name.Inspect())
+	}
+
+	if fn := vm.functions[idx]; fn != nil {
+		return fn, true
+	}
+
+	fn, ok := vm.environment.GetFunction(name.Inspect())
+	if ok {
+		vm.functions[idx] = fn
+	}
+	return fn, ok
+}
+
 // convert a native (go) boolean to an Object
 func (vm *VM) nativeBoolToBooleanObject(input bool) *object.Boolean {
 	if input {
@@ -979,7 +1939,12 @@ func (vm *VM) nativeBoolToBooleanObject(input bool) *object.Boolean {
 }
 
 // lookup the name of the given field/map-member.
-func (vm *VM) lookup(obj interface{}, name string) object.Object {
+//
+// Names which aren't local to a function, or block, are resolved in a
+// fixed order: variables, which are set by the script or via SetVariable,
+// then the object itself, then its fields, and finally the functions the
+// script defines.  So variables reliably shadow fields of the same name.
+func (vm *VM) lookup(obj interface{}, name string) (object.Object, bool) {
 
 	//
 	// Remove legacy "$" prefix, if present.
@@ -990,61 +1955,270 @@ func (vm *VM) lookup(obj interface{}, name string) object.Object {
 	// Look for this as a variable first, they take precedence.
 	//
 	if val, ok := vm.environment.Get(name); ok {
-		return val
+		return val, true
+	}
+
+	//
+	// Is this a reference to the whole object?
+	//
+	if name == vm.inputName {
+		if vm.input == nil {
+			vm.input = inputObject(obj)
+		}
+		return vm.input, true
 	}
 
 	//
 	// Now we assume this is a reference to a map-key, or
 	// object member.
 	//
-	// If we've not discovered them then do so now
-	//
-	if len(vm.fields) == 0 {
-		vm.inspectObject(obj)
+	if val, ok := vm.field(obj, name); ok {
+		return val, true
 	}
 
 	//
-	// Now perform the lookup
+	// Functions defined within the script may be referred to by
+	// name, so that they can be passed to functions such as `map`.
 	//
-	if cached, found := vm.fields[name]; found {
-		return cached
+	if fn, ok := vm.environment.GetFunction(name); ok {
+		if fn, ok := fn.(*object.Function); ok {
+			return fn, true
+		}
 	}
 
 	//
 	// If it was not found it is an unknown/unset value.
 	//
-	return Null
+	return Null, false
+}
+
+// field returns the value of the named field of the given object, and
+// whether the object has such a field.
+//
+// A field which is present may still have a null value.
+func (vm *VM) field(obj interface{}, name string) (object.Object, bool) {
+
+	//
+	// Give the host application the chance to resolve it
+	// first, if it wishes to.  The result isn't cached because
+	// the value might be computed.
+	//
+	if vm.resolver != nil {
+		if val, ok := vm.resolver(obj, name); ok {
+			if val == nil {
+				return Null, true
+			}
+			return val, true
+		}
+	}
+
+	//
+	// Objects which can look up their own fields do so, and
+	// their fields aren't discovered via reflection.
+	//
+	if l, ok := obj.(Lookupable); ok {
+		val, ok := l.Lookup(name)
+		if val == nil {
+			val = Null
+		}
+		return val, ok
+	}
+
+	//
+	// If we've not discovered them then do so now
+	//
+	if len(vm.fields) == 0 {
+		vm.inspectObject(obj)
+	}
+
+	val, ok := vm.fields[name]
+	return val, ok
+}
+
+// hasField is used by the `exists` function to look up a field of the
+// object the script is running against.
+func (vm *VM) hasField(name string) (object.Object, bool) {
+	return vm.field(vm.obj, name)
+}
+
+// variable returns the value of the block or local variable with the
+// given name, searching from the innermost block outwards.
+func (f *frame) variable(name string) (object.Object, bool) {
+	for i := len(f.scopes) - 1; i >= 0; i-- {
+		if val, ok := f.scopes[i][name]; ok {
+			return val, true
+		}
+	}
+	val, ok := f.locals[name]
+	return val, ok
+}
+
+// setVariable sets the value of a variable, by name.
+//
+// The variable which is updated is the nearest one with the given name:
+// first those of the blocks being executed, from the innermost outwards,
+// then the local variables of the function, and finally the global
+// variables.  If there is no such variable a new one is created in the
+// innermost block, so that it is discarded at the end of that block.
+// (Blocks only have scopes if the script was compiled with the
+// BlockScope flag.)
+//
+// Outside a block, within a function, a new local variable is created.
+// Outside both all variables are global.  Global constants, which were
+// set by the host application, cannot be changed.
+func (vm *VM) setVariable(cur *frame, name string, val object.Object) error {
+
+	for i := len(cur.scopes) - 1; i >= 0; i-- {
+		if _, ok := cur.scopes[i][name]; ok {
+			cur.scopes[i][name] = val
+			return nil
+		}
+	}
+
+	if len(cur.scopes) > 0 {
+		if _, ok := cur.locals[name]; ok {
+			cur.locals[name] = val
+			return nil
+		}
+		if _, ok := vm.environment.Get(name); !ok {
+			cur.scopes[len(cur.scopes)-1][name] = val
+			return nil
+		}
+	}
+
+	if cur.locals != nil {
+		if _, ok := cur.locals[name]; ok {
+			cur.locals[name] = val
+			return nil
+		}
+		if _, ok := vm.environment.Get(name); !ok {
+			cur.locals[name] = val
+			return nil
+		}
+	}
+
+	if vm.environment.IsConstant(name) {
+		return runtimeError(ErrConstant, "cannot assign to constant %s", name)
+	}
+
+	vm.environment.Set(name, val)
+	return nil
+}
+
+// executeHashLiteral creates a hash from the given number of key/value
+// pairs which are present upon the stack.
+func (vm *VM) executeHashLiteral(count int) error {
+
+	// The pairs are upon the stack in reverse order.
+	items := make([]object.Object, count*2)
+	for i := count*2 - 1; i >= 0; i-- {
+		var err error
+		items[i], err = vm.stack.Pop()
+		if err != nil {
+			return err
+		}
+	}
+
+	hash := &object.Hash{Pairs: make(map[object.HashKey]object.HashPair)}
+	for i := 0; i < len(items); i += 2 {
+		key := items[i]
+		value := items[i+1]
+
+		hashKey, ok := key.(object.Hashable)
+		if !ok {
+			return runtimeError(ErrIndex, "unusable as hash key: %s", key.Type())
+		}
+		hash.Pairs[hashKey.HashKey()] = object.HashPair{Key: key, Value: value}
+	}
+
+	vm.stack.Push(hash)
+	return nil
 }
 
 // executeIndexExpression lookup the array value at the given index.
 func (vm *VM) executeIndexExpression(left, index object.Object) error {
 
+	// Native values are indexed by converting them first, unless
+	// they can index themselves.
+	if native, ok := left.(*object.Native); ok {
+		switch value := native.Value.(type) {
+		case Indexable:
+			val, ok := value.Index(index)
+			if !ok || val == nil {
+				val = Null
+			}
+			vm.stack.Push(val)
+			return nil
+		case Lookupable:
+			name, ok := index.(*object.String)
+			if !ok {
+				return runtimeError(ErrIndex, "fields must be looked up by name, not %s", index.Type())
+			}
+			val, ok := value.Lookup(name.Value)
+			if !ok || val == nil {
+				val = Null
+			}
+			vm.stack.Push(val)
+			return nil
+		}
+		if native != vm.convertedFrom {
+			vm.converted = objectFromValue(reflect.ValueOf(native.Value), make(map[reference]bool))
+			vm.convertedFrom = native
+		}
+		left = vm.converted
+	}
+
+	// Hashes are indexed by key, rather than by position.
+	if left.Type() == object.HASH {
+		return vm.executeHashIndex(left, index)
+	}
+
+	// Indexing null returns null, so that missing values within
+	// nested objects, such as `user.address.city`, are not errors.
+	if left.Type() == object.NULL {
+		vm.stack.Push(Null)
+		return nil
+	}
+
 	// Check arguments
 	if left.Type() != object.ARRAY && left.Type() != object.STRING {
-		return fmt.Errorf("the index operator can only be applied to strings and arrays, not %s", left.Type())
+		return runtimeError(ErrIndex, "the index operator can only be applied to strings, arrays, and hashes, not %s", left.Type())
 	}
 	if index.Type() != object.INTEGER {
-		return fmt.Errorf("index operator must be given an integer, not %s", index.Type())
+		return runtimeError(ErrIndex, "index operator must be given an integer, not %s", index.Type())
 	}
 
 	// Get the index we should lookup
 	idx := index.(*object.Integer).Value
 
 	// Looking at a string?
+	//
+	// Strings are indexed by character, as they are sliced, and
+	// negative indexes count from the end in the same way as for
+	// arrays.
 	if left.Type() == object.STRING {
 
-		str := left.(*object.String).Inspect()
-		if idx < 0 || int(idx) > len(str) {
+		chars := []rune(left.(*object.String).Value)
+		if idx < 0 {
+			idx += int64(len(chars))
+		}
+		if idx < 0 || idx >= int64(len(chars)) {
 			vm.stack.Push(Null)
 			return nil
 		}
-		vm.stack.Push(&object.String{Value: string(str[idx])})
+		vm.stack.Push(&object.String{Value: string(chars[idx])})
 		return nil
 	}
 
 	// OK here we know we're dealing with an array.
 	arrayObject := left.(*object.Array)
 
+	// Negative indexes count from the end of the array, so
+	// `-1` is the last element.
+	if idx < 0 {
+		idx += int64(len(arrayObject.Elements))
+	}
+
 	// bounds-check
 	max := int64(len(arrayObject.Elements) - 1)
 	if idx < 0 || idx > max {
@@ -1056,3 +2230,190 @@ func (vm *VM) executeIndexExpression(left, index object.Object) error {
 	vm.stack.Push(arrayObject.Elements[idx])
 	return nil
 }
+
+// sliceBound converts the given index to an offset within a sequence of
+// the given length.
+//
+// Negative indexes count from the end, and indexes which are out of
+// range are clamped.  Null means the given default.
+func sliceBound(index object.Object, length int, def int) (int, error) {
+
+	if index.Type() == object.NULL {
+		return def, nil
+	}
+
+	i, ok := index.(*object.Integer)
+	if !ok {
+		return 0, runtimeError(ErrIndex, "slice indexes must be integers, not %s", index.Type())
+	}
+
+	idx := i.Value
+	if idx < 0 {
+		idx += int64(length)
+	}
+	if idx < 0 {
+		idx = 0
+	}
+	if idx > int64(length) {
+		idx = int64(length)
+	}
+	return int(idx), nil
+}
+
+// executeSliceExpression returns a portion of an array, or a string.
+//
+// Strings are sliced by character, rather than by byte.
+func (vm *VM) executeSliceExpression(left, start, end object.Object) error {
+
+	var length int
+	var runes []rune
+
+	switch obj := left.(type) {
+	case *object.Array:
+		length = len(obj.Elements)
+	case *object.String:
+		runes = []rune(obj.Value)
+		length = len(runes)
+	default:
+		return runtimeError(ErrIndex, "the slice operator can only be applied to strings and arrays, not %s", left.Type())
+	}
+
+	from, err := sliceBound(start, length, 0)
+	if err != nil {
+		return err
+	}
+	to, err := sliceBound(end, length, length)
+	if err != nil {
+		return err
+	}
+	if to < from {
+		to = from
+	}
+
+	if left.Type() == object.STRING {
+		vm.stack.Push(&object.String{Value: string(runes[from:to])})
+		return nil
+	}
+
+	// Copy the elements, so the slice doesn't share storage with
+	// the original array.
+	elements := make([]object.Object, to-from)
+	copy(elements, left.(*object.Array).Elements[from:to])
+	vm.stack.Push(&object.Array{Elements: elements})
+	return nil
+}
+
+// callGolang invokes a function which was provided by the host
+// application, or one of our built-ins.
+//
+// If the function panics the panic is recovered and returned as an
+// error instead, so that a misbehaving function cannot crash the host.
+//
+// Errors returned by the function are wrapped in a RuntimeError, unless
+// they came from the script, via a built-in such as `map`.  The errors
+// of the maths functions get the same code as the equivalent operator.
+func (vm *VM) callGolang(name string, fn interface{}, args []object.Object) (res object.Object, err error) {
+
+	defer func() {
+		if r := recover(); r != nil {
+			re := runtimeError(ErrFunctionFailed, "the function %s panicked: %v", name, r)
+			re.panicked = true
+			err = re
+		}
+	}()
+
+	switch fn := fn.(type) {
+	case func(args []object.Object) object.Object:
+		res = fn(args)
+	case func(args []object.Object) (object.Object, error):
+		res, err = fn(args)
+		if err != nil {
+			if _, ok := err.(*RuntimeError); ok || err == ErrInstructionLimit || (vm.ctx != nil && err == vm.ctx.Err()) {
+				return nil, err
+			}
+			if m, ok := err.(*environment.MathError); ok {
+				code := ErrInvalidValue
+				if m.Overflow {
+					code = ErrOverflow
+				}
+				return nil, &RuntimeError{Code: code, Message: m.Message, Err: err}
+			}
+			return nil, &RuntimeError{Code: ErrFunctionFailed, Message: err.Error(), Err: err}
+		}
+	}
+
+	if res == nil {
+		res = Null
+	}
+	return res, nil
+}
+
+// call invokes the given function, with the given arguments, and
+// returns the result.
+//
+// The function is either a function defined within the script, or a
+// string containing the name of any function.  This is used by built-in
+// functions, such as `map`, which call other functions.
+func (vm *VM) call(fn object.Object, args []object.Object) (object.Object, error) {
+
+	if name, ok := fn.(*object.String); ok {
+
+		f, ok := vm.environment.GetFunction(name.Value)
+		if !ok {
+			return nil, runtimeError(ErrUnknownFunction, "the function %s does not exist", name.Value)
+		}
+
+		switch f := f.(type) {
+		case *object.Function:
+			fn = f
+		case func(args []object.Object) object.Object, func(args []object.Object) (object.Object, error):
+			return vm.callGolang(name.Value, f, args)
+		default:
+			return nil, runtimeError(ErrInternal, "the function %s has unsupported type %T", name.Value, f)
+		}
+	}
+
+	f, ok := fn.(*object.Function)
+	if !ok {
+		return nil, runtimeError(ErrTypeMismatch, "%s is not a function", fn.Type())
+	}
+
+	if len(args) != len(f.Parameters) {
+		return nil, runtimeError(ErrArgumentCount, "the function %s expects %d argument(s), got %d", f.Name, len(f.Parameters), len(args))
+	}
+
+	// Bind the arguments to the parameters.
+	locals := make(map[string]object.Object)
+	for i, name := range f.Parameters {
+		locals[name] = args[i]
+	}
+
+	// The function gets a stack of its own, so the stack of
+	// the caller is left untouched.
+	saved := vm.stack
+	vm.stack = stack.New()
+	defer func() { vm.stack = saved }()
+
+	return vm.execute(vm.ctx, vm.obj, &frame{bytecode: f.Instructions, locals: locals, positions: f.Positions})
+}
+
+// executeHashIndex lookup the hash value with the given key.
+//
+// Missing keys result in a null value.
+func (vm *VM) executeHashIndex(left, index object.Object) error {
+	hash := left.(*object.Hash)
+
+	key, ok := index.(object.Hashable)
+	if !ok {
+		return runtimeError(ErrIndex, "unusable as hash key: %s", index.Type())
+	}
+
+	pair, ok := hash.Pairs[key.HashKey()]
+	if !ok {
+		vm.stack.Push(Null)
+		return nil
+	}
+
+	vm.stack.Push(pair.Value)
+	return nil
+}